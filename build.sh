@@ -6,6 +6,13 @@ mkdir -p bootdrive/EFI/BOOT
 go build -ldflags="-E eliasnaur.com/unik/kernel.rt0 -T 0x1700000" -o bootdrive/KERNEL.ELF $@
 cp uefi/loader.efi bootdrive/EFI/BOOT/BOOTX64.EFI
 
+# Pack the root file system, if any.
+ROOTFS=${ROOTFS:-rootfs}
+rm -f bootdrive/INITRAMFS.CPIO
+if [ -d "$ROOTFS" ]; then
+	(cd "$ROOTFS" && find . | cpio --quiet -o -H newc) > bootdrive/INITRAMFS.CPIO
+fi
+
 # Create disk image
 rm -f boot.img
 dd if=/dev/zero of=boot.img bs=1M count=20
@@ -0,0 +1,817 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	entrySize = 32
+	// lfnChars is the number of characters in a long name entry.
+	lfnChars = 13
+	maxName  = 255
+
+	// Flags of the NT reserved byte for lower case short names.
+	lowerBase = 0x08
+	lowerExt  = 0x10
+
+	entryFree = 0xe5
+)
+
+// dirent is a parsed directory entry.
+type dirent struct {
+	name  string
+	short [11]byte
+	attr  byte
+	// nt is the NT reserved byte.
+	nt      byte
+	cluster uint32
+	size    uint32
+	mtime   time.Time
+	// start is the offset of the first entry, including long name
+	// entries, and off the offset of the short name entry.
+	start, off int
+}
+
+// lfnOffsets are the offsets of the characters of a long name entry.
+var lfnOffsets = [lfnChars]int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
+// readDir returns the contents of the directory d.
+func (f *FS) readDir(d *node) ([]byte, error) {
+	var size int
+	if d.root && d.cluster == 0 {
+		size = f.rootSize
+	} else {
+		chain, err := f.chain(d)
+		if err != nil {
+			return nil, err
+		}
+		size = len(chain) * f.clusterSize
+	}
+	data := make([]byte, size)
+	if err := f.access(d, data, 0, false); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// entries parses the directory data, excluding the "." and ".."
+// entries and volume labels.
+func entries(data []byte) []dirent {
+	var ents []dirent
+	var lfn [20 * lfnChars]uint16
+	// seq is the expected sequence number of the next long name
+	// entry, and start the offset of the first.
+	seq, sum, start := 0, byte(0), 0
+	for off := 0; off+entrySize <= len(data); off += entrySize {
+		e := data[off : off+entrySize]
+		if e[0] == 0 {
+			break
+		}
+		if e[0] == entryFree {
+			seq = 0
+			continue
+		}
+		attr := e[11]
+		if attr&attrLongName == attrLongName {
+			n := int(e[0] & 0x1f)
+			switch {
+			case e[0]&0x40 != 0 && n > 0 && n <= 20:
+				seq, sum, start = n, e[13], off
+				for i := range lfn {
+					lfn[i] = 0xffff
+				}
+			case seq > 1 && n == seq-1 && e[13] == sum:
+				seq = n
+			default:
+				seq = 0
+				continue
+			}
+			for i, o := range lfnOffsets {
+				lfn[(n-1)*lfnChars+i] = binary.LittleEndian.Uint16(e[o:])
+			}
+			continue
+		}
+		var ent dirent
+		copy(ent.short[:], e[:11])
+		if ent.short[0] == 0x05 {
+			ent.short[0] = entryFree
+		}
+		ent.attr = attr
+		ent.nt = e[12]
+		ent.cluster = uint32(binary.LittleEndian.Uint16(e[20:]))<<16 | uint32(binary.LittleEndian.Uint16(e[26:]))
+		ent.size = binary.LittleEndian.Uint32(e[28:])
+		ent.mtime = fatTime(binary.LittleEndian.Uint16(e[24:]), binary.LittleEndian.Uint16(e[22:]))
+		ent.start, ent.off = off, off
+		if seq == 1 && checksum(ent.short) == sum {
+			ent.name = lfnString(lfn[:])
+			ent.start = start
+		}
+		seq = 0
+		if ent.name == "" {
+			ent.name = shortString(ent.short, ent.nt)
+		}
+		if attr&attrVolumeID != 0 || ent.name == "." || ent.name == ".." {
+			continue
+		}
+		ents = append(ents, ent)
+	}
+	return ents
+}
+
+// lfnString decodes a long name terminated by NUL or padding.
+func lfnString(lfn []uint16) string {
+	n := 0
+	for n < len(lfn) && lfn[n] != 0 && lfn[n] != 0xffff {
+		n++
+	}
+	return string(utf16.Decode(lfn[:n]))
+}
+
+// shortString decodes a short name.
+func shortString(short [11]byte, nt byte) string {
+	base := strings.TrimRight(string(short[:8]), " ")
+	ext := strings.TrimRight(string(short[8:]), " ")
+	if nt&lowerBase != 0 {
+		base = strings.ToLower(base)
+	}
+	if nt&lowerExt != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// checksum computes the checksum of a short name stored in long name
+// entries.
+func checksum(short [11]byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum>>1 | sum<<7) + c
+	}
+	return sum
+}
+
+// fatTime converts a FAT date and time.
+func fatTime(date, tim uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(
+		1980+int(date>>9), time.Month(date>>5&0xf), int(date&0x1f),
+		int(tim>>11), int(tim>>5&0x3f), int(tim&0x1f)*2, 0, time.UTC,
+	)
+}
+
+// toFATTime converts t to a FAT date and time.
+func toFATTime(t time.Time) (uint16, uint16) {
+	t = t.UTC()
+	if t.Year() < 1980 {
+		return 1<<5 | 1, 0
+	}
+	date := uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tim := uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tim
+}
+
+// find returns the entry named name in ents.
+func find(ents []dirent, name string) (dirent, bool) {
+	for _, e := range ents {
+		if strings.EqualFold(e.name, name) {
+			return e, true
+		}
+	}
+	return dirent{}, false
+}
+
+// node returns the node of the entry e of the directory d.
+func (f *FS) node(d *node, e dirent) *node {
+	loc := location{dir: d.cluster, off: e.off}
+	if n, ok := f.nodes[loc]; ok {
+		return n
+	}
+	return &node{
+		cluster: e.cluster,
+		size:    int64(e.size),
+		attr:    e.attr,
+		mtime:   e.mtime,
+		name:    e.name,
+		loc:     loc,
+	}
+}
+
+// lookup returns the node named by the valid path name along with
+// its parent directory.
+func (f *FS) lookup(op, name string) (*node, *node, error) {
+	if !fs.ValidPath(name) {
+		return nil, nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return f.root, nil, nil
+	}
+	d := f.root
+	for {
+		elem := name
+		i := strings.IndexByte(name, '/')
+		if i != -1 {
+			elem, name = name[:i], name[i+1:]
+		}
+		if !d.isDir() {
+			return nil, nil, syscall.ENOTDIR
+		}
+		data, err := f.readDir(d)
+		if err != nil {
+			return nil, nil, err
+		}
+		e, ok := find(entries(data), elem)
+		if !ok {
+			return nil, d, fs.ErrNotExist
+		}
+		n := f.node(d, e)
+		if i == -1 {
+			return n, d, nil
+		}
+		d = n
+	}
+}
+
+// lookupParent returns the parent directory of name.
+func (f *FS) lookupParent(op, name string) (*node, error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	dir := path.Dir(name)
+	d, _, err := f.lookup(op, dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if !d.isDir() {
+		return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return d, nil
+}
+
+func (n *node) isDir() bool {
+	return n.attr&attrDirectory != 0
+}
+
+// dirCluster returns the cluster to store in entries referring to the
+// directory d.
+func (f *FS) dirCluster(d *node) uint32 {
+	if d.root {
+		return 0
+	}
+	return d.cluster
+}
+
+// encode encodes the short name entry of n.
+func (f *FS) encode(e []byte, n *node) {
+	bo := binary.LittleEndian
+	e[11] = n.attr
+	bo.PutUint16(e[20:], uint16(n.cluster>>16))
+	bo.PutUint16(e[26:], uint16(n.cluster))
+	size := uint32(n.size)
+	if n.isDir() {
+		size = 0
+	}
+	bo.PutUint32(e[28:], size)
+	date, tim := toFATTime(n.mtime)
+	bo.PutUint16(e[22:], tim)
+	bo.PutUint16(e[24:], date)
+	bo.PutUint16(e[18:], date)
+}
+
+// writeEntry updates the directory entry of n.
+func (f *FS) writeEntry(n *node) error {
+	if n.root || n.removed {
+		return nil
+	}
+	d, err := f.dirNode(n.loc.dir)
+	if err != nil {
+		return err
+	}
+	var e [entrySize]byte
+	if err := f.access(d, e[:], int64(n.loc.off), false); err != nil {
+		return err
+	}
+	f.encode(e[:], n)
+	return f.access(d, e[:], int64(n.loc.off), true)
+}
+
+// dirNode returns a node for accessing the directory starting at
+// cluster.
+func (f *FS) dirNode(cluster uint32) (*node, error) {
+	if cluster == f.root.cluster || cluster == 0 {
+		return f.root, nil
+	}
+	for _, n := range f.nodes {
+		if n.cluster == cluster {
+			return n, nil
+		}
+	}
+	return &node{cluster: cluster, attr: attrDirectory}, nil
+}
+
+// create adds an entry named name for n to the directory d and sets
+// the location of n.
+func (f *FS) create(d *node, name string, n *node) error {
+	if len(name) > maxName || strings.ContainsAny(name, `"*:<>?\|`) {
+		return fs.ErrInvalid
+	}
+	data, err := f.readDir(d)
+	if err != nil {
+		return err
+	}
+	ents := entries(data)
+	if _, ok := find(ents, name); ok {
+		return fs.ErrExist
+	}
+	short, nt, exact := shortName(name)
+	for _, e := range ents {
+		if exact && e.short == short {
+			// Collision with a generated short name.
+			exact, nt = false, 0
+		}
+	}
+	if !exact {
+		short = uniqueShort(ents, short)
+	}
+	var lfn []uint16
+	count := 1
+	if !exact {
+		lfn = utf16.Encode([]rune(name))
+		count += (len(lfn) + lfnChars - 1) / lfnChars
+	}
+	// Find count free entries in a row.
+	start, run := -1, 0
+	for off := 0; off+entrySize <= len(data); off += entrySize {
+		if b := data[off]; b == 0 || b == entryFree {
+			if run == 0 {
+				start = off
+			}
+			run++
+			if run == count {
+				break
+			}
+		} else {
+			run = 0
+		}
+	}
+	if run < count {
+		if d.root && d.cluster == 0 {
+			return errNoSpace
+		}
+		if run == 0 {
+			start = len(data)
+		}
+		need := start + count*entrySize
+		clusters := (need + f.clusterSize - 1) / f.clusterSize
+		if err := f.grow(d, clusters); err != nil {
+			return err
+		}
+		grown := make([]byte, clusters*f.clusterSize)
+		copy(grown, data)
+		data = grown
+	}
+	if err := f.modify(); err != nil {
+		return err
+	}
+	ents2 := data[start : start+count*entrySize]
+	for i := range ents2 {
+		ents2[i] = 0
+	}
+	sum := checksum(short)
+	for i := 0; i < count-1; i++ {
+		// Long name entries are stored in reverse order.
+		seq := count - 1 - i
+		e := ents2[i*entrySize : (i+1)*entrySize]
+		e[0] = byte(seq)
+		if i == 0 {
+			e[0] |= 0x40
+		}
+		e[11] = attrLongName
+		e[13] = sum
+		for j, o := range lfnOffsets {
+			k := (seq-1)*lfnChars + j
+			c := uint16(0xffff)
+			switch {
+			case k < len(lfn):
+				c = lfn[k]
+			case k == len(lfn):
+				c = 0
+			}
+			binary.LittleEndian.PutUint16(e[o:], c)
+		}
+	}
+	e := ents2[(count-1)*entrySize:]
+	copy(e, short[:])
+	if e[0] == entryFree {
+		e[0] = 0x05
+	}
+	e[12] = nt
+	f.encode(e, n)
+	n.name = name
+	n.loc = location{dir: d.cluster, off: start + (count-1)*entrySize}
+	return f.access(d, ents2, int64(start), true)
+}
+
+// removeEntry marks the entries of e in the directory d as free.
+func (f *FS) removeEntry(d *node, e dirent) error {
+	if err := f.modify(); err != nil {
+		return err
+	}
+	for off := e.start; off <= e.off; off += entrySize {
+		b := [1]byte{entryFree}
+		if err := f.access(d, b[:], int64(off), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shortName converts name to a short name. If the name can't be
+// represented exactly, the short name is a basis for generating a
+// unique name.
+func shortName(name string) ([11]byte, byte, bool) {
+	var short [11]byte
+	for i := range short {
+		short[i] = ' '
+	}
+	base, ext := name, ""
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	exact := len(base) <= 8 && len(ext) <= 3 && !(ext == "" && strings.HasSuffix(name, "."))
+	var nt byte
+	conv := func(dst []byte, s string, lower byte) {
+		hasLower, hasUpper := false, false
+		n := 0
+		for _, r := range s {
+			c := byte('_')
+			switch {
+			case 'a' <= r && r <= 'z':
+				hasLower = true
+				c = byte(r) - 'a' + 'A'
+			case 'A' <= r && r <= 'Z':
+				hasUpper = true
+				c = byte(r)
+			case '0' <= r && r <= '9', r < 0x80 && strings.ContainsRune("$%'-_@~`!(){}^#&", r):
+				c = byte(r)
+			case r == ' ' || r == '.':
+				// Dropped.
+				exact = false
+				continue
+			default:
+				exact = false
+			}
+			if n < len(dst) {
+				dst[n] = c
+			}
+			n++
+		}
+		if n > len(dst) {
+			exact = false
+		}
+		if hasLower && hasUpper {
+			exact = false
+		}
+		if hasLower {
+			nt |= lower
+		}
+	}
+	conv(short[:8], base, lowerBase)
+	conv(short[8:], ext, lowerExt)
+	if short[0] == ' ' {
+		short[0] = '_'
+		exact = false
+	}
+	if !exact {
+		nt = 0
+	}
+	return short, nt, exact
+}
+
+// uniqueShort derives a short name from basis that is unique among
+// ents, in the form BASIS~N.EXT.
+func uniqueShort(ents []dirent, basis [11]byte) [11]byte {
+	baseLen := bytes.IndexByte(basis[:8], ' ')
+	if baseLen == -1 {
+		baseLen = 8
+	}
+	for i := 1; ; i++ {
+		tail := "~" + strconv.Itoa(i)
+		n := baseLen
+		if n > 8-len(tail) {
+			n = 8 - len(tail)
+		}
+		short := basis
+		copy(short[n:8], tail)
+		for j := n + len(tail); j < 8; j++ {
+			short[j] = ' '
+		}
+		unique := true
+		for _, e := range ents {
+			if e.short == short {
+				unique = false
+				break
+			}
+		}
+		if unique {
+			return short
+		}
+	}
+}
+
+// Stat implements fs.StatFS.
+func (f *FS) Stat(name string) (fs.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, _, err := f.lookup("stat", name)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return n.info(), nil
+}
+
+// ReadDir implements fs.ReadDirFS. The entries are sorted by name.
+func (f *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, _, err := f.lookup("readdir", name)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	list, err := f.readDirEntries(d)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name() < list[j].Name()
+	})
+	return list, nil
+}
+
+func (f *FS) readDirEntries(d *node) ([]fs.DirEntry, error) {
+	if !d.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	data, err := f.readDir(d)
+	if err != nil {
+		return nil, err
+	}
+	ents := entries(data)
+	list := make([]fs.DirEntry, len(ents))
+	for i, e := range ents {
+		list[i] = fs.FileInfoToDirEntry(f.node(d, e).info())
+	}
+	return list, nil
+}
+
+// Mkdir creates the directory name.
+func (f *FS) Mkdir(name string, perm fs.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.mkdir(name); err != nil {
+		return pathError("mkdir", name, err)
+	}
+	return nil
+}
+
+func (f *FS) mkdir(name string) error {
+	d, err := f.lookupParent("mkdir", name)
+	if err != nil {
+		return err
+	}
+	n := &node{attr: attrDirectory, mtime: time.Now()}
+	if err := f.grow(n, 1); err != nil {
+		return err
+	}
+	// Write the "." and ".." entries.
+	dots := make([]byte, 2*entrySize)
+	copy(dots, ".          ")
+	f.encode(dots, n)
+	parent := &node{attr: attrDirectory, cluster: f.dirCluster(d), mtime: n.mtime}
+	copy(dots[entrySize:], "..         ")
+	f.encode(dots[entrySize:], parent)
+	if err := f.access(n, dots, 0, true); err != nil {
+		f.free(n)
+		return err
+	}
+	if err := f.create(d, path.Base(name), n); err != nil {
+		f.free(n)
+		return err
+	}
+	return nil
+}
+
+// Remove removes the file or empty directory name.
+func (f *FS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.remove(name); err != nil {
+		return pathError("remove", name, err)
+	}
+	return nil
+}
+
+func (f *FS) remove(name string) error {
+	n, d, err := f.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if n.root {
+		return fs.ErrInvalid
+	}
+	if n.isDir() {
+		data, err := f.readDir(n)
+		if err != nil {
+			return err
+		}
+		if len(entries(data)) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+	return f.unlink(d, n)
+}
+
+// unlink removes n from its directory d and frees its clusters unless
+// n is open.
+func (f *FS) unlink(d *node, n *node) error {
+	data, err := f.readDir(d)
+	if err != nil {
+		return err
+	}
+	var ent dirent
+	found := false
+	for _, e := range entries(data) {
+		if e.off == n.loc.off {
+			ent, found = e, true
+			break
+		}
+	}
+	if !found {
+		return errCorrupt
+	}
+	if err := f.removeEntry(d, ent); err != nil {
+		return err
+	}
+	delete(f.nodes, n.loc)
+	n.removed = true
+	if n.refs > 0 {
+		return nil
+	}
+	return f.free(n)
+}
+
+// Rename moves the file or directory oldname to newname, replacing
+// any existing file or empty directory.
+func (f *FS) Rename(oldname, newname string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.rename(oldname, newname); err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname + " " + newname, Err: unwrap(err)}
+	}
+	return nil
+}
+
+func (f *FS) rename(oldname, newname string) error {
+	n, od, err := f.lookup("rename", oldname)
+	if err != nil {
+		return err
+	}
+	if n.root {
+		return fs.ErrInvalid
+	}
+	nd, err := f.lookupParent("rename", newname)
+	if err != nil {
+		return err
+	}
+	if n.isDir() && (newname == oldname || strings.HasPrefix(newname, oldname+"/")) {
+		return fs.ErrInvalid
+	}
+	if old, _, err := f.lookup("rename", newname); err == nil {
+		if old.loc == n.loc {
+			return nil
+		}
+		switch {
+		case n.isDir() && !old.isDir():
+			return syscall.ENOTDIR
+		case !n.isDir() && old.isDir():
+			return syscall.EISDIR
+		}
+		if err := f.remove(newname); err != nil {
+			return err
+		}
+	}
+	oldLoc := n.loc
+	if err := f.create(nd, path.Base(newname), n); err != nil {
+		n.loc = oldLoc
+		return err
+	}
+	newLoc := n.loc
+	n.loc = oldLoc
+	refs := n.refs
+	// Unlink the old entry without freeing the clusters.
+	n.refs = 1
+	err = f.unlink(od, n)
+	n.refs, n.removed, n.loc = refs, false, newLoc
+	if refs > 0 {
+		f.nodes[newLoc] = n
+	}
+	if err != nil {
+		return err
+	}
+	if n.isDir() && od != nd {
+		// Update the ".." entry.
+		var e [entrySize]byte
+		if err := f.access(n, e[:], entrySize, false); err != nil {
+			return err
+		}
+		if string(e[:11]) == "..         " {
+			cluster := f.dirCluster(nd)
+			binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+			binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+			return f.access(n, e[:], entrySize, true)
+		}
+	}
+	return nil
+}
+
+// info returns the fs.FileInfo of n.
+func (n *node) info() fs.FileInfo {
+	name := n.name
+	if n.root {
+		name = "."
+	}
+	return &fileInfo{
+		name:  name,
+		size:  n.size,
+		attr:  n.attr,
+		mtime: n.mtime,
+	}
+}
+
+type fileInfo struct {
+	name  string
+	size  int64
+	attr  byte
+	mtime time.Time
+}
+
+func (i *fileInfo) Name() string {
+	return i.name
+}
+
+func (i *fileInfo) Size() int64 {
+	if i.attr&attrDirectory != 0 {
+		return 0
+	}
+	return i.size
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(0666)
+	if i.attr&attrReadOnly != 0 {
+		mode = 0444
+	}
+	if i.attr&attrDirectory != 0 {
+		mode |= fs.ModeDir | 0111
+	}
+	return mode
+}
+
+func (i *fileInfo) ModTime() time.Time {
+	return i.mtime
+}
+
+func (i *fileInfo) IsDir() bool {
+	return i.attr&attrDirectory != 0
+}
+
+func (i *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// pathError wraps err in a *fs.PathError, unless it already is one.
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: unwrap(err)}
+}
+
+func unwrap(err error) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
@@ -0,0 +1,482 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+// Package fat implements the FAT12, FAT16 and FAT32 file systems on
+// top of a block device. File systems implement io/fs.FS along with
+// methods for creating, modifying and removing files.
+package fat
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sync"
+	"time"
+)
+
+// Device is the storage of a file system, typically a block device
+// such as *blk.Device. If the device has a Flush() error method,
+// Sync calls it.
+type Device interface {
+	io.ReaderAt
+	io.WriterAt
+	// Size returns the capacity of the device in bytes.
+	Size() int64
+}
+
+// FS is a FAT file system. Its methods are safe for concurrent use.
+type FS struct {
+	mu  sync.Mutex
+	dev Device
+	// typ is 12, 16 or 32.
+	typ         int
+	sectorSize  int
+	clusterSize int
+	// fatOff is the device offset of the first FAT, fatSize the size
+	// of each copy and numFATs the number of copies.
+	fatOff  int64
+	fatSize int64
+	numFATs int
+	// fat is the first FAT. The byte range [dirtyLo, dirtyHi[ is
+	// not yet written to the device.
+	fat              []byte
+	dirtyLo, dirtyHi int
+	// rootOff and rootSize locate the fixed root directory of FAT12
+	// and FAT16.
+	rootOff  int64
+	rootSize int
+	dataOff  int64
+	// clusters is the number of data clusters. Valid cluster
+	// numbers are in the range [2, clusters+2[.
+	clusters uint32
+	// nextFree is where to start looking for a free cluster.
+	nextFree uint32
+	// fsInfo is the device offset of the FAT32 FSInfo sector, or 0.
+	// The free cluster hints are invalidated before the first
+	// modification.
+	fsInfo int64
+
+	root *node
+	// nodes are the open files and directories by the location of
+	// their directory entries.
+	nodes map[location]*node
+}
+
+// location is the location of a directory entry: the first cluster
+// of the directory and the offset of the entry in it.
+type location struct {
+	dir uint32
+	off int
+}
+
+// node is a file or directory. Open files share nodes.
+type node struct {
+	// cluster is the first cluster, or 0 for empty files and the
+	// fixed root directory.
+	cluster uint32
+	// chain is the list of clusters, if loaded.
+	chain  []uint32
+	loaded bool
+	size   int64
+	attr   byte
+	mtime  time.Time
+	name   string
+	// loc is the location of the directory entry of non-root nodes.
+	loc  location
+	root bool
+	refs int
+	// removed is set for removed files whose clusters are freed at
+	// their last close.
+	removed bool
+}
+
+const (
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = attrReadOnly | attrHidden | attrSystem | attrVolumeID
+)
+
+var (
+	errCorrupt = errors.New("fat: corrupt file system")
+	errNoSpace = errors.New("fat: no space left on device")
+)
+
+// New opens the FAT file system on dev.
+func New(dev Device) (*FS, error) {
+	var bs [512]byte
+	if _, err := dev.ReadAt(bs[:], 0); err != nil {
+		return nil, fmt.Errorf("fat: reading boot sector: %v", err)
+	}
+	if bs[510] != 0x55 || bs[511] != 0xaa {
+		return nil, errors.New("fat: no boot sector signature")
+	}
+	bo := binary.LittleEndian
+	sectorSize := int(bo.Uint16(bs[11:]))
+	secPerClus := int(bs[13])
+	reserved := int64(bo.Uint16(bs[14:]))
+	numFATs := int(bs[16])
+	rootEntries := int(bo.Uint16(bs[17:]))
+	totSec := int64(bo.Uint16(bs[19:]))
+	if totSec == 0 {
+		totSec = int64(bo.Uint32(bs[32:]))
+	}
+	fatSec := int64(bo.Uint16(bs[22:]))
+	if fatSec == 0 {
+		fatSec = int64(bo.Uint32(bs[36:]))
+	}
+	switch sectorSize {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("fat: invalid sector size %d", sectorSize)
+	}
+	if secPerClus == 0 || secPerClus&(secPerClus-1) != 0 {
+		return nil, fmt.Errorf("fat: invalid cluster size of %d sectors", secPerClus)
+	}
+	if reserved == 0 || numFATs == 0 || fatSec == 0 {
+		return nil, errCorrupt
+	}
+	ss := int64(sectorSize)
+	if totSec*ss > dev.Size() {
+		return nil, errors.New("fat: file system larger than device")
+	}
+	f := &FS{
+		dev:         dev,
+		sectorSize:  sectorSize,
+		clusterSize: sectorSize * secPerClus,
+		fatOff:      reserved * ss,
+		fatSize:     fatSec * ss,
+		numFATs:     numFATs,
+		nodes:       make(map[location]*node),
+	}
+	rootSec := (int64(rootEntries)*32 + ss - 1) / ss
+	f.rootOff = f.fatOff + int64(numFATs)*f.fatSize
+	f.rootSize = rootEntries * 32
+	f.dataOff = f.rootOff + rootSec*ss
+	dataSec := totSec - f.dataOff/ss
+	if dataSec <= 0 {
+		return nil, errCorrupt
+	}
+	clusters := dataSec / int64(secPerClus)
+	switch {
+	case clusters < 4085:
+		f.typ = 12
+	case clusters < 65525:
+		f.typ = 16
+	default:
+		f.typ = 32
+	}
+	// Don't trust clusters that the FAT can't describe.
+	if max := f.fatSize * 8 / int64(f.typ); clusters+2 > max {
+		clusters = max - 2
+	}
+	if f.typ == 32 && clusters > 0x0ffffff5 {
+		clusters = 0x0ffffff5
+	}
+	f.clusters = uint32(clusters)
+	f.nextFree = 2
+	f.root = &node{attr: attrDirectory, root: true}
+	if f.typ == 32 {
+		if rootEntries != 0 {
+			return nil, errCorrupt
+		}
+		f.root.cluster = bo.Uint32(bs[44:])
+		if !f.valid(f.root.cluster) {
+			return nil, errCorrupt
+		}
+		if s := int64(bo.Uint16(bs[48:])); s != 0 && s < reserved {
+			f.fsInfo = s * ss
+		}
+	} else if rootEntries == 0 {
+		return nil, errCorrupt
+	}
+	f.fat = make([]byte, f.fatSize)
+	if _, err := dev.ReadAt(f.fat, f.fatOff); err != nil {
+		return nil, fmt.Errorf("fat: reading FAT: %v", err)
+	}
+	return f, nil
+}
+
+// valid reports whether c is a data cluster.
+func (f *FS) valid(c uint32) bool {
+	return c >= 2 && c-2 < f.clusters
+}
+
+// eoc returns the end of chain marker.
+func (f *FS) eoc() uint32 {
+	switch f.typ {
+	case 12:
+		return 0xfff
+	case 16:
+		return 0xffff
+	default:
+		return 0x0fffffff
+	}
+}
+
+// entry returns the FAT entry of the cluster c.
+func (f *FS) entry(c uint32) uint32 {
+	bo := binary.LittleEndian
+	switch f.typ {
+	case 12:
+		o := c + c/2
+		v := uint32(bo.Uint16(f.fat[o:]))
+		if c&1 != 0 {
+			return v >> 4
+		}
+		return v & 0xfff
+	case 16:
+		return uint32(bo.Uint16(f.fat[c*2:]))
+	default:
+		return bo.Uint32(f.fat[c*4:]) & 0x0fffffff
+	}
+}
+
+// setEntry sets the FAT entry of the cluster c to v.
+func (f *FS) setEntry(c, v uint32) {
+	bo := binary.LittleEndian
+	var o, n int
+	switch f.typ {
+	case 12:
+		o, n = int(c+c/2), 2
+		old := uint32(bo.Uint16(f.fat[o:]))
+		if c&1 != 0 {
+			v = old&0x000f | v<<4
+		} else {
+			v = old&0xf000 | v&0xfff
+		}
+		bo.PutUint16(f.fat[o:], uint16(v))
+	case 16:
+		o, n = int(c*2), 2
+		bo.PutUint16(f.fat[o:], uint16(v))
+	default:
+		o, n = int(c*4), 4
+		old := bo.Uint32(f.fat[o:])
+		bo.PutUint32(f.fat[o:], old&0xf0000000|v&0x0fffffff)
+	}
+	if f.dirtyHi == 0 {
+		f.dirtyLo, f.dirtyHi = o, o+n
+		return
+	}
+	if o < f.dirtyLo {
+		f.dirtyLo = o
+	}
+	if o+n > f.dirtyHi {
+		f.dirtyHi = o + n
+	}
+}
+
+// isEOC reports whether the FAT entry v ends a chain.
+func (f *FS) isEOC(v uint32) bool {
+	return v >= f.eoc()&^7
+}
+
+// flushFAT writes the modified part of the FAT to every copy.
+func (f *FS) flushFAT() error {
+	if f.dirtyHi == 0 {
+		return nil
+	}
+	lo, hi := f.dirtyLo, f.dirtyHi
+	f.dirtyLo, f.dirtyHi = 0, 0
+	for i := 0; i < f.numFATs; i++ {
+		off := f.fatOff + int64(i)*f.fatSize + int64(lo)
+		if _, err := f.dev.WriteAt(f.fat[lo:hi], off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modify prepares the file system for modification.
+func (f *FS) modify() error {
+	if f.fsInfo == 0 {
+		return nil
+	}
+	// Invalidate the free cluster count and hint rather than
+	// maintaining them.
+	var info [8]byte
+	for i := range info {
+		info[i] = 0xff
+	}
+	off := f.fsInfo
+	f.fsInfo = 0
+	_, err := f.dev.WriteAt(info[:], off+488)
+	return err
+}
+
+// chain returns the clusters of n.
+func (f *FS) chain(n *node) ([]uint32, error) {
+	if n.loaded {
+		return n.chain, nil
+	}
+	var chain []uint32
+	for c := n.cluster; c != 0; {
+		if !f.valid(c) || uint32(len(chain)) >= f.clusters {
+			return nil, errCorrupt
+		}
+		chain = append(chain, c)
+		next := f.entry(c)
+		if f.isEOC(next) {
+			break
+		}
+		c = next
+	}
+	n.chain, n.loaded = chain, true
+	return chain, nil
+}
+
+// clusterOff returns the device offset of the cluster c.
+func (f *FS) clusterOff(c uint32) int64 {
+	return f.dataOff + int64(c-2)*int64(f.clusterSize)
+}
+
+// grow extends the chain of n to count clusters. New clusters are
+// zeroed.
+func (f *FS) grow(n *node, count int) error {
+	chain, err := f.chain(n)
+	if err != nil {
+		return err
+	}
+	if len(chain) >= count {
+		return nil
+	}
+	if err := f.modify(); err != nil {
+		return err
+	}
+	zero := make([]byte, f.clusterSize)
+	for len(chain) < count {
+		c, ok := f.allocCluster()
+		if !ok {
+			f.flushFAT()
+			return errNoSpace
+		}
+		if _, err := f.dev.WriteAt(zero, f.clusterOff(c)); err != nil {
+			f.setEntry(c, 0)
+			f.flushFAT()
+			return err
+		}
+		if len(chain) == 0 {
+			n.cluster = c
+		} else {
+			f.setEntry(chain[len(chain)-1], c)
+		}
+		chain = append(chain, c)
+		n.chain = chain
+	}
+	return f.flushFAT()
+}
+
+// allocCluster marks a free cluster as the end of a chain.
+func (f *FS) allocCluster() (uint32, bool) {
+	for i := uint32(0); i < f.clusters; i++ {
+		c := 2 + (f.nextFree-2+i)%f.clusters
+		if f.entry(c) == 0 {
+			f.setEntry(c, f.eoc())
+			f.nextFree = c + 1
+			if !f.valid(f.nextFree) {
+				f.nextFree = 2
+			}
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// shrink truncates the chain of n to count clusters.
+func (f *FS) shrink(n *node, count int) error {
+	chain, err := f.chain(n)
+	if err != nil {
+		return err
+	}
+	if len(chain) <= count {
+		return nil
+	}
+	if err := f.modify(); err != nil {
+		return err
+	}
+	for _, c := range chain[count:] {
+		f.setEntry(c, 0)
+	}
+	if count == 0 {
+		n.cluster = 0
+	} else {
+		f.setEntry(chain[count-1], f.eoc())
+	}
+	n.chain = chain[:count]
+	return f.flushFAT()
+}
+
+// access reads or writes the bytes of n at off. The chain must cover
+// the range.
+func (f *FS) access(n *node, p []byte, off int64, write bool) error {
+	if n.root && n.cluster == 0 {
+		if write {
+			_, err := f.dev.WriteAt(p, f.rootOff+off)
+			return err
+		}
+		_, err := f.dev.ReadAt(p, f.rootOff+off)
+		return err
+	}
+	chain, err := f.chain(n)
+	if err != nil {
+		return err
+	}
+	cs := int64(f.clusterSize)
+	for len(p) > 0 {
+		i := off / cs
+		start := chain[i]
+		// Coalesce contiguous clusters.
+		end := i + 1
+		for end < int64(len(chain)) && chain[end] == chain[end-1]+1 {
+			end++
+		}
+		o := off % cs
+		run := end*cs - off
+		if run > int64(len(p)) {
+			run = int64(len(p))
+		}
+		devOff := f.clusterOff(start) + o
+		if write {
+			_, err = f.dev.WriteAt(p[:run], devOff)
+		} else {
+			_, err = f.dev.ReadAt(p[:run], devOff)
+		}
+		if err != nil {
+			return err
+		}
+		p = p[run:]
+		off += run
+	}
+	return nil
+}
+
+// free releases the clusters of a removed node.
+func (f *FS) free(n *node) error {
+	return f.shrink(n, 0)
+}
+
+// Sync flushes the device, if it supports flushing.
+func (f *FS) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sync()
+}
+
+func (f *FS) sync() error {
+	if err := f.flushFAT(); err != nil {
+		return err
+	}
+	if d, ok := f.dev.(interface{ Flush() error }); ok {
+		return d.Flush()
+	}
+	return nil
+}
+
+// Open implements fs.FS.
+func (f *FS) Open(name string) (fs.File, error) {
+	return f.OpenFile(name, 0, 0)
+}
@@ -0,0 +1,268 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package fat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+// memDevice is a Device backed by memory.
+type memDevice struct {
+	data []byte
+}
+
+func (d *memDevice) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d *memDevice) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(d.data)) {
+		return 0, errors.New("write past end of device")
+	}
+	return copy(d.data[off:], p), nil
+}
+
+func (d *memDevice) Size() int64 {
+	return int64(len(d.data))
+}
+
+// newFloppy returns an empty FAT12 file system with the layout of a
+// 1.44MB floppy disk.
+func newFloppy(t *testing.T) *memDevice {
+	const (
+		sectorSize  = 512
+		totSec      = 2880
+		reserved    = 1
+		numFATs     = 2
+		fatSec      = 9
+		rootEntries = 224
+	)
+	dev := &memDevice{data: make([]byte, totSec*sectorSize)}
+	bs := dev.data[:sectorSize]
+	bo := binary.LittleEndian
+	copy(bs, "\xeb\x3c\x90MSWIN4.1")
+	bo.PutUint16(bs[11:], sectorSize)
+	bs[13] = 1 // Sectors per cluster.
+	bo.PutUint16(bs[14:], reserved)
+	bs[16] = numFATs
+	bo.PutUint16(bs[17:], rootEntries)
+	bo.PutUint16(bs[19:], totSec)
+	bs[21] = 0xf0 // Media descriptor.
+	bo.PutUint16(bs[22:], fatSec)
+	bs[510], bs[511] = 0x55, 0xaa
+	for i := 0; i < numFATs; i++ {
+		fat := dev.data[(reserved+i*fatSec)*sectorSize:]
+		// Media descriptor and end of chain entries of the
+		// reserved clusters 0 and 1.
+		copy(fat, []byte{0xf0, 0xff, 0xff})
+	}
+	return dev
+}
+
+func newFS(t *testing.T, dev *memDevice) *FS {
+	f, err := New(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func writeFile(t *testing.T, f *FS, name string, data []byte) {
+	file, err := f.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.(io.Writer).Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFAT12Entries(t *testing.T) {
+	tests := []struct {
+		name string
+		// sets are pairs of clusters and values to set, in order.
+		sets [][2]uint32
+		// off and want are the expected FAT bytes at off.
+		off  int
+		want []byte
+	}{
+		{"even", [][2]uint32{{2, 0x123}}, 3, []byte{0x23, 0x01, 0x00}},
+		{"odd", [][2]uint32{{3, 0x456}}, 3, []byte{0x00, 0x60, 0x45}},
+		{"pair", [][2]uint32{{2, 0x123}, {3, 0x456}}, 3, []byte{0x23, 0x61, 0x45}},
+		{"pair reversed", [][2]uint32{{3, 0x456}, {2, 0x123}}, 3, []byte{0x23, 0x61, 0x45}},
+		{"overwrite odd", [][2]uint32{{2, 0xabc}, {3, 0xfff}, {3, 0x001}}, 3, []byte{0xbc, 0x1a, 0x00}},
+		{"overwrite even", [][2]uint32{{4, 0xfff}, {5, 0x789}, {4, 0x000}}, 6, []byte{0x00, 0x90, 0x78}},
+		{"truncate", [][2]uint32{{2, 0x1fff}}, 3, []byte{0xff, 0x0f, 0x00}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := &FS{typ: 12, fat: make([]byte, 512), clusters: 300}
+			for _, s := range test.sets {
+				f.setEntry(s[0], s[1])
+			}
+			if got := f.fat[test.off : test.off+len(test.want)]; !bytes.Equal(got, test.want) {
+				t.Errorf("FAT bytes %#x, want %#x", got, test.want)
+			}
+			// The last value set for each cluster must read back.
+			want := make(map[uint32]uint32)
+			for _, s := range test.sets {
+				want[s[0]] = s[1] & 0xfff
+			}
+			for c, v := range want {
+				if got := f.entry(c); got != v {
+					t.Errorf("entry(%d) = %#x, want %#x", c, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	large := make([]byte, 3000)
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"hello.txt", []byte("hello, world\n")},
+		{"empty", nil},
+		{"dir/Long File Name.data", large},
+		{"dir/sub/UPPER.TXT", []byte("upper")},
+		{"dir/sub/mixed.Case", []byte("mixed")},
+	}
+	dev := newFloppy(t)
+	f := newFS(t, dev)
+	for _, dir := range []string{"dir", "dir/sub"} {
+		if err := f.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range files {
+		writeFile(t, f, file.name, file.data)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the files back from a fresh instance.
+	f = newFS(t, dev)
+	for _, file := range files {
+		got, err := fs.ReadFile(f, file.name)
+		if err != nil {
+			t.Errorf("%s: %v", file.name, err)
+			continue
+		}
+		if !bytes.Equal(got, file.data) {
+			t.Errorf("%s: read %d bytes, want %d", file.name, len(got), len(file.data))
+		}
+	}
+	ents, err := f.ReadDir("dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range ents {
+		names = append(names, e.Name())
+	}
+	if want := []string{"Long File Name.data", "sub"}; !equalNames(names, want) {
+		t.Errorf("ReadDir(dir) = %q, want %q", names, want)
+	}
+
+	// Removal must free the clusters for reuse.
+	if err := f.Remove("dir/Long File Name.data"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	f = newFS(t, dev)
+	if _, err := f.Stat("dir/Long File Name.data"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat of removed file: %v, want ErrNotExist", err)
+	}
+	writeFile(t, f, "again", large)
+	if got, err := fs.ReadFile(f, "again"); err != nil || !bytes.Equal(got, large) {
+		t.Errorf("reading file in freed clusters: %v", err)
+	}
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestLFN(t *testing.T) {
+	tests := []struct {
+		name  string
+		short string
+		// lfns is the number of long name entries.
+		lfns int
+	}{
+		{"README.TXT", "README  TXT", 0},
+		{"readme.txt", "README  TXT", 0},
+		{"Readme.txt", "README~1TXT", 1},
+		{"abcdefghijklm", "ABCDEF~1   ", 1},
+		{"abcdefghijklmn", "ABCDEF~1   ", 2},
+		{"A long file name.text", "ALONGF~1TEX", 2},
+		{"two.dots.txt", "TWODOT~1TXT", 1},
+		{"héllo.txt", "H_LLO~1 TXT", 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFS(t, newFloppy(t))
+			writeFile(t, f, test.name, []byte("data"))
+			data, err := f.readDir(f.root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ents := entries(data)
+			if len(ents) != 1 {
+				t.Fatalf("got %d entries, want 1", len(ents))
+			}
+			e := ents[0]
+			if e.name != test.name {
+				t.Errorf("name %q, want %q", e.name, test.name)
+			}
+			if got := string(e.short[:]); got != test.short {
+				t.Errorf("short name %q, want %q", got, test.short)
+			}
+			if got := (e.off - e.start) / entrySize; got != test.lfns {
+				t.Errorf("%d long name entries, want %d", got, test.lfns)
+			}
+			if test.lfns > 0 {
+				// Every long name entry carries the checksum of
+				// the short name.
+				sum := checksum(e.short)
+				for off := e.start; off < e.off; off += entrySize {
+					if data[off+11] != attrLongName || data[off+13] != sum {
+						t.Errorf("invalid long name entry at %d", off)
+					}
+				}
+			}
+		})
+	}
+}
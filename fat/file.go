@@ -0,0 +1,337 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package fat
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// File is an open file or directory.
+type File struct {
+	fs   *FS
+	n    *node
+	name string
+	flag int
+	// off is the offset of Read, Write and Seek.
+	off int64
+	// dir holds the remaining entries of ReadDir.
+	dir    []fs.DirEntry
+	dirOff int
+	closed bool
+}
+
+// maxFileSize is the size limit of files.
+const maxFileSize = 1<<32 - 1
+
+// OpenFile opens the file name with the os.O_* flags. If the file is
+// created, perm is ignored except for the write permission.
+func (f *FS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := f.openFile(name, flag, perm)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return file, nil
+}
+
+func (f *FS) openFile(name string, flag int, perm fs.FileMode) (*File, error) {
+	n, d, err := f.lookup("open", name)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && d != nil && flag&os.O_CREATE != 0:
+		attr := byte(attrArchive)
+		if perm&0222 == 0 {
+			attr |= attrReadOnly
+		}
+		n = &node{attr: attr, mtime: time.Now()}
+		if err := f.create(d, path.Base(name), n); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, fs.ErrExist
+	}
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if n.isDir() && (write || flag&os.O_TRUNC != 0) {
+		return nil, syscall.EISDIR
+	}
+	if write && n.attr&attrReadOnly != 0 {
+		return nil, fs.ErrPermission
+	}
+	if flag&os.O_TRUNC != 0 && write {
+		if err := f.truncate(n, 0); err != nil {
+			return nil, err
+		}
+	}
+	f.ref(n)
+	return &File{fs: f, n: n, name: name, flag: flag}, nil
+}
+
+// ref adds a reference to n.
+func (f *FS) ref(n *node) {
+	n.refs++
+	if !n.root && !n.removed {
+		f.nodes[n.loc] = n
+	}
+}
+
+// unref releases a reference to n.
+func (f *FS) unref(n *node) error {
+	n.refs--
+	if n.refs > 0 || n.root {
+		return nil
+	}
+	if n.removed {
+		return f.free(n)
+	}
+	delete(f.nodes, n.loc)
+	return nil
+}
+
+// truncate changes the size of n.
+func (f *FS) truncate(n *node, size int64) error {
+	if size < 0 || size > maxFileSize {
+		return fs.ErrInvalid
+	}
+	if size == n.size {
+		return nil
+	}
+	cs := int64(f.clusterSize)
+	count := int((size + cs - 1) / cs)
+	if size > n.size {
+		// Zero the remainder of the last cluster.
+		if err := f.zero(n, n.size, size); err != nil {
+			return err
+		}
+		if err := f.grow(n, count); err != nil {
+			return err
+		}
+	} else if err := f.shrink(n, count); err != nil {
+		return err
+	}
+	n.size = size
+	n.mtime = time.Now()
+	return f.writeEntry(n)
+}
+
+// zero clears the bytes of n from the offset start to the end of the
+// allocated clusters, or end, whichever comes first.
+func (f *FS) zero(n *node, start, end int64) error {
+	chain, err := f.chain(n)
+	if err != nil {
+		return err
+	}
+	if alloc := int64(len(chain)) * int64(f.clusterSize); end > alloc {
+		end = alloc
+	}
+	if start >= end {
+		return nil
+	}
+	return f.access(n, make([]byte, end-start), start, true)
+}
+
+func (fl *File) check(op string, write bool) error {
+	switch {
+	case fl.closed:
+		return &fs.PathError{Op: op, Path: fl.name, Err: fs.ErrClosed}
+	case fl.n.isDir():
+		return &fs.PathError{Op: op, Path: fl.name, Err: syscall.EISDIR}
+	case write && fl.flag&(os.O_WRONLY|os.O_RDWR) == 0,
+		!write && fl.flag&os.O_WRONLY != 0:
+		return &fs.PathError{Op: op, Path: fl.name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+// Read implements io.Reader.
+func (fl *File) Read(p []byte) (int, error) {
+	n, err := fl.ReadAt(p, fl.off)
+	fl.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (fl *File) ReadAt(p []byte, off int64) (int, error) {
+	f := fl.fs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := fl.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: fl.name, Err: fs.ErrInvalid}
+	}
+	if off >= fl.n.size {
+		return 0, io.EOF
+	}
+	var err error
+	if rem := fl.n.size - off; int64(len(p)) > rem {
+		p = p[:rem]
+		err = io.EOF
+	}
+	if e := f.access(fl.n, p, off, false); e != nil {
+		return 0, &fs.PathError{Op: "read", Path: fl.name, Err: e}
+	}
+	return len(p), err
+}
+
+// Write implements io.Writer.
+func (fl *File) Write(p []byte) (int, error) {
+	off := fl.off
+	if fl.flag&os.O_APPEND != 0 {
+		fl.fs.mu.Lock()
+		off = fl.n.size
+		fl.fs.mu.Unlock()
+	}
+	n, err := fl.WriteAt(p, off)
+	fl.off = off + int64(n)
+	return n, err
+}
+
+// WriteAt implements io.WriterAt.
+func (fl *File) WriteAt(p []byte, off int64) (int, error) {
+	f := fl.fs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := fl.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 || off+int64(len(p)) > maxFileSize {
+		return 0, &fs.PathError{Op: "write", Path: fl.name, Err: fs.ErrInvalid}
+	}
+	if err := f.write(fl.n, p, off); err != nil {
+		return 0, &fs.PathError{Op: "write", Path: fl.name, Err: err}
+	}
+	return len(p), nil
+}
+
+func (f *FS) write(n *node, p []byte, off int64) error {
+	n.mtime = time.Now()
+	if len(p) == 0 {
+		return f.writeEntry(n)
+	}
+	end := off + int64(len(p))
+	if end > n.size {
+		cs := int64(f.clusterSize)
+		if err := f.zero(n, n.size, off); err != nil {
+			return err
+		}
+		if err := f.grow(n, int((end+cs-1)/cs)); err != nil {
+			return err
+		}
+	}
+	if err := f.access(n, p, off, true); err != nil {
+		return err
+	}
+	if end > n.size {
+		n.size = end
+	}
+	return f.writeEntry(n)
+}
+
+// Seek implements io.Seeker.
+func (fl *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += fl.off
+	case io.SeekEnd:
+		fl.fs.mu.Lock()
+		offset += fl.n.size
+		fl.fs.mu.Unlock()
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: fl.name, Err: fs.ErrInvalid}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: fl.name, Err: fs.ErrInvalid}
+	}
+	fl.off = offset
+	fl.dir, fl.dirOff = nil, 0
+	return offset, nil
+}
+
+// Truncate changes the size of the file.
+func (fl *File) Truncate(size int64) error {
+	f := fl.fs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := fl.check("truncate", true); err != nil {
+		return err
+	}
+	if err := f.truncate(fl.n, size); err != nil {
+		return &fs.PathError{Op: "truncate", Path: fl.name, Err: err}
+	}
+	return nil
+}
+
+// Sync commits the file system to stable storage.
+func (fl *File) Sync() error {
+	if err := fl.fs.Sync(); err != nil {
+		return &fs.PathError{Op: "sync", Path: fl.name, Err: err}
+	}
+	return nil
+}
+
+// Stat implements fs.File.
+func (fl *File) Stat() (fs.FileInfo, error) {
+	f := fl.fs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fl.closed {
+		return nil, &fs.PathError{Op: "stat", Path: fl.name, Err: fs.ErrClosed}
+	}
+	return fl.n.info(), nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (fl *File) ReadDir(count int) ([]fs.DirEntry, error) {
+	f := fl.fs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fl.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: fl.name, Err: fs.ErrClosed}
+	}
+	if fl.dir == nil {
+		ents, err := f.readDirEntries(fl.n)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: fl.name, Err: err}
+		}
+		fl.dir = ents
+	}
+	ents := fl.dir[fl.dirOff:]
+	if count > 0 {
+		if len(ents) == 0 {
+			return nil, io.EOF
+		}
+		if len(ents) > count {
+			ents = ents[:count]
+		}
+	}
+	fl.dirOff += len(ents)
+	return ents, nil
+}
+
+// Close implements fs.File.
+func (fl *File) Close() error {
+	f := fl.fs
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fl.closed {
+		return &fs.PathError{Op: "close", Path: fl.name, Err: fs.ErrClosed}
+	}
+	fl.closed = true
+	if err := f.unref(fl.n); err != nil {
+		return &fs.PathError{Op: "close", Path: fl.name, Err: err}
+	}
+	return nil
+}
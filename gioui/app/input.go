@@ -0,0 +1,171 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package app
+
+import (
+	"gioui.org/f32"
+	"gioui.org/io/event"
+	"gioui.org/io/pointer"
+
+	"eliasnaur.com/unik/virtio/input"
+)
+
+// inputEvent is an event from the input device with index dev.
+type inputEvent struct {
+	dev int
+	e   input.Event
+}
+
+// inputMapper translates input device events to Gio events.
+type inputMapper struct {
+	// emit delivers Gio events.
+	emit          func(e event.Event)
+	width, height int
+	begun         bool
+	devs          []deviceMapper
+	x, y          float32
+	buttons       pointer.Buttons
+	kbd           *input.Keyboard
+	touches       []input.Touch
+}
+
+// deviceMapper is the state of an input device.
+type deviceMapper struct {
+	xinf input.AbsInfo
+	yinf input.AbsInfo
+	// mt is non-nil for multitouch devices, whose axes are the
+	// ABS_MT_POSITION axes.
+	mt *input.Multitouch
+}
+
+func newInputMapper(devs []*input.Device, emit func(e event.Event)) *inputMapper {
+	m := &inputMapper{emit: emit, kbd: input.NewKeyboard()}
+	for _, d := range devs {
+		dm := deviceMapper{mt: input.NewMultitouch(d)}
+		if dm.mt != nil {
+			dm.xinf, _ = d.AbsInfo(input.ABS_MT_POSITION_X)
+			dm.yinf, _ = d.AbsInfo(input.ABS_MT_POSITION_Y)
+		} else {
+			dm.xinf, _ = d.AbsInfo(input.ABS_X)
+			dm.yinf, _ = d.AbsInfo(input.ABS_Y)
+		}
+		m.devs = append(m.devs, dm)
+	}
+	return m
+}
+
+func (m *inputMapper) event(dev int, e input.Event) {
+	d := &m.devs[dev]
+	if d.mt != nil {
+		m.touchEvent(d, e)
+		return
+	}
+	switch e.Type {
+	case input.EV_SYN:
+		if m.begun {
+			m.emit(pointer.Event{
+				Type:     pointer.Move,
+				Source:   pointer.Mouse,
+				Position: f32.Point{X: m.x, Y: m.y},
+				Buttons:  m.buttons,
+			})
+			m.begun = false
+		}
+	case input.EV_REL:
+		switch e.Code {
+		case input.REL_WHEEL:
+			amount := -int32(e.Value)
+			m.emit(pointer.Event{
+				Type:     pointer.Move,
+				Source:   pointer.Mouse,
+				Position: f32.Point{X: m.x, Y: m.y},
+				Scroll:   f32.Point{Y: float32(amount) * 120},
+				Buttons:  m.buttons,
+			})
+		case input.REL_HWHEEL:
+			amount := -int32(e.Value)
+			m.emit(pointer.Event{
+				Type:     pointer.Move,
+				Source:   pointer.Mouse,
+				Position: f32.Point{X: m.x, Y: m.y},
+				Scroll:   f32.Point{X: float32(amount) * 120},
+				Buttons:  m.buttons,
+			})
+		}
+	case input.EV_ABS:
+		val := int(e.Value)
+		switch e.Code {
+		case input.ABS_X:
+			m.begun = true
+			m.x = m.mapAxis(d.xinf, m.width, val)
+		case input.ABS_Y:
+			m.begun = true
+			m.y = m.mapAxis(d.yinf, m.height, val)
+		}
+	case input.EV_KEY:
+		var button pointer.Buttons
+		switch e.Code {
+		case input.BTN_LEFT:
+			button = pointer.ButtonLeft
+		case input.BTN_RIGHT:
+			button = pointer.ButtonRight
+		case input.BTN_MIDDLE:
+			button = pointer.ButtonMiddle
+		default:
+			m.key(e)
+			return
+		}
+		var t pointer.Type
+		if e.Value != 0 {
+			t = pointer.Press
+			m.buttons |= button
+		} else {
+			t = pointer.Release
+			m.buttons &^= button
+		}
+		m.begun = false
+		m.emit(pointer.Event{
+			Type:     t,
+			Source:   pointer.Mouse,
+			Position: f32.Point{X: m.x, Y: m.y},
+			Buttons:  m.buttons,
+		})
+	}
+}
+
+// touchEvent maps the contacts of multitouch devices to touch
+// pointers. Other events from multitouch devices, such as the
+// emulated single touch events, are ignored.
+func (m *inputMapper) touchEvent(d *deviceMapper, e input.Event) {
+	m.touches = d.mt.Event(m.touches[:0], e)
+	for _, t := range m.touches {
+		var typ pointer.Type
+		switch t.Type {
+		case input.TouchDown:
+			typ = pointer.Press
+		case input.TouchMove:
+			typ = pointer.Move
+		case input.TouchUp:
+			typ = pointer.Release
+		}
+		m.emit(pointer.Event{
+			Type:   typ,
+			Source: pointer.Touch,
+			// Offset the slots to keep pointer ID 0 for the
+			// mouse.
+			PointerID: pointer.ID(t.Slot + 1),
+			Position: f32.Point{
+				X: m.mapAxis(d.xinf, m.width, int(t.X)),
+				Y: m.mapAxis(d.yinf, m.height, int(t.Y)),
+			},
+		})
+	}
+}
+
+func (m *inputMapper) mapAxis(inf input.AbsInfo, dim, val int) float32 {
+	d := inf.Max - inf.Min
+	if d <= 0 {
+		return 0
+	}
+	return float32((val-int(inf.Min))*dim) / float32(d)
+}
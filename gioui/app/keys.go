@@ -0,0 +1,208 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package app
+
+import (
+	"time"
+	"unicode"
+
+	"gioui.org/io/key"
+
+	"eliasnaur.com/unik/virtio/input"
+)
+
+// usLayout maps key codes to their unshifted and shifted characters
+// in the US keyboard layout.
+var usLayout = map[uint16][2]rune{
+	input.KEY_1:          {'1', '!'},
+	input.KEY_2:          {'2', '@'},
+	input.KEY_3:          {'3', '#'},
+	input.KEY_4:          {'4', '$'},
+	input.KEY_5:          {'5', '%'},
+	input.KEY_6:          {'6', '^'},
+	input.KEY_7:          {'7', '&'},
+	input.KEY_8:          {'8', '*'},
+	input.KEY_9:          {'9', '('},
+	input.KEY_0:          {'0', ')'},
+	input.KEY_MINUS:      {'-', '_'},
+	input.KEY_EQUAL:      {'=', '+'},
+	input.KEY_Q:          {'q', 'Q'},
+	input.KEY_W:          {'w', 'W'},
+	input.KEY_E:          {'e', 'E'},
+	input.KEY_R:          {'r', 'R'},
+	input.KEY_T:          {'t', 'T'},
+	input.KEY_Y:          {'y', 'Y'},
+	input.KEY_U:          {'u', 'U'},
+	input.KEY_I:          {'i', 'I'},
+	input.KEY_O:          {'o', 'O'},
+	input.KEY_P:          {'p', 'P'},
+	input.KEY_LEFTBRACE:  {'[', '{'},
+	input.KEY_RIGHTBRACE: {']', '}'},
+	input.KEY_A:          {'a', 'A'},
+	input.KEY_S:          {'s', 'S'},
+	input.KEY_D:          {'d', 'D'},
+	input.KEY_F:          {'f', 'F'},
+	input.KEY_G:          {'g', 'G'},
+	input.KEY_H:          {'h', 'H'},
+	input.KEY_J:          {'j', 'J'},
+	input.KEY_K:          {'k', 'K'},
+	input.KEY_L:          {'l', 'L'},
+	input.KEY_SEMICOLON:  {';', ':'},
+	input.KEY_APOSTROPHE: {'\'', '"'},
+	input.KEY_GRAVE:      {'`', '~'},
+	input.KEY_BACKSLASH:  {'\\', '|'},
+	input.KEY_Z:          {'z', 'Z'},
+	input.KEY_X:          {'x', 'X'},
+	input.KEY_C:          {'c', 'C'},
+	input.KEY_V:          {'v', 'V'},
+	input.KEY_B:          {'b', 'B'},
+	input.KEY_N:          {'n', 'N'},
+	input.KEY_M:          {'m', 'M'},
+	input.KEY_COMMA:      {',', '<'},
+	input.KEY_DOT:        {'.', '>'},
+	input.KEY_SLASH:      {'/', '?'},
+	input.KEY_102ND:      {'<', '>'},
+	input.KEY_KPASTERISK: {'*', '*'},
+	input.KEY_KPMINUS:    {'-', '-'},
+	input.KEY_KPPLUS:     {'+', '+'},
+	input.KEY_KPSLASH:    {'/', '/'},
+	input.KEY_KPEQUAL:    {'=', '='},
+	input.KEY_KPCOMMA:    {',', ','},
+}
+
+// keypad maps the keypad keys to their characters when num lock is
+// on.
+var keypad = map[uint16]rune{
+	input.KEY_KP0:   '0',
+	input.KEY_KP1:   '1',
+	input.KEY_KP2:   '2',
+	input.KEY_KP3:   '3',
+	input.KEY_KP4:   '4',
+	input.KEY_KP5:   '5',
+	input.KEY_KP6:   '6',
+	input.KEY_KP7:   '7',
+	input.KEY_KP8:   '8',
+	input.KEY_KP9:   '9',
+	input.KEY_KPDOT: '.',
+}
+
+// keyNames maps key codes to the Gio names of keys that don't
+// produce characters.
+var keyNames = map[uint16]string{
+	input.KEY_ESC:       key.NameEscape,
+	input.KEY_BACKSPACE: key.NameDeleteBackward,
+	input.KEY_DELETE:    key.NameDeleteForward,
+	input.KEY_TAB:       key.NameTab,
+	input.KEY_ENTER:     key.NameReturn,
+	input.KEY_KPENTER:   key.NameEnter,
+	input.KEY_LEFT:      key.NameLeftArrow,
+	input.KEY_RIGHT:     key.NameRightArrow,
+	input.KEY_UP:        key.NameUpArrow,
+	input.KEY_DOWN:      key.NameDownArrow,
+	input.KEY_HOME:      key.NameHome,
+	input.KEY_END:       key.NameEnd,
+	input.KEY_PAGEUP:    key.NamePageUp,
+	input.KEY_PAGEDOWN:  key.NamePageDown,
+	input.KEY_SPACE:     "Space",
+	input.KEY_F1:        "F1",
+	input.KEY_F2:        "F2",
+	input.KEY_F3:        "F3",
+	input.KEY_F4:        "F4",
+	input.KEY_F5:        "F5",
+	input.KEY_F6:        "F6",
+	input.KEY_F7:        "F7",
+	input.KEY_F8:        "F8",
+	input.KEY_F9:        "F9",
+	input.KEY_F10:       "F10",
+	input.KEY_F11:       "F11",
+	input.KEY_F12:       "F12",
+}
+
+// keypadNames maps the keypad keys to the names of their functions
+// when num lock is off.
+var keypadNames = map[uint16]string{
+	input.KEY_KP1:   key.NameEnd,
+	input.KEY_KP2:   key.NameDownArrow,
+	input.KEY_KP3:   key.NamePageDown,
+	input.KEY_KP4:   key.NameLeftArrow,
+	input.KEY_KP6:   key.NameRightArrow,
+	input.KEY_KP7:   key.NameHome,
+	input.KEY_KP8:   key.NameUpArrow,
+	input.KEY_KP9:   key.NamePageUp,
+	input.KEY_KPDOT: key.NameDeleteForward,
+}
+
+func (m *inputMapper) key(e input.Event) {
+	m.kbd.Event(time.Now(), e)
+	if e.Value == input.KeyReleased {
+		return
+	}
+	m.keyPress(e.Code)
+}
+
+// repeat generates the events for the repeat of the held key, if
+// any.
+func (m *inputMapper) repeat() {
+	if code, ok := m.kbd.Repeat(time.Now()); ok {
+		m.keyPress(code)
+	}
+}
+
+func (m *inputMapper) keyPress(code uint16) {
+	mods := m.kbd.Modifiers()
+	var gmods key.Modifiers
+	if mods&input.ModCtrl != 0 {
+		gmods |= key.ModCtrl
+	}
+	if mods&input.ModShift != 0 {
+		gmods |= key.ModShift
+	}
+	if mods&input.ModAlt != 0 {
+		gmods |= key.ModAlt
+	}
+	if mods&input.ModSuper != 0 {
+		gmods |= key.ModSuper
+	}
+	r, name := translateKey(code, mods)
+	if name == "" {
+		return
+	}
+	m.emit(key.Event{Name: name, Modifiers: gmods})
+	if r != 0 && mods&(input.ModCtrl|input.ModAlt|input.ModSuper) == 0 {
+		m.emit(key.EditEvent{Text: string(r)})
+	}
+}
+
+// translateKey returns the character and the Gio name of the key
+// with the given code. The character is 0 for keys that don't
+// produce text and the name is empty for unknown keys.
+func translateKey(code uint16, mods input.Modifiers) (rune, string) {
+	if mods&input.ModNumLock != 0 {
+		if r, ok := keypad[code]; ok {
+			return r, string(r)
+		}
+	} else if n, ok := keypadNames[code]; ok {
+		return 0, n
+	}
+	if n, ok := keyNames[code]; ok {
+		r := rune(0)
+		if code == input.KEY_SPACE {
+			r = ' '
+		}
+		return r, n
+	}
+	chars, ok := usLayout[code]
+	if !ok {
+		return 0, ""
+	}
+	shift := mods&input.ModShift != 0
+	r := chars[0]
+	if unicode.IsLetter(r) && mods&input.ModCapsLock != 0 {
+		shift = !shift
+	}
+	if shift {
+		r = chars[1]
+	}
+	// Names use the upper case form of letters.
+	return r, string(unicode.ToUpper(r))
+}
@@ -0,0 +1,878 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package app
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+
+	virtgpu "eliasnaur.com/unik/virtio/gpu"
+	"gioui.org/gpu/backend"
+)
+
+// softBackend is a backend.Device that rasterizes in software, for
+// devices without 3D support. It implements the shaders of the Gio
+// renderer in Go and follows the OpenGL conventions: the first row
+// of framebuffers and textures is at the bottom of clip space and at
+// texture coordinate 0.
+type softBackend struct {
+	fb       *softFramebuffer
+	bound    *softFramebuffer
+	viewport image.Rectangle
+	prog     *softProgram
+	layout   *softInputLayout
+	vertBuf  struct {
+		buf            *softBuffer
+		stride, offset int
+	}
+	indexBuf *softBuffer
+	texUnits [maxSamplerUnits]*softTexture
+	depth    struct {
+		enable, mask bool
+	}
+	blend struct {
+		enable           bool
+		sfactor, dfactor backend.BlendFactor
+	}
+}
+
+type softFramebuffer struct {
+	tex *softTexture
+	// depth holds the window z values of the framebuffer, if any.
+	depth []float32
+}
+
+type softTexture struct {
+	width, height int
+	// pix holds the linear RGBA components of the pixels.
+	pix    []float32
+	linear bool
+	// srgb is set for textures stored as 8-bit sRGB by a GPU.
+	// Their components are clamped to [0, 1].
+	srgb bool
+}
+
+type softBuffer struct {
+	data []byte
+}
+
+type softInputLayout struct {
+	inputs []backend.InputLocation
+	layout []backend.InputDesc
+}
+
+// shaderKind identifies a Gio vertex shader.
+type shaderKind uint8
+
+const (
+	blitShader shaderKind = iota
+	coverShader
+	intersectShader
+	stencilShader
+)
+
+type softProgram struct {
+	kind shaderKind
+	// texture is set if the fragment shader samples an image texture.
+	texture bool
+	// texUnit and coverUnit are the texture units of the image and
+	// cover samplers.
+	texUnit, coverUnit int
+	vert, frag         struct {
+		uniforms *softBuffer
+		locs     []backend.UniformLocation
+	}
+	u softUniforms
+}
+
+// softUniforms holds the union of the uniforms of the Gio shaders.
+type softUniforms struct {
+	transform        [4]float32
+	uvTransform      [4]float32
+	uvCoverTransform [4]float32
+	subUVTransform   [4]float32
+	pathOffset       [4]float32
+	color            [4]float32
+	z                [4]float32
+}
+
+// softVertex is a transformed vertex in window coordinates.
+type softVertex struct {
+	x, y, z float32
+	vary    [maxVaryings]float32
+}
+
+const (
+	maxInputs   = 5
+	maxVaryings = 6
+)
+
+var (
+	// srgbToLinear maps 8-bit sRGB components to linear components.
+	srgbToLinear [256]float32
+	// linearToSRGB maps linear components in steps of
+	// 1/(len(linearToSRGB)-1) to 8-bit sRGB components.
+	linearToSRGB [4096]uint8
+)
+
+func init() {
+	for i := range srgbToLinear {
+		c := float64(i) / 255
+		if c <= 0.04045 {
+			c = c / 12.92
+		} else {
+			c = math.Pow((c+0.055)/1.055, 2.4)
+		}
+		srgbToLinear[i] = float32(c)
+	}
+	for i := range linearToSRGB {
+		c := float64(i) / float64(len(linearToSRGB)-1)
+		if c <= 0.0031308 {
+			c = c * 12.92
+		} else {
+			c = 1.055*math.Pow(c, 1/2.4) - 0.055
+		}
+		linearToSRGB[i] = uint8(c*255 + .5)
+	}
+}
+
+func newSoftBackend(width, height int) *softBackend {
+	fb := &softFramebuffer{
+		tex:   newSoftTexture(width, height, false, true),
+		depth: make([]float32, width*height),
+	}
+	b := &softBackend{fb: fb, bound: fb}
+	// Depth mask is on by default.
+	b.depth.mask = true
+	b.viewport = image.Rectangle{Max: image.Point{X: width, Y: height}}
+	return b
+}
+
+func newSoftTexture(width, height int, linear, srgb bool) *softTexture {
+	return &softTexture{
+		width:  width,
+		height: height,
+		pix:    make([]float32, width*height*4),
+		linear: linear,
+		srgb:   srgb,
+	}
+}
+
+func (b *softBackend) BeginFrame() {}
+
+func (b *softBackend) EndFrame() {}
+
+func (b *softBackend) Caps() backend.Caps {
+	return backend.Caps{
+		MaxTextureSize: 4096,
+	}
+}
+
+func (b *softBackend) NewTimer() backend.Timer {
+	panic("timers not implemented")
+}
+
+func (b *softBackend) IsTimeContinuous() bool {
+	panic("timers not implemented")
+}
+
+func (b *softBackend) NewTexture(format backend.TextureFormat, width, height int, minFilter, magFilter backend.TextureFilter, binding backend.BufferBinding) (backend.Texture, error) {
+	var srgb bool
+	switch format {
+	case backend.TextureFormatSRGB:
+		srgb = true
+	case backend.TextureFormatFloat:
+	default:
+		return nil, fmt.Errorf("gpu: unsupported texture format: %v", format)
+	}
+	// Textures are not mipmapped, so the magnification filter
+	// applies to minification as well.
+	linear := magFilter == backend.FilterLinear
+	return newSoftTexture(width, height, linear, srgb), nil
+}
+
+func (b *softBackend) CurrentFramebuffer() backend.Framebuffer {
+	return b.fb
+}
+
+func (b *softBackend) NewFramebuffer(tex backend.Texture, depthBits int) (backend.Framebuffer, error) {
+	t := tex.(*softTexture)
+	fb := &softFramebuffer{tex: t}
+	if depthBits > 0 {
+		fb.depth = make([]float32, t.width*t.height)
+	}
+	return fb, nil
+}
+
+func (b *softBackend) NewImmutableBuffer(typ backend.BufferBinding, data []byte) (backend.Buffer, error) {
+	buf := &softBuffer{data: make([]byte, len(data))}
+	copy(buf.data, data)
+	return buf, nil
+}
+
+func (b *softBackend) NewBuffer(typ backend.BufferBinding, size int) (backend.Buffer, error) {
+	return &softBuffer{data: make([]byte, size)}, nil
+}
+
+func (b *softBackend) NewProgram(vertShader, fragShader backend.ShaderSources) (backend.Program, error) {
+	p := new(softProgram)
+	switch {
+	case len(vertShader.Inputs) > 0 && vertShader.Inputs[0].Name == "corner":
+		p.kind = stencilShader
+	case hasUniform(vertShader, "subUVTransform"):
+		p.kind = intersectShader
+	case hasUniform(vertShader, "uvCoverTransform"):
+		p.kind = coverShader
+	case hasUniform(vertShader, "uvTransform"):
+		p.kind = blitShader
+	default:
+		return nil, errors.New("gpu: unrecognized vertex shader")
+	}
+	for _, t := range fragShader.Textures {
+		switch t.Name {
+		case "tex":
+			p.texture = true
+			p.texUnit = t.Binding
+		case "cover":
+			p.coverUnit = t.Binding
+		}
+	}
+	p.vert.locs = vertShader.Uniforms.Locations
+	p.frag.locs = fragShader.Uniforms.Locations
+	return p, nil
+}
+
+// hasUniform reports whether the shader declares the uniform name.
+func hasUniform(src backend.ShaderSources, name string) bool {
+	for _, l := range src.Uniforms.Locations {
+		if uniformName(l) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// uniformName strips the block prefix from the name of a uniform.
+func uniformName(l backend.UniformLocation) string {
+	name := l.Name
+	if i := strings.LastIndexByte(name, '.'); i != -1 {
+		name = name[i+1:]
+	}
+	return strings.TrimPrefix(name, "_")
+}
+
+func (b *softBackend) NewInputLayout(vs backend.ShaderSources, layout []backend.InputDesc) (backend.InputLayout, error) {
+	if len(vs.Inputs) > maxInputs {
+		return nil, fmt.Errorf("gpu: too many vertex inputs: %d", len(vs.Inputs))
+	}
+	for _, l := range layout {
+		if l.Type != backend.DataTypeFloat || l.Size > 2 {
+			return nil, fmt.Errorf("gpu: invalid data type %v, size %d", l.Type, l.Size)
+		}
+	}
+	return &softInputLayout{inputs: vs.Inputs, layout: layout}, nil
+}
+
+func (b *softBackend) DepthFunc(f backend.DepthFunc) {
+	if f != backend.DepthFuncGreater {
+		panic("unsupported depth func")
+	}
+}
+
+func (b *softBackend) ClearDepth(d float32) {
+	for i := range b.bound.depth {
+		b.bound.depth[i] = d
+	}
+}
+
+func (b *softBackend) Clear(colR, colG, colB, colA float32) {
+	pix := b.bound.tex.pix
+	for i := 0; i < len(pix); i += 4 {
+		pix[i+0] = colR
+		pix[i+1] = colG
+		pix[i+2] = colB
+		pix[i+3] = colA
+	}
+}
+
+func (b *softBackend) Viewport(x, y, width, height int) {
+	b.viewport = image.Rect(x, y, x+width, y+height)
+}
+
+func (b *softBackend) DrawArrays(mode backend.DrawMode, off, count int) {
+	b.draw(mode, count, func(i int) int {
+		return off + i
+	})
+}
+
+func (b *softBackend) DrawElements(mode backend.DrawMode, off, count int) {
+	indices := b.indexBuf.data
+	b.draw(mode, count, func(i int) int {
+		return int(binary.LittleEndian.Uint16(indices[(off+i)*2:]))
+	})
+}
+
+func (b *softBackend) SetBlend(enable bool) {
+	b.blend.enable = enable
+}
+
+func (b *softBackend) SetDepthTest(enable bool) {
+	b.depth.enable = enable
+}
+
+func (b *softBackend) DepthMask(mask bool) {
+	b.depth.mask = mask
+}
+
+func (b *softBackend) BlendFunc(sfactor, dfactor backend.BlendFactor) {
+	b.blend.sfactor = sfactor
+	b.blend.dfactor = dfactor
+}
+
+func (b *softBackend) BindInputLayout(layout backend.InputLayout) {
+	b.layout = layout.(*softInputLayout)
+}
+
+func (b *softBackend) BindProgram(prog backend.Program) {
+	b.prog = prog.(*softProgram)
+}
+
+func (b *softBackend) BindFramebuffer(fbo backend.Framebuffer) {
+	b.bound = fbo.(*softFramebuffer)
+}
+
+func (b *softBackend) BindTexture(unit int, tex backend.Texture) {
+	b.texUnits[unit] = tex.(*softTexture)
+}
+
+func (b *softBackend) BindVertexBuffer(buf backend.Buffer, stride, offset int) {
+	b.vertBuf.buf = buf.(*softBuffer)
+	b.vertBuf.stride = stride
+	b.vertBuf.offset = offset
+}
+
+func (b *softBackend) BindIndexBuffer(buf backend.Buffer) {
+	b.indexBuf = buf.(*softBuffer)
+}
+
+func (b *softBackend) Release() {}
+
+// draw runs the vertex shader for count vertices, where index maps
+// vertex numbers to indices into the vertex buffer, and rasterizes
+// the resulting triangles.
+func (b *softBackend) draw(mode backend.DrawMode, count int, index func(i int) int) {
+	p := b.prog
+	p.loadUniforms()
+	verts := make([]softVertex, count)
+	for i := range verts {
+		verts[i] = b.vertex(index(i))
+	}
+	switch mode {
+	case backend.DrawModeTriangles:
+		for i := 0; i+2 < count; i += 3 {
+			b.triangle(&verts[i], &verts[i+1], &verts[i+2])
+		}
+	case backend.DrawModeTriangleStrip:
+		for i := 0; i+2 < count; i++ {
+			b.triangle(&verts[i], &verts[i+1], &verts[i+2])
+		}
+	default:
+		panic("unsupported draw mode")
+	}
+}
+
+// vertex fetches the attributes of vertex idx and transforms them to
+// window coordinates.
+func (b *softBackend) vertex(idx int) softVertex {
+	var in [maxInputs][2]float32
+	data := b.vertBuf.buf.data[b.vertBuf.offset+idx*b.vertBuf.stride:]
+	for i, l := range b.layout.layout {
+		for j := 0; j < l.Size; j++ {
+			bits := binary.LittleEndian.Uint32(data[l.Offset+j*4:])
+			in[i][j] = math.Float32frombits(bits)
+		}
+	}
+	pos, vary := b.prog.vertex(&in)
+	vp := b.viewport
+	return softVertex{
+		x:    (pos[0]+1)*.5*float32(vp.Dx()) + float32(vp.Min.X),
+		y:    (pos[1]+1)*.5*float32(vp.Dy()) + float32(vp.Min.Y),
+		z:    (pos[2] + 1) * .5,
+		vary: vary,
+	}
+}
+
+// triangle rasterizes a triangle by sampling at pixel centers. Pixels
+// on edges shared by two triangles are covered by exactly one of them.
+func (b *softBackend) triangle(v0, v1, v2 *softVertex) {
+	area := edge(v0, v1, v2.x, v2.y)
+	if area == 0 {
+		return
+	}
+	if area < 0 {
+		v1, v2 = v2, v1
+		area = -area
+	}
+	fb := b.bound
+	tex := fb.tex
+	bounds := b.viewport.Intersect(image.Rectangle{Max: image.Point{X: tex.width, Y: tex.height}})
+	minx := math.Min(math.Min(float64(v0.x), float64(v1.x)), float64(v2.x))
+	maxx := math.Max(math.Max(float64(v0.x), float64(v1.x)), float64(v2.x))
+	miny := math.Min(math.Min(float64(v0.y), float64(v1.y)), float64(v2.y))
+	maxy := math.Max(math.Max(float64(v0.y), float64(v1.y)), float64(v2.y))
+	bounds = bounds.Intersect(image.Rect(
+		int(math.Floor(minx)), int(math.Floor(miny)),
+		int(math.Ceil(maxx)), int(math.Ceil(maxy)),
+	))
+	depthTest := b.depth.enable && fb.depth != nil
+	var vary [maxVaryings]float32
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		py := float32(y) + .5
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			px := float32(x) + .5
+			w0 := edge(v1, v2, px, py)
+			w1 := edge(v2, v0, px, py)
+			w2 := edge(v0, v1, px, py)
+			if !inside(w0, v1, v2) || !inside(w1, v2, v0) || !inside(w2, v0, v1) {
+				continue
+			}
+			w0, w1, w2 = w0/area, w1/area, w2/area
+			idx := y*tex.width + x
+			if depthTest {
+				z := w0*v0.z + w1*v1.z + w2*v2.z
+				if z <= fb.depth[idx] {
+					continue
+				}
+				if b.depth.mask {
+					fb.depth[idx] = z
+				}
+			}
+			for i := range vary {
+				vary[i] = w0*v0.vary[i] + w1*v1.vary[i] + w2*v2.vary[i]
+			}
+			src := b.prog.fragment(b, &vary)
+			b.output(tex.pix[idx*4:idx*4+4], src)
+		}
+	}
+}
+
+// edge returns the signed area of the parallelogram spanned by the
+// edge from a to b and the point (x, y).
+func edge(a, b *softVertex, x, y float32) float32 {
+	return (b.x-a.x)*(y-a.y) - (b.y-a.y)*(x-a.x)
+}
+
+// inside reports whether a point with edge value e relative to the
+// edge from a to b is inside the triangle. Points on the edge are
+// inside for exactly one of the directions of the edge.
+func inside(e float32, a, b *softVertex) bool {
+	if e != 0 {
+		return e > 0
+	}
+	dx, dy := b.x-a.x, b.y-a.y
+	return dy < 0 || dy == 0 && dx < 0
+}
+
+// output blends the fragment color src into the pixel dst.
+func (b *softBackend) output(dst []float32, src [4]float32) {
+	var res [4]float32
+	if b.blend.enable {
+		sf := blendFactor(b.blend.sfactor, src, dst)
+		df := blendFactor(b.blend.dfactor, src, dst)
+		for i := range res {
+			res[i] = src[i]*sf[i] + dst[i]*df[i]
+		}
+	} else {
+		res = src
+	}
+	if b.bound.tex.srgb {
+		for i, c := range res {
+			res[i] = clamp(c, 0, 1)
+		}
+	}
+	copy(dst, res[:])
+}
+
+func blendFactor(f backend.BlendFactor, src [4]float32, dst []float32) [4]float32 {
+	switch f {
+	case backend.BlendFactorOne:
+		return [4]float32{1, 1, 1, 1}
+	case backend.BlendFactorOneMinusSrcAlpha:
+		a := 1 - src[3]
+		return [4]float32{a, a, a, a}
+	case backend.BlendFactorZero:
+		return [4]float32{}
+	case backend.BlendFactorDstColor:
+		return [4]float32{dst[0], dst[1], dst[2], dst[3]}
+	default:
+		panic("unsupported blend factor")
+	}
+}
+
+// loadUniforms decodes the uniform buffers of the program.
+func (p *softProgram) loadUniforms() {
+	p.u = softUniforms{}
+	p.u.load(p.vert.uniforms, p.vert.locs)
+	p.u.load(p.frag.uniforms, p.frag.locs)
+}
+
+func (u *softUniforms) load(buf *softBuffer, locs []backend.UniformLocation) {
+	if buf == nil {
+		return
+	}
+	for _, l := range locs {
+		var dst *[4]float32
+		switch uniformName(l) {
+		case "transform":
+			dst = &u.transform
+		case "uvTransform":
+			dst = &u.uvTransform
+		case "uvCoverTransform":
+			dst = &u.uvCoverTransform
+		case "subUVTransform":
+			dst = &u.subUVTransform
+		case "pathOffset":
+			dst = &u.pathOffset
+		case "color":
+			dst = &u.color
+		case "z":
+			dst = &u.z
+		default:
+			continue
+		}
+		for i := 0; i < l.Size && i < len(dst); i++ {
+			bits := binary.LittleEndian.Uint32(buf.data[l.Offset+i*4:])
+			dst[i] = math.Float32frombits(bits)
+		}
+	}
+}
+
+// vertex runs the vertex shader and returns the clip space position
+// and the varyings.
+func (p *softProgram) vertex(in *[maxInputs][2]float32) ([3]float32, [maxVaryings]float32) {
+	u := &p.u
+	var vary [maxVaryings]float32
+	switch p.kind {
+	case blitShader:
+		pos, uv := in[0], in[1]
+		vary[0] = uv[0]*u.uvTransform[0] + u.uvTransform[2]
+		vary[1] = uv[1]*u.uvTransform[1] + u.uvTransform[3]
+		return [3]float32{
+			pos[0]*u.transform[0] + u.transform[2],
+			pos[1]*u.transform[1] + u.transform[3],
+			u.z[0],
+		}, vary
+	case coverShader:
+		pos, uv := in[0], in[1]
+		// vCoverUV.
+		vary[0] = uv[0]*u.uvCoverTransform[0] + u.uvCoverTransform[2]
+		vary[1] = uv[1]*u.uvCoverTransform[1] + u.uvCoverTransform[3]
+		// vUV.
+		vary[2] = uv[0]*u.uvTransform[0] + u.uvTransform[2]
+		vary[3] = uv[1]*u.uvTransform[1] + u.uvTransform[3]
+		return [3]float32{
+			pos[0]*u.transform[0] + u.transform[2],
+			pos[1]*u.transform[1] + u.transform[3],
+			u.z[0],
+		}, vary
+	case intersectShader:
+		pos, uv := in[0], in[1]
+		vary[0] = (uv[0]*u.subUVTransform[0]+u.subUVTransform[2])*u.uvTransform[0] + u.uvTransform[2]
+		vary[1] = (uv[1]*u.subUVTransform[1]+u.subUVTransform[3])*u.uvTransform[1] + u.uvTransform[3]
+		return [3]float32{pos[0], -pos[1], 0}, vary
+	case stencilShader:
+		corner, maxy := in[0][0], in[1][0]+u.pathOffset[1]
+		from := [2]float32{in[2][0] + u.pathOffset[0], in[2][1] + u.pathOffset[1]}
+		ctrl := [2]float32{in[3][0] + u.pathOffset[0], in[3][1] + u.pathOffset[1]}
+		to := [2]float32{in[4][0] + u.pathOffset[0], in[4][1] + u.pathOffset[1]}
+		// Add a one pixel overlap so curve quads cover their
+		// entire curves.
+		var pos [2]float32
+		c := corner
+		if c >= 0.375 {
+			// North.
+			c -= 0.5
+			pos[1] = maxy + 1
+		} else {
+			// South.
+			pos[1] = min3(from[1], ctrl[1], to[1]) - 1
+		}
+		if c >= 0.125 {
+			// East.
+			pos[0] = max3(from[0], ctrl[0], to[0]) + 1
+		} else {
+			// West.
+			pos[0] = min3(from[0], ctrl[0], to[0]) - 1
+		}
+		vary = [maxVaryings]float32{
+			from[0] - pos[0], from[1] - pos[1],
+			ctrl[0] - pos[0], ctrl[1] - pos[1],
+			to[0] - pos[0], to[1] - pos[1],
+		}
+		return [3]float32{
+			pos[0]*u.transform[0] + u.transform[2],
+			pos[1]*u.transform[1] + u.transform[3],
+			1,
+		}, vary
+	default:
+		panic("unknown shader")
+	}
+}
+
+// fragment runs the fragment shader.
+func (p *softProgram) fragment(b *softBackend, vary *[maxVaryings]float32) [4]float32 {
+	switch p.kind {
+	case blitShader:
+		return p.fetchColor(b, vary[0], vary[1])
+	case coverShader:
+		c := p.fetchColor(b, vary[2], vary[3])
+		cover := b.sample(p.coverUnit, vary[0], vary[1])
+		cov := float32(math.Abs(float64(cover[0])))
+		return [4]float32{c[0] * cov, c[1] * cov, c[2] * cov, c[3] * cov}
+	case intersectShader:
+		cover := b.sample(p.coverUnit, vary[0], vary[1])
+		return [4]float32{float32(math.Abs(float64(cover[0])))}
+	case stencilShader:
+		return [4]float32{stencilArea(vary)}
+	default:
+		panic("unknown shader")
+	}
+}
+
+// fetchColor returns the color of the material at (u, v).
+func (p *softProgram) fetchColor(b *softBackend, u, v float32) [4]float32 {
+	if p.texture {
+		return b.sample(p.texUnit, u, v)
+	}
+	return p.u.color
+}
+
+// stencilArea computes the fragment area covered by a quadratic
+// Bézier curve. See stencil.frag in gioui.org/gpu/shaders for the
+// derivation.
+func stencilArea(vary *[maxVaryings]float32) float32 {
+	from := [2]float32{vary[0], vary[1]}
+	ctrl := [2]float32{vary[2], vary[3]}
+	to := [2]float32{vary[4], vary[5]}
+	// Sort from and to in increasing order so the root below
+	// is always the positive square root, if any.
+	left, right := from, to
+	if to[0] < from[0] {
+		left, right = to, from
+	}
+	// The signed horizontal extent of the fragment.
+	extent := [2]float32{clamp(from[0], -.5, .5), clamp(to[0], -.5, .5)}
+	width := extent[1] - extent[0]
+	if width == 0 {
+		return 0
+	}
+	// Find the t where the curve crosses the middle of the extent.
+	midx := mix(extent[0], extent[1], .5)
+	x0 := midx - left[0]
+	p1 := [2]float32{ctrl[0] - left[0], ctrl[1] - left[1]}
+	v := [2]float32{right[0] - ctrl[0], right[1] - ctrl[1]}
+	t := x0 / (p1[0] + float32(math.Sqrt(float64(p1[0]*p1[0]+(v[0]-p1[0])*x0))))
+	// Find y(t) on the curve and the slope.
+	y := mix(mix(left[1], ctrl[1], t), mix(ctrl[1], right[1], t), t)
+	dhalf := [2]float32{mix(p1[0], v[0], t), mix(p1[1], v[1], t)}
+	dy := dhalf[1] / dhalf[0]
+	// Compute the fragment area above the line approximation.
+	dy = float32(math.Abs(float64(dy * width)))
+	sides := [4]float32{dy*+.5 + y, dy*-.5 + y, (+.5 - y) / dy, (-.5 - y) / dy}
+	for i, s := range sides {
+		sides[i] = clamp(s+.5, 0, 1)
+	}
+	area := .5 * (sides[2] - sides[2]*sides[1] + 1 - sides[0] + sides[0]*sides[3])
+	return area * width
+}
+
+// sample returns the texel of the texture bound to unit at the
+// texture coordinates (u, v), clamped to the edge.
+func (b *softBackend) sample(unit int, u, v float32) [4]float32 {
+	t := b.texUnits[unit]
+	if t == nil || t.pix == nil {
+		return [4]float32{}
+	}
+	x, y := u*float32(t.width), v*float32(t.height)
+	if !t.linear {
+		return t.texel(int(floor(x)), int(floor(y)))
+	}
+	x, y = x-.5, y-.5
+	x0, y0 := floor(x), floor(y)
+	fx, fy := x-x0, y-y0
+	ix, iy := int(x0), int(y0)
+	c00, c10 := t.texel(ix, iy), t.texel(ix+1, iy)
+	c01, c11 := t.texel(ix, iy+1), t.texel(ix+1, iy+1)
+	var c [4]float32
+	for i := range c {
+		c[i] = mix(mix(c00[i], c10[i], fx), mix(c01[i], c11[i], fx), fy)
+	}
+	return c
+}
+
+// texel returns the texel at (x, y), clamped to the edge.
+func (t *softTexture) texel(x, y int) [4]float32 {
+	x = clampInt(x, 0, t.width-1)
+	y = clampInt(y, 0, t.height-1)
+	idx := (y*t.width + x) * 4
+	p := t.pix[idx : idx+4]
+	return [4]float32{p[0], p[1], p[2], p[3]}
+}
+
+func (t *softTexture) Upload(img *image.RGBA) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > t.width || h > t.height {
+		panic("image larger than texture")
+	}
+	for y := 0; y < h; y++ {
+		src := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+		dst := t.pix[y*t.width*4:]
+		for x := 0; x < w; x++ {
+			s, d := src[x*4:x*4+4], dst[x*4:x*4+4]
+			d[0] = srgbToLinear[s[0]]
+			d[1] = srgbToLinear[s[1]]
+			d[2] = srgbToLinear[s[2]]
+			d[3] = float32(s[3]) / 255
+		}
+	}
+}
+
+func (t *softTexture) Release() {
+	t.pix = nil
+}
+
+func (b *softBuffer) Upload(data []byte) {
+	copy(b.data, data)
+}
+
+func (b *softBuffer) Release() {}
+
+func (l *softInputLayout) Release() {}
+
+func (p *softProgram) SetVertexUniforms(uniforms backend.Buffer) {
+	p.vert.uniforms = uniforms.(*softBuffer)
+}
+
+func (p *softProgram) SetFragmentUniforms(uniforms backend.Buffer) {
+	p.frag.uniforms = uniforms.(*softBuffer)
+}
+
+func (p *softProgram) Release() {}
+
+func (f *softFramebuffer) Invalidate() {}
+
+func (f *softFramebuffer) Release() {
+	f.depth = nil
+}
+
+// ReadPixels reads the pixels of the rectangle src in OpenGL
+// coordinates into pix as RGBA values.
+func (f *softFramebuffer) ReadPixels(src image.Rectangle, pix []byte) error {
+	t := f.tex
+	if !src.In(image.Rectangle{Max: image.Point{X: t.width, Y: t.height}}) {
+		return errors.New("gpu: ReadPixels outside framebuffer")
+	}
+	if len(pix) < src.Dx()*src.Dy()*4 {
+		return errors.New("gpu: ReadPixels buffer too small")
+	}
+	for y := src.Min.Y; y < src.Max.Y; y++ {
+		for x := src.Min.X; x < src.Max.X; x++ {
+			c := t.texel(x, y)
+			d := pix[((y-src.Min.Y)*src.Dx()+x-src.Min.X)*4:]
+			for i := 0; i < 3; i++ {
+				if t.srgb {
+					d[i] = toSRGB(c[i])
+				} else {
+					d[i] = uint8(clamp(c[i], 0, 1)*255 + .5)
+				}
+			}
+			d[3] = uint8(clamp(c[3], 0, 1)*255 + .5)
+		}
+	}
+	return nil
+}
+
+// copyTo converts the framebuffer to sRGB and copies it to the
+// scanout, flipping it vertically. It returns the bounds of the
+// pixels that changed.
+func (f *softFramebuffer) copyTo(dst *virtgpu.Scanout) image.Rectangle {
+	t := f.tex
+	var damage image.Rectangle
+	sz := dst.Rect.Size()
+	w, h := t.width, t.height
+	if sz.X < w {
+		w = sz.X
+	}
+	if sz.Y < h {
+		h = sz.Y
+	}
+	for y := 0; y < h; y++ {
+		src := t.pix[(t.height-1-y)*t.width*4:]
+		row := dst.Pix[dst.PixOffset(dst.Rect.Min.X, dst.Rect.Min.Y+y):]
+		minx, maxx := w, 0
+		for x := 0; x < w; x++ {
+			s, d := src[x*4:x*4+4], row[x*4:x*4+4]
+			// The scanout is in B, G, R, X order.
+			b, g, r := toSRGB(s[2]), toSRGB(s[1]), toSRGB(s[0])
+			if d[0] == b && d[1] == g && d[2] == r {
+				continue
+			}
+			d[0], d[1], d[2] = b, g, r
+			if x < minx {
+				minx = x
+			}
+			maxx = x + 1
+		}
+		if minx < maxx {
+			damage = damage.Union(image.Rect(minx, y, maxx, y+1))
+		}
+	}
+	return damage.Add(dst.Rect.Min)
+}
+
+func toSRGB(c float32) uint8 {
+	c = clamp(c, 0, 1)
+	return linearToSRGB[int(c*float32(len(linearToSRGB)-1)+.5)]
+}
+
+func mix(a, b, t float32) float32 {
+	return a + (b-a)*t
+}
+
+// clamp clamps v to [min, max]. NaN values are clamped to min.
+func clamp(v, min, max float32) float32 {
+	if !(v >= min) {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func floor(v float32) float32 {
+	return float32(math.Floor(float64(v)))
+}
+
+func min3(a, b, c float32) float32 {
+	return float32(math.Min(math.Min(float64(a), float64(b)), float64(c)))
+}
+
+func max3(a, b, c float32) float32 {
+	return float32(math.Max(math.Max(float64(a), float64(b)), float64(c)))
+}
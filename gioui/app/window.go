@@ -0,0 +1,439 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+// Package app runs Gio programs on the virtio GPU and input devices.
+// Its API mirrors the package gioui.org/app, so Gio programs run as
+// unikernels by importing this package in its place.
+package app
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/png"
+	"math"
+	"sync"
+	"time"
+
+	"gioui.org/gpu"
+	"gioui.org/io/event"
+	"gioui.org/io/router"
+	"gioui.org/io/system"
+	"gioui.org/op"
+	"gioui.org/unit"
+
+	virtgpu "eliasnaur.com/unik/virtio/gpu"
+	"eliasnaur.com/unik/virtio/input"
+)
+
+// Window is the display of the virtio GPU.
+type Window struct {
+	scale float32
+
+	out         chan event.Event
+	invalidates chan struct{}
+
+	queue Queue
+}
+
+// Queue is an event.Queue implementation that distributes system events
+// to the input handlers declared in the most recent frame.
+type Queue struct {
+	q router.Router
+}
+
+// Option configures a Window.
+type Option func(w *Window)
+
+// display is the state of the display while a Window runs.
+type display struct {
+	w      *Window
+	dev    *virtgpu.Device
+	cursor virtgpu.Resource
+	imap   *inputMapper
+	// redraw is set when the window needs a new frame.
+	redraw bool
+	// frames receives the frame of the most recent FrameEvent,
+	// and frameDone is closed when the frame is drawn or discarded.
+	// Both are nil when no FrameEvent is pending.
+	frames    chan *op.Ops
+	frameDone chan struct{}
+	// err is the first error from drawing a frame while
+	// delivering an input event.
+	err error
+
+	width, height int
+	fb            *framebuffer
+	colorRes      virtgpu.Resource
+	gpu           *gpu.GPU
+
+	// scanout and soft replace fb and colorRes on devices
+	// without 3D support.
+	scanout *virtgpu.Scanout
+	soft    *softBackend
+}
+
+type config struct {
+	Scale float32
+}
+
+// defaultScale is the default number of pixels per dp. The virtio
+// GPU doesn't report the physical size of the display.
+const defaultScale = 1.5
+
+var (
+	windowMu sync.Mutex
+	// windowCreated is set when a Window has been created. The
+	// display supports only one Window.
+	windowCreated bool
+)
+
+// NewWindow creates the Window. The display is shared among
+// windows, so only the first Window runs; later windows are
+// destroyed with an error.
+func NewWindow(options ...Option) *Window {
+	w := &Window{
+		scale:       defaultScale,
+		out:         make(chan event.Event),
+		invalidates: make(chan struct{}, 1),
+	}
+	for _, o := range options {
+		o(w)
+	}
+	windowMu.Lock()
+	created := windowCreated
+	windowCreated = true
+	windowMu.Unlock()
+	go func() {
+		defer close(w.out)
+		var err error
+		if created {
+			err = errors.New("app: the display supports only one window")
+		} else {
+			err = w.run()
+		}
+		w.out <- system.DestroyEvent{Err: err}
+	}()
+	return w
+}
+
+// Events returns the channel where events are delivered.
+func (w *Window) Events() <-chan event.Event {
+	return w.out
+}
+
+// Queue returns the Window's event queue. The queue contains
+// the events received since the last frame.
+func (w *Window) Queue() *Queue {
+	return &w.queue
+}
+
+// Invalidate the window such that a FrameEvent will be generated
+// immediately. Invalidate is safe for concurrent use.
+func (w *Window) Invalidate() {
+	select {
+	case w.invalidates <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Window) run() error {
+	dev, err := virtgpu.New()
+	if err != nil {
+		return err
+	}
+	cursor, err := newCursor(dev)
+	if err != nil {
+		return err
+	}
+	d := &display{w: w, dev: dev, cursor: cursor, redraw: true}
+	inputDevs, err := input.New()
+	if err != nil {
+		// Run without input.
+		inputDevs = nil
+	}
+	d.imap = newInputMapper(inputDevs, d.event)
+	events := make(chan inputEvent, 100)
+	errs := make(chan error, len(inputDevs))
+	for i, dev := range inputDevs {
+		i, dev := i, dev
+		go func() {
+			buf := make([]input.Event, cap(events))
+			for {
+				n, err := dev.Read(buf)
+				for _, e := range buf[:n] {
+					events <- inputEvent{dev: i, e: e}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	defer d.release()
+	defer d.discardFrame()
+	w.out <- system.StageEvent{Stage: system.StageRunning}
+	wakeup := time.NewTimer(0)
+	repeat := time.NewTimer(0)
+	for {
+		if d.err != nil {
+			return d.err
+		}
+		if d.redraw {
+			if err := d.frame(); err != nil {
+				return err
+			}
+		}
+		if t, ok := d.imap.kbd.NextRepeat(); ok {
+			resetTimer(repeat, time.Until(t))
+		}
+		select {
+		case frame := <-d.frames:
+			if err := d.draw(frame); err != nil {
+				return err
+			}
+			if t, ok := w.queue.q.WakeupTime(); ok {
+				resetTimer(wakeup, time.Until(t))
+			}
+		case e := <-events:
+			d.imap.event(e.dev, e.e)
+		loop:
+			for {
+				select {
+				case e := <-events:
+					d.imap.event(e.dev, e.e)
+				default:
+					break loop
+				}
+			}
+			dev.MoveCursor(cursor, uint32(d.imap.x+.5), uint32(d.imap.y+.5))
+		case err := <-errs:
+			return err
+		case <-repeat.C:
+			d.imap.repeat()
+		case <-dev.ConfigNotify():
+			// The display changed size.
+			d.release()
+			d.redraw = true
+		case <-w.invalidates:
+			d.redraw = true
+		case <-wakeup.C:
+			d.redraw = true
+		}
+	}
+}
+
+// resetTimer is like t.Reset but drops an expiry not yet received
+// from t.C.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// event delivers an input event to the queue and the program.
+func (d *display) event(e event.Event) {
+	if d.w.queue.q.Add(e) {
+		d.redraw = true
+	}
+	if err := d.send(e); err != nil && d.err == nil {
+		d.err = err
+	}
+}
+
+// send delivers e to the program. The program may instead send the
+// frame of a pending FrameEvent, which is drawn before e is delivered.
+// Once the program receives e it can no longer send the frame, and
+// the FrameEvent is discarded.
+func (d *display) send(e event.Event) error {
+	for {
+		select {
+		case d.w.out <- e:
+			d.discardFrame()
+			return nil
+		case frame := <-d.frames:
+			if err := d.draw(frame); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// frame sends a FrameEvent to the program. The frame is drawn when
+// the program sends it through FrameEvent.Frame.
+func (d *display) frame() error {
+	d.redraw = false
+	if d.gpu == nil {
+		if err := d.setup(); err != nil {
+			return err
+		}
+	}
+	if err := d.dev.Flush3D(); err != nil {
+		return err
+	}
+	return d.sendFrame(system.FrameEvent{
+		Config: &config{Scale: d.w.scale},
+		Size:   image.Point{X: d.width, Y: d.height},
+	})
+}
+
+// sendFrame sends e to the program and makes its frame pending.
+func (d *display) sendFrame(e system.FrameEvent) error {
+	frames, done := make(chan *op.Ops), make(chan struct{})
+	e.Frame = func(frame *op.Ops) {
+		// The program may call Frame after the display
+		// discarded the FrameEvent, or not at all.
+		select {
+		case frames <- frame:
+			<-done
+		case <-done:
+		}
+	}
+	err := d.send(e)
+	d.frames, d.frameDone = frames, done
+	return err
+}
+
+// draw draws the frame of the pending FrameEvent and releases the
+// program waiting in FrameEvent.Frame.
+func (d *display) draw(frame *op.Ops) error {
+	defer d.discardFrame()
+	if d.gpu == nil {
+		// The display was released after the FrameEvent.
+		d.redraw = true
+		return nil
+	}
+	sz := image.Point{X: d.width, Y: d.height}
+	d.gpu.Collect(sz, frame)
+	d.gpu.BeginFrame()
+	d.w.queue.q.Frame(frame)
+	d.gpu.EndFrame()
+	if d.soft != nil {
+		damage := d.soft.fb.copyTo(d.scanout)
+		return d.scanout.Flush(damage)
+	}
+	d.dev.CmdResourceFlush(d.fb.colorRes)
+	return nil
+}
+
+// discardFrame ends the pending FrameEvent, if any.
+func (d *display) discardFrame() {
+	if d.frames == nil {
+		return
+	}
+	close(d.frameDone)
+	d.frames, d.frameDone = nil, nil
+}
+
+// setup creates the display buffer for the current size of the
+// display.
+func (d *display) setup() error {
+	width, height, err := d.dev.QueryScanout()
+	if err != nil {
+		return err
+	}
+	d.width, d.height = width, height
+	d.imap.width, d.imap.height = width, height
+	if !d.dev.Has3D() {
+		return d.setupSoft()
+	}
+	d.colorRes = createDisplayBuffer(d.dev, width, height)
+	d.fb = newFramebuffer(d.dev, d.colorRes, virtgpu.VIRGL_FORMAT_B8G8R8A8_SRGB, width, height, 16)
+	d.dev.CmdSetScanout(d.fb.colorRes)
+	backend, err := newBackend(d.dev, d.fb)
+	if err != nil {
+		return err
+	}
+	backend.BindFramebuffer(d.fb)
+	d.gpu, err = gpu.New(backend)
+	return err
+}
+
+// setupSoft creates a scanout and a software renderer for devices
+// without 3D support.
+func (d *display) setupSoft() error {
+	scanout, err := d.dev.NewScanout()
+	if err != nil {
+		return err
+	}
+	d.scanout = scanout
+	d.soft = newSoftBackend(d.width, d.height)
+	d.gpu, err = gpu.New(d.soft)
+	return err
+}
+
+// release frees the display buffer.
+func (d *display) release() {
+	if d.gpu == nil {
+		return
+	}
+	d.gpu.Release()
+	if d.soft != nil {
+		d.scanout.Release()
+		d.scanout = nil
+		d.soft = nil
+		d.gpu = nil
+		return
+	}
+	d.fb.Release()
+	d.dev.CmdCtxDetachResource(d.colorRes)
+	d.dev.CmdResourceUnref(d.colorRes)
+	d.gpu = nil
+}
+
+// Events returns the events for the handler key.
+func (q *Queue) Events(k event.Key) []event.Event {
+	return q.q.Events(k)
+}
+
+// Scale sets the number of pixels per dp and sp.
+func Scale(s float32) Option {
+	return func(w *Window) {
+		w.scale = s
+	}
+}
+
+// Title is accepted for compatibility with Gio programs. The display
+// has no title.
+func Title(t string) Option {
+	return func(w *Window) {}
+}
+
+// Size is accepted for compatibility with Gio programs. The window
+// covers the display.
+func Size(width, height unit.Value) Option {
+	return func(w *Window) {}
+}
+
+// Main blocks forever. It is called from the main function of Gio
+// programs, whose windows run in other goroutines.
+func Main() {
+	select {}
+}
+
+func (s *config) Now() time.Time {
+	return time.Now()
+}
+
+func (s *config) Px(v unit.Value) int {
+	scale := s.Scale
+	if v.U == unit.UnitPx {
+		scale = 1
+	}
+	return int(math.Round(float64(scale * v.V)))
+}
+
+func newCursor(d *virtgpu.Device) (virtgpu.Resource, error) {
+	cursorImg, _, err := image.Decode(bytes.NewBuffer(cursor))
+	if err != nil {
+		return 0, err
+	}
+	rgba := image.NewRGBA(cursorImg.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), cursorImg, cursorImg.Bounds().Min, draw.Src)
+	return d.NewCursor(rgba, image.Point{})
+}
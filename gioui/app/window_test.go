@@ -0,0 +1,85 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package app
+
+import (
+	"testing"
+	"time"
+
+	"gioui.org/io/event"
+	"gioui.org/io/pointer"
+	"gioui.org/io/system"
+	"gioui.org/op"
+)
+
+// callFrame calls the Frame function of e and fails the test if it
+// doesn't return.
+func callFrame(t *testing.T, e system.FrameEvent) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		e.Frame(new(op.Ops))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("FrameEvent.Frame blocked")
+	}
+}
+
+func TestFrameAfterDiscard(t *testing.T) {
+	out := make(chan event.Event)
+	d := &display{w: &Window{out: out}}
+	events := make(chan event.Event, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			events <- <-out
+		}
+	}()
+	if err := d.sendFrame(system.FrameEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	// Delivering another event discards the pending FrameEvent.
+	if err := d.send(pointer.Event{}); err != nil {
+		t.Fatal(err)
+	}
+	if d.frames != nil {
+		t.Error("FrameEvent still pending after the next event")
+	}
+	e := (<-events).(system.FrameEvent)
+	<-events
+	callFrame(t, e)
+}
+
+func TestFrameBeforeNextEvent(t *testing.T) {
+	out := make(chan event.Event)
+	d := &display{w: &Window{out: out}}
+	go func() {
+		e := (<-out).(system.FrameEvent)
+		// Call Frame while the display is blocked sending the
+		// next event.
+		e.Frame(new(op.Ops))
+		<-out
+	}()
+	if err := d.sendFrame(system.FrameEvent{}); err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.send(pointer.Event{})
+	}()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("FrameEvent.Frame blocked")
+	}
+	// The display wasn't set up, so drawing the frame requests
+	// another.
+	if !d.redraw {
+		t.Error("frame drawn without a display")
+	}
+}
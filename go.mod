@@ -1,6 +1,6 @@
 module eliasnaur.com/unik
 
-go 1.14
+go 1.16
 
 require (
 	gioui.org v0.0.0-20200403084947-efce78d414f3
@@ -0,0 +1,612 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+// Package acpi parses the ACPI system description tables.
+//
+// The parser doesn't allocate and is safe to run before the Go
+// runtime is initialized, such as during kernel startup.
+package acpi
+
+import "encoding/binary"
+
+// Mapper returns the size bytes of physical memory starting at
+// addr, or a shorter slice if the memory is not accessible.
+type Mapper func(addr uint64, size int) []byte
+
+// Error is the type of errors returned by Parse.
+type Error string
+
+// Limits of the number of parsed table entries.
+const (
+	MaxProcessors = 256
+	MaxIOAPICs    = 16
+	MaxOverrides  = 16
+	MaxSegments   = 8
+)
+
+// Tables contains the parsed system description tables.
+type Tables struct {
+	// RSDP is the physical address of the root system
+	// description pointer.
+	RSDP     uint64
+	Revision uint8
+	OEMID    [6]byte
+
+	MADT MADT
+	HPET HPET
+	MCFG MCFG
+	FADT FADT
+}
+
+// MADT describes the interrupt controllers from the multiple APIC
+// description table.
+type MADT struct {
+	Present bool
+	// LocalAPICAddr is the physical address of the local APICs.
+	LocalAPICAddr uint64
+	// PCATCompat is set if the system has dual 8259 interrupt
+	// controllers that must be disabled.
+	PCATCompat bool
+
+	localAPICs  [MaxProcessors]LocalAPIC
+	nlocalAPICs int
+	ioAPICs     [MaxIOAPICs]IOAPIC
+	nioAPICs    int
+	overrides   [MaxOverrides]InterruptOverride
+	noverrides  int
+}
+
+// LocalAPIC describes a processor.
+type LocalAPIC struct {
+	ProcessorUID uint32
+	APICID       uint32
+	// Enabled is set if the processor is usable.
+	Enabled bool
+}
+
+// IOAPIC describes an I/O APIC.
+type IOAPIC struct {
+	ID   uint8
+	Addr uint64
+	// GSIBase is the first global system interrupt handled by
+	// the I/O APIC.
+	GSIBase uint32
+}
+
+// InterruptOverride describes the mapping of an ISA interrupt to a
+// global system interrupt.
+type InterruptOverride struct {
+	Source uint8
+	GSI    uint32
+	// Flags contains the polarity and trigger mode.
+	Flags uint16
+}
+
+// HPET describes the high precision event timer.
+type HPET struct {
+	Present bool
+	// Addr is the physical address of the timer registers.
+	Addr   uint64
+	ID     uint32
+	Number uint8
+	// MinTick is the minimum clock tick in periodic mode.
+	MinTick uint16
+}
+
+// MCFG describes the memory mapped PCI configuration spaces.
+type MCFG struct {
+	Present   bool
+	segments  [MaxSegments]ECAM
+	nsegments int
+}
+
+// ECAM describes the enhanced configuration access mechanism area
+// of a PCI segment.
+type ECAM struct {
+	Addr     uint64
+	Segment  uint16
+	StartBus uint8
+	EndBus   uint8
+}
+
+// FADT contains the power management details from the fixed ACPI
+// description table.
+type FADT struct {
+	Present bool
+	// DSDT is the physical address of the differentiated system
+	// description table.
+	DSDT         uint64
+	SCIInterrupt uint16
+	// SMICommand is the port for enabling ACPI mode by writing
+	// ACPIEnable.
+	SMICommand  uint32
+	ACPIEnable  uint8
+	ACPIDisable uint8
+	// PM1aControl and PM1bControl are the ports of the power
+	// management control registers.
+	PM1aControl uint32
+	PM1bControl uint32
+	PM1aEvent   uint32
+	PM1bEvent   uint32
+	PMTimer     uint32
+	// Century is the index of the century in the CMOS, or 0.
+	Century uint8
+	// BootArch contains the IA-PC boot architecture flags.
+	BootArch uint16
+	Flags    uint32
+	// ResetReg and ResetValue describe the register and value for
+	// resetting the system, if the FlagResetReg is set.
+	ResetReg   GenericAddress
+	ResetValue uint8
+}
+
+// GenericAddress is the location of a register.
+type GenericAddress struct {
+	Space      uint8
+	BitWidth   uint8
+	BitOffset  uint8
+	AccessSize uint8
+	Addr       uint64
+}
+
+// Address spaces of GenericAddress.
+const (
+	SpaceMemory = 0
+	SpaceIO     = 1
+	SpacePCI    = 2
+)
+
+// FADT flags.
+const (
+	// FlagTimerExt is set if the PM timer is 32 bits wide instead
+	// of 24 bits.
+	FlagTimerExt  = 1 << 8
+	FlagResetReg  = 1 << 10
+	FlagHWReduced = 1 << 20
+)
+
+// IA-PC boot architecture flags.
+const (
+	BootArchLegacyDevices = 1 << 0
+	Boot8042              = 1 << 1
+	BootNoVGA             = 1 << 2
+)
+
+const (
+	// headerSize is the size of the common header of all
+	// system description tables.
+	headerSize = 36
+	rsdpSize   = 20
+	xsdpSize   = 36
+)
+
+// MADT entry types.
+const (
+	madtLocalAPIC         = 0
+	madtIOAPIC            = 1
+	madtOverride          = 2
+	madtLocalAPICOverride = 5
+	madtLocalX2APIC       = 9
+
+	madtLocalAPICEnabled = 1 << 0
+	madtPCATCompat       = 1 << 0
+)
+
+// AML opcodes.
+const (
+	amlZeroOp      = 0x00
+	amlOneOp       = 0x01
+	amlNameOp      = 0x08
+	amlBytePrefix  = 0x0a
+	amlWordPrefix  = 0x0b
+	amlDWordPrefix = 0x0c
+	amlPackageOp   = 0x12
+	amlOnesOp      = 0xff
+)
+
+// Parse reads the tables reachable from the root system description
+// pointer at the physical address rsdp. Invalid tables other than
+// the root tables are skipped.
+//go:nosplit
+func Parse(t *Tables, rsdp uint64, mem Mapper) error {
+	*t = Tables{}
+	p := mem(rsdp, rsdpSize)
+	if len(p) < rsdpSize || string(p[:8]) != "RSD PTR " {
+		return Error("acpi: no RSDP")
+	}
+	if !checksum(p) {
+		return Error("acpi: invalid RSDP checksum")
+	}
+	bo := binary.LittleEndian
+	t.RSDP = rsdp
+	t.Revision = p[15]
+	copy(t.OEMID[:], p[9:15])
+	rootAddr := uint64(bo.Uint32(p[16:]))
+	entrySize := 4
+	// Prefer the XSDT with 64-bit entries, available from ACPI
+	// revision 2.
+	if t.Revision >= 2 {
+		p = mem(rsdp, xsdpSize)
+		if len(p) < xsdpSize {
+			return Error("acpi: truncated XSDP")
+		}
+		length := int(bo.Uint32(p[20:]))
+		if length < xsdpSize {
+			return Error("acpi: invalid XSDP length")
+		}
+		if p = mem(rsdp, length); len(p) < length || !checksum(p) {
+			return Error("acpi: invalid XSDP checksum")
+		}
+		if xsdt := bo.Uint64(p[24:]); xsdt != 0 {
+			rootAddr = xsdt
+			entrySize = 8
+		}
+	}
+	root, err := table(mem, rootAddr)
+	if err != nil {
+		return err
+	}
+	for entries := root[headerSize:]; len(entries) >= entrySize; entries = entries[entrySize:] {
+		var addr uint64
+		if entrySize == 8 {
+			addr = bo.Uint64(entries)
+		} else {
+			addr = uint64(bo.Uint32(entries))
+		}
+		tab, err := table(mem, addr)
+		if err != nil {
+			continue
+		}
+		switch string(tab[:4]) {
+		case "APIC":
+			t.MADT.parse(tab)
+		case "HPET":
+			t.HPET.parse(tab)
+		case "MCFG":
+			t.MCFG.parse(tab)
+		case "FACP":
+			t.FADT.parse(tab)
+		}
+	}
+	return nil
+}
+
+// Table returns the contents of the first table with the signature
+// sig, including its header.
+//go:nosplit
+func (t *Tables) Table(sig string, mem Mapper) ([]byte, bool) {
+	if t.RSDP == 0 {
+		return nil, false
+	}
+	if sig == "DSDT" {
+		// The DSDT is referenced by the FADT, not the root
+		// table.
+		if !t.FADT.Present {
+			return nil, false
+		}
+		tab, err := table(mem, t.FADT.DSDT)
+		return tab, err == nil
+	}
+	bo := binary.LittleEndian
+	p := mem(t.RSDP, xsdpSize)
+	if len(p) < rsdpSize {
+		return nil, false
+	}
+	rootAddr := uint64(bo.Uint32(p[16:]))
+	entrySize := 4
+	if t.Revision >= 2 && len(p) == xsdpSize {
+		if xsdt := bo.Uint64(p[24:]); xsdt != 0 {
+			rootAddr = xsdt
+			entrySize = 8
+		}
+	}
+	root, err := table(mem, rootAddr)
+	if err != nil {
+		return nil, false
+	}
+	for entries := root[headerSize:]; len(entries) >= entrySize; entries = entries[entrySize:] {
+		var addr uint64
+		if entrySize == 8 {
+			addr = bo.Uint64(entries)
+		} else {
+			addr = uint64(bo.Uint32(entries))
+		}
+		if tab, err := table(mem, addr); err == nil && string(tab[:4]) == sig {
+			return tab, true
+		}
+	}
+	return nil, false
+}
+
+// SleepType returns the values of the SLP_TYPa and SLP_TYPb fields
+// for entering the sleep state, 0 through 5. The values are read from
+// the \_Sx object of the DSDT.
+//go:nosplit
+func (t *Tables) SleepType(state int, mem Mapper) (uint16, uint16, bool) {
+	if state < 0 || state > 5 {
+		return 0, 0, false
+	}
+	dsdt, ok := t.Table("DSDT", mem)
+	if !ok {
+		return 0, 0, false
+	}
+	name := [4]byte{'_', 'S', '0' + byte(state), '_'}
+	aml := dsdt[headerSize:]
+	for i := 0; i+len(name) < len(aml); i++ {
+		if string(aml[i:i+len(name)]) != string(name[:]) {
+			continue
+		}
+		// Expect a name definition of a package.
+		if i == 0 || (aml[i-1] != amlNameOp && (aml[i-1] != '\\' || i < 2 || aml[i-2] != amlNameOp)) {
+			continue
+		}
+		pkg := aml[i+len(name):]
+		if len(pkg) < 2 || pkg[0] != amlPackageOp {
+			continue
+		}
+		// Skip the package length and element count.
+		n := 1 + 1 + int(pkg[1]>>6) + 1
+		if n > len(pkg) {
+			continue
+		}
+		pkg = pkg[n:]
+		a, n := amlInteger(pkg)
+		if n == 0 {
+			continue
+		}
+		b, n := amlInteger(pkg[n:])
+		if n == 0 {
+			continue
+		}
+		return uint16(a), uint16(b), true
+	}
+	return 0, 0, false
+}
+
+// amlInteger decodes an AML integer constant and returns its value
+// and encoded length. It returns a zero length if b doesn't start
+// with an integer.
+//go:nosplit
+func amlInteger(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	bo := binary.LittleEndian
+	switch b[0] {
+	case amlZeroOp:
+		return 0, 1
+	case amlOneOp:
+		return 1, 1
+	case amlOnesOp:
+		return ^uint64(0), 1
+	case amlBytePrefix:
+		if len(b) >= 2 {
+			return uint64(b[1]), 2
+		}
+	case amlWordPrefix:
+		if len(b) >= 3 {
+			return uint64(bo.Uint16(b[1:])), 3
+		}
+	case amlDWordPrefix:
+		if len(b) >= 5 {
+			return uint64(bo.Uint32(b[1:])), 5
+		}
+	}
+	return 0, 0
+}
+
+// table returns the checksummed system description table at addr,
+// including its header.
+//go:nosplit
+func table(mem Mapper, addr uint64) ([]byte, error) {
+	if addr == 0 {
+		return nil, Error("acpi: nil table address")
+	}
+	hdr := mem(addr, headerSize)
+	if len(hdr) < headerSize {
+		return nil, Error("acpi: truncated table header")
+	}
+	length := int(binary.LittleEndian.Uint32(hdr[4:]))
+	if length < headerSize {
+		return nil, Error("acpi: invalid table length")
+	}
+	tab := mem(addr, length)
+	if len(tab) < length {
+		return nil, Error("acpi: truncated table")
+	}
+	if !checksum(tab) {
+		return nil, Error("acpi: invalid table checksum")
+	}
+	return tab, nil
+}
+
+// checksum reports whether the bytes of b sum to zero.
+//go:nosplit
+func checksum(b []byte) bool {
+	var sum uint8
+	for i := 0; i < len(b); i++ {
+		sum += b[i]
+	}
+	return sum == 0
+}
+
+//go:nosplit
+func (m *MADT) parse(tab []byte) {
+	if len(tab) < headerSize+8 {
+		return
+	}
+	bo := binary.LittleEndian
+	m.Present = true
+	m.LocalAPICAddr = uint64(bo.Uint32(tab[headerSize:]))
+	m.PCATCompat = bo.Uint32(tab[headerSize+4:])&madtPCATCompat != 0
+	entries := tab[headerSize+8:]
+	for len(entries) >= 2 {
+		typ, length := entries[0], int(entries[1])
+		if length < 2 || length > len(entries) {
+			break
+		}
+		e := entries[:length]
+		entries = entries[length:]
+		switch {
+		case typ == madtLocalAPIC && length >= 8:
+			m.addLocalAPIC(LocalAPIC{
+				ProcessorUID: uint32(e[2]),
+				APICID:       uint32(e[3]),
+				Enabled:      bo.Uint32(e[4:])&madtLocalAPICEnabled != 0,
+			})
+		case typ == madtLocalX2APIC && length >= 16:
+			m.addLocalAPIC(LocalAPIC{
+				APICID:       bo.Uint32(e[4:]),
+				Enabled:      bo.Uint32(e[8:])&madtLocalAPICEnabled != 0,
+				ProcessorUID: bo.Uint32(e[12:]),
+			})
+		case typ == madtIOAPIC && length >= 12:
+			if m.nioAPICs < len(m.ioAPICs) {
+				m.ioAPICs[m.nioAPICs] = IOAPIC{
+					ID:      e[2],
+					Addr:    uint64(bo.Uint32(e[4:])),
+					GSIBase: bo.Uint32(e[8:]),
+				}
+				m.nioAPICs++
+			}
+		case typ == madtOverride && length >= 10:
+			if m.noverrides < len(m.overrides) {
+				m.overrides[m.noverrides] = InterruptOverride{
+					Source: e[3],
+					GSI:    bo.Uint32(e[4:]),
+					Flags:  bo.Uint16(e[8:]),
+				}
+				m.noverrides++
+			}
+		case typ == madtLocalAPICOverride && length >= 12:
+			m.LocalAPICAddr = bo.Uint64(e[4:])
+		}
+	}
+}
+
+//go:nosplit
+func (m *MADT) addLocalAPIC(l LocalAPIC) {
+	if m.nlocalAPICs < len(m.localAPICs) {
+		m.localAPICs[m.nlocalAPICs] = l
+		m.nlocalAPICs++
+	}
+}
+
+// LocalAPICs returns the processors.
+//go:nosplit
+func (m *MADT) LocalAPICs() []LocalAPIC {
+	return m.localAPICs[:m.nlocalAPICs]
+}
+
+// IOAPICs returns the I/O APICs.
+//go:nosplit
+func (m *MADT) IOAPICs() []IOAPIC {
+	return m.ioAPICs[:m.nioAPICs]
+}
+
+// Overrides returns the ISA interrupt overrides.
+//go:nosplit
+func (m *MADT) Overrides() []InterruptOverride {
+	return m.overrides[:m.noverrides]
+}
+
+// ISAInterrupt returns the global system interrupt and flags of an
+// ISA interrupt. Without an override, ISA interrupts are identity
+// mapped.
+//go:nosplit
+func (m *MADT) ISAInterrupt(irq uint8) (uint32, uint16) {
+	for _, o := range m.Overrides() {
+		if o.Source == irq {
+			return o.GSI, o.Flags
+		}
+	}
+	return uint32(irq), 0
+}
+
+//go:nosplit
+func (h *HPET) parse(tab []byte) {
+	if len(tab) < headerSize+20 {
+		return
+	}
+	bo := binary.LittleEndian
+	h.Present = true
+	h.ID = bo.Uint32(tab[headerSize:])
+	h.Addr = bo.Uint64(tab[headerSize+8:])
+	h.Number = tab[headerSize+16]
+	h.MinTick = bo.Uint16(tab[headerSize+17:])
+}
+
+//go:nosplit
+func (m *MCFG) parse(tab []byte) {
+	const entrySize = 16
+	if len(tab) < headerSize+8 {
+		return
+	}
+	bo := binary.LittleEndian
+	m.Present = true
+	for e := tab[headerSize+8:]; len(e) >= entrySize; e = e[entrySize:] {
+		if m.nsegments == len(m.segments) {
+			break
+		}
+		m.segments[m.nsegments] = ECAM{
+			Addr:     bo.Uint64(e),
+			Segment:  bo.Uint16(e[8:]),
+			StartBus: e[10],
+			EndBus:   e[11],
+		}
+		m.nsegments++
+	}
+}
+
+// Segments returns the configuration space areas.
+//go:nosplit
+func (m *MCFG) Segments() []ECAM {
+	return m.segments[:m.nsegments]
+}
+
+//go:nosplit
+func (f *FADT) parse(tab []byte) {
+	// Require the ACPI 1.0 fields.
+	if len(tab) < 116 {
+		return
+	}
+	bo := binary.LittleEndian
+	f.Present = true
+	f.DSDT = uint64(bo.Uint32(tab[40:]))
+	f.SCIInterrupt = bo.Uint16(tab[46:])
+	f.SMICommand = bo.Uint32(tab[48:])
+	f.ACPIEnable = tab[52]
+	f.ACPIDisable = tab[53]
+	f.PM1aEvent = bo.Uint32(tab[56:])
+	f.PM1bEvent = bo.Uint32(tab[60:])
+	f.PM1aControl = bo.Uint32(tab[64:])
+	f.PM1bControl = bo.Uint32(tab[68:])
+	f.PMTimer = bo.Uint32(tab[76:])
+	f.Century = tab[108]
+	f.BootArch = bo.Uint16(tab[109:])
+	f.Flags = bo.Uint32(tab[112:])
+	if len(tab) >= 129 {
+		f.ResetReg = parseGenericAddress(tab[116:])
+		f.ResetValue = tab[128]
+	}
+	if len(tab) >= 148 {
+		if dsdt := bo.Uint64(tab[140:]); dsdt != 0 {
+			f.DSDT = dsdt
+		}
+	}
+}
+
+//go:nosplit
+func parseGenericAddress(b []byte) GenericAddress {
+	return GenericAddress{
+		Space:      b[0],
+		BitWidth:   b[1],
+		BitOffset:  b[2],
+		AccessSize: b[3],
+		Addr:       binary.LittleEndian.Uint64(b[4:]),
+	}
+}
+
+//go:nosplit
+func (e Error) Error() string {
+	return string(e)
+}
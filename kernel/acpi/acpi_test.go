@@ -0,0 +1,585 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package acpi
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// physMem is a sparse physical memory of table fixtures.
+type physMem map[uint64][]byte
+
+func (m physMem) mapper(addr uint64, size int) []byte {
+	for base, b := range m {
+		if addr < base || addr >= base+uint64(len(b)) {
+			continue
+		}
+		b = b[addr-base:]
+		if len(b) > size {
+			b = b[:size]
+		}
+		return b
+	}
+	return nil
+}
+
+// fixChecksum sets the byte at off so the bytes of b sum to zero.
+func fixChecksum(b []byte, off int) {
+	b[off] = 0
+	var sum uint8
+	for _, v := range b {
+		sum += v
+	}
+	b[off] = -sum
+}
+
+// sdt returns a system description table with the body.
+func sdt(sig string, rev byte, body []byte) []byte {
+	b := make([]byte, headerSize+len(body))
+	copy(b, sig)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	b[8] = rev
+	copy(b[10:], "UNIKTS")
+	copy(b[16:], "UNIKTEST")
+	copy(b[headerSize:], body)
+	fixChecksum(b, 9)
+	return b
+}
+
+// rsdp returns a root system description pointer of the revision
+// with the RSDT and XSDT addresses.
+func rsdp(rev byte, rsdt uint32, xsdt uint64) []byte {
+	b := make([]byte, xsdpSize)
+	copy(b, "RSD PTR ")
+	copy(b[9:], "UNIKTS")
+	b[15] = rev
+	binary.LittleEndian.PutUint32(b[16:], rsdt)
+	fixChecksum(b[:rsdpSize], 8)
+	if rev < 2 {
+		return b[:rsdpSize]
+	}
+	binary.LittleEndian.PutUint32(b[20:], xsdpSize)
+	binary.LittleEndian.PutUint64(b[24:], xsdt)
+	fixChecksum(b, 32)
+	return b
+}
+
+// rootTable returns an RSDT or XSDT referencing the addresses.
+func rootTable(sig string, entrySize int, addrs ...uint64) []byte {
+	body := make([]byte, entrySize*len(addrs))
+	for i, a := range addrs {
+		if entrySize == 8 {
+			binary.LittleEndian.PutUint64(body[i*8:], a)
+		} else {
+			binary.LittleEndian.PutUint32(body[i*4:], uint32(a))
+		}
+	}
+	return sdt(sig, 1, body)
+}
+
+func le16(v uint16) []byte { return []byte{byte(v), byte(v >> 8)} }
+func le32(v uint32) []byte { return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)} }
+func le64(v uint64) []byte { return append(le32(uint32(v)), le32(uint32(v>>32))...) }
+
+func concat(bs ...[]byte) []byte {
+	var b []byte
+	for _, v := range bs {
+		b = append(b, v...)
+	}
+	return b
+}
+
+// madtBody returns the body of a MADT with the entries.
+func madtBody(lapicAddr, flags uint32, entries ...[]byte) []byte {
+	return concat(append([][]byte{le32(lapicAddr), le32(flags)}, entries...)...)
+}
+
+func localAPICEntry(uid, id byte, flags uint32) []byte {
+	return concat([]byte{madtLocalAPIC, 8, uid, id}, le32(flags))
+}
+
+func x2APICEntry(id, flags, uid uint32) []byte {
+	return concat([]byte{madtLocalX2APIC, 16, 0, 0}, le32(id), le32(flags), le32(uid))
+}
+
+func ioAPICEntry(id byte, addr, gsiBase uint32) []byte {
+	return concat([]byte{madtIOAPIC, 12, id, 0}, le32(addr), le32(gsiBase))
+}
+
+func overrideEntry(src byte, gsi uint32, flags uint16) []byte {
+	return concat([]byte{madtOverride, 10, 0, src}, le32(gsi), le16(flags))
+}
+
+func hpetBody(id uint32, addr uint64, number byte, minTick uint16) []byte {
+	// The address is a generic address structure.
+	gas := concat([]byte{SpaceMemory, 64, 0, 0}, le64(addr))
+	return concat(le32(id), gas, []byte{number}, le16(minTick), []byte{0})
+}
+
+// fadt returns a FADT of the size in bytes, including the header.
+func fadt(size int, dsdt uint32, xdsdt uint64) []byte {
+	b := make([]byte, size-headerSize)
+	put := func(off int, v []byte) {
+		off -= headerSize
+		if off+len(v) <= len(b) {
+			copy(b[off:], v)
+		}
+	}
+	put(40, le32(dsdt))
+	put(46, le16(9))
+	put(48, le32(0xb2))
+	put(52, []byte{0xf1, 0xf0})
+	put(56, le32(0x600))
+	put(64, le32(0x604))
+	put(76, le32(0x608))
+	put(108, []byte{0x32})
+	put(109, le16(BootArchLegacyDevices|Boot8042))
+	put(112, le32(FlagTimerExt|FlagResetReg))
+	put(116, concat([]byte{SpaceIO, 8, 0, 1}, le64(0xcf9)))
+	put(128, []byte{0x06})
+	put(140, le64(xdsdt))
+	return sdt("FACP", 3, b)
+}
+
+func TestParse(t *testing.T) {
+	const (
+		rsdpAddr = 0xe0000
+		rootAddr = 0x7f00000
+		madtAddr = 0x7f01000
+		hpetAddr = 0x7f02000
+		fadtAddr = 0x7f03000
+		dsdtAddr = 0x7f04000
+		mcfgAddr = 0x7f05000
+	)
+	madt := sdt("APIC", 3, madtBody(0xfee00000, madtPCATCompat,
+		localAPICEntry(0, 0, madtLocalAPICEnabled),
+		localAPICEntry(1, 1, 0),
+		ioAPICEntry(2, 0xfec00000, 0),
+		overrideEntry(0, 2, 0),
+	))
+	hpet := sdt("HPET", 1, hpetBody(0x8086a201, 0xfed00000, 0, 0x80))
+	mcfg := sdt("MCFG", 1, concat(make([]byte, 8),
+		le64(0xb0000000), le16(0), []byte{0, 0xff}, make([]byte, 4)))
+	dsdt := sdt("DSDT", 2, []byte{amlNameOp, '_', 'S', '5', '_', amlPackageOp, 0x06, 0x04, amlBytePrefix, 0x05, amlZeroOp, 0x00, 0x00})
+	badHPET := append([]byte(nil), hpet...)
+	badHPET[headerSize] ^= 1
+
+	wantMADT := MADT{Present: true, LocalAPICAddr: 0xfee00000, PCATCompat: true}
+	wantMADT.addLocalAPIC(LocalAPIC{ProcessorUID: 0, APICID: 0, Enabled: true})
+	wantMADT.addLocalAPIC(LocalAPIC{ProcessorUID: 1, APICID: 1})
+	wantMADT.ioAPICs[0] = IOAPIC{ID: 2, Addr: 0xfec00000}
+	wantMADT.nioAPICs = 1
+	wantMADT.overrides[0] = InterruptOverride{Source: 0, GSI: 2}
+	wantMADT.noverrides = 1
+	wantHPET := HPET{Present: true, Addr: 0xfed00000, ID: 0x8086a201, MinTick: 0x80}
+	wantMCFG := MCFG{Present: true, nsegments: 1}
+	wantMCFG.segments[0] = ECAM{Addr: 0xb0000000, EndBus: 0xff}
+
+	tests := []struct {
+		name string
+		mem  physMem
+		err  bool
+		// check verifies the parsed tables.
+		check func(t *testing.T, tabs *Tables)
+	}{
+		{
+			name: "RSDT",
+			mem: physMem{
+				rsdpAddr: rsdp(0, rootAddr, 0),
+				rootAddr: rootTable("RSDT", 4, madtAddr, hpetAddr, fadtAddr),
+				madtAddr: madt,
+				hpetAddr: hpet,
+				fadtAddr: fadt(116, dsdtAddr, 0),
+				dsdtAddr: dsdt,
+			},
+			check: func(t *testing.T, tabs *Tables) {
+				if !reflect.DeepEqual(tabs.MADT, wantMADT) {
+					t.Errorf("MADT %+v, want %+v", tabs.MADT, wantMADT)
+				}
+				if tabs.HPET != wantHPET {
+					t.Errorf("HPET %+v, want %+v", tabs.HPET, wantHPET)
+				}
+				if tabs.MCFG.Present {
+					t.Error("MCFG present")
+				}
+				want := FADT{
+					Present:      true,
+					DSDT:         dsdtAddr,
+					SCIInterrupt: 9,
+					SMICommand:   0xb2,
+					ACPIEnable:   0xf1,
+					ACPIDisable:  0xf0,
+					PM1aEvent:    0x600,
+					PM1aControl:  0x604,
+					PMTimer:      0x608,
+					Century:      0x32,
+					BootArch:     BootArchLegacyDevices | Boot8042,
+					Flags:        FlagTimerExt | FlagResetReg,
+				}
+				if tabs.FADT != want {
+					t.Errorf("FADT %+v, want %+v", tabs.FADT, want)
+				}
+			},
+		},
+		{
+			name: "XSDT",
+			mem: physMem{
+				rsdpAddr: rsdp(2, 0, rootAddr),
+				rootAddr: rootTable("XSDT", 8, mcfgAddr, hpetAddr, fadtAddr, madtAddr),
+				madtAddr: madt,
+				hpetAddr: hpet,
+				mcfgAddr: mcfg,
+				fadtAddr: fadt(244, 0, dsdtAddr),
+				dsdtAddr: dsdt,
+			},
+			check: func(t *testing.T, tabs *Tables) {
+				if tabs.Revision != 2 || string(tabs.OEMID[:]) != "UNIKTS" {
+					t.Errorf("revision %d, OEM ID %q", tabs.Revision, tabs.OEMID)
+				}
+				if !reflect.DeepEqual(tabs.MADT, wantMADT) {
+					t.Errorf("MADT %+v, want %+v", tabs.MADT, wantMADT)
+				}
+				if tabs.HPET != wantHPET {
+					t.Errorf("HPET %+v, want %+v", tabs.HPET, wantHPET)
+				}
+				if !reflect.DeepEqual(tabs.MCFG, wantMCFG) {
+					t.Errorf("MCFG %+v, want %+v", tabs.MCFG, wantMCFG)
+				}
+				f := tabs.FADT
+				wantReset := GenericAddress{Space: SpaceIO, BitWidth: 8, AccessSize: 1, Addr: 0xcf9}
+				if f.DSDT != dsdtAddr || f.ResetReg != wantReset || f.ResetValue != 6 {
+					t.Errorf("FADT DSDT %#x, reset %+v value %d", f.DSDT, f.ResetReg, f.ResetValue)
+				}
+			},
+		},
+		{
+			name: "invalid table skipped",
+			mem: physMem{
+				rsdpAddr: rsdp(0, rootAddr, 0),
+				rootAddr: rootTable("RSDT", 4, hpetAddr, 0, madtAddr),
+				madtAddr: madt,
+				hpetAddr: badHPET,
+			},
+			check: func(t *testing.T, tabs *Tables) {
+				if tabs.HPET.Present {
+					t.Error("HPET with invalid checksum present")
+				}
+				if !tabs.MADT.Present {
+					t.Error("MADT missing")
+				}
+			},
+		},
+		{
+			name: "no RSDP",
+			mem:  physMem{rsdpAddr: make([]byte, rsdpSize)},
+			err:  true,
+		},
+		{
+			name: "invalid RSDP checksum",
+			mem: physMem{
+				rsdpAddr: func() []byte {
+					b := rsdp(0, rootAddr, 0)
+					b[16]++
+					return b
+				}(),
+			},
+			err: true,
+		},
+		{
+			name: "missing root table",
+			mem:  physMem{rsdpAddr: rsdp(0, rootAddr, 0)},
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tabs Tables
+			err := Parse(&tabs, rsdpAddr, test.mem.mapper)
+			if (err != nil) != test.err {
+				t.Fatalf("Parse error %v, want error %v", err, test.err)
+			}
+			if test.check != nil {
+				test.check(t, &tabs)
+			}
+		})
+	}
+}
+
+func TestSleepType(t *testing.T) {
+	const (
+		rsdpAddr = 0xe0000
+		rootAddr = 0x7f00000
+		fadtAddr = 0x7f01000
+		dsdtAddr = 0x7f02000
+	)
+	tests := []struct {
+		name  string
+		aml   []byte
+		state int
+		a, b  uint16
+		ok    bool
+	}{
+		{
+			name:  "byte and zero",
+			aml:   []byte{amlNameOp, '_', 'S', '5', '_', amlPackageOp, 0x06, 0x04, amlBytePrefix, 0x05, amlZeroOp, 0x00, 0x00},
+			state: 5, a: 5, b: 0, ok: true,
+		},
+		{
+			name:  "root prefix",
+			aml:   []byte{amlNameOp, '\\', '_', 'S', '5', '_', amlPackageOp, 0x08, 0x04, amlWordPrefix, 0x07, 0x00, amlOneOp, 0x00, 0x00},
+			state: 5, a: 7, b: 1, ok: true,
+		},
+		{
+			name: "skip other states",
+			aml: []byte{
+				amlNameOp, '_', 'S', '3', '_', amlPackageOp, 0x04, 0x02, amlOneOp, amlOneOp,
+				amlNameOp, '_', 'S', '5', '_', amlPackageOp, 0x0a, 0x02, amlDWordPrefix, 0x02, 0x00, 0x00, 0x00, amlBytePrefix, 0x03,
+			},
+			state: 5, a: 2, b: 3, ok: true,
+		},
+		{
+			name:  "not a name definition",
+			aml:   []byte{0x10, '_', 'S', '5', '_', amlPackageOp, 0x04, 0x02, amlOneOp, amlOneOp},
+			state: 5,
+		},
+		{
+			name:  "missing state",
+			aml:   []byte{amlNameOp, '_', 'S', '5', '_', amlPackageOp, 0x04, 0x02, amlOneOp, amlOneOp},
+			state: 4,
+		},
+		{
+			name:  "invalid state",
+			state: 6,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mem := physMem{
+				rsdpAddr: rsdp(0, rootAddr, 0),
+				rootAddr: rootTable("RSDT", 4, fadtAddr),
+				fadtAddr: fadt(116, dsdtAddr, 0),
+				dsdtAddr: sdt("DSDT", 2, test.aml),
+			}
+			var tabs Tables
+			if err := Parse(&tabs, rsdpAddr, mem.mapper); err != nil {
+				t.Fatal(err)
+			}
+			a, b, ok := tabs.SleepType(test.state, mem.mapper)
+			if ok != test.ok || a != test.a || b != test.b {
+				t.Errorf("SleepType(%d) = %d, %d, %v, want %d, %d, %v", test.state, a, b, ok, test.a, test.b, test.ok)
+			}
+		})
+	}
+}
+
+func TestMADT(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      []byte
+		present   bool
+		lapicAddr uint64
+		lapics    []LocalAPIC
+		ioapics   []IOAPIC
+		overrides []InterruptOverride
+	}{
+		{
+			name: "short",
+			body: make([]byte, 4),
+		},
+		{
+			name:      "empty",
+			body:      madtBody(0xfee00000, 0),
+			present:   true,
+			lapicAddr: 0xfee00000,
+		},
+		{
+			name: "x2APIC",
+			body: madtBody(0xfee00000, 0,
+				localAPICEntry(0, 0, madtLocalAPICEnabled),
+				x2APICEntry(0x100, madtLocalAPICEnabled, 7),
+			),
+			present:   true,
+			lapicAddr: 0xfee00000,
+			lapics: []LocalAPIC{
+				{ProcessorUID: 0, APICID: 0, Enabled: true},
+				{ProcessorUID: 7, APICID: 0x100, Enabled: true},
+			},
+		},
+		{
+			name: "local APIC address override",
+			body: madtBody(0xfee00000, 0,
+				concat([]byte{madtLocalAPICOverride, 12, 0, 0}, le64(0x1fee00000)),
+			),
+			present:   true,
+			lapicAddr: 0x1fee00000,
+		},
+		{
+			name: "I/O APICs and overrides",
+			body: madtBody(0xfee00000, 0,
+				ioAPICEntry(0, 0xfec00000, 0),
+				ioAPICEntry(1, 0xfec01000, 24),
+				overrideEntry(0, 2, 0),
+				overrideEntry(9, 9, 0xd),
+			),
+			present:   true,
+			lapicAddr: 0xfee00000,
+			ioapics: []IOAPIC{
+				{ID: 0, Addr: 0xfec00000, GSIBase: 0},
+				{ID: 1, Addr: 0xfec01000, GSIBase: 24},
+			},
+			overrides: []InterruptOverride{
+				{Source: 0, GSI: 2},
+				{Source: 9, GSI: 9, Flags: 0xd},
+			},
+		},
+		{
+			name: "unknown and short entries skipped",
+			body: madtBody(0xfee00000, 0,
+				[]byte{0x7f, 4, 0, 0},
+				[]byte{madtLocalAPIC, 4, 1, 1},
+				localAPICEntry(2, 2, madtLocalAPICEnabled),
+			),
+			present:   true,
+			lapicAddr: 0xfee00000,
+			lapics:    []LocalAPIC{{ProcessorUID: 2, APICID: 2, Enabled: true}},
+		},
+		{
+			name: "truncated entry",
+			body: madtBody(0xfee00000, 0,
+				localAPICEntry(0, 0, madtLocalAPICEnabled),
+				[]byte{madtIOAPIC, 12, 0, 0},
+			),
+			present:   true,
+			lapicAddr: 0xfee00000,
+			lapics:    []LocalAPIC{{Enabled: true}},
+		},
+		{
+			name: "zero length entry",
+			body: madtBody(0xfee00000, 0,
+				[]byte{madtLocalAPIC, 0},
+				localAPICEntry(0, 0, madtLocalAPICEnabled),
+			),
+			present:   true,
+			lapicAddr: 0xfee00000,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var m MADT
+			m.parse(sdt("APIC", 3, test.body))
+			if m.Present != test.present || m.LocalAPICAddr != test.lapicAddr {
+				t.Errorf("present %v, local APIC address %#x; want %v, %#x",
+					m.Present, m.LocalAPICAddr, test.present, test.lapicAddr)
+			}
+			if got := m.LocalAPICs(); !equalSlices(got, test.lapics) {
+				t.Errorf("local APICs %+v, want %+v", got, test.lapics)
+			}
+			if got := m.IOAPICs(); !equalSlices(got, test.ioapics) {
+				t.Errorf("I/O APICs %+v, want %+v", got, test.ioapics)
+			}
+			if got := m.Overrides(); !equalSlices(got, test.overrides) {
+				t.Errorf("overrides %+v, want %+v", got, test.overrides)
+			}
+		})
+	}
+}
+
+// equalSlices is like reflect.DeepEqual but treats nil and empty
+// slices as equal.
+func equalSlices(a, b interface{}) bool {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	if va.Len() == 0 && vb.Len() == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestISAInterrupt(t *testing.T) {
+	var m MADT
+	m.parse(sdt("APIC", 3, madtBody(0xfee00000, 0,
+		overrideEntry(0, 2, 0),
+		overrideEntry(9, 20, 0xf),
+	)))
+	tests := []struct {
+		irq   uint8
+		gsi   uint32
+		flags uint16
+	}{
+		{0, 2, 0},
+		{1, 1, 0},
+		{9, 20, 0xf},
+		{4, 4, 0},
+	}
+	for _, test := range tests {
+		gsi, flags := m.ISAInterrupt(test.irq)
+		if gsi != test.gsi || flags != test.flags {
+			t.Errorf("ISAInterrupt(%d) = %d, %#x; want %d, %#x", test.irq, gsi, flags, test.gsi, test.flags)
+		}
+	}
+}
+
+func TestFADT(t *testing.T) {
+	reset := GenericAddress{Space: SpaceIO, BitWidth: 8, AccessSize: 1, Addr: 0xcf9}
+	tests := []struct {
+		name       string
+		tab        []byte
+		present    bool
+		dsdt       uint64
+		resetReg   GenericAddress
+		resetValue uint8
+	}{
+		{"too short", fadt(115, 0x1000, 0), false, 0, GenericAddress{}, 0},
+		{"ACPI 1.0", fadt(116, 0x1000, 0), true, 0x1000, GenericAddress{}, 0},
+		{"reset register", fadt(129, 0x1000, 0), true, 0x1000, reset, 6},
+		{"X_DSDT", fadt(148, 0x1000, 0x100002000), true, 0x100002000, reset, 6},
+		{"zero X_DSDT", fadt(244, 0x1000, 0), true, 0x1000, reset, 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var f FADT
+			f.parse(test.tab)
+			if f.Present != test.present {
+				t.Fatalf("present %v, want %v", f.Present, test.present)
+			}
+			if !f.Present {
+				return
+			}
+			if f.DSDT != test.dsdt {
+				t.Errorf("DSDT %#x, want %#x", f.DSDT, test.dsdt)
+			}
+			if f.ResetReg != test.resetReg || f.ResetValue != test.resetValue {
+				t.Errorf("reset %+v value %d, want %+v value %d", f.ResetReg, f.ResetValue, test.resetReg, test.resetValue)
+			}
+			if f.PMTimer != 0x608 || f.Flags != FlagTimerExt|FlagResetReg || f.Century != 0x32 {
+				t.Errorf("PM timer %#x, flags %#x, century %#x", f.PMTimer, f.Flags, f.Century)
+			}
+		})
+	}
+}
+
+func TestHPET(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+		want HPET
+	}{
+		{"short", make([]byte, 19), HPET{}},
+		{"QEMU", hpetBody(0x8086a201, 0xfed00000, 0, 0x80), HPET{
+			Present: true, Addr: 0xfed00000, ID: 0x8086a201, MinTick: 0x80,
+		}},
+		{"second block", hpetBody(0x10228201, 0xfed01000, 1, 0x37ee), HPET{
+			Present: true, Addr: 0xfed01000, ID: 0x10228201, Number: 1, MinTick: 0x37ee,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var h HPET
+			h.parse(sdt("HPET", 1, test.body))
+			if h != test.want {
+				t.Errorf("HPET %+v, want %+v", h, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import "eliasnaur.com/unik/kernel/acpi"
+
+const (
+	efiACPIReclaimMemory efiMemoryType = 9
+	efiACPIMemoryNVS     efiMemoryType = 10
+)
+
+// acpiTables contains the parsed ACPI tables. It is only written by
+// initACPI and may be read without locking afterwards.
+var acpiTables acpi.Tables
+
+//go:nosplit
+func initACPI(efiMap efiMemoryMap, rsdp physicalAddress) {
+	// Older boot loaders don't pass the RSDP; check that the
+	// address points to ACPI memory before trusting it.
+	if !efiMap.isACPI(rsdp) {
+		return
+	}
+	if err := acpi.Parse(&acpiTables, uint64(rsdp), mapACPI); err != nil {
+		outputString(string(err.(acpi.Error)))
+		outputString("\n")
+		acpiTables = acpi.Tables{}
+	}
+}
+
+// mapACPI implements acpi.Mapper for the identity mapped physical
+// memory.
+//go:nosplit
+func mapACPI(addr uint64, size int) []byte {
+	if size < 0 || addr+uint64(size) < addr {
+		return nil
+	}
+	start := physToVirt(physicalAddress(addr))
+	end := start + virtualAddress(size)
+	for page := start &^ (pageSize - 1); page < end; page += pageSize {
+		if !readableAddr(uint64(page)) {
+			return nil
+		}
+	}
+	return sliceForMem(start, size)
+}
+
+// isACPI reports whether the memory region contains ACPI tables.
+//go:nosplit
+func (e *efiMemoryDescriptor) isACPI() bool {
+	return e._type == efiACPIReclaimMemory || e._type == efiACPIMemoryNVS
+}
+
+// isACPI reports whether addr is inside an ACPI memory region.
+//go:nosplit
+func (m *efiMemoryMap) isACPI(addr physicalAddress) bool {
+	for i := 0; i < m.len(); i++ {
+		desc := m.entry(i)
+		if !desc.isACPI() {
+			continue
+		}
+		end := desc.physicalStart + physicalAddress(desc.numberOfPages*pageSize)
+		if desc.physicalStart <= addr && addr < end {
+			return true
+		}
+	}
+	return false
+}
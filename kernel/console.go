@@ -0,0 +1,33 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// ServeConsole makes rw the console of the program: reads from the
+// standard input return data read from rw, and writes to the standard
+// output and error go to rw instead of the serial port. If writing to
+// rw fails, the console returns to the serial port. ServeConsole may
+// be called at most once.
+func ServeConsole(rw io.ReadWriter) error {
+	fd, _, errno := syscall.Syscall(_SYS_consoleopen, 0, 0, 0)
+	switch errno {
+	case 0:
+	case syscall.EBUSY:
+		return errors.New("kernel: console already served")
+	default:
+		return errno
+	}
+	master := os.NewFile(fd, "console")
+	go func() {
+		io.Copy(rw, master)
+		master.Close()
+	}()
+	go io.Copy(master, rw)
+	return nil
+}
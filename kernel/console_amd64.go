@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+// The console files, among them the standard input, output and
+// error, read from and write to the serial port until the program
+// serves the console. A served console works like a pseudo terminal:
+// the program opens the console master file, reads the console output
+// from it and writes the console input to it.
+
+// console is the state of the console files.
+type console struct {
+	// served is set while the console master is open.
+	served bool
+	master int32
+	// in and out buffer the console input and output.
+	in, out ring
+}
+
+// sysConsoleOpen opens the console master and returns its file
+// descriptor.
+//go:nosplit
+func sysConsoleOpen() uint64 {
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	ret := fs.openConsoleMaster()
+	ts.lock.unlock()
+	return ret
+}
+
+//go:nosplit
+func (fs *files) openConsoleMaster() uint64 {
+	c := &fs.console
+	if c.served {
+		return _EBUSY
+	}
+	d := fs.newFd0(fileConsoleMaster, _O_CLOEXEC)
+	if isErrno(d) {
+		return d
+	}
+	c.served = true
+	c.master = fs.fds[d].file
+	return d
+}
+
+// readConsole reads console input into p.
+//go:nosplit
+func (fs *files) readConsole(p []byte) (uint64, bool) {
+	c := &fs.console
+	if !c.served {
+		return fs.readSerial(p), false
+	}
+	if c.in.n == 0 {
+		return _EAGAIN, false
+	}
+	n := c.in.read(p)
+	return uint64(n), fs.notify(c.master)
+}
+
+// writeConsole writes p to the output of the served console.
+//go:nosplit
+func (fs *files) writeConsole(p []byte) (uint64, bool) {
+	c := &fs.console
+	if c.out.n == len(c.out.buf) {
+		return _EAGAIN, false
+	}
+	n := c.out.write(p)
+	return uint64(n), fs.notify(c.master)
+}
+
+// readConsoleMaster reads console output into p.
+//go:nosplit
+func (fs *files) readConsoleMaster(p []byte) (uint64, bool) {
+	c := &fs.console
+	if c.out.n == 0 {
+		return _EAGAIN, false
+	}
+	n := c.out.read(p)
+	// Console files can't be watched by epoll instances, so
+	// only blocked threads need waking.
+	return uint64(n), fs.hasWaiters()
+}
+
+// writeConsoleMaster writes p to the console input.
+//go:nosplit
+func (fs *files) writeConsoleMaster(p []byte) (uint64, bool) {
+	c := &fs.console
+	if c.in.n == len(c.in.buf) {
+		return _EAGAIN, false
+	}
+	n := c.in.write(p)
+	return uint64(n), fs.hasWaiters()
+}
+
+// consoleReady returns the readiness events of a console file or,
+// if master is set, the console master.
+//go:nosplit
+func (fs *files) consoleReady(master bool) uint32 {
+	c := &fs.console
+	var ev uint32
+	if master {
+		if c.out.n > 0 {
+			ev |= _EPOLLIN
+		}
+		if c.in.n < len(c.in.buf) {
+			ev |= _EPOLLOUT
+		}
+		return ev
+	}
+	if !c.served {
+		return fs.serialReady()
+	}
+	if c.in.n > 0 {
+		ev |= _EPOLLIN
+	}
+	if c.out.n < len(c.out.buf) {
+		ev |= _EPOLLOUT
+	}
+	return ev
+}
+
+// releaseConsoleMaster returns the console to the serial port.
+//go:nosplit
+func (fs *files) releaseConsoleMaster() {
+	c := &fs.console
+	c.served = false
+	c.flush()
+}
+
+// flush writes the buffered console output to the serial port.
+//go:nosplit
+func (c *console) flush() {
+	end := c.out.off + c.out.n
+	if end > len(c.out.buf) {
+		serialWrite(c.out.buf[c.out.off:])
+		end -= len(c.out.buf)
+		c.out.off = 0
+	}
+	serialWrite(c.out.buf[c.out.off:end])
+	c.out.off, c.out.n = 0, 0
+}
@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+// devFS is the file system of the device files in /dev.
+type devFS struct{}
+
+// Device inodes. The devices follow the root directory.
+const (
+	devRoot = 1 + iota
+	devNull
+	devZero
+	devConsole
+	devSerial
+	devRandom
+	devURandom
+
+	devLast = devURandom
+)
+
+// device returns the name, mode and device number of the device
+// inode ino.
+//go:nosplit
+func (*devFS) device(ino uint64) (string, uint32, uint64) {
+	switch ino {
+	case devNull:
+		return "null", _S_IFCHR | 0666, 1<<8 | 3
+	case devZero:
+		return "zero", _S_IFCHR | 0666, 1<<8 | 5
+	case devConsole:
+		return "console", _S_IFCHR | 0620, 5<<8 | 1
+	case devSerial:
+		return "ttyS0", _S_IFCHR | 0660, 4<<8 | 64
+	case devRandom:
+		return "random", _S_IFCHR | 0666, 1<<8 | 8
+	case devURandom:
+		return "urandom", _S_IFCHR | 0666, 1<<8 | 9
+	}
+	return "", _S_IFDIR | 0755, 0
+}
+
+//go:nosplit
+func (*devFS) root() uint64 {
+	return devRoot
+}
+
+//go:nosplit
+func (d *devFS) lookup(dir uint64, name []byte) (uint64, uint64) {
+	if dir != devRoot {
+		return 0, _ENOTDIR
+	}
+	if string(name) == ".." {
+		return devRoot, _EOK
+	}
+	for ino := uint64(devRoot + 1); ino <= devLast; ino++ {
+		if n, _, _ := d.device(ino); n == string(name) {
+			return ino, _EOK
+		}
+	}
+	return 0, _ENOENT
+}
+
+//go:nosplit
+func (d *devFS) readdir(dir uint64, i int) (dirent, bool) {
+	ino := uint64(devRoot + 1 + i)
+	if dir != devRoot || ino > devLast {
+		return dirent{}, false
+	}
+	name, mode, _ := d.device(ino)
+	return dirent{ino: ino, mode: mode, name: name}, true
+}
+
+//go:nosplit
+func (d *devFS) stat(ino uint64, st *stat) uint64 {
+	if ino < devRoot || ino > devLast {
+		return _ENOENT
+	}
+	_, st.mode, st.rdev = d.device(ino)
+	st.nlink = 1
+	return _EOK
+}
+
+//go:nosplit
+func (*devFS) open(ino uint64, flags uint64) (fileKind, uint64) {
+	switch ino {
+	case devConsole:
+		return fileConsole, _EOK
+	case devSerial:
+		return fileSerial, _EOK
+	}
+	return fileFS, _EOK
+}
+
+//go:nosplit
+func (*devFS) read(ino uint64, p []byte, off int64) uint64 {
+	switch ino {
+	case devZero:
+		for i := range p {
+			p[i] = 0
+		}
+		return uint64(len(p))
+	case devRandom, devURandom:
+		if len(p) > maxGetrandom {
+			p = p[:maxGetrandom]
+		}
+		readRandom(p)
+		return uint64(len(p))
+	}
+	// End of file.
+	return 0
+}
+
+//go:nosplit
+func (*devFS) write(ino uint64, p []byte, off int64) uint64 {
+	switch ino {
+	case devRandom, devURandom:
+		addEntropy(p)
+	}
+	// Other devices discard the data.
+	return uint64(len(p))
+}
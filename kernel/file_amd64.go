@@ -0,0 +1,1001 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"time"
+	"unsafe"
+)
+
+const (
+	// maxFds is the size of the file descriptor table.
+	maxFds = 256
+	// maxFiles is the maximum number of open files.
+	maxFiles = maxFds
+	// maxPipes is the maximum number of open pipes.
+	maxPipes = 32
+	// pipeSize is the capacity of a pipe.
+	pipeSize = pageSize
+	// maxEpollItems is the maximum number of file descriptors
+	// registered with all epoll instances.
+	maxEpollItems = 256
+	// maxEventfdValue is the largest value of an eventfd counter.
+	maxEventfdValue = ^uint64(0) - 1
+)
+
+const (
+	_O_RDONLY    = 0x0
+	_O_WRONLY    = 0x1
+	_O_RDWR      = 0x2
+	_O_ACCMODE   = 0x3
+	_O_CREAT     = 0x40
+	_O_EXCL      = 0x80
+	_O_TRUNC     = 0x200
+	_O_APPEND    = 0x400
+	_O_NONBLOCK  = 0x800
+	_O_DIRECTORY = 0x10000
+	_O_CLOEXEC   = 0x80000
+
+	_EFD_SEMAPHORE = 0x1
+
+	_EPOLL_CTL_ADD = 1
+	_EPOLL_CTL_DEL = 2
+	_EPOLL_CTL_MOD = 3
+
+	_EPOLLIN      = 0x1
+	_EPOLLOUT     = 0x4
+	_EPOLLERR     = 0x8
+	_EPOLLHUP     = 0x10
+	_EPOLLRDHUP   = 0x2000
+	_EPOLLONESHOT = 1 << 30
+	_EPOLLET      = 1 << 31
+
+	_F_DUPFD         = 0
+	_F_GETFD         = 1
+	_F_SETFD         = 2
+	_F_GETFL         = 3
+	_F_SETFL         = 4
+	_F_DUPFD_CLOEXEC = 1030
+
+	_FD_CLOEXEC = 1
+)
+
+type fileKind uint32
+
+const (
+	fileNone fileKind = iota
+	fileConsole
+	// fileConsoleMaster is the master side of the served console.
+	fileConsoleMaster
+	// fileSerial is the serial port.
+	fileSerial
+	filePipeReader
+	filePipeWriter
+	fileEventfd
+	fileEpoll
+	// fileFS is a file or directory of a mounted file system.
+	fileFS
+	// fileSocket is a socket served by the program.
+	fileSocket
+)
+
+var globalFiles files
+
+// files is the file descriptor table of the process along with the
+// state of its open files. Files are protected by globalThreads.lock,
+// so that readiness changes and the wakeup of threads blocked on them
+// are atomic.
+//
+// Files, pipes and epoll registrations refer to each other by index
+// to avoid pointer writes and their write barriers.
+type files struct {
+	fds    [maxFds]fd
+	files  [maxFiles]file
+	pipes  [maxPipes]pipe
+	items  [maxEpollItems]epollItem
+	mounts [maxMounts]mount
+	// root is the mount of the root directory.
+	root  int32
+	calls [maxFSCalls]fsCall
+	// pendingCalls is the number of calls waiting for a server.
+	pendingCalls int
+	// network is set when the program serves sockets.
+	network bool
+	console console
+	// serial buffers the input of the serial port.
+	serial ring
+	// st is scratch space for the status of kernel files. A local
+	// stat passed to a fileSystem method would be moved to the
+	// heap.
+	st stat
+}
+
+// fd is an entry in the file descriptor table.
+type fd struct {
+	open    bool
+	cloexec bool
+	file    int32
+}
+
+// file is an open file. It may be referenced by several file
+// descriptors.
+type file struct {
+	kind fileKind
+	// flags are the access mode and the file status flags.
+	flags uint32
+	// refs is the number of descriptors referring to the file.
+	refs int32
+	// pipe is the pipe of a pipe reader or writer.
+	pipe int32
+	// semaphore is set for eventfds in semaphore mode.
+	semaphore bool
+	// dir is set for directories.
+	dir bool
+	// counter is the value of an eventfd.
+	counter uint64
+
+	// For fileFS files, the mount and inode of the file and the
+	// file offset. For sockets, ino is the socket handle.
+	mount int32
+	ino   uint64
+	off   int64
+	// events are the readiness events of a socket.
+	events uint32
+}
+
+// pipe is a ring buffer shared by a pipe reader and writer.
+type pipe struct {
+	used bool
+	// readerClosed and writerClosed track the ends of the pipe.
+	readerClosed bool
+	writerClosed bool
+	reader       int32
+	writer       int32
+	ring
+}
+
+// ring is a byte ring buffer.
+type ring struct {
+	off, n int
+	buf    [pipeSize]byte
+}
+
+// read moves bytes from the ring into p and returns their number.
+//go:nosplit
+func (r *ring) read(p []byte) int {
+	n := 0
+	for n < len(p) && r.n > 0 {
+		end := r.off + r.n
+		if end > len(r.buf) {
+			end = len(r.buf)
+		}
+		c := copy(p[n:], r.buf[r.off:end])
+		n += c
+		r.n -= c
+		r.off = (r.off + c) % len(r.buf)
+	}
+	if r.n == 0 {
+		r.off = 0
+	}
+	return n
+}
+
+// write moves bytes from p into the ring and returns their number.
+//go:nosplit
+func (r *ring) write(p []byte) int {
+	n := 0
+	for n < len(p) && r.n < len(r.buf) {
+		end := (r.off + r.n) % len(r.buf)
+		lim := len(r.buf)
+		if end < r.off {
+			lim = r.off
+		}
+		c := copy(r.buf[end:lim], p[n:])
+		n += c
+		r.n += c
+	}
+	return n
+}
+
+// epollItem is a file descriptor registered with an epoll instance.
+type epollItem struct {
+	used bool
+	// triggered is set when the file became ready since the
+	// last time an edge triggered event was reported.
+	triggered bool
+	epoll     int32
+	file      int32
+	fd        int32
+	events    uint32
+	data      [8]byte
+}
+
+// epollEvent is struct epoll_event, which is packed on amd64.
+type epollEvent struct {
+	events uint32
+	data   [8]byte
+}
+
+//go:nosplit
+func initFiles(initramfs []byte) {
+	if unsafe.Sizeof(epollEvent{}) != 12 {
+		fatal("initFiles: invalid epollEvent size")
+	}
+	fs := &globalFiles
+	// Standard input, output and error refer to the console.
+	f, ok := fs.newFile(fileConsole)
+	if !ok {
+		fatal("initFiles: no console file")
+	}
+	fs.files[f].flags = _O_RDWR
+	for i := 0; i < 3; i++ {
+		fs.newFd(f, false)
+	}
+	initMounts(initramfs)
+}
+
+// newFile allocates an open file of the given kind.
+//go:nosplit
+func (fs *files) newFile(kind fileKind) (int32, bool) {
+	for i := range fs.files {
+		f := &fs.files[i]
+		if f.kind == fileNone {
+			*f = file{kind: kind}
+			return int32(i), true
+		}
+	}
+	return 0, false
+}
+
+// newFd allocates the lowest available file descriptor for the file
+// f.
+//go:nosplit
+func (fs *files) newFd(f int32, cloexec bool) (int, bool) {
+	return fs.newFdFrom(f, 0, cloexec)
+}
+
+// newFdFrom is like newFd but allocates a descriptor greater than or
+// equal to min.
+//go:nosplit
+func (fs *files) newFdFrom(f int32, min int, cloexec bool) (int, bool) {
+	for i := min; i < len(fs.fds); i++ {
+		d := &fs.fds[i]
+		if !d.open {
+			*d = fd{open: true, cloexec: cloexec, file: f}
+			fs.files[f].refs++
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// lookup returns the file index of the file descriptor d.
+//go:nosplit
+func (fs *files) lookup(d uint64) (int32, bool) {
+	if d >= maxFds || !fs.fds[d].open {
+		return 0, false
+	}
+	return fs.fds[d].file, true
+}
+
+// close closes the file descriptor d and reports whether a thread
+// may have been woken.
+//go:nosplit
+func (fs *files) close(d uint64) (uint64, bool) {
+	f, ok := fs.lookup(d)
+	if !ok {
+		return _EBADF, false
+	}
+	fs.fds[d] = fd{}
+	fs.files[f].refs--
+	if fs.files[f].refs > 0 {
+		return _EOK, false
+	}
+	return _EOK, fs.release(f)
+}
+
+// release frees the file f along with its epoll registrations and
+// reports whether a thread may have been woken.
+//go:nosplit
+func (fs *files) release(f int32) bool {
+	for i := range fs.items {
+		it := &fs.items[i]
+		if it.used && (it.file == f || it.epoll == f) {
+			*it = epollItem{}
+		}
+	}
+	kind, pi := fs.files[f].kind, fs.files[f].pipe
+	m, ino := fs.files[f].mount, fs.files[f].ino
+	user := fs.isUser(f)
+	fs.files[f] = file{}
+	switch kind {
+	case fileFS:
+		if user {
+			fs.closeUser(m, ino)
+			// Wake the server.
+			return true
+		}
+	case fileSocket:
+		fs.closeSocket(ino)
+		return true
+	case fileConsoleMaster:
+		fs.releaseConsoleMaster()
+	case filePipeReader, filePipeWriter:
+		p := &fs.pipes[pi]
+		if kind == filePipeReader {
+			p.readerClosed = true
+			fs.notify(p.writer)
+		} else {
+			p.writerClosed = true
+			fs.notify(p.reader)
+		}
+		if p.readerClosed && p.writerClosed {
+			p.used = false
+		}
+	}
+	// Wake threads blocked on the file, so they can observe that
+	// it is closed.
+	return fs.hasWaiters()
+}
+
+// hasWaiters reports whether any thread is blocked on a file.
+//go:nosplit
+func (fs *files) hasWaiters() bool {
+	ts := &globalThreads
+	for i := range ts.threads {
+		if ts.threads[i].block.conditions&(fileCondition|pollCondition) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ready returns the readiness events of the file f.
+//go:nosplit
+func (fs *files) ready(f int32) uint32 {
+	file := &fs.files[f]
+	switch file.kind {
+	case fileConsole:
+		return fs.consoleReady(false)
+	case fileConsoleMaster:
+		return fs.consoleReady(true)
+	case fileSerial:
+		return fs.serialReady()
+	case fileFS:
+		return _EPOLLIN | _EPOLLOUT
+	case fileSocket:
+		return file.events
+	case filePipeReader:
+		p := &fs.pipes[file.pipe]
+		var ev uint32
+		if p.n > 0 {
+			ev |= _EPOLLIN
+		}
+		if p.writerClosed {
+			ev |= _EPOLLIN | _EPOLLHUP
+		}
+		return ev
+	case filePipeWriter:
+		p := &fs.pipes[file.pipe]
+		var ev uint32
+		if p.n < len(p.buf) {
+			ev |= _EPOLLOUT
+		}
+		if p.readerClosed {
+			ev |= _EPOLLOUT | _EPOLLERR
+		}
+		return ev
+	case fileEventfd:
+		var ev uint32
+		if file.counter > 0 {
+			ev |= _EPOLLIN
+		}
+		if file.counter < maxEventfdValue {
+			ev |= _EPOLLOUT
+		}
+		return ev
+	case fileNone:
+		// Closed files are always ready, to wake up threads
+		// blocked on them.
+		return _EPOLLIN | _EPOLLOUT | _EPOLLERR | _EPOLLHUP
+	}
+	return 0
+}
+
+// notify records a change in the readiness of the file f with the
+// epoll instances watching it. It reports whether a thread may have
+// become runnable.
+//go:nosplit
+func (fs *files) notify(f int32) bool {
+	ready := fs.ready(f)
+	for i := range fs.items {
+		it := &fs.items[i]
+		if !it.used || it.file != f {
+			continue
+		}
+		if ready&(it.events|_EPOLLERR|_EPOLLHUP) != 0 {
+			it.triggered = true
+		}
+	}
+	return fs.hasWaiters()
+}
+
+// epollCtl implements epoll_ctl for the epoll instance ep.
+//go:nosplit
+func (fs *files) epollCtl(ep int32, op, d uint64, ev *epollEvent) uint64 {
+	f, ok := fs.lookup(d)
+	if !ok {
+		return _EBADF
+	}
+	switch fs.files[f].kind {
+	case fileEpoll:
+		// Nested epoll instances are not supported.
+		return _EINVAL
+	case fileConsole, fileFS:
+		// Like regular files, console files are not pollable.
+		return _EPERM
+	}
+	var item *epollItem
+	for i := range fs.items {
+		it := &fs.items[i]
+		if it.used && it.epoll == ep && it.file == f && it.fd == int32(d) {
+			item = it
+			break
+		}
+	}
+	switch op {
+	case _EPOLL_CTL_ADD:
+		if item != nil {
+			return _EEXIST
+		}
+		for i := range fs.items {
+			if !fs.items[i].used {
+				item = &fs.items[i]
+				break
+			}
+		}
+		if item == nil {
+			return _ENOSPC
+		}
+		*item = epollItem{used: true, epoll: ep, file: f, fd: int32(d)}
+	case _EPOLL_CTL_MOD:
+		if item == nil {
+			return _ENOENT
+		}
+	case _EPOLL_CTL_DEL:
+		if item == nil {
+			return _ENOENT
+		}
+		*item = epollItem{}
+		return _EOK
+	default:
+		return _EINVAL
+	}
+	if ev == nil {
+		*item = epollItem{}
+		return _EFAULT
+	}
+	item.events = ev.events
+	item.data = ev.data
+	// Report the current readiness of the file.
+	item.triggered = true
+	return _EOK
+}
+
+// epollCollect fills events with the ready events of the epoll
+// instance ep and returns the number of events.
+//go:nosplit
+func (fs *files) epollCollect(ep int32, events []epollEvent) int {
+	n := 0
+	for i := range fs.items {
+		if n == len(events) {
+			break
+		}
+		it := &fs.items[i]
+		if !it.used || it.epoll != ep {
+			continue
+		}
+		ready := fs.itemReady(it)
+		it.triggered = false
+		if ready == 0 {
+			continue
+		}
+		events[n] = epollEvent{events: ready, data: it.data}
+		n++
+		if it.events&_EPOLLONESHOT != 0 {
+			// Disable the item until it is modified.
+			it.events = 0
+		}
+	}
+	return n
+}
+
+// epollReady reports whether epollCollect would return events for
+// the epoll instance ep.
+//go:nosplit
+func (fs *files) epollReady(ep int32) bool {
+	for i := range fs.items {
+		it := &fs.items[i]
+		if it.used && it.epoll == ep && fs.itemReady(it) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// itemReady returns the events to report for the epoll item it.
+//go:nosplit
+func (fs *files) itemReady(it *epollItem) uint32 {
+	if it.events&_EPOLLET != 0 && !it.triggered {
+		return 0
+	}
+	return fs.ready(it.file) & (it.events | _EPOLLERR | _EPOLLHUP)
+}
+
+// read reads from the file f into p. It returns _EAGAIN if the file is
+// not ready.
+//go:nosplit
+func (fs *files) read(f int32, p []byte) (uint64, bool) {
+	file := &fs.files[f]
+	switch file.kind {
+	case fileConsole:
+		return fs.readConsole(p)
+	case fileConsoleMaster:
+		return fs.readConsoleMaster(p)
+	case fileSerial:
+		return fs.readSerial(p), false
+	case fileFS:
+		if file.dir {
+			return _EISDIR, false
+		}
+		n := fs.mounts[file.mount].fs.read(file.ino, p, file.off)
+		if !isErrno(n) {
+			file.off += int64(n)
+		}
+		return n, false
+	case filePipeReader:
+		pp := &fs.pipes[file.pipe]
+		if pp.n == 0 {
+			if pp.writerClosed {
+				return 0, false
+			}
+			return _EAGAIN, false
+		}
+		n := pp.read(p)
+		return uint64(n), fs.notify(pp.writer)
+	case fileEventfd:
+		if len(p) < 8 {
+			return _EINVAL, false
+		}
+		if file.counter == 0 {
+			return _EAGAIN, false
+		}
+		v := file.counter
+		if file.semaphore {
+			v = 1
+		}
+		file.counter -= v
+		*(*uint64)(unsafe.Pointer(&p[0])) = v
+		return 8, fs.notify(f)
+	}
+	return _EINVAL, false
+}
+
+// write writes p to the file f. It returns _EAGAIN if the file is
+// not ready.
+//go:nosplit
+func (fs *files) write(f int32, p []byte) (uint64, bool) {
+	file := &fs.files[f]
+	switch file.kind {
+	case fileConsole:
+		return fs.writeConsole(p)
+	case fileConsoleMaster:
+		return fs.writeConsoleMaster(p)
+	case fileFS:
+		if file.flags&_O_APPEND != 0 {
+			st := &fs.st
+			if errno := fs.statAt(file.mount, file.ino, st); errno != _EOK {
+				return errno, false
+			}
+			file.off = st.size
+		}
+		n := fs.mounts[file.mount].fs.write(file.ino, p, file.off)
+		if !isErrno(n) {
+			file.off += int64(n)
+		}
+		return n, false
+	case filePipeWriter:
+		pp := &fs.pipes[file.pipe]
+		if pp.readerClosed {
+			// SIGPIPE is not raised; the Go runtime ignores it for
+			// anything but the standard output anyway.
+			return _EPIPE, false
+		}
+		if pp.n == len(pp.buf) {
+			return _EAGAIN, false
+		}
+		n := pp.write(p)
+		return uint64(n), fs.notify(pp.reader)
+	case fileEventfd:
+		if len(p) < 8 {
+			return _EINVAL, false
+		}
+		v := *(*uint64)(unsafe.Pointer(&p[0]))
+		if v == ^uint64(0) {
+			return _EINVAL, false
+		}
+		if v > maxEventfdValue-file.counter {
+			return _EAGAIN, false
+		}
+		file.counter += v
+		return 8, fs.notify(f)
+	}
+	return _EINVAL, false
+}
+
+// sysRead implements read(2). Reads from files without O_NONBLOCK
+// block until the file is readable.
+//go:nosplit
+func sysRead(t *thread, d uint64, p virtualAddress, n uint64) (uint64, uint64) {
+	if !userAccessible(p, n, true) {
+		return _EFAULT, 0
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, ok := fs.lookup(d)
+	if !ok {
+		ts.lock.unlock()
+		return _EBADF, 0
+	}
+	if fs.files[f].flags&_O_ACCMODE == _O_WRONLY {
+		ts.lock.unlock()
+		return _EBADF, 0
+	}
+	if fs.isUser(f) {
+		ret := uint64(_EISDIR)
+		if !fs.files[f].dir {
+			ret = fs.forwardFile(t, f, fsRead, p, n, fs.files[f].off, true)
+		}
+		ts.lock.unlock()
+		return ret, 0
+	}
+	if fs.files[f].kind == fileSocket {
+		c, ret := fs.forwardSocket(t, f, sockRecv)
+		if ret == _EOK {
+			c.req.buf = uint64(p)
+			c.req.n = n
+		}
+		ts.lock.unlock()
+		return ret, 0
+	}
+	ret, woken := fs.read(f, sliceForMem(p, int(n)))
+	if ret == _EAGAIN && fs.files[f].flags&_O_NONBLOCK == 0 {
+		t.waitFile(f, _EPOLLIN)
+		ts.lock.unlock()
+		return t.restartSyscall(_SYS_read, n)
+	}
+	ts.lock.unlock()
+	if woken {
+		wakeIdleCPUs()
+	}
+	return ret, 0
+}
+
+// sysWrite implements write(2). Writes to files without O_NONBLOCK
+// block until the file is writable.
+//go:nosplit
+func sysWrite(t *thread, d uint64, p virtualAddress, n uint64) (uint64, uint64) {
+	if !userAccessible(p, n, false) {
+		return _EFAULT, 0
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, ok := fs.lookup(d)
+	if !ok {
+		ts.lock.unlock()
+		return _EBADF, 0
+	}
+	if fs.files[f].flags&_O_ACCMODE == _O_RDONLY {
+		ts.lock.unlock()
+		return _EBADF, 0
+	}
+	if fs.isUser(f) {
+		off := fs.files[f].off
+		if fs.files[f].flags&_O_APPEND != 0 {
+			off = -1
+		}
+		ret := fs.forwardFile(t, f, fsWrite, p, n, off, true)
+		ts.lock.unlock()
+		return ret, 0
+	}
+	if fs.files[f].kind == fileSocket {
+		c, ret := fs.forwardSocket(t, f, sockSend)
+		if ret == _EOK {
+			c.req.buf = uint64(p)
+			c.req.n = n
+		}
+		ts.lock.unlock()
+		return ret, 0
+	}
+	bytes := sliceForMem(p, int(n))
+	if kind := fs.files[f].kind; kind == fileSerial || kind == fileConsole && !fs.console.served {
+		// Don't hold the lock while writing to the slow serial
+		// port.
+		ts.lock.unlock()
+		output(bytes)
+		return n, 0
+	}
+	ret, woken := fs.write(f, bytes)
+	if ret == _EAGAIN && fs.files[f].flags&_O_NONBLOCK == 0 {
+		t.waitFile(f, _EPOLLOUT)
+		ts.lock.unlock()
+		return t.restartSyscall(_SYS_write, n)
+	}
+	ts.lock.unlock()
+	if woken {
+		wakeIdleCPUs()
+	}
+	return ret, 0
+}
+
+//go:nosplit
+func sysClose(d uint64) uint64 {
+	ts := &globalThreads
+	ts.lock.lock()
+	ret, woken := globalFiles.close(d)
+	ts.lock.unlock()
+	if woken {
+		wakeIdleCPUs()
+	}
+	return ret
+}
+
+//go:nosplit
+func sysPipe2(fds *[2]int32, flags uint64) uint64 {
+	if flags&^(_O_NONBLOCK|_O_CLOEXEC) != 0 {
+		return _EINVAL
+	}
+	if fds == nil || !userPtr(unsafe.Pointer(fds), unsafe.Sizeof(*fds), true) {
+		return _EFAULT
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	ret := fs.newPipe(fds, uint32(flags&_O_NONBLOCK), flags&_O_CLOEXEC != 0)
+	ts.lock.unlock()
+	return ret
+}
+
+// newPipe creates a pipe and stores its reader and writer descriptors
+// in fds.
+//go:nosplit
+func (fs *files) newPipe(fds *[2]int32, flags uint32, cloexec bool) uint64 {
+	pi := -1
+	for i := range fs.pipes {
+		if !fs.pipes[i].used {
+			pi = i
+			break
+		}
+	}
+	if pi == -1 {
+		return _ENFILE
+	}
+	r, ok := fs.newFile(filePipeReader)
+	if !ok {
+		return _ENFILE
+	}
+	w, ok := fs.newFile(filePipeWriter)
+	if !ok {
+		fs.files[r] = file{}
+		return _ENFILE
+	}
+	rfd, ok := fs.newFd(r, cloexec)
+	if !ok {
+		fs.files[r] = file{}
+		fs.files[w] = file{}
+		return _EMFILE
+	}
+	wfd, ok := fs.newFd(w, cloexec)
+	if !ok {
+		fs.fds[rfd] = fd{}
+		fs.files[r] = file{}
+		fs.files[w] = file{}
+		return _EMFILE
+	}
+	p := &fs.pipes[pi]
+	p.used = true
+	p.readerClosed = false
+	p.writerClosed = false
+	p.reader = r
+	p.writer = w
+	p.off, p.n = 0, 0
+	for _, f := range [...]int32{r, w} {
+		fs.files[f].pipe = int32(pi)
+	}
+	fs.files[r].flags = _O_RDONLY | flags
+	fs.files[w].flags = _O_WRONLY | flags
+	fds[0] = int32(rfd)
+	fds[1] = int32(wfd)
+	return _EOK
+}
+
+//go:nosplit
+func sysEventfd2(initval, flags uint64) uint64 {
+	if flags&^(_O_NONBLOCK|_O_CLOEXEC|_EFD_SEMAPHORE) != 0 {
+		return _EINVAL
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	ret := fs.newFd0(fileEventfd, flags)
+	if ret < maxFds {
+		file := &fs.files[fs.fds[ret].file]
+		file.counter = uint64(uint32(initval))
+		file.semaphore = flags&_EFD_SEMAPHORE != 0
+	}
+	ts.lock.unlock()
+	return ret
+}
+
+//go:nosplit
+func sysEpollCreate1(flags uint64) uint64 {
+	if flags&^_O_CLOEXEC != 0 {
+		return _EINVAL
+	}
+	ts := &globalThreads
+	ts.lock.lock()
+	ret := globalFiles.newFd0(fileEpoll, flags)
+	ts.lock.unlock()
+	return ret
+}
+
+// newFd0 creates a file of the given kind and returns its descriptor
+// or an errno. The _O_NONBLOCK and _O_CLOEXEC flags are honored.
+//go:nosplit
+func (fs *files) newFd0(kind fileKind, flags uint64) uint64 {
+	f, ok := fs.newFile(kind)
+	if !ok {
+		return _ENFILE
+	}
+	d, ok := fs.newFd(f, flags&_O_CLOEXEC != 0)
+	if !ok {
+		fs.files[f] = file{}
+		return _EMFILE
+	}
+	fs.files[f].flags = _O_RDWR | uint32(flags&_O_NONBLOCK)
+	return uint64(d)
+}
+
+//go:nosplit
+func sysEpollCtl(epfd, op, d uint64, ev *epollEvent) uint64 {
+	if !userPtr(unsafe.Pointer(ev), unsafe.Sizeof(*ev), false) {
+		return _EFAULT
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	ep, ok := fs.lookup(epfd)
+	if !ok {
+		ts.lock.unlock()
+		return _EBADF
+	}
+	if fs.files[ep].kind != fileEpoll || epfd == d {
+		ts.lock.unlock()
+		return _EINVAL
+	}
+	ret := fs.epollCtl(ep, op, d, ev)
+	ts.lock.unlock()
+	return ret
+}
+
+// sysEpollPwait implements epoll_pwait. The signal mask is ignored.
+// A blocked call runs again when the epoll instance is ready or, with
+// a zero timeout, when the timeout expires.
+//go:nosplit
+func sysEpollPwait(t *thread, epfd uint64, events virtualAddress, maxEvents, timeout int32) (uint64, uint64) {
+	if maxEvents <= 0 {
+		return _EINVAL, 0
+	}
+	if maxEvents > maxEpollItems {
+		// There can't be more events than registrations.
+		maxEvents = maxEpollItems
+	}
+	if !userAccessible(events, uint64(maxEvents)*uint64(unsafe.Sizeof(epollEvent{})), true) {
+		return _EFAULT, 0
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	ep, ok := fs.lookup(epfd)
+	if !ok {
+		ts.lock.unlock()
+		return _EBADF, 0
+	}
+	if fs.files[ep].kind != fileEpoll {
+		ts.lock.unlock()
+		return _EINVAL, 0
+	}
+	// Collect the events into the processor's buffer, and copy them
+	// to the user buffer after releasing the lock.
+	evs := t.cpu.epollEvents[:maxEvents]
+	if n := fs.epollCollect(ep, evs); n > 0 || timeout == 0 {
+		ts.lock.unlock()
+		copy(epollEvents(events, n), evs[:n])
+		return uint64(n), 0
+	}
+	if timeout > 0 {
+		t.sleepFor(time.Duration(timeout) * time.Millisecond)
+	}
+	t.block.conditions |= pollCondition
+	t.block.poll.epoll = ep
+	ts.lock.unlock()
+	return t.restartSyscall(_SYS_epoll_pwait, uint64(maxEvents))
+}
+
+// epollEvents returns the user buffer of n epoll events at addr.
+//go:nosplit
+func epollEvents(addr virtualAddress, n int) []epollEvent {
+	return (*[maxEpollItems]epollEvent)(unsafe.Pointer(addr))[:n:n]
+}
+
+//go:nosplit
+func sysFcntl(d, cmd, arg uint64) uint64 {
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, ok := fs.lookup(d)
+	if !ok {
+		ts.lock.unlock()
+		return _EBADF
+	}
+	ret := uint64(_EOK)
+	switch cmd {
+	case _F_DUPFD, _F_DUPFD_CLOEXEC:
+		if arg >= maxFds {
+			ret = _EINVAL
+			break
+		}
+		d, ok := fs.newFdFrom(f, int(arg), cmd == _F_DUPFD_CLOEXEC)
+		if !ok {
+			ret = _EMFILE
+			break
+		}
+		ret = uint64(d)
+	case _F_GETFD:
+		if fs.fds[d].cloexec {
+			ret = _FD_CLOEXEC
+		}
+	case _F_SETFD:
+		fs.fds[d].cloexec = arg&_FD_CLOEXEC != 0
+	case _F_GETFL:
+		ret = uint64(fs.files[f].flags)
+	case _F_SETFL:
+		const setFlags = _O_NONBLOCK | _O_APPEND
+		fs.files[f].flags = fs.files[f].flags&^setFlags | uint32(arg&setFlags)
+	default:
+		ret = _EINVAL
+	}
+	ts.lock.unlock()
+	return ret
+}
+
+// waitFile blocks t until the file f is ready for the events. It must
+// be called with globalThreads.lock held.
+//go:nosplit
+func (t *thread) waitFile(f int32, events uint32) {
+	t.block.conditions |= fileCondition
+	t.block.file.file = f
+	t.block.file.events = events
+}
+
+// restartSyscall arranges for the system call sysno to run again
+// when t resumes. The returned values replace the system call
+// number in AX and the third argument in DX.
+//go:nosplit
+func (t *thread) restartSyscall(sysno, a2 uint64) (uint64, uint64) {
+	const syscallLen = 2 // Length of the SYSCALL instruction.
+	t.ip -= syscallLen
+	return sysno, a2
+}
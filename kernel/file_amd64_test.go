@@ -0,0 +1,229 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTestPipe(t *testing.T, fs *files) (int32, int32) {
+	var fds [2]int32
+	if errno := fs.newPipe(&fds, 0, false); errno != _EOK {
+		t.Fatalf("newPipe failed: %d", int64(errno))
+	}
+	return fds[0], fds[1]
+}
+
+// testFile returns the file index of the descriptor d.
+func testFile(t *testing.T, fs *files, d int32) int32 {
+	f, ok := fs.lookup(uint64(d))
+	if !ok {
+		t.Fatalf("descriptor %d is not open", d)
+	}
+	return f
+}
+
+func TestPipe(t *testing.T) {
+	fs := new(files)
+	rfd, wfd := newTestPipe(t, fs)
+	r, w := testFile(t, fs, rfd), testFile(t, fs, wfd)
+	buf := make([]byte, 2*pipeSize)
+	if n, _ := fs.read(r, buf); n != _EAGAIN {
+		t.Errorf("read from empty pipe returned %d, want EAGAIN", int64(n))
+	}
+	if ev := fs.ready(r); ev != 0 {
+		t.Errorf("empty pipe reader ready for %#x", ev)
+	}
+	if n, _ := fs.write(w, []byte("hello")); n != 5 {
+		t.Fatalf("write returned %d, want 5", int64(n))
+	}
+	if ev := fs.ready(r); ev != _EPOLLIN {
+		t.Errorf("pipe reader ready for %#x, want EPOLLIN", ev)
+	}
+	if n, _ := fs.read(r, buf); n != 5 || !bytes.Equal(buf[:n], []byte("hello")) {
+		t.Errorf("read returned %q, want \"hello\"", buf[:n])
+	}
+	// Fill the pipe.
+	if n, _ := fs.write(w, buf); n != pipeSize {
+		t.Errorf("write returned %d, want the pipe size %d", int64(n), pipeSize)
+	}
+	if n, _ := fs.write(w, buf); n != _EAGAIN {
+		t.Errorf("write to full pipe returned %d, want EAGAIN", int64(n))
+	}
+	if ev := fs.ready(w); ev&_EPOLLOUT != 0 {
+		t.Errorf("full pipe writer ready for %#x", ev)
+	}
+	// Closing the writer leaves the data to read, followed by end of
+	// file.
+	if errno, _ := fs.close(uint64(wfd)); errno != _EOK {
+		t.Fatal(errno)
+	}
+	if ev := fs.ready(r); ev != _EPOLLIN|_EPOLLHUP {
+		t.Errorf("pipe reader ready for %#x, want EPOLLIN|EPOLLHUP", ev)
+	}
+	if n, _ := fs.read(r, buf); n != pipeSize {
+		t.Errorf("read returned %d, want %d", int64(n), pipeSize)
+	}
+	if n, _ := fs.read(r, buf); n != 0 {
+		t.Errorf("read from closed pipe returned %d, want 0", int64(n))
+	}
+}
+
+func TestPipeClosedReader(t *testing.T) {
+	fs := new(files)
+	rfd, wfd := newTestPipe(t, fs)
+	w := testFile(t, fs, wfd)
+	fs.close(uint64(rfd))
+	if ev := fs.ready(w); ev != _EPOLLOUT|_EPOLLERR {
+		t.Errorf("pipe writer ready for %#x, want EPOLLOUT|EPOLLERR", ev)
+	}
+	if n, _ := fs.write(w, []byte("x")); n != _EPIPE {
+		t.Errorf("write to pipe without reader returned %d, want EPIPE", int64(n))
+	}
+	fs.close(uint64(wfd))
+	for i := range fs.pipes {
+		if fs.pipes[i].used {
+			t.Errorf("pipe %d still in use after closing both ends", i)
+		}
+	}
+}
+
+func TestEventfd(t *testing.T) {
+	fs := new(files)
+	d := fs.newFd0(fileEventfd, 0)
+	if d >= maxFds {
+		t.Fatalf("newFd0 failed: %d", int64(d))
+	}
+	f := testFile(t, fs, int32(d))
+	val := func(v uint64) []byte {
+		b := make([]byte, 8)
+		for i := range b {
+			b[i] = byte(v >> (8 * i))
+		}
+		return b
+	}
+	if ev := fs.ready(f); ev != _EPOLLOUT {
+		t.Errorf("eventfd ready for %#x, want EPOLLOUT", ev)
+	}
+	buf := make([]byte, 8)
+	if n, _ := fs.read(f, buf); n != _EAGAIN {
+		t.Errorf("read from zero eventfd returned %d, want EAGAIN", int64(n))
+	}
+	fs.write(f, val(3))
+	fs.write(f, val(4))
+	if n, _ := fs.read(f, buf); n != 8 || !bytes.Equal(buf, val(7)) {
+		t.Errorf("read returned %v, want the sum 7", buf)
+	}
+	if n, _ := fs.read(f, buf[:4]); n != _EINVAL {
+		t.Errorf("short read returned %d, want EINVAL", int64(n))
+	}
+	if n, _ := fs.write(f, val(^uint64(0))); n != _EINVAL {
+		t.Errorf("write of the maximum value returned %d, want EINVAL", int64(n))
+	}
+	fs.write(f, val(maxEventfdValue))
+	if n, _ := fs.write(f, val(1)); n != _EAGAIN {
+		t.Errorf("overflowing write returned %d, want EAGAIN", int64(n))
+	}
+	if ev := fs.ready(f); ev != _EPOLLIN {
+		t.Errorf("full eventfd ready for %#x, want EPOLLIN", ev)
+	}
+
+	// In semaphore mode, reads decrement the counter by one.
+	fs.files[f].counter = 2
+	fs.files[f].semaphore = true
+	for i := 0; i < 2; i++ {
+		if n, _ := fs.read(f, buf); n != 8 || !bytes.Equal(buf, val(1)) {
+			t.Errorf("semaphore read returned %v, want 1", buf)
+		}
+	}
+	if n, _ := fs.read(f, buf); n != _EAGAIN {
+		t.Errorf("read from drained semaphore returned %d, want EAGAIN", int64(n))
+	}
+}
+
+func TestEpoll(t *testing.T) {
+	fs := new(files)
+	epfd := fs.newFd0(fileEpoll, 0)
+	ep := testFile(t, fs, int32(epfd))
+	rfd, wfd := newTestPipe(t, fs)
+	w := testFile(t, fs, wfd)
+	events := make([]epollEvent, 4)
+	ctl := func(op uint64, flags uint32) uint64 {
+		ev := &epollEvent{events: flags, data: [8]byte{byte(rfd)}}
+		return fs.epollCtl(ep, op, uint64(rfd), ev)
+	}
+	collect := func() int {
+		n := fs.epollCollect(ep, events)
+		for _, ev := range events[:n] {
+			if ev.events != _EPOLLIN || ev.data[0] != byte(rfd) {
+				t.Errorf("unexpected event %+v", ev)
+			}
+		}
+		return n
+	}
+	if errno := ctl(_EPOLL_CTL_ADD, _EPOLLIN); errno != _EOK {
+		t.Fatal(errno)
+	}
+	if errno := ctl(_EPOLL_CTL_ADD, _EPOLLIN); errno != _EEXIST {
+		t.Errorf("adding a file twice returned %d, want EEXIST", int64(errno))
+	}
+	if errno := fs.epollCtl(ep, _EPOLL_CTL_ADD, uint64(epfd), &epollEvent{}); errno != _EINVAL {
+		t.Errorf("adding an epoll instance returned %d, want EINVAL", int64(errno))
+	}
+	if fs.epollReady(ep) || collect() != 0 {
+		t.Error("empty pipe reported ready")
+	}
+
+	// Level triggered items are reported while the file is ready.
+	fs.write(w, []byte("x"))
+	if !fs.epollReady(ep) {
+		t.Error("epoll instance not ready after write")
+	}
+	for i := 0; i < 2; i++ {
+		if n := collect(); n != 1 {
+			t.Errorf("level triggered collect returned %d events, want 1", n)
+		}
+	}
+
+	// Edge triggered items are reported once per readiness change.
+	if errno := ctl(_EPOLL_CTL_MOD, _EPOLLIN|_EPOLLET); errno != _EOK {
+		t.Fatal(errno)
+	}
+	if n := collect(); n != 1 {
+		t.Errorf("edge triggered collect returned %d events, want 1", n)
+	}
+	if fs.epollReady(ep) || collect() != 0 {
+		t.Error("edge triggered item reported twice")
+	}
+	fs.write(w, []byte("x"))
+	if !fs.epollReady(ep) || collect() != 1 {
+		t.Error("edge triggered item not reported after write")
+	}
+
+	// One-shot items are disabled after their first event.
+	if errno := ctl(_EPOLL_CTL_MOD, _EPOLLIN|_EPOLLONESHOT); errno != _EOK {
+		t.Fatal(errno)
+	}
+	if n := collect(); n != 1 {
+		t.Errorf("one-shot collect returned %d events, want 1", n)
+	}
+	if fs.epollReady(ep) || collect() != 0 {
+		t.Error("one-shot item reported twice")
+	}
+
+	if errno := ctl(_EPOLL_CTL_DEL, 0); errno != _EOK {
+		t.Fatal(errno)
+	}
+	if errno := ctl(_EPOLL_CTL_DEL, 0); errno != _ENOENT {
+		t.Errorf("deleting a missing item returned %d, want ENOENT", int64(errno))
+	}
+	// Closing a file removes its registrations.
+	ctl(_EPOLL_CTL_ADD, _EPOLLIN)
+	fs.close(uint64(rfd))
+	for i := range fs.items {
+		if fs.items[i].used {
+			t.Errorf("item %d still registered after close", i)
+		}
+	}
+}
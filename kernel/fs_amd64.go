@@ -0,0 +1,680 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"encoding/binary"
+	"unsafe"
+)
+
+// maxMounts is the maximum number of mounted file systems.
+const maxMounts = 8
+
+const (
+	_AT_FDCWD            = -100
+	_AT_SYMLINK_NOFOLLOW = 0x100
+	_AT_EMPTY_PATH       = 0x1000
+
+	_PATH_MAX = 4096
+
+	_SEEK_SET = 0
+	_SEEK_CUR = 1
+	_SEEK_END = 2
+
+	_S_IFMT  = 0xf000
+	_S_IFIFO = 0x1000
+	_S_IFCHR = 0x2000
+	_S_IFDIR = 0x4000
+	_S_IFREG = 0x8000
+)
+
+// fileSystem is the interface implemented by file systems. Inodes
+// are numbers chosen by the file system. The methods are called with
+// globalThreads.lock held, must not block and must be nosplit.
+//
+// The nosplit checks don't follow calls through the interface.
+// Calling the file systems through a type switch instead measures
+// the deepest system call, an openat looking up a path in the
+// initramfs, at about 1.2KB of the 40KB kernel stack.
+type fileSystem interface {
+	// root returns the inode of the root directory.
+	root() uint64
+	// lookup returns the inode of the entry name in the directory
+	// dir. The name ".." refers to the parent directory.
+	lookup(dir uint64, name []byte) (uint64, uint64)
+	// readdir returns the ith entry of the directory dir.
+	readdir(dir uint64, i int) (dirent, bool)
+	// stat fills in the status of an inode, except for its device.
+	stat(ino uint64, st *stat) uint64
+	// open checks whether ino can be opened with the open flags and
+	// returns the kind of file, usually fileFS.
+	open(ino uint64, flags uint64) (fileKind, uint64)
+	// read and write transfer data at an offset of the inode.
+	read(ino uint64, p []byte, off int64) uint64
+	write(ino uint64, p []byte, off int64) uint64
+}
+
+// dirent is a directory entry.
+type dirent struct {
+	ino  uint64
+	mode uint32
+	name string
+}
+
+// mount is a file system mounted at a directory entry.
+type mount struct {
+	fs fileSystem
+	// user is set for file systems served by the program. Their
+	// fs is nil.
+	user bool
+	// parent and dir is the mount and inode of the directory
+	// containing the mount point name. The mount point need not
+	// exist in the parent directory.
+	parent int32
+	dir    uint64
+	name   string
+	// nameBuf holds the name of user mount points.
+	nameBuf [maxMountName]byte
+}
+
+// stat is struct stat.
+type stat struct {
+	dev     uint64
+	ino     uint64
+	nlink   uint64
+	mode    uint32
+	uid     uint32
+	gid     uint32
+	_       uint32
+	rdev    uint64
+	size    int64
+	blksize int64
+	blocks  int64
+	atime   timespec
+	mtime   timespec
+	ctime   timespec
+	_       [3]int64
+}
+
+var (
+	// rootFS is the root file system if there is no initramfs.
+	rootFS emptyFS
+	// initramfsFS is the root file system loaded by the boot loader.
+	initramfsFS cpioFS
+	devfs       devFS
+)
+
+//go:nosplit
+func initMounts(initramfs []byte) {
+	if unsafe.Sizeof(stat{}) != 144 {
+		fatal("initMounts: invalid stat size")
+	}
+	var root fileSystem = &rootFS
+	if len(initramfs) > 0 {
+		if initramfsFS.init(initramfs) {
+			root = &initramfsFS
+		} else {
+			outputString("initramfs: invalid cpio archive\n")
+		}
+	}
+	fs := &globalFiles
+	fs.mount(-1, 0, "", root)
+	fs.mount(0, root.root(), "dev", &devfs)
+}
+
+// mount mounts fsys at the entry name in the directory dir of
+// the mount parent. A parent of -1 replaces the root file system.
+// It must be called before the program starts, because storing
+// fsys involves pointer writes.
+//go:nosplit
+func (fs *files) mount(parent int32, dir uint64, name string, fsys fileSystem) {
+	var m *mount
+	if parent == -1 {
+		m = &fs.mounts[0]
+	} else {
+		for i := 1; i < len(fs.mounts); i++ {
+			if !fs.mounts[i].used() {
+				m = &fs.mounts[i]
+				break
+			}
+		}
+	}
+	if m == nil {
+		fatal("mount: too many mounts")
+	}
+	// Assign the fields one by one to avoid the bulk write barriers
+	// of struct assignment.
+	m.fs = fsys
+	m.parent = parent
+	m.dir = dir
+	m.name = name
+}
+
+//go:nosplit
+func (m *mount) used() bool {
+	return m.fs != nil || m.user
+}
+
+// rootOf returns the root inode of the mount m.
+//go:nosplit
+func (fs *files) rootOf(m int32) uint64 {
+	// Mount indices are valid, but checking m spares the bounds
+	// check and its deep panic call on the syscall paths.
+	if uint32(m) >= maxMounts {
+		return 0
+	}
+	mnt := &fs.mounts[m]
+	if mnt.user {
+		return userRoot
+	}
+	return mnt.fs.root()
+}
+
+// mountAt returns the mount at the entry name of the directory dir
+// in mount m, or -1.
+//go:nosplit
+func (fs *files) mountAt(m int32, dir uint64, name string) int32 {
+	for i := 1; i < len(fs.mounts); i++ {
+		mnt := &fs.mounts[i]
+		if mnt.used() && mnt.parent == m && mnt.dir == dir && mnt.name == name {
+			return int32(i)
+		}
+	}
+	return -1
+}
+
+// walk resolves path relative to the directory dir of mount m and
+// returns the mount and inode of the named file. If the path leads
+// into a user file system, walk returns the mount and directory
+// along with the remaining path for the server to resolve.
+//go:nosplit
+func (fs *files) walk(m int32, dir uint64, path []byte) (int32, uint64, []byte, uint64) {
+	if len(path) == 0 {
+		return 0, 0, nil, _ENOENT
+	}
+	if path[0] == '/' {
+		m, dir = fs.root, fs.rootOf(fs.root)
+	}
+	for len(path) > 0 {
+		rest := path
+		// Split off the next path element.
+		name := path
+		path = nil
+		for i, c := range rest {
+			if c == '/' {
+				name, path = rest[:i], rest[i+1:]
+				break
+			}
+		}
+		if len(name) == 0 || string(name) == "." {
+			continue
+		}
+		if uint32(m) >= maxMounts {
+			return 0, 0, nil, _ENOENT
+		}
+		mnt := &fs.mounts[m]
+		if string(name) == ".." && m != fs.root && dir == fs.rootOf(m) {
+			// Leave the mounted file system.
+			m, dir = mnt.parent, mnt.dir
+			continue
+		}
+		if sub := fs.mountAt(m, dir, string(name)); sub != -1 {
+			m, dir = sub, fs.rootOf(sub)
+			continue
+		}
+		if mnt.user {
+			return m, dir, rest, _EOK
+		}
+		ino, errno := mnt.fs.lookup(dir, name)
+		if errno != _EOK {
+			return 0, 0, nil, errno
+		}
+		dir = ino
+	}
+	return m, dir, nil, _EOK
+}
+
+// walkAt is like walk, but resolves relative paths from the directory
+// file descriptor dirfd.
+//go:nosplit
+func (fs *files) walkAt(dirfd int32, path []byte) (int32, uint64, []byte, uint64) {
+	m, dir := fs.root, fs.rootOf(fs.root)
+	// The working directory is always the root directory.
+	if len(path) > 0 && path[0] != '/' && dirfd != _AT_FDCWD {
+		f, ok := fs.lookup(uint64(dirfd))
+		if !ok {
+			return 0, 0, nil, _EBADF
+		}
+		if uint32(f) >= maxFiles {
+			return 0, 0, nil, _EBADF
+		}
+		file := &fs.files[f]
+		if file.kind != fileFS || !file.dir {
+			return 0, 0, nil, _ENOTDIR
+		}
+		m, dir = file.mount, file.ino
+	}
+	return fs.walk(m, dir, path)
+}
+
+// statAt fills in the status of the inode ino in mount m.
+//go:nosplit
+func (fs *files) statAt(m int32, ino uint64, st *stat) uint64 {
+	*st = stat{}
+	if errno := fs.mounts[m].fs.stat(ino, st); errno != _EOK {
+		return errno
+	}
+	st.dev = uint64(m) + 1
+	st.ino = ino
+	if st.blksize == 0 {
+		st.blksize = pageSize
+	}
+	return _EOK
+}
+
+// fstat fills in the status of the file f.
+//go:nosplit
+func (fs *files) fstat(t *thread, f int32, st *stat) uint64 {
+	file := &fs.files[f]
+	if fs.isUser(f) {
+		return fs.forwardFile(t, f, fsStat, virtualAddress(uintptr(unsafe.Pointer(st))), 0, 0, false)
+	}
+	if file.kind == fileFS {
+		return fs.statAt(file.mount, file.ino, st)
+	}
+	*st = stat{
+		ino:     uint64(f) + 1,
+		nlink:   1,
+		blksize: pageSize,
+	}
+	switch file.kind {
+	case fileConsole:
+		st.mode = _S_IFCHR | 0620
+		st.rdev = 5<<8 | 1
+	case fileSerial:
+		st.mode = _S_IFCHR | 0660
+		st.rdev = 4<<8 | 64
+	case filePipeReader, filePipeWriter:
+		st.mode = _S_IFIFO | 0600
+	case fileSocket:
+		st.mode = _S_IFSOCK | 0777
+	default:
+		// Anonymous files.
+		st.mode = 0600
+	}
+	return _EOK
+}
+
+// openat opens path relative to dirfd and returns the new file
+// descriptor.
+//go:nosplit
+func (fs *files) openat(t *thread, dirfd int32, path []byte, flags, mode uint64) uint64 {
+	m, ino, rest, errno := fs.walkAt(dirfd, path)
+	if errno == _ENOENT && flags&_O_CREAT != 0 {
+		// No kernel file system supports creating files.
+		return _EROFS
+	}
+	if errno != _EOK {
+		return errno
+	}
+	if fs.mounts[m].user {
+		c, errno := fs.forwardPath(t, m, fsOpen, ino, rest)
+		if errno == _EOK {
+			c.req.flags = flags
+			c.req.mode = mode
+			c.cloexec = flags&_O_CLOEXEC != 0
+		}
+		return errno
+	}
+	if flags&(_O_CREAT|_O_EXCL) == _O_CREAT|_O_EXCL {
+		return _EEXIST
+	}
+	st := &fs.st
+	if errno := fs.statAt(m, ino, st); errno != _EOK {
+		return errno
+	}
+	dir := st.mode&_S_IFMT == _S_IFDIR
+	if !dir && flags&_O_DIRECTORY != 0 {
+		return _ENOTDIR
+	}
+	if dir && flags&_O_ACCMODE != _O_RDONLY {
+		return _EISDIR
+	}
+	kind, errno := fs.mounts[m].fs.open(ino, flags)
+	if errno != _EOK {
+		return errno
+	}
+	f, ok := fs.newFile(kind)
+	if !ok {
+		return _ENFILE
+	}
+	nf := &fs.files[f]
+	nf.flags = uint32(flags & (_O_ACCMODE | _O_NONBLOCK | _O_APPEND))
+	nf.dir = dir
+	nf.mount = m
+	nf.ino = ino
+	d, ok := fs.newFd(f, flags&_O_CLOEXEC != 0)
+	if !ok {
+		fs.files[f] = file{}
+		return _EMFILE
+	}
+	return uint64(d)
+}
+
+// getdents fills the n bytes at p with the directory entries of the
+// file f from its offset onwards. The offset is the index of the next
+// entry.
+//go:nosplit
+func (fs *files) getdents(t *thread, f int32, addr virtualAddress, size uint64) uint64 {
+	file := &fs.files[f]
+	if file.kind != fileFS || !file.dir {
+		return _ENOTDIR
+	}
+	if fs.isUser(f) {
+		return fs.forwardFile(t, f, fsReaddir, addr, size, file.off, true)
+	}
+	p := sliceForMem(addr, int(size))
+	n := 0
+	for {
+		ent, shadowed, ok := fs.dirent(file.mount, file.ino, int(file.off))
+		if !ok {
+			break
+		}
+		if !shadowed {
+			typ := uint8(ent.mode & _S_IFMT >> 12)
+			c := putDirent(p[n:], ent.ino, file.off+1, typ, ent.name)
+			if c == 0 {
+				if n == 0 {
+					return _EINVAL
+				}
+				break
+			}
+			n += c
+		}
+		file.off++
+	}
+	return uint64(n)
+}
+
+// dirent returns the ith entry of the directory dir in mount m. The
+// mount points in the directory come first. Entries hidden by mount
+// points are reported as shadowed.
+//go:nosplit
+func (fs *files) dirent(m int32, dir uint64, i int) (dirent, bool, bool) {
+	for j := 1; j < len(fs.mounts); j++ {
+		mnt := &fs.mounts[j]
+		if !mnt.used() || mnt.parent != m || mnt.dir != dir {
+			continue
+		}
+		if i == 0 {
+			return dirent{ino: fs.rootOf(int32(j)), mode: _S_IFDIR, name: mnt.name}, false, true
+		}
+		i--
+	}
+	ent, ok := fs.mounts[m].fs.readdir(dir, i)
+	if !ok {
+		return dirent{}, false, false
+	}
+	return ent, fs.mountAt(m, dir, ent.name) != -1, true
+}
+
+// putDirent writes a struct linux_dirent64 to p and returns its
+// length, or 0 if p is too small.
+//go:nosplit
+func putDirent(p []byte, ino uint64, off int64, typ uint8, name string) int {
+	const hdrSize = 19
+	n := (hdrSize + len(name) + 1 + 7) &^ 7
+	if n > len(p) {
+		return 0
+	}
+	bo := binary.LittleEndian
+	bo.PutUint64(p[0:], ino)
+	bo.PutUint64(p[8:], uint64(off))
+	bo.PutUint16(p[16:], uint16(n))
+	p[18] = typ
+	copy(p[hdrSize:], name)
+	for i := hdrSize + len(name); i < n; i++ {
+		p[i] = 0
+	}
+	return n
+}
+
+// seek implements lseek for the file f.
+//go:nosplit
+func (fs *files) seek(t *thread, f int32, off int64, whence uint64) uint64 {
+	file := &fs.files[f]
+	if file.kind != fileFS {
+		return _ESPIPE
+	}
+	switch whence {
+	case _SEEK_SET:
+	case _SEEK_CUR:
+		off += file.off
+	case _SEEK_END:
+		if fs.isUser(f) {
+			return fs.forwardFile(t, f, fsSize, 0, 0, off, false)
+		}
+		st := &fs.st
+		if errno := fs.statAt(file.mount, file.ino, st); errno != _EOK {
+			return errno
+		}
+		off += st.size
+	default:
+		return _EINVAL
+	}
+	if off < 0 {
+		return _EINVAL
+	}
+	file.off = off
+	return uint64(off)
+}
+
+//go:nosplit
+func sysOpenat(t *thread, dirfd int32, path virtualAddress, flags, mode uint64) uint64 {
+	p, errno := userPath(path)
+	if errno != _EOK {
+		return errno
+	}
+	ts := &globalThreads
+	ts.lock.lock()
+	ret := globalFiles.openat(t, dirfd, p, flags, mode)
+	ts.lock.unlock()
+	return ret
+}
+
+//go:nosplit
+func sysFstat(t *thread, d uint64, st *stat) uint64 {
+	if st == nil || !userPtr(unsafe.Pointer(st), unsafe.Sizeof(*st), true) {
+		return _EFAULT
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, ok := fs.lookup(d)
+	if !ok {
+		ts.lock.unlock()
+		return _EBADF
+	}
+	ret := fs.fstat(t, f, st)
+	ts.lock.unlock()
+	return ret
+}
+
+// sysFstatat implements newfstatat. There are no symbolic links, so
+// _AT_SYMLINK_NOFOLLOW is ignored.
+//go:nosplit
+func sysFstatat(t *thread, dirfd int32, path virtualAddress, st *stat, flags uint64) uint64 {
+	if flags&^(_AT_SYMLINK_NOFOLLOW|_AT_EMPTY_PATH) != 0 {
+		return _EINVAL
+	}
+	if st == nil || !userPtr(unsafe.Pointer(st), unsafe.Sizeof(*st), true) {
+		return _EFAULT
+	}
+	p, errno := userPath(path)
+	if errno != _EOK {
+		return errno
+	}
+	if len(p) == 0 && flags&_AT_EMPTY_PATH != 0 {
+		return sysFstat(t, uint64(dirfd), st)
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	m, ino, rest, errno := fs.walkAt(dirfd, p)
+	switch {
+	case errno == _EOK && fs.mounts[m].user:
+		var c *fsCall
+		c, errno = fs.forwardPath(t, m, fsStat, ino, rest)
+		if errno == _EOK {
+			c.req.buf = uint64(uintptr(unsafe.Pointer(st)))
+		}
+	case errno == _EOK:
+		errno = fs.statAt(m, ino, st)
+	}
+	ts.lock.unlock()
+	return errno
+}
+
+//go:nosplit
+func sysLseek(t *thread, d uint64, off int64, whence uint64) uint64 {
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, ok := fs.lookup(d)
+	if !ok {
+		ts.lock.unlock()
+		return _EBADF
+	}
+	ret := fs.seek(t, f, off, whence)
+	ts.lock.unlock()
+	return ret
+}
+
+//go:nosplit
+func sysGetdents64(t *thread, d uint64, p virtualAddress, n uint64) uint64 {
+	if !userAccessible(p, n, true) {
+		return _EFAULT
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, ok := fs.lookup(d)
+	if !ok {
+		ts.lock.unlock()
+		return _EBADF
+	}
+	ret := fs.getdents(t, f, p, n)
+	ts.lock.unlock()
+	return ret
+}
+
+// sysPread implements pread64 and, if write is set, pwrite64.
+//go:nosplit
+func sysPread(t *thread, d uint64, p virtualAddress, n uint64, off int64, write bool) uint64 {
+	if off < 0 {
+		return _EINVAL
+	}
+	// Reading from the file writes to p.
+	if !userAccessible(p, n, !write) {
+		return _EFAULT
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, ok := fs.lookup(d)
+	if !ok {
+		ts.lock.unlock()
+		return _EBADF
+	}
+	file := &fs.files[f]
+	mode := file.flags & _O_ACCMODE
+	var ret uint64
+	switch {
+	case file.kind != fileFS:
+		ret = _ESPIPE
+	case file.dir:
+		ret = _EISDIR
+	case write && mode == _O_RDONLY, !write && mode == _O_WRONLY:
+		ret = _EBADF
+	case fs.isUser(f) && write:
+		ret = fs.forwardFile(t, f, fsWrite, p, n, off, false)
+	case fs.isUser(f):
+		ret = fs.forwardFile(t, f, fsRead, p, n, off, false)
+	case write:
+		ret = fs.mounts[file.mount].fs.write(file.ino, sliceForMem(p, int(n)), off)
+	default:
+		ret = fs.mounts[file.mount].fs.read(file.ino, sliceForMem(p, int(n)), off)
+	}
+	ts.lock.unlock()
+	return ret
+}
+
+// userPath returns the NUL terminated path at addr.
+//go:nosplit
+func userPath(addr virtualAddress) ([]byte, uint64) {
+	if addr == 0 {
+		return nil, _EFAULT
+	}
+	// Check every page the path reaches, because the path may end
+	// before the end of its memory range.
+	for a := addr; a < addr+_PATH_MAX; a++ {
+		if (a == addr || a&(pageSize-1) == 0) && !userAccessible(a, 1, false) {
+			return nil, _EFAULT
+		}
+		if *(*byte)(unsafe.Pointer(a)) == 0 {
+			return sliceForMem(addr, int(a-addr)), _EOK
+		}
+	}
+	return nil, _ENAMETOOLONG
+}
+
+// isErrno reports whether the system call result v is an errno.
+//go:nosplit
+func isErrno(v uint64) bool {
+	return v > ^uint64(4095)
+}
+
+// emptyFS is a file system with an empty root directory.
+type emptyFS struct{}
+
+const emptyRoot = 1
+
+//go:nosplit
+func (*emptyFS) root() uint64 {
+	return emptyRoot
+}
+
+//go:nosplit
+func (*emptyFS) lookup(dir uint64, name []byte) (uint64, uint64) {
+	if string(name) == ".." {
+		return emptyRoot, _EOK
+	}
+	return 0, _ENOENT
+}
+
+//go:nosplit
+func (*emptyFS) readdir(dir uint64, i int) (dirent, bool) {
+	return dirent{}, false
+}
+
+//go:nosplit
+func (*emptyFS) stat(ino uint64, st *stat) uint64 {
+	st.mode = _S_IFDIR | 0555
+	st.nlink = 2
+	return _EOK
+}
+
+//go:nosplit
+func (*emptyFS) open(ino uint64, flags uint64) (fileKind, uint64) {
+	return fileFS, _EOK
+}
+
+//go:nosplit
+func (*emptyFS) read(ino uint64, p []byte, off int64) uint64 {
+	return _EISDIR
+}
+
+//go:nosplit
+func (*emptyFS) write(ino uint64, p []byte, off int64) uint64 {
+	return _EISDIR
+}
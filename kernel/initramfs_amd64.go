@@ -0,0 +1,335 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import "unsafe"
+
+// cpioFS is a read-only file system backed by an initramfs archive
+// in the cpio "newc" format. The inode of an entry is its offset in
+// the archive plus cpioFirstIno; cpioRoot is the root directory.
+type cpioFS struct {
+	archive []byte
+	// rootEntry is the inode of the "." entry, or 0.
+	rootEntry uint64
+}
+
+const (
+	cpioRoot     = 1
+	cpioFirstIno = 2
+
+	cpioHeaderSize = 110
+	cpioTrailer    = "TRAILER!!!"
+)
+
+// cpioEntry is a parsed archive entry.
+type cpioEntry struct {
+	mode  uint32
+	uid   uint32
+	gid   uint32
+	nlink uint64
+	mtime int64
+	// nameOff and nameLen locate the path of the entry without
+	// leading "./" or "/". The name of the root directory is empty.
+	nameOff, nameLen int
+	// dataOff and size locate the file data.
+	dataOff, size int
+	// next is the offset of the following entry.
+	next int
+}
+
+// init validates the archive and reports whether it is usable.
+//go:nosplit
+func (c *cpioFS) init(archive []byte) bool {
+	root, ok := validateCPIO(archive)
+	if !ok {
+		return false
+	}
+	// Store the archive only after validating it, to keep the write
+	// barriers out of the calls below validateCPIO.
+	c.archive = archive
+	c.rootEntry = root
+	return true
+}
+
+// validateCPIO validates an archive and returns the inode of its
+// "." entry, or 0.
+//go:nosplit
+func validateCPIO(archive []byte) (uint64, bool) {
+	c := cpioFS{archive: archive}
+	var e cpioEntry
+	for off := 0; ; {
+		if !c.entry(off, &e) {
+			return 0, false
+		}
+		if string(c.name(&e)) == cpioTrailer {
+			return c.rootEntry, true
+		}
+		if e.nameLen == 0 {
+			c.rootEntry = uint64(off + cpioFirstIno)
+		}
+		off = e.next
+	}
+}
+
+// name returns the path of an entry.
+//go:nosplit
+func (c *cpioFS) name(e *cpioEntry) []byte {
+	return c.slice(e.nameOff, e.nameLen)
+}
+
+// data returns the contents of an entry.
+//go:nosplit
+func (c *cpioFS) data(e *cpioEntry) []byte {
+	return c.slice(e.dataOff, e.size)
+}
+
+// slice returns n bytes of the archive at off. The range is checked
+// by entry, but checking it here too spares the bounds checks and
+// their deep panic calls.
+//go:nosplit
+func (c *cpioFS) slice(off, n int) []byte {
+	start, end := uint(off), uint(off+n)
+	if start > end || end > uint(len(c.archive)) {
+		return nil
+	}
+	return c.archive[start:end]
+}
+
+// entry parses the archive entry at off into e.
+//go:nosplit
+func (c *cpioFS) entry(off int, e *cpioEntry) bool {
+	a := c.archive
+	if off < 0 || off >= len(a) || len(a)-off < cpioHeaderSize {
+		return false
+	}
+	// Address the header through a pointer, to avoid the bounds
+	// checks of slicing it.
+	hdr := (*[cpioHeaderSize]byte)(unsafe.Pointer(&a[off]))
+	if string(hdr[:6]) != "070701" && string(hdr[:6]) != "070702" {
+		return false
+	}
+	// Validate all fields, including the unused ones.
+	for i := 6; i < cpioHeaderSize; i++ {
+		if _, ok := hexDigit(hdr[i]); !ok {
+			return false
+		}
+	}
+	e.mode = cpioField(hdr, 1)
+	e.uid = cpioField(hdr, 2)
+	e.gid = cpioField(hdr, 3)
+	e.nlink = uint64(cpioField(hdr, 4))
+	e.mtime = int64(cpioField(hdr, 5))
+	size := int(cpioField(hdr, 6))
+	nameSize := int(cpioField(hdr, 11))
+	nameStart := off + cpioHeaderSize
+	// The name includes a terminating NUL.
+	if nameSize < 1 || len(a)-nameStart < nameSize {
+		return false
+	}
+	e.nameOff = nameStart
+	e.nameLen = nameSize - 1
+	dataStart := align4(nameStart + nameSize)
+	if dataStart > len(a) || len(a)-dataStart < size {
+		return false
+	}
+	e.dataOff = dataStart
+	e.size = size
+	e.next = align4(dataStart + size)
+	// Normalize "./name", "/name" and "." to "name" and "".
+	name := c.name(e)
+	switch {
+	case string(name) == ".":
+		e.nameLen = 0
+	case len(name) >= 2 && name[0] == '.' && name[1] == '/':
+		e.nameOff += 2
+		e.nameLen -= 2
+	case len(name) >= 1 && name[0] == '/':
+		e.nameOff++
+		e.nameLen--
+	}
+	return true
+}
+
+// lookupEntry parses the entry for the inode ino into e.
+//go:nosplit
+func (c *cpioFS) lookupEntry(ino uint64, e *cpioEntry) bool {
+	if ino == cpioRoot {
+		if c.rootEntry != 0 {
+			return c.entry(int(c.rootEntry-cpioFirstIno), e)
+		}
+		// Synthesize a root directory for archives without one.
+		e.mode = _S_IFDIR | 0555
+		e.nlink = 2
+		return true
+	}
+	if ino < cpioFirstIno || ino-cpioFirstIno >= uint64(len(c.archive)) {
+		return false
+	}
+	return c.entry(int(ino-cpioFirstIno), e)
+}
+
+// child returns the name of the entry path relative to dir, if path
+// is an immediate child of dir.
+//go:nosplit
+func cpioChild(dir, path []byte) ([]byte, bool) {
+	if len(path) == 0 {
+		return nil, false
+	}
+	if len(dir) > 0 {
+		if len(path) <= len(dir)+1 || string(path[:len(dir)]) != string(dir) || path[len(dir)] != '/' {
+			return nil, false
+		}
+		path = path[len(dir)+1:]
+	}
+	for _, b := range path {
+		if b == '/' {
+			return nil, false
+		}
+	}
+	return path, true
+}
+
+//go:nosplit
+func (*cpioFS) root() uint64 {
+	return cpioRoot
+}
+
+//go:nosplit
+func (c *cpioFS) lookup(dir uint64, name []byte) (uint64, uint64) {
+	var d, e cpioEntry
+	if !c.lookupEntry(dir, &d) {
+		return 0, _ENOENT
+	}
+	if d.mode&_S_IFMT != _S_IFDIR {
+		return 0, _ENOTDIR
+	}
+	var parent []byte
+	if string(name) == ".." {
+		if dir == cpioRoot {
+			return cpioRoot, _EOK
+		}
+		parent = c.name(&d)
+		for len(parent) > 0 && parent[len(parent)-1] != '/' {
+			parent = parent[:len(parent)-1]
+		}
+		if len(parent) == 0 {
+			return cpioRoot, _EOK
+		}
+		parent = parent[:len(parent)-1]
+	}
+	for off := 0; ; {
+		if !c.entry(off, &e) || string(c.name(&e)) == cpioTrailer {
+			return 0, _ENOENT
+		}
+		if parent != nil {
+			if string(c.name(&e)) == string(parent) {
+				return uint64(off + cpioFirstIno), _EOK
+			}
+		} else if n, ok := cpioChild(c.name(&d), c.name(&e)); ok && string(n) == string(name) {
+			return uint64(off + cpioFirstIno), _EOK
+		}
+		off = e.next
+	}
+}
+
+//go:nosplit
+func (c *cpioFS) readdir(dir uint64, i int) (dirent, bool) {
+	var d, e cpioEntry
+	if !c.lookupEntry(dir, &d) || d.mode&_S_IFMT != _S_IFDIR {
+		return dirent{}, false
+	}
+	for off := 0; ; {
+		if !c.entry(off, &e) || string(c.name(&e)) == cpioTrailer {
+			return dirent{}, false
+		}
+		if n, ok := cpioChild(c.name(&d), c.name(&e)); ok {
+			if i == 0 {
+				return dirent{
+					ino:  uint64(off + cpioFirstIno),
+					mode: e.mode,
+					// The archive is never freed.
+					name: *(*string)(unsafe.Pointer(&n)),
+				}, true
+			}
+			i--
+		}
+		off = e.next
+	}
+}
+
+//go:nosplit
+func (c *cpioFS) stat(ino uint64, st *stat) uint64 {
+	var e cpioEntry
+	if !c.lookupEntry(ino, &e) {
+		return _ENOENT
+	}
+	st.mode = e.mode
+	st.uid = e.uid
+	st.gid = e.gid
+	st.nlink = e.nlink
+	st.size = int64(e.size)
+	st.blocks = (st.size + 511) / 512
+	st.mtime.seconds = e.mtime
+	st.atime = st.mtime
+	st.ctime = st.mtime
+	return _EOK
+}
+
+//go:nosplit
+func (*cpioFS) open(ino uint64, flags uint64) (fileKind, uint64) {
+	if flags&_O_ACCMODE != _O_RDONLY || flags&_O_TRUNC != 0 {
+		return fileNone, _EROFS
+	}
+	return fileFS, _EOK
+}
+
+//go:nosplit
+func (c *cpioFS) read(ino uint64, p []byte, off int64) uint64 {
+	var e cpioEntry
+	if !c.lookupEntry(ino, &e) {
+		return _ENOENT
+	}
+	if e.mode&_S_IFMT == _S_IFDIR {
+		return _EISDIR
+	}
+	if off >= int64(e.size) {
+		return 0
+	}
+	return uint64(copy(p, c.data(&e)[off:]))
+}
+
+//go:nosplit
+func (*cpioFS) write(ino uint64, p []byte, off int64) uint64 {
+	return _EROFS
+}
+
+// cpioField returns the ith 8 digit hexadecimal field of a validated
+// header.
+//go:nosplit
+func cpioField(hdr *[cpioHeaderSize]byte, i int) uint32 {
+	var v uint32
+	start := 6 + uint(i)*8
+	for j := start; j < start+8 && j < cpioHeaderSize; j++ {
+		d, _ := hexDigit(hdr[j])
+		v = v<<4 | uint32(d)
+	}
+	return v
+}
+
+//go:nosplit
+func hexDigit(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+//go:nosplit
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
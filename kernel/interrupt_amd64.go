@@ -13,8 +13,10 @@ const (
 
 const (
 	intDivideError            intVector = 0x0
+	intInvalidOpcode          intVector = 0x6
 	intGeneralProtectionFault intVector = 0xd
 	intPageFault              intVector = 0xe
+	intAlignmentCheck         intVector = 0x11
 	intSSE                    intVector = 0x13
 
 	apic
@@ -24,10 +26,40 @@ const (
 	firstAvailableInterrupt intVector = 0x20 + iota
 	intAPICError
 	intTimer
+	// intWakeup is the vector of the inter-processor interrupt
+	// for waking up idle processors.
+	intWakeup
+	// intTLBFlush is the vector of the inter-processor interrupt
+	// for invalidating TLB entries.
+	intTLBFlush
+	// intSerial is the vector of the serial port interrupt.
+	intSerial
 	intFirstUser
 
-	intLastUser           = intFirstUser + 10
-	intSpurious intVector = 0xff
+	intLastUser = intFirstUser + 10
+	// intTraceback is the vector of the interrupt raised by fatal
+	// errors to print their stack traces. It must match the vector
+	// of raiseTraceback.
+	intTraceback intVector = 0xfe
+	intSpurious  intVector = 0xff
+)
+
+// Local APIC registers.
+const (
+	apicRegID           = 0x020
+	apicRegEOI          = 0x0b0
+	apicRegSpurious     = 0x0f0
+	apicRegICRLow       = 0x300
+	apicRegICRHigh      = 0x310
+	apicRegLVTTimer     = 0x320
+	apicRegLVTLINT0     = 0x350
+	apicRegLVTLINT1     = 0x360
+	apicRegLVTError     = 0x370
+	apicRegTimerInitial = 0x380
+	apicRegTimerCurrent = 0x390
+	apicRegTimerDivide  = 0x3e0
+
+	apicIntMasked = 1 << 17
 )
 
 var pendingInterrupts [intLastUser - intFirstUser]bool
@@ -54,7 +86,7 @@ func initAPIC() error {
 	// Enable APIC.
 	wrmsr(_IA32_APIC_BASE, apicBaseMSR|1<<11)
 
-	apicEOI = (*uint32)(unsafe.Pointer(apicBase + 0xb0))
+	apicEOI = (*uint32)(unsafe.Pointer(apicBase + apicRegEOI))
 
 	// Map the APIC page.
 	flags := pageFlagWritable | pageFlagNX | pageFlagNoCache
@@ -63,26 +95,51 @@ func initAPIC() error {
 		return err
 	}
 
-	globalIDT.install(intDivideError, ring0, istGeneric, divFault)
+	globalIDT.install(intDivideError, ring0, istGeneric, divFaultTrampoline)
+	globalIDT.install(intInvalidOpcode, ring0, istGeneric, invalidOpcodeTrampoline)
 	globalIDT.install(intGeneralProtectionFault, ring0, istGeneric, generalProtectionFaultTrampoline)
-	globalIDT.install(intSSE, ring0, istGeneric, sseException)
+	globalIDT.install(intAlignmentCheck, ring0, istGeneric, alignmentCheckTrampoline)
+	globalIDT.install(intSSE, ring0, istGeneric, sseExceptionTrampoline)
 	globalIDT.install(intPageFault, ring0, istPageFault, pageFaultTrampoline)
 
 	globalIDT.install(intAPICError, ring0, istGeneric, unknownInterruptTrampoline)
 	globalIDT.install(intSpurious, ring0, istGeneric, unknownInterruptTrampoline)
+	// The wakeup interrupt only needs to interrupt the halted
+	// processor, and the timer handler does just that.
+	globalIDT.install(intWakeup, ring0, istGeneric, timerTrampoline)
+	globalIDT.install(intTLBFlush, ring0, istGeneric, tlbFlushTrampoline)
+	globalIDT.install(intSerial, ring0, istGeneric, serialTrampoline)
+	globalIDT.install(intTraceback, ring0, istTraceback, tracebackTrampoline)
 	installUserHandlers()
 
 	reloadIDT()
+	atomic.StoreUint32(&tracebackReady, 1)
+	initLocalAPIC()
+	cpus[0].apicID = apicID()
+
+	return nil
+}
+
+// initLocalAPIC configures the local APIC of the current
+// processor.
+//go:nosplit
+func initLocalAPIC() {
 	// Mask LINT0-1.
-	const apicIntMasked = 1 << 17
-	apicWrite(0x350 /* LVT LINT0*/, apicIntMasked)
-	apicWrite(0x360 /* LVT LINT1*/, apicIntMasked)
+	apicWrite(apicRegLVTLINT0, apicIntMasked)
+	apicWrite(apicRegLVTLINT1, apicIntMasked)
 	// Setup error interrupt.
-	apicWrite(0x370 /* LVT Error*/, uint32(intAPICError))
+	apicWrite(apicRegLVTError, uint32(intAPICError))
+	// Mask the APIC timer, and count at the bus frequency.
+	apicWrite(apicRegLVTTimer, apicIntMasked)
+	apicWrite(apicRegTimerDivide, 0xb)
 	// Setup spurious interrupt handler and enable interrupts.
-	apicWrite(0x0f0, 0x100|uint32(intSpurious))
+	apicWrite(apicRegSpurious, 0x100|uint32(intSpurious))
+}
 
-	return nil
+// apicID returns the local APIC ID of the current processor.
+//go:nosplit
+func apicID() uint32 {
+	return apicRead(apicRegID) >> 24
 }
 
 //go:nosplit
@@ -103,6 +160,50 @@ func sseException() {
 	fatal("SSE exception")
 }
 
+//go:nosplit
+func invalidOpcode() {
+	fatal("invalid opcode")
+}
+
+//go:nosplit
+func alignmentCheck() {
+	fatal("alignment check")
+}
+
+// userFault is called for processor exceptions in user mode. It
+// raises the corresponding signal in the faulting thread t.
+//go:nosplit
+func userFault(t *thread, vector intVector, errCode, addr uint64) {
+	switch vector {
+	case intPageFault:
+		code := int32(_SEGV_ACCERR)
+		if errCode&faultFlagPresent == 0 {
+			if err := faultPage(virtualAddress(addr), errCode); err == nil {
+				resumeThread()
+			}
+			if !isMapped(virtualAddress(addr)) {
+				code = _SEGV_MAPERR
+			}
+		}
+		t.forceSignal(_SIGSEGV, code, addr, vector, errCode)
+	case intGeneralProtectionFault:
+		// The fault address is not known.
+		t.forceSignal(_SIGSEGV, _SI_KERNEL, 0, vector, errCode)
+	case intAlignmentCheck:
+		t.forceSignal(_SIGBUS, _BUS_ADRALN, t.ip, vector, errCode)
+	case intInvalidOpcode:
+		t.forceSignal(_SIGILL, _ILL_ILLOPN, t.ip, vector, errCode)
+	case intDivideError:
+		t.forceSignal(_SIGFPE, _FPE_INTDIV, t.ip, vector, errCode)
+	case intSSE:
+		t.forceSignal(_SIGFPE, t.sseExceptionCode(), t.ip, vector, errCode)
+	default:
+		fatal("userFault: unknown exception")
+	}
+	t.block = blockCondition{}
+	globalThreads.schedule(t.cpu, t)
+}
+
 //go:nosplit
 func installUserHandlers() {
 	vector := intFirstUser
@@ -153,7 +254,11 @@ func maskPIC() {
 
 //go:nosplit
 func userInterrupt(vector uint64) {
+	ts := &globalThreads
+	ts.lock.lock()
 	pendingInterrupts[vector] = true
+	ts.lock.unlock()
+	wakeIdleCPUs()
 }
 
 //go:nosplit
@@ -163,6 +268,11 @@ func unknownInterrupt() {
 
 func unknownInterruptTrampoline()
 
+func divFaultTrampoline()
+func invalidOpcodeTrampoline()
+func alignmentCheckTrampoline()
+func sseExceptionTrampoline()
+
 func userInterruptTrampoline0()
 func userInterruptTrampoline1()
 func userInterruptTrampoline2()
@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"eliasnaur.com/unik/kernel/acpi"
+)
+
+// I/O APIC registers, accessed indirectly through the register select
+// and window registers.
+const (
+	ioapicRegSelect = 0x00
+	ioapicRegWindow = 0x10
+
+	ioapicRegVersion     = 0x01
+	ioapicRegRedirection = 0x10
+
+	// Redirection entry flags.
+	ioapicActiveLow = 1 << 13
+	ioapicLevel     = 1 << 15
+	ioapicMasked    = 1 << 16
+
+	// defaultIOAPICAddr is the address of the I/O APIC on systems
+	// without ACPI tables.
+	defaultIOAPICAddr = 0xfec00000
+)
+
+// ACPI MPS INTI flags for the polarity and trigger mode of
+// interrupts.
+const (
+	mpsPolarityMask = 0b11
+	mpsActiveLow    = 0b11
+	mpsTriggerMask  = 0b1100
+	mpsLevel        = 0b1100
+)
+
+// ioAPIC is an I/O APIC, identity mapped.
+type ioAPIC struct {
+	base virtualAddress
+	// gsiBase is the first global system interrupt of the I/O APIC
+	// and entries the number of interrupts.
+	gsiBase uint32
+	entries uint32
+}
+
+var (
+	ioAPICs  [acpi.MaxIOAPICs]ioAPIC
+	nioAPICs int
+)
+
+// initIOAPIC maps the I/O APICs and masks their interrupts.
+//go:nosplit
+func initIOAPIC() error {
+	if acpiTables.RSDP == 0 {
+		return addIOAPIC(defaultIOAPICAddr, 0)
+	}
+	for _, a := range acpiTables.MADT.IOAPICs() {
+		if err := addIOAPIC(a.Addr, a.GSIBase); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//go:nosplit
+func addIOAPIC(addr uint64, gsiBase uint32) error {
+	base := virtualAddress(addr)
+	flags := pageFlagWritable | pageFlagNX | pageFlagNoCache
+	globalMap.mustAddRange(base, base+pageSize, flags)
+	if err := mmapAligned(&globalMem, globalPT, base, base+pageSize, physicalAddress(base), flags); err != nil {
+		return err
+	}
+	a := &ioAPICs[nioAPICs]
+	*a = ioAPIC{base: base, gsiBase: gsiBase}
+	// Missing devices read as all ones.
+	ver := a.read(ioapicRegVersion)
+	if ver == ^uint32(0) {
+		return nil
+	}
+	a.entries = (ver>>16)&0xff + 1
+	for i := uint32(0); i < a.entries; i++ {
+		a.write(ioapicRegRedirection+2*i, ioapicMasked)
+	}
+	nioAPICs++
+	return nil
+}
+
+// routeISAInterrupt routes the ISA interrupt irq to vector on the
+// boot processor. It reports whether an I/O APIC handles the
+// interrupt.
+//go:nosplit
+func routeISAInterrupt(irq uint8, vector intVector) bool {
+	gsi, mps := acpiTables.MADT.ISAInterrupt(irq)
+	// ISA interrupts default to active high, edge triggered.
+	entry := uint32(vector)
+	if mps&mpsPolarityMask == mpsActiveLow {
+		entry |= ioapicActiveLow
+	}
+	if mps&mpsTriggerMask == mpsLevel {
+		entry |= ioapicLevel
+	}
+	for i := 0; i < nioAPICs; i++ {
+		a := &ioAPICs[i]
+		if gsi < a.gsiBase || gsi-a.gsiBase >= a.entries {
+			continue
+		}
+		reg := ioapicRegRedirection + 2*(gsi-a.gsiBase)
+		a.write(reg+1, cpus[0].apicID<<24)
+		a.write(reg, entry)
+		return true
+	}
+	return false
+}
+
+//go:nosplit
+func (a *ioAPIC) read(reg uint32) uint32 {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(a.base+ioapicRegSelect)), reg)
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(a.base + ioapicRegWindow)))
+}
+
+//go:nosplit
+func (a *ioAPIC) write(reg, val uint32) {
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(a.base+ioapicRegSelect)), reg)
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(a.base+ioapicRegWindow)), val)
+}
@@ -15,6 +15,7 @@ const (
 	_MSR_FS_BASE   = 0xc0000100
 
 	_EFER_SCE = 1 << 0  // Enable SYSCALL.
+	_EFER_LME = 1 << 8  // Enable long mode.
 	_EFER_NXE = 1 << 11 // Enable no-execute page bit.
 
 	_XCR0_FPU = 1 << 0
@@ -28,6 +29,9 @@ const (
 	_CR4_OSXMMEXCPT = 1 << 10
 	_CR4_FSGSBASE   = 1 << 16
 	_CR4_OSXSAVE    = 1 << 18
+
+	// cr4Flags are the CR4 flags set on every processor.
+	cr4Flags = _CR4_PAE | _CR4_PSE | _CR4_DE | _CR4_FXSTOR | _CR4_OSXMMEXCPT
 )
 
 type stack [10 * pageSize]byte
@@ -37,7 +41,6 @@ var (
 	kstack stack
 
 	fpuContextSize uint64
-	kstackTop      uint64
 )
 
 //go:nosplit
@@ -46,10 +49,19 @@ func kernelStackTop() uint64 {
 }
 
 //go:nosplit
-func runKernel(mmapSize, descSize, kernelImageSize uint64, mmapAddr, kernelImage *byte) {
+func runKernel(mmapSize, descSize, kernelImageSize uint64, mmapAddr, kernelImage *byte, rsdp, initramfsAddr, initramfsSize uint64) {
 	mmap := (*(*[1 << 30]byte)(unsafe.Pointer(mmapAddr)))[:mmapSize:mmapSize]
 	img := (*(*[1 << 30]byte)(unsafe.Pointer(kernelImage)))[:kernelImageSize:kernelImageSize]
-	if err := initKernel(descSize, mmap, img); err != nil {
+	efiMap := efiMemoryMap{mmap: mmap, stride: int(descSize)}
+	setCR4Reg(cr4Flags)
+	initBootThread()
+	// Set up memory here and not in initKernel, to keep the frame
+	// of initKernel off the deep call chains below initMemory.
+	if err := initMemory(&efiMap, &img); err != nil {
+		fatalError(err)
+	}
+	initSymbols(img)
+	if err := initKernel(efiMap, physicalAddress(rsdp), physicalAddress(initramfsAddr), initramfsSize); err != nil {
 		fatalError(err)
 	}
 	if err := runGo(); err != nil {
@@ -58,19 +70,26 @@ func runKernel(mmapSize, descSize, kernelImageSize uint64, mmapAddr, kernelImage
 	fatal("runKernel: runGo returned")
 }
 
+// initBootThread sets up the boot processor and runs thread0 on it.
 //go:nosplit
-func initKernel(descSize uint64, mmap, kernelImage []byte) error {
-	kstackTop = kernelStackTop()
-	efiMap := efiMemoryMap{mmap: mmap, stride: int(descSize)}
-	setCR4Reg(_CR4_PAE | _CR4_PSE | _CR4_DE | _CR4_FXSTOR | _CR4_OSXMMEXCPT)
-	loadGDT()
-	kernelThread.self = &kernelThread
+func initBootThread() {
+	bsp := initBootCPU()
+	bsp.loadGDT()
 	thread0.self = &thread0
-	thread0.makeCurrent()
-	if err := initMemory(efiMap, kernelImage); err != nil {
+	thread0.makeCurrent(bsp)
+}
+
+//go:nosplit
+func initKernel(efiMap efiMemoryMap, rsdp, initramfsAddr physicalAddress, initramfsSize uint64) error {
+	// The loader memory was freed by initMemory; reserve the
+	// initramfs before anything allocates.
+	initRootFS(&efiMap, initramfsAddr, initramfsSize)
+	initACPI(efiMap, rsdp)
+	initRandom()
+	if err := initAPIC(); err != nil {
 		return err
 	}
-	if err := initAPIC(); err != nil {
+	if err := initIOAPIC(); err != nil {
 		return err
 	}
 	initSYSCALL()
@@ -80,12 +99,25 @@ func initKernel(descSize uint64, mmap, kernelImage []byte) error {
 	if err := initThreads(); err != nil {
 		return err
 	}
+	initSerial()
 	if err := initClock(); err != nil {
 		return err
 	}
+	if err := initSMP(); err != nil {
+		return err
+	}
 	return nil
 }
 
+// initRootFS reserves the initramfs loaded by the loader and
+// serves it through the file table.
+//go:nosplit
+func initRootFS(efiMap *efiMemoryMap, addr physicalAddress, size uint64) {
+	initramfs := efiMap.loaderBuffer(addr, size)
+	keepLoaderBuffer(&initramfs)
+	initFiles(initramfs)
+}
+
 //go:nosplit
 func runGo() error {
 	// Allocate initial stack.
@@ -96,13 +128,18 @@ func runGo() error {
 	}
 	stack := (*stack)(unsafe.Pointer(addr))
 
-	// Allocate initial thread.
-	t, err := globalThreads.newThread()
+	// Allocate initial thread. Mark it running before releasing
+	// the lock to keep the other processors from scheduling it.
+	ts := &globalThreads
+	ts.lock.lock()
+	t, err := ts.newThread()
 	if err != nil {
+		ts.lock.unlock()
 		return err
 	}
+	t.makeCurrent(&cpus[0])
+	ts.lock.unlock()
 	t.sp = uint64(stack.top())
-	t.makeCurrent()
 
 	// Set up sane initial state, in particular the MXCSR flags.
 	saveThread()
@@ -138,6 +175,16 @@ func setupEnv(stack []byte) {
 	args = args[8:]
 	bo.PutUint64(args, pageSize)
 	args = args[8:]
+	// vDSO.
+	bo.PutUint64(args, _AT_SYSINFO_EHDR)
+	args = args[8:]
+	bo.PutUint64(args, uint64(vdsoImageAddress))
+	args = args[8:]
+	// Random bytes for seeding the runtime.
+	bo.PutUint64(args, _AT_RANDOM)
+	args = args[8:]
+	randAddr := args[:8]
+	args = args[8:]
 	// End of auxv.
 	bo.PutUint64(args, _AT_NULL)
 	args = args[8:]
@@ -146,6 +193,8 @@ func setupEnv(stack []byte) {
 	bo.PutUint64(binAddr, uint64(uintptr(unsafe.Pointer(&args[0]))))
 	n := copy(args, []byte("kernel\x00"))
 	args = args[n:]
+	bo.PutUint64(randAddr, uint64(uintptr(unsafe.Pointer(&args[0]))))
+	readRandom(args[:16])
 }
 
 //go:nosplit
@@ -182,6 +231,8 @@ func fatal(msg string) {
 	outputString("fatal error: ")
 	outputString(msg)
 	outputString("\n")
+	pc, bp := callerFrame()
+	tracebackFatal(pc, bp)
 	halt()
 }
 
@@ -24,10 +24,33 @@
 #define CONTEXT_FSBASE 19*8
 #define CONTEXT_FPSTATE 20*8
 
+// Field offsets of type thread.
+#define THREAD_CPU 20*8+512
+
+// Field offsets of type cpu.
+#define CPU_KSTACKTOP 1*8
+#define CPU_KERNELTHREAD 2*8
+
 // Field offsets of type clock.
 #define CLOCK_SEQ 0
-#define CLOCK_SECONDS 8
-#define CLOCK_NANOSECONDS 16
+#define CLOCK_TIME 8
+#define CLOCK_MONOTONE_TIME 24
+#define CLOCK_TSC_BASE 40
+#define CLOCK_TSC_MULT 48
+
+// Field offsets of type instant.
+#define INSTANT_SECONDS 0
+#define INSTANT_NANOSECONDS 8
+
+// Clock ids of clock_gettime.
+#define CLOCK_REALTIME 0
+#define CLOCK_MONOTONIC 1
+#define CLOCK_MONOTONIC_RAW 4
+#define CLOCK_REALTIME_COARSE 5
+#define CLOCK_MONOTONIC_COARSE 6
+#define CLOCK_BOOTTIME 7
+
+#define SYS_clock_gettime 228
 
 // Send end-of-interrupt to the APIC.
 #define APICEOI	MOVQ	·apicEOI(SB), AX \
@@ -87,8 +110,9 @@ TEXT ·syscallTrampoline(SB),NOSPLIT|NOFRAME,$0
 	// Save stack pointer.
 	MOVQ	SP, CONTEXT_SP(GS)
 
-	// Switch stack.
-	MOVQ	·kstackTop(SB), SP
+	// Switch to the stack of the current processor.
+	MOVQ	THREAD_CPU(GS), SP
+	MOVQ	CPU_KSTACKTOP(SP), SP
 
 	CALL	·saveThread(SB)
 
@@ -110,8 +134,10 @@ TEXT ·syscallTrampoline(SB),NOSPLIT|NOFRAME,$0
 
 	UNDEF // sysenter never returns.
 
-// vdsoGettimeofday uses the C ABI.
-TEXT ·vdsoGettimeofday(SB),NOSPLIT|NOFRAME,$0
+// vdsoReadClock reads the instant at offset R11 of unixClock and
+// returns the seconds in CX and the nanoseconds in AX. It clobbers
+// DX, R8, R9 and R10.
+TEXT ·vdsoReadClock(SB),NOSPLIT|NOFRAME,$0
 	MOVQ	$·unixClock(SB), R10
 
 retry:
@@ -119,23 +145,152 @@ retry:
 	// Retry if seq is odd, indicating a write in progress.
 	TESTB	$1, R8
 	JNZ		retry
-	MOVQ	CLOCK_SECONDS(R10), CX
-	MOVL	CLOCK_NANOSECONDS(R10), AX
+	MOVQ	INSTANT_SECONDS(R10)(R11*1), CX
+	MOVLQZX	INSTANT_NANOSECONDS(R10)(R11*1), R9
+	// Add the nanoseconds elapsed since tscBase, if the TSC is
+	// enabled.
+	CMPQ	CLOCK_TSC_MULT(R10), $0
+	JEQ		notsc
+	LFENCE
+	RDTSC
+	SHLQ	$32, DX
+	ORQ		DX, AX
+	SUBQ	CLOCK_TSC_BASE(R10), AX
+	MULQ	CLOCK_TSC_MULT(R10)
+	// Convert from 32.32 fixed point.
+	SHRQ	$32, DX, AX
+	ADDQ	AX, R9
+notsc:
 	// Retry if seq changed during the read.
-	MOVQ	CLOCK_SEQ(R10), R9
-	CMPQ	R8, R9
+	MOVQ	CLOCK_SEQ(R10), AX
+	CMPQ	R8, AX
 	JNE		retry
-	// Convert to milliseconds.
-	MOVL	$0, DX
-	MOVL	$1000, R9
-	DIVL	R9
+	// Normalize.
+	MOVQ	R9, AX
+	MOVQ	$0, DX
+	MOVQ	$1000000000, R8
+	DIVQ	R8
+	ADDQ	AX, CX
+	MOVQ	DX, AX
+	RET
+
+// vdsoGettimeofday uses the C ABI.
+TEXT ·vdsoGettimeofday(SB),NOSPLIT|NOFRAME,$0
+	MOVQ	$CLOCK_TIME, R11
+	CALL	·vdsoReadClock(SB)
+	// Convert to microseconds.
+	MOVQ	$0, DX
+	MOVQ	$1000, R9
+	DIVQ	R9
 	// Address of the result is in DI.
+	TESTQ	DI, DI
+	JZ		done
 	MOVQ	CX, 0(DI) // Seconds.
-	MOVL	AX, 8(DI) // Microseconds.
+	MOVQ	AX, 8(DI) // Microseconds.
+done:
 	MOVQ	$0, AX // Success.
 	RET
 
+// vdsoClockGettime uses the C ABI.
+TEXT ·vdsoClockGettime(SB),NOSPLIT|NOFRAME,$0
+	MOVQ	$CLOCK_TIME, R11
+	CMPQ	DI, $CLOCK_REALTIME
+	JEQ		read
+	CMPQ	DI, $CLOCK_REALTIME_COARSE
+	JEQ		read
+	MOVQ	$CLOCK_MONOTONE_TIME, R11
+	CMPQ	DI, $CLOCK_MONOTONIC
+	JEQ		read
+	CMPQ	DI, $CLOCK_MONOTONIC_RAW
+	JEQ		read
+	CMPQ	DI, $CLOCK_MONOTONIC_COARSE
+	JEQ		read
+	CMPQ	DI, $CLOCK_BOOTTIME
+	JEQ		read
+	// Let the kernel handle the rest.
+	MOVQ	$SYS_clock_gettime, AX
+	SYSCALL
+	RET
+read:
+	CALL	·vdsoReadClock(SB)
+	// Address of the result is in SI.
+	MOVQ	CX, 0(SI) // Seconds.
+	MOVQ	AX, 8(SI) // Nanoseconds.
+	MOVQ	$0, AX // Success.
+	RET
+
+// FAULT_FROM_USER jumps to userFaultTrampoline with the vector
+// pushed if the fault occurred in user mode. The interrupt frame
+// must start with an error code.
+#define FAULT_FROM_USER(VECTOR) TESTQ	$3, 2*8(SP) \
+	JZ	3(PC) \
+	PUSHQ	$VECTOR \
+	JMP	·userFaultTrampoline(SB)
+
+// userFaultTrampoline saves the state of the faulting thread and
+// calls userFault. The stack contains the interrupt vector followed
+// by the interrupt frame with error code.
+TEXT ·userFaultTrampoline(SB),NOSPLIT|NOFRAME,$0
+	SWAPGS
+	// Save CX and R11 not saved by saveThread.
+	MOVQ	CX, CONTEXT_CX(GS)
+	MOVQ	R11, CONTEXT_R11(GS)
+
+	CALL	·saveThread(SB)
+
+	// Save return address, stack pointer, flags from the
+	// interrupt stack frame.
+	MOVQ	5*8(SP), AX // SP.
+	MOVQ	AX, CONTEXT_SP(GS)
+	MOVQ	4*8(SP), AX	// rflags.
+	MOVQ	AX, CONTEXT_FLAGS(GS)
+	MOVQ	2*8(SP), AX // Return address.
+	MOVQ	AX, CONTEXT_IP(GS)
+
+	MOVQ	0*8(SP), AX // Vector.
+	MOVQ	1*8(SP), DX // Error code.
+	MOVQ	CR2, CX // Fault address.
+	MOVQ	CONTEXT_SELF(GS), BX
+
+	// Switch to the stack of the current processor.
+	MOVQ	THREAD_CPU(GS), SP
+	MOVQ	CPU_KSTACKTOP(SP), SP
+
+	SUBQ	$4*8, SP
+	MOVQ	BX, 0*8(SP) // Thread.
+	MOVQ	AX, 1*8(SP)
+	MOVQ	DX, 2*8(SP)
+	MOVQ	CX, 3*8(SP)
+	CALL	·userFault(SB)
+	ADDQ	$4*8, SP
+
+	UNDEF // userFault never returns.
+
+TEXT ·divFaultTrampoline(SB),NOSPLIT|NOFRAME,$0
+	PUSHQ	$0 // Error code.
+	FAULT_FROM_USER(0x0)
+	CALL	·divFault(SB)
+	UNDEF
+
+TEXT ·invalidOpcodeTrampoline(SB),NOSPLIT|NOFRAME,$0
+	PUSHQ	$0 // Error code.
+	FAULT_FROM_USER(0x6)
+	CALL	·invalidOpcode(SB)
+	UNDEF
+
+TEXT ·alignmentCheckTrampoline(SB),NOSPLIT|NOFRAME,$0
+	FAULT_FROM_USER(0x11)
+	CALL	·alignmentCheck(SB)
+	UNDEF
+
+TEXT ·sseExceptionTrampoline(SB),NOSPLIT|NOFRAME,$0
+	PUSHQ	$0 // Error code.
+	FAULT_FROM_USER(0x13)
+	CALL	·sseException(SB)
+	UNDEF
+
 TEXT ·generalProtectionFaultTrampoline(SB),NOSPLIT|NOFRAME,$0
+	FAULT_FROM_USER(0xd)
 	// The error code offsets the interrupt alignment by 8.
 	// Re-align.
 	SUBQ	$1*8, SP
@@ -156,6 +311,7 @@ TEXT ·generalProtectionFaultTrampoline(SB),NOSPLIT|NOFRAME,$0
 	IRETQ
 
 TEXT ·pageFaultTrampoline(SB),NOSPLIT|NOFRAME,$0
+	FAULT_FROM_USER(0xe)
 	// The error code offsets the interrupt alignment by 8.
 	// Re-align.
 	SUBQ	$1*8, SP
@@ -177,6 +333,20 @@ TEXT ·pageFaultTrampoline(SB),NOSPLIT|NOFRAME,$0
 
 	IRETQ
 
+TEXT ·tlbFlushTrampoline(SB),NOSPLIT|NOFRAME,$0
+	INTERRUPT_SAVE
+	CALL	·tlbFlushInterrupt(SB)
+	APICEOI
+	INTERRUPT_RESTORE
+	IRETQ
+
+TEXT ·serialTrampoline(SB),NOSPLIT|NOFRAME,$0
+	INTERRUPT_SAVE
+	CALL	·serialInterrupt(SB)
+	APICEOI
+	INTERRUPT_RESTORE
+	IRETQ
+
 TEXT ·timerTrampoline(SB),NOSPLIT|NOFRAME,$0
 	SWAPGS
 	// Save CX and R11 not saved by saveThread.
@@ -198,12 +368,16 @@ TEXT ·timerTrampoline(SB),NOSPLIT|NOFRAME,$0
 	APICEOI
 
 	MOVQ	CONTEXT_SELF(GS), BX
-	MOVQ	$·kernelThread(SB), CX
+	MOVQ	THREAD_CPU(GS), CX
+	MOVQ	CPU_KERNELTHREAD(CX), CX
 	CMPQ	BX, CX
 	JEQ	kernelThread
 
-	// Pop interrupt frame (5 words)
-	ADDQ	$5*8, SP
+	// Switch to the stack of the current processor. The
+	// interrupt stack can't be used, because the scheduler may
+	// halt the processor and be interrupted again.
+	MOVQ	THREAD_CPU(GS), SP
+	MOVQ	CPU_KSTACKTOP(SP), SP
 
 	SUBQ	$8, SP
 	MOVQ	BX, 0*8(SP) // Thread.
@@ -228,21 +402,38 @@ TEXT ·rt0(SB),NOSPLIT|NOFRAME,$0
 	// Switch stack.
 	CALL	·kernelStackTop(SB)
 	MOVQ	0(SP), BP
+	// The remaining arguments are on the loader stack.
+	MOVQ	8(SP), R10
+	MOVQ	16(SP), R11
 	MOVQ	BP, SP
 
-	SUBQ	$5*8, SP
+	SUBQ	$8*8, SP
 	MOVQ	DI, 0(SP)	// Memory map size
 	MOVQ	SI, 8(SP)	// Memory map descriptor size
 	MOVQ	DX, 16(SP)	// Kernel image size
 	MOVQ	CX, 24(SP)	// Memory map
 	MOVQ	R8, 32(SP)	// Kernel image
+	MOVQ	R9, 40(SP)	// ACPI RSDP
+	MOVQ	R10, 48(SP)	// Initramfs
+	MOVQ	R11, 56(SP)	// Initramfs size
 	CALL	·runKernel(SB)
-	ADDQ	$5*8, SP
+	ADDQ	$8*8, SP
 
 	// runKernel should never return.
 	UNDEF
 	RET
 
+// apEntry is the long mode entry point of the application
+// processors.
+TEXT ·apEntry(SB),NOSPLIT|NOFRAME,$0
+	MOVQ	·apBoot+8(SB), SP // apBoot.stack
+	MOVQ	SP, BP
+	CALL	·apMain(SB)
+
+	// apMain should never return.
+	UNDEF
+	RET
+
 TEXT ·jumpToGo(SB),NOSPLIT|NOFRAME,$0
 	JMP _rt0_amd64_linux(SB)
 
@@ -294,6 +485,16 @@ TEXT ·setCR3Reg(SB),NOSPLIT,$0-8
 	MOVQ	AX, CR3
 	RET
 
+TEXT ·invlpg(SB),NOSPLIT,$0-8
+	MOVQ	addr+0(FP), AX
+	INVLPG	(AX)
+	RET
+
+TEXT ·flushTLB(SB),NOSPLIT,$0
+	MOVQ	CR3, AX
+	MOVQ	AX, CR3
+	RET
+
 TEXT ·setCR4Reg(SB),NOSPLIT,$0-8
 	MOVQ	flags+0(FP), AX
 	MOVQ	AX, CR4
@@ -335,6 +536,10 @@ TEXT ·yield0(SB),NOSPLIT,$0-0
 	CLI
 	RET
 
+TEXT ·pause(SB),NOSPLIT,$0-0
+	PAUSE
+	RET
+
 TEXT ·halt(SB),NOSPLIT,$0-0
 hlt:
 	HLT
@@ -375,6 +580,51 @@ TEXT ·outb(SB),NOSPLIT,$0-3
 	OUTB
 	RET
 
+TEXT ·mfence(SB),NOSPLIT,$0-0
+	MFENCE
+	RET
+
+TEXT ·rdtsc(SB),NOSPLIT,$0-8
+	LFENCE
+	RDTSC
+	SHLQ	$32, DX
+	ORQ		DX, AX
+	MOVQ	AX, ret+0(FP)
+	RET
+
+TEXT ·rdrand(SB),NOSPLIT,$0-9
+	RDRANDQ	AX
+	MOVQ	AX, ret+0(FP)
+	SETCS	ret1+8(FP)
+	RET
+
+TEXT ·rdseed(SB),NOSPLIT,$0-9
+	RDSEEDQ	AX
+	MOVQ	AX, ret+0(FP)
+	SETCS	ret1+8(FP)
+	RET
+
+TEXT ·inw(SB),NOSPLIT,$0-10
+	MOVW	port+0(FP), DX
+	INW
+	MOVW	AX, ret+8(FP)
+	RET
+
+TEXT ·outw(SB),NOSPLIT,$0-4
+	MOVW	port+0(FP), DX
+	MOVW	w+2(FP), AX
+	OUTW
+	RET
+
+// tripleFault resets the processor by loading an empty IDT and
+// raising an interrupt.
+TEXT ·tripleFault(SB),NOSPLIT,$16-0
+	MOVQ	$0, 0(SP)
+	MOVQ	$0, 8(SP)
+	LIDT	0(SP)
+	INT	$3
+	RET
+
 TEXT ·swapgs(SB),NOSPLIT|NOFRAME,$0-0
 	SWAPGS
 	RET
@@ -388,6 +638,23 @@ TEXT ·currentThread(SB),NOSPLIT,$0-8
 	MOVQ	AX, ret+0(FP)
 	RET
 
+TEXT ·callerFrame(SB),NOSPLIT|NOFRAME,$0-16
+	MOVQ	0(SP), AX
+	MOVQ	AX, pc+0(FP)
+	MOVQ	BP, bp+8(FP)
+	RET
+
+// raiseTraceback raises intTraceback.
+TEXT ·raiseTraceback(SB),NOSPLIT,$0
+	INT	$0xfe
+	RET
+
+TEXT ·tracebackTrampoline(SB),NOSPLIT|NOFRAME,$0
+	// Keep interrupts from running over the stacks being unwound.
+	CLI
+	CALL	·tracebackInterrupt(SB)
+	UNDEF // tracebackInterrupt never returns.
+
 TEXT ·saveThread(SB),NOSPLIT|NOFRAME,$0
 	MOVQ	BP, CONTEXT_BP(GS)
 	MOVQ	AX, CONTEXT_AX(GS)
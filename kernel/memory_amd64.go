@@ -23,6 +23,16 @@ const (
 	pageTableSize = 512
 )
 
+const (
+	// maxOrder is the order of the largest physical memory
+	// block.
+	maxOrder     = 18
+	maxBlockSize = pageSize << maxOrder
+
+	// noBlock terminates a free list.
+	noBlock = -1
+)
+
 // physicalMapOffset is the offset at which the physical memory
 // is identity mapped. It is 0 until after initPageTables.
 var physicalMapOffset virtualAddress
@@ -80,15 +90,29 @@ type pageTableEntry uint64
 
 type pageVisitor func(addr virtualAddress, entry *pageTableEntry)
 
-// memory is a simple allocator for physical memory, tracking free
-// pages with a bitmap.
+// memory is a buddy allocator for physical memory. Free memory is
+// kept in blocks of 2^order pages, aligned to their size, with a
+// free list for every order.
 type memory struct {
 	start physicalAddress
-	// The index into bits of the last allocated block.
-	word int
-	// bits represent each physical memory page with one bit. 1
-	// mean free, 0 means allocated or reserved.
-	bits []uint64
+	// pages contain the state of every physical page.
+	pages []pageInfo
+	// freeLists contains the first free block of every order, or
+	// noBlock.
+	freeLists [maxOrder + 1]int32
+}
+
+// pageInfo is the allocator state of a physical page. It is kept
+// outside the page itself, so free memory is never written to.
+type pageInfo struct {
+	// next and prev link free blocks of the same order.
+	next, prev int32
+	// order is one plus the order of the free block starting at
+	// the page, or zero if no free block starts at the page.
+	order uint8
+	// userPages is the number of pages of the user allocation
+	// starting at the page, or zero.
+	userPages int32
 }
 
 // virtMemory tracks the all reserved virtual memory ranges
@@ -126,6 +150,22 @@ const (
 	allPageFlags                 = pageFlagPresent | pageFlagWritable | pageFlagNX | pageFlagUserAccess | pageFlagNoCache
 
 	pageSizeFlag pageFlags = 1 << 7
+
+	// pageFlagAllocated marks pages backed by memory from
+	// globalMem, to be freed when unmapped. It is one of the bits
+	// ignored by the processor.
+	pageFlagAllocated pageFlags = 1 << 9
+
+	// protNone is the flags of PROT_NONE user memory.
+	protNone = pageFlagNX
+)
+
+// Page fault error code flags.
+const (
+	faultFlagPresent = 1 << 0
+	faultFlagWrite   = 1 << 1
+	faultFlagUser    = 1 << 2
+	faultFlagFetch   = 1 << 4
 )
 
 const (
@@ -158,9 +198,12 @@ func newELFImage(img []byte) (elfImage, error) {
 	return elfImage{phdr: phdr, phdrSize: int(phdrSize), phdrCount: int(phdrCount)}, nil
 }
 
+// initMemory sets up the kernel page tables and virtual memory map.
+// It updates efiMap and kernelImage to point to their new
+// locations.
 //go:nosplit
-func initMemory(efiMap efiMemoryMap, kernelImage []byte) error {
-	if err := setupPageTable(efiMap, kernelImage); err != nil {
+func initMemory(efiMap *efiMemoryMap, kernelImage *[]byte) error {
+	if err := setupPageTable(*efiMap, *kernelImage); err != nil {
 		return err
 	}
 	// Hold the virtual memory map structure and the physical identity
@@ -172,30 +215,37 @@ func initMemory(efiMap efiMemoryMap, kernelImage []byte) error {
 	virtMapEnd := virtMapStart + virtMapSize
 	// Identity map physical memory in the upper half of the virtual
 	// memory space.
-	if err := identityMapMem(&globalMem, globalPT, efiMap, virtMapEnd); err != nil {
+	if err := identityMapMem(&globalMem, globalPT, *efiMap, virtMapEnd); err != nil {
 		return err
 	}
-	if err := identityMapKernel(&globalMem, globalPT, kernelImage); err != nil {
+	if err := identityMapKernel(&globalMem, globalPT, *kernelImage); err != nil {
 		return err
 	}
 	physicalMapOffset = virtMapEnd
-	switchMemoryMap(&efiMap, &kernelImage)
+	switchMemoryMap(efiMap, kernelImage)
 
 	// Initialize virtual memory map.
 	vmap, err := newVirtMemory(&globalMem, globalPT, virtMapStart, virtMapSize)
 	if err != nil {
 		return err
 	}
-	if err := addKernelRanges(&vmap, kernelImage); err != nil {
+	if err := addKernelRanges(&vmap, *kernelImage); err != nil {
 		return err
 	}
 	// Reserve the upper half of the virtual memory, up until the vDSO
 	// starting address.
 	vmap.mustAddRange(physicalMapOffset, vdsoAddress, pageFlagWritable|pageFlagNX)
-	if err := mapReservedMem(&globalMem, globalPT, &vmap, efiMap); err != nil {
+	if err := mapReservedMem(&globalMem, globalPT, &vmap, *efiMap); err != nil {
 		return err
 	}
-	freeLoaderMem(&globalMem, efiMap)
+	// The memory map is loader data, but is still needed after the
+	// loader memory is freed.
+	if err := copyMemoryMap(&globalMem, efiMap); err != nil {
+		return err
+	}
+	freeLoaderMem(&globalMem, *efiMap)
+	// Keep the kernel image file for symbolizing stack traces.
+	reserveLoaderBuffer(&globalMem, *kernelImage)
 	globalMap = vmap
 	return nil
 }
@@ -206,7 +256,7 @@ func switchMemoryMap(efiMap *efiMemoryMap, kernelImage *[]byte) {
 	setCR3Reg(uintptr(unsafe.Pointer(globalPT)))
 	// Offset pointers allocated with 0-based offsets.
 	*(*uintptr)(unsafe.Pointer(&globalPT)) += uintptr(physicalMapOffset)
-	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&globalMem.bits))
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&globalMem.pages))
 	hdr.Data += uintptr(physicalMapOffset)
 	hdr = (*reflect.SliceHeader)(unsafe.Pointer(&efiMap.mmap))
 	hdr.Data += uintptr(physicalMapOffset)
@@ -223,13 +273,13 @@ func setupPageTable(efiMap efiMemoryMap, kernelImage []byte) error {
 		wrmsr(_MSR_IA32_EFER, efer|_EFER_NXE)
 	}
 
-	if err := initMemBitmap(&globalMem, efiMap); err != nil {
+	if err := initMemAllocator(&globalMem, efiMap); err != nil {
 		return err
 	}
 	if err := reserveImageMem(&globalMem, kernelImage); err != nil {
 		return err
 	}
-	page, _, err := globalMem.alloc(pageSize)
+	page, err := globalMem.alloc(pageSize)
 	if err != nil {
 		return err
 	}
@@ -247,7 +297,7 @@ func newVirtMemory(mem *memory, pt *pageTable, start virtualAddress, size uint64
 	hdr.Cap = int(uintptr(size) / unsafe.Sizeof(vm.ranges[0]))
 	// Eagerly allocate the first page to fit its own mapping. The
 	// rest is faulted in.
-	addr, _, err := mem.alloc(pageSize)
+	addr, err := mem.alloc(pageSize)
 	if err != nil {
 		return virtMemory{}, err
 	}
@@ -262,21 +312,110 @@ func newVirtMemory(mem *memory, pt *pageTable, start virtualAddress, size uint64
 
 // faultPage is called from the page fault interrupt handler.
 //go:nosplit
-func faultPage(addr virtualAddress) error {
+func faultPage(addr virtualAddress, errCode uint64) error {
+	memLock.lock()
+	err := faultPage0(addr, errCode)
+	memLock.unlock()
+	return err
+}
+
+//go:nosplit
+func faultPage0(addr virtualAddress, errCode uint64) error {
 	addr = addr & ^virtualAddress(pageSize-1)
+	if e, ok := globalPT.lookup(addr); ok && e.present() {
+		// Another processor faulted the page in.
+		return nil
+	}
 	r, ok := globalMap.rangeForAddress(addr, pageSize)
 	if !ok {
 		return kernError("faultPage: page fault for unmapped address")
 	}
 	flags := r.flags
-	if flags == pageFlagNX {
+	if flags == protNone {
 		return kernError("faultPage: page fault for PROT_NONE address")
 	}
-	paddr, _, err := globalMem.alloc(pageSize)
+	if !r.permits(errCode) {
+		return kernError("faultPage: page protection violation")
+	}
+	paddr, err := globalMem.alloc(pageSize)
 	if err != nil {
 		return err
 	}
-	return mmapAligned(&globalMem, globalPT, addr, addr+pageSize, paddr, flags)
+	return mmapAligned(&globalMem, globalPT, addr, addr+pageSize, paddr, flags|pageFlagAllocated)
+}
+
+// isMapped reports whether the address is in a range of the virtual
+// memory map.
+//go:nosplit
+func isMapped(addr virtualAddress) bool {
+	memLock.lock()
+	_, ok := globalMap.rangeForAddress(addr, 1)
+	memLock.unlock()
+	return ok
+}
+
+// userAccessible reports whether the size bytes at addr are user
+// memory that permits reading and, if write is set, writing. System
+// calls check the user memory they access with userAccessible, because
+// a kernel mode page fault outside the mapped ranges is fatal. Only an
+// unmap racing with the access by another thread can still fault.
+//go:nosplit
+func userAccessible(addr virtualAddress, size uint64, write bool) bool {
+	end := addr + virtualAddress(size)
+	if end < addr {
+		return false
+	}
+	errCode := uint64(faultFlagUser)
+	if write {
+		errCode |= faultFlagWrite
+	}
+	memLock.lock()
+	// The memory may span several adjacent ranges.
+	for addr < end {
+		r, ok := globalMap.rangeForAddress(addr, 1)
+		if !ok || !r.permits(errCode) {
+			break
+		}
+		addr = r.end
+	}
+	memLock.unlock()
+	return addr >= end
+}
+
+// userPtr reports whether the optional pointer argument p is nil or
+// points to size bytes of accessible user memory.
+//go:nosplit
+func userPtr(p unsafe.Pointer, size uintptr, write bool) bool {
+	return p == nil || userAccessible(virtualAddress(uintptr(p)), uint64(size), write)
+}
+
+// mmapPopulated is like globalMap.mmap but backs the range with
+// physical memory up front.
+//go:nosplit
+func mmapPopulated(size uint64, flags pageFlags) (virtualAddress, error) {
+	memLock.lock()
+	addr, err := mmapPopulated0(size, flags)
+	memLock.unlock()
+	return addr, err
+}
+
+//go:nosplit
+func mmapPopulated0(size uint64, flags pageFlags) (virtualAddress, error) {
+	start, err := globalMap.mmap(0, size, flags)
+	if err != nil {
+		return 0, err
+	}
+	end := (start + virtualAddress(size)).AlignUp()
+	for addr := start; addr < end; addr += pageSize {
+		paddr, err := globalMem.alloc(pageSize)
+		if err != nil {
+			return 0, err
+		}
+		if err := mmapAligned(&globalMem, globalPT, addr, addr+pageSize, paddr, flags|pageFlagAllocated); err != nil {
+			return 0, err
+		}
+	}
+	return start, nil
 }
 
 // identityMapMem makes the physical memory directly addressable for
@@ -287,7 +426,8 @@ func identityMapMem(mem *memory, pt *pageTable, efiMap efiMemoryMap, offset virt
 	end := physicalAddress(0)
 	for i := 0; i < efiMap.len(); i++ {
 		desc := efiMap.entry(i)
-		if !desc.isUsable() {
+		// Include the ACPI tables for the benefit of initACPI.
+		if !desc.isUsable() && !desc.isACPI() {
 			continue
 		}
 		if desc.physicalStart < start {
@@ -306,6 +446,20 @@ func identityMapMem(mem *memory, pt *pageTable, efiMap efiMemoryMap, offset virt
 	return mmapAligned(mem, pt, vaddr, vaddr+virtualAddress(size), start, pageFlagWritable|pageFlagNX)
 }
 
+// copyMemoryMap moves the memory map to memory allocated from mem.
+//go:nosplit
+func copyMemoryMap(mem *memory, efiMap *efiMemoryMap) error {
+	addr, err := mem.alloc(len(efiMap.mmap))
+	if err != nil {
+		return err
+	}
+	buf := sliceForMem(physToVirt(addr), len(efiMap.mmap))
+	copy(buf, efiMap.mmap)
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&efiMap.mmap))
+	hdr.Data = uintptr(physToVirt(addr))
+	return nil
+}
+
 //go:nosplit
 func freeLoaderMem(mem *memory, efiMap efiMemoryMap) {
 	for i := 0; i < efiMap.len(); i++ {
@@ -318,6 +472,55 @@ func freeLoaderMem(mem *memory, efiMap efiMemoryMap) {
 	}
 }
 
+// loaderBuffer returns the buffer at addr allocated by the loader, or
+// nil if the buffer is not entirely inside a loader data region.
+//go:nosplit
+func (m *efiMemoryMap) loaderBuffer(addr physicalAddress, size uint64) []byte {
+	end := addr + physicalAddress(size)
+	if size == 0 || end < addr {
+		return nil
+	}
+	for i := 0; i < m.len(); i++ {
+		desc := m.entry(i)
+		if desc._type != efiLoaderData {
+			continue
+		}
+		dend := desc.physicalStart + physicalAddress(desc.numberOfPages*pageSize)
+		if desc.physicalStart <= addr && end <= dend {
+			return sliceForMem(virtualAddress(addr), int(size))
+		}
+	}
+	return nil
+}
+
+// keepLoaderBuffer moves a buffer allocated by the loader to the
+// physical memory map and marks its pages in use. It must be called
+// after initMemory.
+//go:nosplit
+func keepLoaderBuffer(buf *[]byte) {
+	if len(*buf) == 0 {
+		return
+	}
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(buf))
+	hdr.Data += uintptr(physicalMapOffset)
+	reserveLoaderBuffer(&globalMem, *buf)
+}
+
+// reserveLoaderBuffer marks the pages of a buffer allocated by the
+// loader in use. The buffer must have been moved to the physical
+// memory map.
+//go:nosplit
+func reserveLoaderBuffer(mem *memory, buf []byte) {
+	if len(buf) == 0 {
+		return
+	}
+	start := uintptr(unsafe.Pointer(&buf[0])) - uintptr(physicalMapOffset)
+	end := start + uintptr(len(buf))
+	start = start &^ (pageSize - 1)
+	end = (end + pageSize - 1) &^ (pageSize - 1)
+	mem.setFree(false, physicalAddress(start), physicalAddress(end))
+}
+
 //go:nosplit
 func mapReservedMem(mem *memory, pt *pageTable, vmap *virtMemory, efiMap efiMemoryMap) error {
 	for i := 0; i < efiMap.len(); i++ {
@@ -363,7 +566,6 @@ func identityMapKernel(mem *memory, pt *pageTable, image []byte) error {
 	if err != nil {
 		return err
 	}
-	mmapAligned := mmapAligned // Cheat the nosplit checks.
 	for i := 0; i < elfImg.phdrCount; i++ {
 		seg := elfImg.readSegHeader(i)
 		if seg.pType != _PT_LOAD {
@@ -430,9 +632,10 @@ func (e *elfSegmentHeader) flags() pageFlags {
 	return flags
 }
 
-// initMem initializes a memory allocator from an EFI memory map.
+// initMemAllocator initializes a memory allocator from an EFI memory
+// map.
 //go:nosplit
-func initMemBitmap(mem *memory, efiMap efiMemoryMap) error {
+func initMemAllocator(mem *memory, efiMap efiMemoryMap) error {
 	// Determine the highest usable physical memory address and
 	// largest memory region.
 	var maxAddr physicalAddress
@@ -464,23 +667,27 @@ func initMemBitmap(mem *memory, efiMap efiMemoryMap) error {
 	if largestDesc == nil {
 		return kernError("initMem: no initial memory")
 	}
-	// Compute the number of pages the memory bitmap takes up.
+	// Align the start so that blocks are aligned to their size in
+	// physical memory as well.
+	minAddr &^= maxBlockSize - 1
+	// Compute the number of pages the page state takes up.
 	rng := uint64(maxAddr - minAddr)
-	nbits := (rng + pageSize - 1) / pageSize
-	nbytes := (nbits + 8 - 1) / 8
-	npages := (nbytes + pageSize - 1) / pageSize
-	if npages > largestDesc.numberOfPages {
-		return kernError("initMem: memory bitmap doesn't fit in available memory")
+	npages := (rng + pageSize - 1) / pageSize
+	nbytes := npages * uint64(unsafe.Sizeof(pageInfo{}))
+	statePages := (nbytes + pageSize - 1) / pageSize
+	if statePages > largestDesc.numberOfPages {
+		return kernError("initMem: page state doesn't fit in available memory")
 	}
 	mem.start = minAddr
-	nwords := (nbytes + 8 - 1) / 8
-	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&mem.bits))
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&mem.pages))
 	hdr.Data = uintptr(largestDesc.physicalStart)
-	hdr.Len = int(nwords)
-	hdr.Cap = int(nwords)
-	// Clear bitmap.
-	for i := range mem.bits {
-		mem.bits[i] = 0
+	hdr.Len = int(npages)
+	hdr.Cap = int(npages)
+	for i := range mem.pages {
+		mem.pages[i] = pageInfo{}
+	}
+	for i := range mem.freeLists {
+		mem.freeLists[i] = noBlock
 	}
 	// Mark free memory.
 	for i := 0; i < efiMap.len(); i++ {
@@ -495,10 +702,13 @@ func initMemBitmap(mem *memory, efiMap efiMemoryMap) error {
 		}
 	}
 	// Reserve memory for the allocator itself.
-	mem.setFree(false, largestDesc.physicalStart, largestDesc.physicalStart+physicalAddress(npages*pageSize))
+	mem.setFree(false, largestDesc.physicalStart, largestDesc.physicalStart+physicalAddress(statePages*pageSize))
 	return nil
 }
 
+// setFree frees or reserves the page aligned physical memory range.
+// Freeing a range that is partially free corrupts the allocator
+// state.
 //go:nosplit
 func (m *memory) setFree(free bool, start, end physicalAddress) {
 	if start&^(pageSize-1) != start || end&^(pageSize-1) != end {
@@ -510,86 +720,242 @@ func (m *memory) setFree(free bool, start, end physicalAddress) {
 	if start < m.start {
 		fatal("markFree: start > m.start")
 	}
-	start -= m.start
-	end -= m.start
-	startBit := uint64(start / pageSize)
-	endBit := uint64(end / pageSize)
-	startWord := startBit / 64
-	endWord := endBit / 64
-	// Set the bits of the first and last word(s).
-	startPattern := uint64(1)<<(64-startBit%64) - 1
-	endPattern := ^(uint64(1)<<(64-endBit%64) - 1)
-	if startWord == endWord {
-		startPattern &= endPattern
-		endPattern = startPattern
-	}
-	var pattern uint64
+	first := int((start - m.start) / pageSize)
+	last := int((end - m.start) / pageSize)
+	if last > len(m.pages) {
+		fatal("markFree: range beyond end of memory")
+	}
 	if free {
-		pattern = ^uint64(0)
-		m.bits[startWord] |= startPattern
-		m.bits[endWord] |= endPattern
+		m.freeRange(first, last)
 	} else {
-		pattern = 0
-		m.bits[startWord] &^= startPattern
-		m.bits[endWord] &^= endPattern
+		m.reserveRange(first, last)
+	}
+}
+
+// alloc allocates size bytes of contiguous memory, rounded up to
+// the page size.
+//go:nosplit
+func (m *memory) alloc(size int) (physicalAddress, error) {
+	return m.allocAligned(size, pageSize)
+}
+
+// allocAligned allocates size bytes of contiguous memory, rounded
+// up to the page size, at an address aligned to align. The alignment
+// must be a power of two.
+//go:nosplit
+func (m *memory) allocAligned(size, align int) (physicalAddress, error) {
+	if size <= 0 {
+		return 0, kernError("alloc: invalid size")
+	}
+	if align < pageSize {
+		align = pageSize
+	}
+	if align&(align-1) != 0 {
+		return 0, kernError("alloc: alignment is not a power of two")
+	}
+	npages := (size + pageSize - 1) / pageSize
+	order := bits.Len(uint(npages - 1))
+	if o := bits.Len(uint(align/pageSize)) - 1; o > order {
+		order = o
+	}
+	if order > maxOrder {
+		return 0, kernError("alloc: allocation too large")
+	}
+	// Find the smallest free block that fits.
+	k := order
+	for k <= maxOrder && m.freeLists[k] == noBlock {
+		k++
+	}
+	if uint(k) > maxOrder {
+		return 0, kernError("alloc: out of memory")
+	}
+	p := int(m.freeLists[k])
+	m.removeBlock(p, k)
+	// Split the block and free the unused halves.
+	for k > order {
+		k--
+		m.insertBlock(p+1<<uint(k), k)
+	}
+	// Free the remaining pages of the last block.
+	m.freeRange(p+npages, p+1<<uint(order))
+	addr := m.start + physicalAddress(p)*pageSize
+	mem := sliceForMem(physToVirt(addr), npages*pageSize)
+	for i := range mem {
+		mem[i] = 0
+	}
+	return addr, nil
+}
+
+// free returns the page aligned physical memory range to the
+// allocator.
+//go:nosplit
+func (m *memory) free(addr physicalAddress, size int) error {
+	end := addr + physicalAddress(size)
+	if addr&(pageSize-1) != 0 || size <= 0 || size%pageSize != 0 {
+		return kernError("free: unaligned memory range")
+	}
+	if addr < m.start || end <= addr || end > m.start+physicalAddress(len(m.pages))*pageSize {
+		return kernError("free: invalid memory range")
 	}
-	// Mark the middle bits.
-	for i := startWord + 1; i < endWord; i++ {
-		m.bits[i] = pattern
+	m.setFree(true, addr, end)
+	return nil
+}
+
+// allocUser is like allocAligned, but records the allocation for
+// freeUser.
+//go:nosplit
+func (m *memory) allocUser(size, align int) (physicalAddress, error) {
+	addr, err := m.allocAligned(size, align)
+	if err != nil {
+		return 0, err
 	}
+	p := int((addr - m.start) / pageSize)
+	m.pages[p].userPages = int32((size + pageSize - 1) / pageSize)
+	return addr, nil
 }
 
-// alloc allocates at most maxSize bytes of contiguous memory, rounded
-// up to the page size. alloc returns at least a page of memory.
+// freeUser frees the allocation at addr made by allocUser. The size,
+// rounded up to the page size, must match the allocation, so a user
+// program can't free memory it doesn't own.
 //go:nosplit
-func (m *memory) alloc(maxSize int) (physicalAddress, int, error) {
-	pageIdx, ok := m.nextFreePage()
-	if !ok {
-		return 0, 0, kernError("alloc: out of memory")
+func (m *memory) freeUser(addr physicalAddress, size int) error {
+	if addr < m.start || addr&(pageSize-1) != 0 || size <= 0 {
+		return kernError("freeUser: invalid memory range")
+	}
+	p := uint((addr - m.start) / pageSize)
+	npages := (size + pageSize - 1) / pageSize
+	if p >= uint(len(m.pages)) || m.pages[p].userPages != int32(npages) {
+		return kernError("freeUser: memory range is not allocated")
 	}
-	addr := physicalAddress(pageIdx * pageSize)
-	var size int
-	for maxSize > 0 {
-		if !m.mark(pageIdx) {
+	m.pages[p].userPages = 0
+	return m.free(addr, npages*pageSize)
+}
+
+// allocPageBelow allocates a page of memory below the physical
+// address limit, excluding the first page.
+//go:nosplit
+func (m *memory) allocPageBelow(limit physicalAddress) (physicalAddress, error) {
+	for addr := m.start; addr+pageSize <= limit; addr += pageSize {
+		p := int((addr - m.start) / pageSize)
+		if p >= len(m.pages) {
 			break
 		}
-		pageIdx++
-		size += pageSize
-		maxSize -= pageSize
-	}
-	mem := sliceForMem(physToVirt(addr), size)
-	for i := range mem {
-		mem[i] = 0
+		if addr == 0 {
+			continue
+		}
+		if _, _, ok := m.findBlock(p); !ok {
+			continue
+		}
+		m.reserveRange(p, p+1)
+		mem := sliceForMem(physToVirt(addr), pageSize)
+		for i := range mem {
+			mem[i] = 0
+		}
+		return addr, nil
 	}
-	return addr, size, nil
+	return 0, kernError("allocPageBelow: out of memory")
 }
 
+// freeRange frees the pages [first; last[ by splitting the range
+// into the largest possible blocks.
 //go:nosplit
-func (m *memory) mark(pageIdx int) bool {
-	wordIdx := pageIdx / 64
-	bit := pageIdx % 64
-	mask := uint64(1 << (64 - bit - 1))
-	word := m.bits[wordIdx]
-	if word&mask == 0 {
-		return false
+func (m *memory) freeRange(first, last int) {
+	for first < last {
+		k := 0
+		for k < maxOrder && first&(1<<uint(k+1)-1) == 0 && first+1<<uint(k+1) <= last {
+			k++
+		}
+		m.release(first, k)
+		first += 1 << uint(k)
 	}
-	m.bits[wordIdx] = word &^ mask
-	return true
 }
 
+// reserveRange marks the free pages in [first; last[ in use.
 //go:nosplit
-func (m *memory) nextFreePage() (int, bool) {
-	for i := 0; i < len(m.bits); i++ {
-		idx := (i + m.word) % len(m.bits)
-		w := m.bits[idx]
-		b := bits.LeadingZeros64(w)
-		if b == 64 {
+func (m *memory) reserveRange(first, last int) {
+	for first < last {
+		p, k, ok := m.findBlock(first)
+		if !ok {
+			first++
 			continue
 		}
-		m.word = idx
-		return idx*64 + b, true
+		m.removeBlock(p, k)
+		end := p + 1<<uint(k)
+		// Free the parts of the block outside the range.
+		m.freeRange(p, first)
+		if last < end {
+			m.freeRange(last, end)
+		}
+		first = end
+	}
+}
+
+// release frees the block of order k at page p, merging it with
+// its free buddies.
+//go:nosplit
+func (m *memory) release(p, k int) {
+	for k < maxOrder {
+		buddy := p ^ 1<<uint(k)
+		if uint(buddy) >= uint(len(m.pages)) || buddy+1<<uint(k) > len(m.pages) || m.pages[buddy].order != uint8(k+1) {
+			break
+		}
+		m.removeBlock(buddy, k)
+		p &^= 1 << uint(k)
+		k++
+	}
+	m.insertBlock(p, k)
+}
+
+// findBlock returns the page and order of the free block containing
+// page p, or false if p is not free.
+//go:nosplit
+func (m *memory) findBlock(p int) (int, int, bool) {
+	for k := 0; k <= maxOrder; k++ {
+		head := p &^ (1<<uint(k) - 1)
+		if uint(head) < uint(len(m.pages)) && m.pages[head].order == uint8(k+1) {
+			return head, k, true
+		}
+	}
+	return 0, 0, false
+}
+
+// insertBlock adds the block of order k at page p to its free list.
+//
+// The block functions check their indices explicitly to avoid the
+// bounds checks and their deep panic calls. Their callers pass valid
+// blocks, and an unsigned noBlock is out of range.
+//go:nosplit
+func (m *memory) insertBlock(p, k int) {
+	if uint(p) >= uint(len(m.pages)) || uint(k) > maxOrder {
+		return
+	}
+	info := &m.pages[p]
+	info.order = uint8(k + 1)
+	info.prev = noBlock
+	info.next = m.freeLists[k]
+	if next := uint(info.next); next < uint(len(m.pages)) {
+		m.pages[next].prev = int32(p)
+	}
+	m.freeLists[k] = int32(p)
+}
+
+// removeBlock removes the block of order k at page p from its free
+// list.
+//go:nosplit
+func (m *memory) removeBlock(p, k int) {
+	if uint(p) >= uint(len(m.pages)) || uint(k) > maxOrder {
+		return
 	}
-	return 0, false
+	info := &m.pages[p]
+	if prev := uint(info.prev); prev < uint(len(m.pages)) {
+		m.pages[prev].next = info.next
+	} else {
+		m.freeLists[k] = info.next
+	}
+	if next := uint(info.next); next < uint(len(m.pages)) {
+		m.pages[next].prev = info.prev
+	}
+	*info = pageInfo{}
 }
 
 //go:nosplit
@@ -650,13 +1016,141 @@ func mmapAligned(mem *memory, pml4 *pageTable, start, end virtualAddress, paddr
 	return nil
 }
 
+// unmapRange removes the page mappings of the page aligned virtual
+// address range and frees the pages allocated for it. Huge pages
+// partially covered by the range are split. Only the TLB of the
+// current processor is invalidated.
+//go:nosplit
+func unmapRange(mem *memory, pml4 *pageTable, start, end virtualAddress) error {
+	for start < end {
+		e, size, err := pml4.leafEntry(mem, start, end)
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			e.unmap(mem)
+			invlpg(uintptr(start))
+		}
+		next := (start + size) &^ (size - 1)
+		if next <= start {
+			break
+		}
+		start = next
+	}
+	return nil
+}
+
+// protectRange changes the flags of the mapped pages in the page
+// aligned virtual address range. Only the TLB of the current
+// processor is invalidated.
+//go:nosplit
+func protectRange(mem *memory, pml4 *pageTable, start, end virtualAddress, flags pageFlags) error {
+	for start < end {
+		e, size, err := pml4.leafEntry(mem, start, end)
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			e.protect(flags)
+			invlpg(uintptr(start))
+		}
+		next := (start + size) &^ (size - 1)
+		if next <= start {
+			break
+		}
+		start = next
+	}
+	return nil
+}
+
+// leafEntry returns the entry mapping the page aligned address, or
+// nil if no page is mapped. Huge pages extending outside the range
+// [addr; end[ are split. leafEntry also returns the size of the
+// memory mapped by the entry, or the size of the unmapped region.
+//go:nosplit
+func (pml4 *pageTable) leafEntry(mem *memory, addr, end virtualAddress) (*pageTableEntry, virtualAddress, error) {
+	e := &pml4[(addr/pageSizeRoot)%pageTableSize]
+	size := virtualAddress(pageSizeRoot)
+	for e.present() {
+		if size == pageSize || pageFlags(*e)&pageSizeFlag != 0 {
+			if addr%size == 0 && end-addr >= size {
+				return e, size, nil
+			}
+			if err := e.splitHugePage(mem, size); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		size /= pageTableSize
+		e = &e.getPageTable()[(addr/size)%pageTableSize]
+	}
+	return nil, size, nil
+}
+
+// splitHugePage replaces the mapping of a huge page of the given
+// size with a page table mapping the same memory with smaller pages.
+//go:nosplit
+func (e *pageTableEntry) splitHugePage(mem *memory, size virtualAddress) error {
+	page, err := mem.alloc(pageSize)
+	if err != nil {
+		return err
+	}
+	pt := (*pageTable)(unsafe.Pointer(physToVirt(page)))
+	addr := e.address()
+	flags := pageFlags(*e) &^ pageFlags(_MAXPHYADDR-pageSize)
+	subSize := physicalAddress(size / pageTableSize)
+	if subSize == pageSize {
+		flags &^= pageSizeFlag
+	}
+	for i := range pt {
+		pt[i] = pageTableEntry(addr+physicalAddress(i)*subSize) | pageTableEntry(flags)
+	}
+	e.setPageTable(page)
+	return nil
+}
+
+// unmap clears the entry and frees its page if it was allocated
+// for the mapping.
+//go:nosplit
+func (e *pageTableEntry) unmap(mem *memory) {
+	if pageFlags(*e)&pageFlagAllocated != 0 {
+		addr := e.address()
+		mem.setFree(true, addr, addr+pageSize)
+	}
+	*e = 0
+}
+
+// lookup returns the entry that maps the virtual address, or false
+// if no such entry exists.
+//go:nosplit
+func (pml4 *pageTable) lookup(addr virtualAddress) (*pageTableEntry, bool) {
+	pml4e := &pml4[(addr/pageSizeRoot)%pageTableSize]
+	if !pml4e.present() {
+		return nil, false
+	}
+	pdpte := &pml4e.table()[(addr/pageSize1GB)%pageTableSize]
+	if !pdpte.present() || pageFlags(*pdpte)&pageSizeFlag != 0 {
+		return pdpte, true
+	}
+	pde := &pdpte.table()[(addr/pageSize2MB)%pageTableSize]
+	if !pde.present() || pageFlags(*pde)&pageSizeFlag != 0 {
+		return pde, true
+	}
+	return &pde.table()[(addr/pageSize)%pageTableSize], true
+}
+
 //go:nosplit
 func (p *pageTable) lookupOrCreatePageTable(mem *memory, index int) (*pageTable, error) {
+	// Check the index explicitly to avoid the bounds check and its
+	// deep panic call.
+	if uint(index) >= uint(len(p)) {
+		return nil, kernError("lookupOrCreatePageTable: invalid index")
+	}
 	entry := &p[index]
 	if entry.present() {
 		return entry.getPageTable(), nil
 	}
-	page, _, err := mem.alloc(pageSize)
+	page, err := mem.alloc(pageSize)
 	if err != nil {
 		return nil, err
 	}
@@ -676,10 +1170,23 @@ func (e *pageTableEntry) getPageTable() *pageTable {
 	if pageFlags(*e)&pageSizeFlag != 0 {
 		fatal("getPageTable: not a page table")
 	}
+	return e.table()
+}
+
+// table is like getPageTable for entries known to reference a page
+// table. Unlike getPageTable it never calls fatal, so it is safe to
+// use from stack traces.
+//go:nosplit
+func (e *pageTableEntry) table() *pageTable {
+	return (*pageTable)(unsafe.Pointer(physToVirt(e.address())))
+}
+
+// address returns the physical address referenced by the entry.
+//go:nosplit
+func (e *pageTableEntry) address() physicalAddress {
 	addr := physicalAddress(*e) & (_MAXPHYADDR - 1)
 	// The address is page-aligned.
-	addr = addr & ^(physicalAddress(pageSize) - 1)
-	return (*pageTable)(unsafe.Pointer(physToVirt(addr)))
+	return addr & ^(physicalAddress(pageSize) - 1)
 }
 
 //go:nosplit
@@ -696,6 +1203,15 @@ func (e *pageTableEntry) mmap(addr physicalAddress, flags pageFlags) {
 	*e = pageTableEntry(addr) | pageTableEntry(flags)
 }
 
+// protect replaces the flags of a present entry.
+//go:nosplit
+func (e *pageTableEntry) protect(flags pageFlags) {
+	if !nxSupport {
+		flags &= ^pageFlagNX
+	}
+	e.setFlags(flags | pageFlagPresent)
+}
+
 //go:nosplit
 func (e *pageTableEntry) setFlags(flags pageFlags) {
 	*e &= ^pageTableEntry(allPageFlags)
@@ -840,6 +1356,38 @@ func (vm *virtMemory) addRange(start, end virtualAddress, flags pageFlags) bool
 	return true
 }
 
+// removeRange removes the address range from the map. Ranges
+// partially overlapping the removed range are shrunk or split.
+//go:nosplit
+func (vm *virtMemory) removeRange(start, end virtualAddress) {
+	if start < vm.next {
+		vm.next = start
+	}
+	i := vm.closestRange(start)
+	for i < len(vm.ranges) && vm.ranges[i].start < end {
+		r := &vm.ranges[i]
+		switch {
+		case r.start < start && r.end > end:
+			// Split.
+			tail := memoryRange{start: end, end: r.end, flags: r.flags}
+			r.end = start
+			vm.ranges = vm.ranges[:len(vm.ranges)+1]
+			copy(vm.ranges[i+2:], vm.ranges[i+1:])
+			vm.ranges[i+1] = tail
+			return
+		case r.start < start:
+			r.end = start
+			i++
+		case r.end > end:
+			r.start = end
+			return
+		default:
+			copy(vm.ranges[i:], vm.ranges[i+1:])
+			vm.ranges = vm.ranges[:len(vm.ranges)-1]
+		}
+	}
+}
+
 // closestRange finds the lowest index i where vm.ranges[i].end > addr.
 //go:nosplit
 func (vm *virtMemory) closestRange(addr virtualAddress) int {
@@ -865,6 +1413,27 @@ func (r memoryRange) contains(addr virtualAddress) bool {
 	return r.start <= addr && addr < r.end
 }
 
+// isUser reports whether the range is user memory.
+//go:nosplit
+func (r memoryRange) isUser() bool {
+	return r.flags&pageFlagUserAccess != 0 || r.flags == protNone
+}
+
+// permits reports whether the range allows the access described by
+// a page fault error code.
+//go:nosplit
+func (r memoryRange) permits(errCode uint64) bool {
+	switch {
+	case errCode&faultFlagWrite != 0 && r.flags&pageFlagWritable == 0:
+		return false
+	case errCode&faultFlagUser != 0 && r.flags&pageFlagUserAccess == 0:
+		return false
+	case errCode&faultFlagFetch != 0 && r.flags&pageFlagNX != 0:
+		return false
+	}
+	return true
+}
+
 //go:nosplit
 func (r memoryRange) overlaps(r2 memoryRange) bool {
 	return r.start <= r2.start && r.end > r2.start ||
@@ -883,16 +1452,13 @@ func (a virtualAddress) AlignUp() virtualAddress {
 
 //go:nosplit
 func handlePageFault(errCode uint64, addr virtualAddress) {
-	const (
-		faultFlagPresent = 1 << 0
-	)
 	if errCode&faultFlagPresent != 0 {
 		outputString("page fault address: ")
 		outputUint64(uint64(addr))
 		outputString("\n")
 		fatal("handlePageFault: page protection fault")
 	}
-	if err := faultPage(addr); err != nil {
+	if err := faultPage(addr, errCode); err != nil {
 		outputString("page fault address: ")
 		outputUint64(uint64(addr))
 		outputString("\n")
@@ -903,3 +1469,5 @@ func handlePageFault(errCode uint64, addr virtualAddress) {
 func pageFaultTrampoline()
 
 func setCR3Reg(addr uintptr)
+func invlpg(addr uintptr)
+func flushTLB()
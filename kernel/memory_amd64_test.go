@@ -0,0 +1,279 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// newTestMemory returns an allocator for npages free pages starting
+// at physical address 0, backed by a buffer in the test process.
+func newTestMemory(t *testing.T, npages int) *memory {
+	buf := make([]byte, (npages+1)*pageSize)
+	base := (uintptr(unsafe.Pointer(&buf[0])) + pageSize - 1) &^ (pageSize - 1)
+	oldOffset := physicalMapOffset
+	physicalMapOffset = virtualAddress(base)
+	t.Cleanup(func() {
+		physicalMapOffset = oldOffset
+		runtime.KeepAlive(buf)
+	})
+	m := &memory{pages: make([]pageInfo, npages)}
+	for i := range m.freeLists {
+		m.freeLists[i] = noBlock
+	}
+	m.setFree(true, 0, physicalAddress(npages*pageSize))
+	return m
+}
+
+// freeBlocks returns the number of free blocks of every order.
+func freeBlocks(m *memory) [maxOrder + 1]int {
+	var n [maxOrder + 1]int
+	for k, p := range m.freeLists {
+		for p != noBlock {
+			n[k]++
+			p = m.pages[p].next
+		}
+	}
+	return n
+}
+
+func TestAllocSplitMerge(t *testing.T) {
+	m := newTestMemory(t, 16)
+	if n := freeBlocks(m); n[4] != 1 {
+		t.Fatalf("free blocks: %v, want a single block of order 4", n[:5])
+	}
+	addr, err := m.alloc(pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != 0 {
+		t.Errorf("alloc returned %#x, want 0", addr)
+	}
+	if n := freeBlocks(m); n != [maxOrder + 1]int{1, 1, 1, 1} {
+		t.Errorf("free blocks after split: %v, want one of each order below 4", n[:5])
+	}
+	if err := m.free(addr, pageSize); err != nil {
+		t.Fatal(err)
+	}
+	if n := freeBlocks(m); n != [maxOrder + 1]int{4: 1} {
+		t.Errorf("free blocks after merge: %v, want a single block of order 4", n[:5])
+	}
+}
+
+func TestAllocAligned(t *testing.T) {
+	m := newTestMemory(t, 64)
+	if _, err := m.alloc(pageSize); err != nil {
+		t.Fatal(err)
+	}
+	// Dirty the memory to check that allocations are zeroed.
+	mem := sliceForMem(physToVirt(0), 64*pageSize)
+	for i := range mem {
+		mem[i] = 0xff
+	}
+	const align = 8 * pageSize
+	addr, err := m.allocAligned(3*pageSize, align)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr == 0 || addr%align != 0 {
+		t.Errorf("allocAligned returned %#x, want a non-zero multiple of %#x", addr, align)
+	}
+	for i, b := range sliceForMem(physToVirt(addr), 3*pageSize) {
+		if b != 0 {
+			t.Fatalf("allocated memory not zeroed at offset %d", i)
+		}
+	}
+	// The pages of the aligned block past the allocation are free.
+	for p := int(addr/pageSize) + 3; p < int((addr+align)/pageSize); p++ {
+		if _, _, ok := m.findBlock(p); !ok {
+			t.Errorf("page %d past the allocation is not free", p)
+		}
+	}
+	if _, err := m.allocAligned(pageSize, 3*pageSize); err == nil {
+		t.Error("allocAligned accepted an alignment that is not a power of two")
+	}
+	if _, err := m.allocAligned(128*pageSize, pageSize); err == nil {
+		t.Error("allocAligned succeeded beyond the end of memory")
+	}
+}
+
+func TestAllocPageBelow(t *testing.T) {
+	m := newTestMemory(t, 16)
+	const limit = 3 * pageSize
+	// The first page is never returned.
+	for _, want := range []physicalAddress{pageSize, 2 * pageSize} {
+		addr, err := m.allocPageBelow(limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr != want {
+			t.Errorf("allocPageBelow returned %#x, want %#x", addr, want)
+		}
+	}
+	if addr, err := m.allocPageBelow(limit); err == nil {
+		t.Errorf("allocPageBelow returned %#x, want out of memory", addr)
+	}
+	// The rest of the memory is still free.
+	if _, _, ok := m.findBlock(0); !ok {
+		t.Error("first page is not free")
+	}
+	for p := 3; p < 16; p++ {
+		if _, _, ok := m.findBlock(p); !ok {
+			t.Errorf("page %d is not free", p)
+		}
+	}
+}
+
+func TestFreeUser(t *testing.T) {
+	m := newTestMemory(t, 16)
+	const size = pageSize + 1
+	addr, err := m.allocUser(size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.freeUser(addr, 3*pageSize); err == nil {
+		t.Error("freeUser accepted a larger size")
+	}
+	if err := m.freeUser(addr+pageSize, pageSize); err == nil {
+		t.Error("freeUser accepted a range inside the allocation")
+	}
+	free, err := m.alloc(pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.freeUser(free, pageSize); err == nil {
+		t.Error("freeUser accepted memory not allocated by allocUser")
+	}
+	if err := m.freeUser(addr, size); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.freeUser(addr, size); err == nil {
+		t.Error("freeUser accepted a double free")
+	}
+	if err := m.free(free, pageSize); err != nil {
+		t.Fatal(err)
+	}
+	if n := freeBlocks(m); n != [maxOrder + 1]int{4: 1} {
+		t.Errorf("free blocks: %v, want a single block of order 4", n[:5])
+	}
+}
+
+// freePages returns the number of free pages.
+func freePages(m *memory) int {
+	n := 0
+	for p := range m.pages {
+		if _, _, ok := m.findBlock(p); ok {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRemoveRange(t *testing.T) {
+	vm := &virtMemory{ranges: make([]memoryRange, 0, 4), next: 0x9000}
+	vm.mustAddRange(0x1000, 0x5000, pageFlagWritable)
+	vm.mustAddRange(0x6000, 0x8000, pageFlagNX)
+	check := func(want ...memoryRange) {
+		t.Helper()
+		if len(vm.ranges) != len(want) {
+			t.Fatalf("ranges: %+v, want %+v", vm.ranges, want)
+		}
+		for i, r := range vm.ranges {
+			if r != want[i] {
+				t.Fatalf("ranges: %+v, want %+v", vm.ranges, want)
+			}
+		}
+	}
+	// Split a range.
+	vm.removeRange(0x2000, 0x3000)
+	check(
+		memoryRange{0x1000, 0x2000, pageFlagWritable},
+		memoryRange{0x3000, 0x5000, pageFlagWritable},
+		memoryRange{0x6000, 0x8000, pageFlagNX},
+	)
+	if vm.next != 0x2000 {
+		t.Errorf("next address %#x, want %#x", vm.next, 0x2000)
+	}
+	// Shrink the ranges on both sides of a hole.
+	vm.removeRange(0x4000, 0x7000)
+	check(
+		memoryRange{0x1000, 0x2000, pageFlagWritable},
+		memoryRange{0x3000, 0x4000, pageFlagWritable},
+		memoryRange{0x7000, 0x8000, pageFlagNX},
+	)
+	vm.removeRange(0, 0x10000)
+	check()
+}
+
+func TestUnmapFreesPages(t *testing.T) {
+	m := newTestMemory(t, 64)
+	pml4 := new(pageTable)
+	const (
+		start = 0x400000
+		end   = start + 4*pageSize
+	)
+	for a := virtualAddress(start); a < end; a += pageSize {
+		page, err := m.alloc(pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mmapAligned(m, pml4, a, a+pageSize, page, pageFlagWritable|pageFlagAllocated); err != nil {
+			t.Fatal(err)
+		}
+	}
+	free := freePages(m)
+	for a := virtualAddress(start); a < end; a += pageSize {
+		e, size, err := pml4.leafEntry(m, a, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil || size != pageSize {
+			t.Fatalf("no page mapped at %#x", a)
+		}
+		e.unmap(m)
+		if e, ok := pml4.lookup(a); ok && e.present() {
+			t.Errorf("page at %#x still mapped", a)
+		}
+	}
+	if n := freePages(m); n != free+4 {
+		t.Errorf("%d free pages after unmap, want %d", n, free+4)
+	}
+}
+
+func TestSplitHugePage(t *testing.T) {
+	m := newTestMemory(t, 16)
+	pml4 := new(pageTable)
+	const (
+		vaddr = 0x200000
+		paddr = 0x40000000
+	)
+	if err := mmapAligned(m, pml4, vaddr, vaddr+pageSize2MB, paddr, pageFlagWritable); err != nil {
+		t.Fatal(err)
+	}
+	free := freePages(m)
+	// Unmap a single page in the middle of the huge page.
+	e, size, err := pml4.leafEntry(m, vaddr+pageSize, vaddr+2*pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || size != pageSize || e.address() != paddr+pageSize {
+		t.Fatalf("leafEntry returned %#x of size %#x, want a page at %#x", e.address(), size, paddr+pageSize)
+	}
+	e.unmap(m)
+	// Splitting allocated a page table, and the unmapped page was
+	// not allocated by the mapping.
+	if n := freePages(m); n != free-1 {
+		t.Errorf("%d free pages after split, want %d", n, free-1)
+	}
+	for _, a := range []virtualAddress{vaddr, vaddr + 2*pageSize, vaddr + pageSize2MB - pageSize} {
+		e, ok := pml4.lookup(a)
+		if !ok || !e.present() || e.address() != paddr+physicalAddress(a-vaddr) {
+			t.Errorf("page at %#x not mapped to %#x after split", a, paddr+physicalAddress(a-vaddr))
+		}
+	}
+	if e, ok := pml4.lookup(vaddr + pageSize); ok && e.present() {
+		t.Error("unmapped page still present")
+	}
+}
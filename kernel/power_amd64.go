@@ -0,0 +1,123 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import "eliasnaur.com/unik/kernel/acpi"
+
+const (
+	// isaDebugExitPort is the port of Qemu's isa-debug-exit
+	// device. Qemu exits with status (value<<1)|1 when a value is
+	// written to it.
+	isaDebugExitPort = 0xf4
+
+	// The keyboard controller command port and the command for
+	// pulsing the processor reset line.
+	kbdControllerPort = 0x64
+	kbdInputFull      = 1 << 1
+	kbdResetCmd       = 0xfe
+
+	// PM1 control register fields.
+	pm1SCIEnable   = 1 << 0
+	pm1SleepType   = 10
+	pm1SleepEnable = 1 << 13
+
+	// acpiS5 is the soft-off sleep state.
+	acpiS5 = 5
+)
+
+// Magic values and commands of the reboot system call.
+const (
+	_LINUX_REBOOT_MAGIC1 = 0xfee1dead
+	_LINUX_REBOOT_MAGIC2 = 672274793
+
+	_LINUX_REBOOT_CMD_RESTART   = 0x01234567
+	_LINUX_REBOOT_CMD_HALT      = 0xcdef0123
+	_LINUX_REBOOT_CMD_POWER_OFF = 0x4321fedc
+)
+
+// powerOff turns off the machine. The exit code is propagated to
+// the host when running in Qemu with the isa-debug-exit device. It
+// returns only if no power off method worked.
+//go:nosplit
+func powerOff(code int) {
+	// ACPI soft-off loses the exit code; try the debug exit device
+	// first for unsuccessful exits.
+	if code != 0 {
+		outl(isaDebugExitPort, uint32(code))
+	}
+	acpiPowerOff()
+	outl(isaDebugExitPort, uint32(code))
+}
+
+// acpiPowerOff enters the ACPI S5 sleep state.
+//go:nosplit
+func acpiPowerOff() {
+	f := &acpiTables.FADT
+	if !f.Present || f.PM1aControl == 0 {
+		return
+	}
+	typA, typB, ok := acpiTables.SleepType(acpiS5, mapACPI)
+	if !ok {
+		return
+	}
+	if !enableACPI() {
+		return
+	}
+	outw(uint16(f.PM1aControl), typA<<pm1SleepType|pm1SleepEnable)
+	if f.PM1bControl != 0 {
+		outw(uint16(f.PM1bControl), typB<<pm1SleepType|pm1SleepEnable)
+	}
+	// Give the hardware time to act.
+	for i := 0; i < 1000000; i++ {
+		pause()
+	}
+}
+
+// enableACPI switches the machine from legacy to ACPI mode, if
+// necessary.
+//go:nosplit
+func enableACPI() bool {
+	f := &acpiTables.FADT
+	if inw(uint16(f.PM1aControl))&pm1SCIEnable != 0 {
+		return true
+	}
+	if f.SMICommand == 0 || f.ACPIEnable == 0 {
+		// Hardware without legacy mode.
+		return true
+	}
+	outb(uint16(f.SMICommand), f.ACPIEnable)
+	for i := 0; i < 1000000; i++ {
+		if inw(uint16(f.PM1aControl))&pm1SCIEnable != 0 {
+			return true
+		}
+		pause()
+	}
+	return false
+}
+
+// reboot resets the machine. It returns only if no reset method
+// worked.
+//go:nosplit
+func reboot() {
+	f := &acpiTables.FADT
+	if f.Present && f.Flags&acpi.FlagResetReg != 0 && f.ResetReg.Space == acpi.SpaceIO {
+		outb(uint16(f.ResetReg.Addr), f.ResetValue)
+	}
+	// Pulse the reset line through the keyboard controller.
+	for i := 0; i < 1000000; i++ {
+		if inb(kbdControllerPort)&kbdInputFull == 0 {
+			break
+		}
+		pause()
+	}
+	outb(kbdControllerPort, kbdResetCmd)
+	for i := 0; i < 1000000; i++ {
+		pause()
+	}
+	// Fall back to a triple fault.
+	tripleFault()
+}
+
+func outw(port uint16, w uint16)
+func inw(port uint16) uint16
+func tripleFault()
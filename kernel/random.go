@@ -0,0 +1,17 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// AddEntropy mixes p into the entropy pool of the kernel, which
+// supplies getrandom(2), /dev/urandom and in turn crypto/rand.
+func AddEntropy(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	syscall.Syscall(_SYS_addentropy, uintptr(unsafe.Pointer(&p[0])), uintptr(len(p)), 0)
+}
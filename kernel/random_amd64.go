@@ -0,0 +1,230 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import "unsafe"
+
+// The kernel entropy pool is a ChaCha20 (RFC 8439) generator whose
+// key accumulates the available entropy: RDSEED and RDRAND output when
+// the processor supports them, timing jitter, and entropy added by the
+// program, for example from a virtio-rng device. The key is replaced
+// after every use, so the state doesn't reveal earlier output.
+
+const (
+	_GRND_NONBLOCK = 0x1
+	_GRND_RANDOM   = 0x2
+	_GRND_INSECURE = 0x4
+
+	_AT_RANDOM = 25
+
+	// maxGetrandom bounds the length of a getrandom read.
+	maxGetrandom = 1 << 16
+	// hwRandomRetries is the number of attempts to read a value
+	// from RDSEED or RDRAND before giving up.
+	hwRandomRetries = 10
+	// jitterSamples is the number of timing samples mixed into
+	// the pool at startup.
+	jitterSamples = 64
+)
+
+// entropyPool is the state of the generator.
+type entropyPool struct {
+	lock spinlock
+	key  [8]uint32
+	// counter is the block counter of the generator.
+	counter uint64
+	// rdrand and rdseed are set if the processor supports the
+	// instructions.
+	rdrand bool
+	rdseed bool
+}
+
+// chachaBlock is a block of ChaCha20 output.
+type chachaBlock [16]uint32
+
+// Nonces separate the key updates from the output.
+const (
+	nonceOutput = 0
+	nonceRekey  = 1
+)
+
+var globalRandom entropyPool
+
+// initRandom seeds the entropy pool.
+//go:nosplit
+func initRandom() {
+	p := &globalRandom
+	if max, _, _, _ := cpuid(0, 0); max >= 7 {
+		_, ebx, _, _ := cpuid(7, 0)
+		p.rdseed = ebx&(1<<18) != 0
+	}
+	_, _, ecx, _ := cpuid(1, 0)
+	p.rdrand = ecx&(1<<30) != 0
+	// The duration of CPUID varies with the state of caches and
+	// pipelines, and with the hypervisor in virtual machines. It
+	// is a poor source, but the only one on processors without
+	// RDRAND.
+	p.lock.lock()
+	for i := 0; i < jitterSamples; i += 4 {
+		var seed [4]uint64
+		for j := range seed {
+			seed[j] = rdtsc()
+			cpuid(0, 0)
+		}
+		p.mix(seed[:])
+	}
+	p.reseed()
+	p.lock.unlock()
+}
+
+// addEntropy mixes b into the entropy pool.
+//go:nosplit
+func addEntropy(b []byte) {
+	p := &globalRandom
+	for len(b) > 0 {
+		var words [8]uint64
+		n := copy((*[64]byte)(unsafe.Pointer(&words))[:], b)
+		b = b[n:]
+		p.lock.lock()
+		p.mix(words[:])
+		p.lock.unlock()
+	}
+}
+
+// readRandom fills b with random bytes.
+//go:nosplit
+func readRandom(b []byte) {
+	p := &globalRandom
+	p.lock.lock()
+	p.reseed()
+	p.lock.unlock()
+	for len(b) > 0 {
+		var blk chachaBlock
+		p.lock.lock()
+		p.block(&blk, nonceOutput)
+		p.lock.unlock()
+		n := copy(b, (*[64]byte)(unsafe.Pointer(&blk))[:])
+		b = b[n:]
+	}
+	p.lock.lock()
+	p.rekey()
+	p.lock.unlock()
+}
+
+// reseed mixes hardware random values into the pool, if available.
+//go:nosplit
+func (p *entropyPool) reseed() {
+	key := (*[4]uint64)(unsafe.Pointer(&p.key))
+	for i := range key {
+		v, ok := p.hwRandom()
+		if !ok {
+			break
+		}
+		key[i] ^= v
+	}
+	p.rekey()
+}
+
+// hwRandom returns a value from RDSEED or, failing that, RDRAND.
+//go:nosplit
+func (p *entropyPool) hwRandom() (uint64, bool) {
+	for i := 0; i < hwRandomRetries; i++ {
+		if p.rdseed {
+			if v, ok := rdseed(); ok {
+				return v, true
+			}
+		}
+		if p.rdrand {
+			if v, ok := rdrand(); ok {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// mix adds words to the key. The key is replaced after every 4
+// words, so the key always depends on all of the input.
+//go:nosplit
+func (p *entropyPool) mix(words []uint64) {
+	key := (*[4]uint64)(unsafe.Pointer(&p.key))
+	for i, w := range words {
+		key[i&3] ^= w
+		if i&3 == 3 || i == len(words)-1 {
+			p.rekey()
+		}
+	}
+}
+
+// rekey replaces the key with output of the generator.
+//go:nosplit
+func (p *entropyPool) rekey() {
+	var blk chachaBlock
+	p.block(&blk, nonceRekey)
+	copy(p.key[:], blk[:8])
+}
+
+// block computes the next block of output for the nonce.
+//go:nosplit
+func (p *entropyPool) block(out *chachaBlock, nonce uint32) {
+	// "expand 32-byte k".
+	*out = chachaBlock{
+		0x61707865, 0x3320646e, 0x79622d32, 0x6b206574,
+		p.key[0], p.key[1], p.key[2], p.key[3],
+		p.key[4], p.key[5], p.key[6], p.key[7],
+		uint32(p.counter), uint32(p.counter >> 32), nonce, 0,
+	}
+	p.counter++
+	in := *out
+	x := out
+	for i := 0; i < 10; i++ {
+		for _, r := range chachaRounds {
+			// Masking the indices elides bounds checks.
+			a, b, c, d := r[0]&15, r[1]&15, r[2]&15, r[3]&15
+			x[a] += x[b]
+			x[d] = rotl(x[d]^x[a], 16)
+			x[c] += x[d]
+			x[b] = rotl(x[b]^x[c], 12)
+			x[a] += x[b]
+			x[d] = rotl(x[d]^x[a], 8)
+			x[c] += x[d]
+			x[b] = rotl(x[b]^x[c], 7)
+		}
+	}
+	for i := range x {
+		x[i] += in[i]
+	}
+}
+
+// chachaRounds lists the quarter rounds of a ChaCha double round:
+// the column rounds followed by the diagonal rounds.
+var chachaRounds = [8][4]uint8{
+	{0, 4, 8, 12}, {1, 5, 9, 13}, {2, 6, 10, 14}, {3, 7, 11, 15},
+	{0, 5, 10, 15}, {1, 6, 11, 12}, {2, 7, 8, 13}, {3, 4, 9, 14},
+}
+
+//go:nosplit
+func rotl(v uint32, n uint) uint32 {
+	return v<<n | v>>(32-n)
+}
+
+// sysGetrandom implements getrandom(2). The pool is seeded at
+// startup, so reads never block.
+//go:nosplit
+func sysGetrandom(buf virtualAddress, n, flags uint64) uint64 {
+	if flags&^(_GRND_NONBLOCK|_GRND_RANDOM|_GRND_INSECURE) != 0 ||
+		flags&(_GRND_RANDOM|_GRND_INSECURE) == _GRND_RANDOM|_GRND_INSECURE {
+		return _EINVAL
+	}
+	if n > maxGetrandom {
+		n = maxGetrandom
+	}
+	if !userAccessible(buf, n, true) {
+		return _EFAULT
+	}
+	readRandom(sliceForMem(buf, int(n)))
+	return n
+}
+
+func rdrand() (uint64, bool)
+func rdseed() (uint64, bool)
@@ -25,18 +25,17 @@ type tss [25]uint32
 // initialization.
 var globalIDT idt
 
-// Golbal task state structure, never touched after initialization.
-var globalTSS tss
-
-// The global descriptor table, never touched after initialization.
-var globalGDT [segmentEnd]segmentDescriptor
-
-// Interrupt and SYSCALL stack.
+// Interrupt stacks for the boot processor. The application
+// processors allocate their own.
 var (
 	istack         stack
 	pageFaultStack stack
 )
 
+// gdt is a global descriptor table. Each processor has its own,
+// because the TSS is per processor.
+type gdt [segmentEnd]segmentDescriptor
+
 // Segment selectors. Note that the SYSCALL/SYSRET
 // instructions force the particular positions of the selectors.
 // See the Intel Architectures Manual Vol 3., 5.8.8 ("Fast System
@@ -92,35 +91,41 @@ const (
 	// Use a separate stack for page faults to handle faults
 	// that occur during interrupts.
 	istPageFault = 2
+	// istTraceback is the stack of the traceback interrupt.
+	istTraceback = 3
 )
 
+// loadGDT sets up and loads the descriptor table and task state
+// structure of the processor.
 //go:nosplit
-func loadGDT() {
-	globalTSS.setISP(istGeneric, uint64(istack.top()))
-	globalTSS.setISP(istPageFault, uint64(pageFaultStack.top()))
-	globalTSS.setRSP(0, uint64(istack.top()))
-	tssAddr := uintptr(unsafe.Pointer(&globalTSS))
-	tssLimit := uint32(unsafe.Sizeof(globalTSS) - 1)
+func (c *cpu) loadGDT() {
+	tss, gdt := &c.tss, &c.gdt
+	tss.setISP(istGeneric, c.istackTop)
+	tss.setISP(istPageFault, c.pageFaultStackTop)
+	tss.setISP(istTraceback, uint64(tracebackStack.top()))
+	tss.setRSP(0, c.istackTop)
+	tssAddr := uintptr(unsafe.Pointer(tss))
+	tssLimit := uint32(unsafe.Sizeof(*tss) - 1)
 	// Block all I/O ports.
-	globalTSS.setIOPerm(uint16(tssLimit + 1))
-	globalGDT[segmentCode0] = newSegmentDescriptor(0, 0, segFlagSystem|segFlagCode|segFlagLong, ring0)
-	globalGDT[segmentData0] = newSegmentDescriptor(0, 0, segFlagSystem|segFlagWrite, ring0)
-	globalGDT[segment32Code3] = newSegmentDescriptor(0, 0, segFlagSystem|segFlagCode|segFlagLong, ring3)
-	globalGDT[segmentData3] = newSegmentDescriptor(0, 0, segFlagSystem|segFlagWrite, ring3)
-	globalGDT[segment64Code3] = newSegmentDescriptor(0, 0, segFlagSystem|segFlagCode|segFlagLong, ring3)
+	tss.setIOPerm(uint16(tssLimit + 1))
+	gdt[segmentCode0] = newSegmentDescriptor(0, 0, segFlagSystem|segFlagCode|segFlagLong, ring0)
+	gdt[segmentData0] = newSegmentDescriptor(0, 0, segFlagSystem|segFlagWrite, ring0)
+	gdt[segment32Code3] = newSegmentDescriptor(0, 0, segFlagSystem|segFlagCode|segFlagLong, ring3)
+	gdt[segmentData3] = newSegmentDescriptor(0, 0, segFlagSystem|segFlagWrite, ring3)
+	gdt[segment64Code3] = newSegmentDescriptor(0, 0, segFlagSystem|segFlagCode|segFlagLong, ring3)
 	// The 64-bit TSS structure spans two descriptor entries,
 	// with the high 32-bit address in the second entry.
-	globalGDT[segmentTSS0] = newSegmentDescriptor(uint32(tssAddr), tssLimit, segFlagAccess|segFlagCode, ring0)
-	globalGDT[segmentTSS0High] = segmentDescriptor(tssAddr >> 32)
+	gdt[segmentTSS0] = newSegmentDescriptor(uint32(tssAddr), tssLimit, segFlagAccess|segFlagCode, ring0)
+	gdt[segmentTSS0High] = segmentDescriptor(tssAddr >> 32)
 	// The GDT register is a 10 byte value: a 16-bit limit followed by
 	// the 64-bit address.
 	var gdtAddr [10]uint8
-	addr := uintptr(unsafe.Pointer(&globalGDT))
+	addr := uintptr(unsafe.Pointer(gdt))
 	// GDT should be 8-byte aligned for best performance.
 	if addr%8 != 0 {
 		fatal("loadGDT: bad GDT alignment")
 	}
-	limit := unsafe.Sizeof(globalGDT) - 1
+	limit := unsafe.Sizeof(*gdt) - 1
 	binary.LittleEndian.PutUint64(gdtAddr[2:], uint64(addr))
 	binary.LittleEndian.PutUint16(gdtAddr[:2], uint16(limit))
 	lgdt(uint64(uintptr(unsafe.Pointer(&gdtAddr))))
@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import "os"
+
+// Serial is the first serial port, COM1. The kernel receives its
+// input through interrupts. Unless the console is served, the
+// standard input reads from the serial port as well, and competes
+// with Serial for its input.
+type Serial struct {
+	f     *os.File
+	input chan []byte
+}
+
+// OpenSerial opens the first serial port.
+func OpenSerial() (*Serial, error) {
+	f, err := os.OpenFile("/dev/ttyS0", os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	s := &Serial{
+		f:     f,
+		input: make(chan []byte),
+	}
+	go s.receive()
+	return s, nil
+}
+
+func (s *Serial) receive() {
+	defer close(s.input)
+	for {
+		buf := make([]byte, 256)
+		n, err := s.f.Read(buf)
+		if n > 0 {
+			s.input <- buf[:n]
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Input returns a channel that receives the data arriving at the
+// port. The channel is closed if the port has no input.
+func (s *Serial) Input() <-chan []byte {
+	return s.input
+}
+
+// Write transmits p.
+func (s *Serial) Write(p []byte) (int, error) {
+	return s.f.Write(p)
+}
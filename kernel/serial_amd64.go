@@ -0,0 +1,194 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+// Driver for the 16550 UART of the first serial port. The kernel
+// writes its diagnostics and the console output to the port, and
+// buffers its input for the console and /dev/ttyS0.
+
+const COM1 = 0x3f8
+
+// UART registers, relative to the port base.
+const (
+	uartRBR = 0 // Receive buffer (read).
+	uartTHR = 0 // Transmit holding (write).
+	uartDLL = 0 // Divisor latch, low byte (DLAB set).
+	uartIER = 1 // Interrupt enable.
+	uartDLM = 1 // Divisor latch, high byte (DLAB set).
+	uartFCR = 2 // FIFO control (write).
+	uartLCR = 3 // Line control.
+	uartMCR = 4 // Modem control.
+	uartLSR = 5 // Line status.
+	uartSCR = 7 // Scratch.
+)
+
+// UART register bits.
+const (
+	uartIERReceive = 1 << 0
+
+	uartFCREnable    = 1 << 0
+	uartFCRClearRx   = 1 << 1
+	uartFCRClearTx   = 1 << 2
+	uartFCRTrigger14 = 0b11 << 6
+
+	uartLCR8N1  = 0b11
+	uartLCRDLAB = 1 << 7
+
+	uartMCRDTR  = 1 << 0
+	uartMCRRTS  = 1 << 1
+	uartMCROut2 = 1 << 3 // Gates the interrupt line.
+
+	uartLSRDataReady = 1 << 0
+	uartLSRTHREmpty  = 1 << 5
+)
+
+const (
+	uartFIFOSize = 16
+	// uartClock is the base rate of the baud rate divisor.
+	uartClock      = 115200
+	serialBaudRate = 115200
+	serialIRQ      = 4
+)
+
+// serial is the state of the serial port. It is written by
+// initSerial and may be read without locking afterwards.
+var serial struct {
+	// fifo is set when the transmit FIFO is enabled.
+	fifo bool
+	// input is set when the port interrupts on received data.
+	input bool
+}
+
+// serialLock serializes writers of the transmit FIFO.
+var serialLock spinlock
+
+// initSerial configures the serial port for 115200 baud, 8 data bits,
+// no parity and 1 stop bit, and enables its receive interrupt.
+//go:nosplit
+func initSerial() {
+	const scratch = 0xa5
+	outb(COM1+uartSCR, scratch)
+	if inb(COM1+uartSCR) != scratch {
+		return
+	}
+	outb(COM1+uartIER, 0)
+	const divisor = uartClock / serialBaudRate
+	outb(COM1+uartLCR, uartLCRDLAB)
+	outb(COM1+uartDLL, uint8(divisor))
+	outb(COM1+uartDLM, uint8(divisor>>8))
+	outb(COM1+uartLCR, uartLCR8N1)
+	outb(COM1+uartFCR, uartFCREnable|uartFCRClearRx|uartFCRClearTx|uartFCRTrigger14)
+	outb(COM1+uartMCR, uartMCRDTR|uartMCRRTS|uartMCROut2)
+	serial.fifo = true
+	if !routeISAInterrupt(serialIRQ, intSerial) {
+		return
+	}
+	// Discard stale input.
+	for inb(COM1+uartLSR)&uartLSRDataReady != 0 {
+		inb(COM1 + uartRBR)
+	}
+	serial.input = true
+	outb(COM1+uartIER, uartIERReceive)
+}
+
+// serialWrite writes b to the serial port.
+//go:nosplit
+func serialWrite(b []byte) {
+	chunk := 1
+	if serial.fifo {
+		chunk = uartFIFOSize
+	}
+	serialLock.lock()
+	for len(b) > 0 {
+		n := chunk
+		if n > len(b) {
+			n = len(b)
+		}
+		serialWait()
+		for i := 0; i < n; i++ {
+			outb(COM1+uartTHR, b[i])
+		}
+		b = b[n:]
+	}
+	serialLock.unlock()
+}
+
+// serialWriteByte writes c to the serial port. Unlike serialWrite,
+// it doesn't lock and is safe to use for diagnostics.
+//go:nosplit
+func serialWriteByte(c byte) {
+	serialWait()
+	outb(COM1+uartTHR, c)
+}
+
+// serialWait waits for the transmitter to become empty. Missing ports
+// read as all ones and never wait.
+//go:nosplit
+func serialWait() {
+	for inb(COM1+uartLSR)&uartLSRTHREmpty == 0 {
+		pause()
+	}
+}
+
+// serialInterrupt moves received data to the serial input buffer.
+//go:nosplit
+func serialInterrupt() {
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	var buf [uartFIFOSize]byte
+	for {
+		n := 0
+		for n < len(buf) && inb(COM1+uartLSR)&uartLSRDataReady != 0 {
+			buf[n] = inb(COM1 + uartRBR)
+			n++
+		}
+		if n == 0 {
+			break
+		}
+		// Drop the data that doesn't fit.
+		fs.serial.write(buf[:n])
+	}
+	woken := fs.notifySerial()
+	ts.lock.unlock()
+	if woken {
+		wakeIdleCPUs()
+	}
+}
+
+// readSerial reads serial input into p.
+//go:nosplit
+func (fs *files) readSerial(p []byte) uint64 {
+	if fs.serial.n == 0 {
+		if !serial.input {
+			// There is no input.
+			return 0
+		}
+		return _EAGAIN
+	}
+	return uint64(fs.serial.read(p))
+}
+
+// serialReady returns the readiness events of serial port files.
+//go:nosplit
+func (fs *files) serialReady() uint32 {
+	ev := uint32(_EPOLLOUT)
+	if fs.serial.n > 0 || !serial.input {
+		ev |= _EPOLLIN
+	}
+	return ev
+}
+
+// notifySerial records the arrival of serial input and reports
+// whether a thread may have become runnable.
+//go:nosplit
+func (fs *files) notifySerial() bool {
+	for i := range fs.files {
+		if fs.files[i].kind == fileSerial {
+			fs.notify(int32(i))
+		}
+	}
+	return fs.hasWaiters()
+}
+
+func serialTrampoline()
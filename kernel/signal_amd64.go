@@ -0,0 +1,500 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Signal delivery, enough for the Go runtime's use of signals for
+// asynchronous preemption. The signal frame layout mimics the Linux
+// kernel's rt_sigframe.
+
+const (
+	_SIGILL  = 4
+	_SIGBUS  = 7
+	_SIGFPE  = 8
+	_SIGKILL = 9
+	_SIGSEGV = 11
+	_SIGSTOP = 19
+
+	// Number of signals, numbered from 1.
+	nsig = 64
+
+	_SIG_DFL = 0
+	_SIG_IGN = 1
+
+	_SIG_BLOCK   = 0
+	_SIG_UNBLOCK = 1
+	_SIG_SETMASK = 2
+
+	_SA_SIGINFO   = 0x4
+	_SA_ONSTACK   = 0x08000000
+	_SA_RESTORER  = 0x04000000
+	_SA_NODEFER   = 0x40000000
+	_SA_RESETHAND = 0x80000000
+
+	_SS_ONSTACK = 1
+	_SS_DISABLE = 2
+
+	// Signal codes.
+	_SI_USER     = 0
+	_SI_KERNEL   = 0x80
+	_SI_TKILL    = -6
+	_SEGV_MAPERR = 1
+	_SEGV_ACCERR = 2
+	_BUS_ADRALN  = 1
+	_ILL_ILLOPN  = 2
+	_FPE_INTDIV  = 1
+	_FPE_FLTDIV  = 3
+	_FPE_FLTOVF  = 4
+	_FPE_FLTUND  = 5
+	_FPE_FLTRES  = 6
+	_FPE_FLTINV  = 7
+
+	// The size of the sigset_t type in system calls.
+	sigsetSize = 8
+
+	// The amd64 ABI reserves 128 bytes below the stack pointer.
+	redZoneSize = 128
+
+	// Process ID reported by getpid.
+	processID = 1
+)
+
+// Flags a signal handler may change in the ucontext before
+// returning.
+const userFlags = 1<<0 | // CF.
+	1<<2 | // PF.
+	1<<4 | // AF.
+	1<<6 | // ZF.
+	1<<7 | // SF.
+	_FLAG_DF |
+	1<<11 | // OF.
+	_FLAG_AC
+
+// sigaction is the kernel layout of struct sigaction.
+type sigaction struct {
+	handler  uint64
+	flags    uint64
+	restorer uint64
+	mask     uint64
+}
+
+// stackt is the layout of stack_t.
+type stackt struct {
+	sp    uint64
+	flags int32
+	_     int32
+	size  uint64
+}
+
+// sigcontext is the layout of the Linux struct sigcontext for
+// amd64.
+type sigcontext struct {
+	r8, r9, r10, r11, r12, r13, r14, r15 uint64
+	di, si, bp, bx, dx, ax, cx, sp, ip   uint64
+	flags                                uint64
+	cs, gs, fs, _                        uint16
+	err, trapno, oldmask, cr2            uint64
+	fpstate                              uint64
+	_                                    [8]uint64
+}
+
+type ucontext struct {
+	flags    uint64
+	link     uint64
+	stack    stackt
+	mcontext sigcontext
+	sigmask  uint64
+}
+
+type siginfo struct {
+	signo int32
+	errno int32
+	code  int32
+	_     int32
+	// addr is the fault address for SIGSEGV, SIGBUS and
+	// SIGFPE. For user signals, it contains the sender pid and
+	// uid.
+	addr uint64
+	_    [13]uint64
+}
+
+// sigframe is the signal frame pushed on the stack of the thread.
+// Its address is 8 bytes off the 16 byte stack alignment, as if the
+// handler was called by the restorer function.
+type sigframe struct {
+	restorer uint64
+	uc       ucontext
+	info     siginfo
+}
+
+// signals is the per-thread signal state. It is protected by the
+// scheduler lock.
+type signals struct {
+	mask     uint64
+	pending  uint64
+	altstack stackt
+	// info holds the siginfo of the most recent signal.
+	info siginfo
+	// trapno and err are the exception vector and error code
+	// of a fault signal.
+	trapno uint64
+	err    uint64
+}
+
+// sigactions are the signal handlers, shared by every thread.
+// It is protected by the scheduler lock.
+var sigactions [nsig + 1]sigaction
+
+//go:nosplit
+func sigbit(sig int) uint64 {
+	return 1 << uint(sig-1)
+}
+
+// unblockable is the set of signals that can't be blocked.
+const unblockable = 1<<(_SIGKILL-1) | 1<<(_SIGSTOP-1)
+
+// sysSigaction implements rt_sigaction.
+//go:nosplit
+func sysSigaction(sig int, act, oact *sigaction, size uint64) uint64 {
+	if size != sigsetSize || sig < 1 || sig > nsig {
+		return _EINVAL
+	}
+	if act != nil && (sig == _SIGKILL || sig == _SIGSTOP) {
+		return _EINVAL
+	}
+	if !userPtr(unsafe.Pointer(act), unsafe.Sizeof(*act), false) || !userPtr(unsafe.Pointer(oact), unsafe.Sizeof(*oact), true) {
+		return _EFAULT
+	}
+	ts := &globalThreads
+	ts.lock.lock()
+	if oact != nil {
+		*oact = sigactions[sig]
+	}
+	if act != nil {
+		sigactions[sig] = *act
+	}
+	ts.lock.unlock()
+	return _EOK
+}
+
+// sysSigprocmask implements rt_sigprocmask.
+//go:nosplit
+func (t *thread) sysSigprocmask(how int, set, oset *uint64, size uint64) uint64 {
+	if size != sigsetSize {
+		return _EINVAL
+	}
+	if !userPtr(unsafe.Pointer(set), unsafe.Sizeof(*set), false) || !userPtr(unsafe.Pointer(oset), unsafe.Sizeof(*oset), true) {
+		return _EFAULT
+	}
+	ts := &globalThreads
+	ts.lock.lock()
+	s := &t.signals
+	old := s.mask
+	ret := uint64(_EOK)
+	if set != nil {
+		switch how {
+		case _SIG_BLOCK:
+			s.mask |= *set
+		case _SIG_UNBLOCK:
+			s.mask &^= *set
+		case _SIG_SETMASK:
+			s.mask = *set
+		default:
+			ret = _EINVAL
+		}
+		s.mask &^= unblockable
+	}
+	ts.lock.unlock()
+	if ret == _EOK && oset != nil {
+		*oset = old
+	}
+	return ret
+}
+
+// sysSigaltstack implements sigaltstack.
+//go:nosplit
+func (t *thread) sysSigaltstack(ss, oss *stackt) uint64 {
+	if !userPtr(unsafe.Pointer(ss), unsafe.Sizeof(*ss), false) || !userPtr(unsafe.Pointer(oss), unsafe.Sizeof(*oss), true) {
+		return _EFAULT
+	}
+	ts := &globalThreads
+	ts.lock.lock()
+	s := &t.signals
+	onStack := s.onAltStack(t.sp)
+	ret := uint64(_EOK)
+	if oss != nil {
+		*oss = s.altstack
+		if onStack {
+			oss.flags |= _SS_ONSTACK
+		}
+	}
+	if ss != nil {
+		switch {
+		case onStack:
+			ret = _EPERM
+		case ss.flags&^_SS_DISABLE != 0:
+			ret = _EINVAL
+		case ss.flags&_SS_DISABLE != 0:
+			s.altstack = stackt{flags: _SS_DISABLE}
+		default:
+			s.altstack = *ss
+		}
+	}
+	ts.lock.unlock()
+	return ret
+}
+
+// sysTgkill implements tgkill.
+//go:nosplit
+func sysTgkill(tgid, id, sig int) uint64 {
+	if tgid != processID || sig < 0 || sig > nsig {
+		return _EINVAL
+	}
+	ts := &globalThreads
+	ts.lock.lock()
+	if id < 0 || id >= len(ts.threads) || ts.threads[id].block.conditions&deadCondition != 0 {
+		ts.lock.unlock()
+		return _ESRCH
+	}
+	t := &ts.threads[id]
+	if sig != 0 {
+		t.signals.info = siginfo{
+			signo: int32(sig),
+			code:  _SI_TKILL,
+			addr:  processID,
+		}
+		atomic.StoreUint64(&t.signals.pending, t.signals.pending|sigbit(sig))
+		// Interrupt the thread if it is running on another
+		// processor. The signal is then delivered when the
+		// thread is rescheduled.
+		if c := t.cpu; c != nil && c != thisCPU() {
+			sendIPI(c.apicID, ipiFixed|ipiAssert|uint32(intWakeup))
+		}
+	}
+	ts.lock.unlock()
+	return _EOK
+}
+
+// forceSignal raises a synchronous signal in t, such as for a
+// processor fault. Like Linux, the default action is restored if
+// the signal is blocked or ignored, killing the process.
+//go:nosplit
+func (t *thread) forceSignal(sig int, code int32, addr uint64, vector intVector, errCode uint64) {
+	ts := &globalThreads
+	ts.lock.lock()
+	s := &t.signals
+	act := &sigactions[sig]
+	if s.mask&sigbit(sig) != 0 || act.handler == _SIG_IGN {
+		act.handler = _SIG_DFL
+		s.mask &^= sigbit(sig)
+	}
+	s.info = siginfo{
+		signo: int32(sig),
+		code:  code,
+		addr:  addr,
+	}
+	s.trapno, s.err = uint64(vector), errCode
+	atomic.StoreUint64(&s.pending, s.pending|sigbit(sig))
+	ts.lock.unlock()
+}
+
+// sseExceptionCode returns the signal code for the unmasked SSE
+// exception recorded in the MXCSR register of t.
+//go:nosplit
+func (t *thread) sseExceptionCode() int32 {
+	const (
+		mxcsrIE = 1 << 0 // Invalid operation.
+		mxcsrZE = 1 << 2 // Divide by zero.
+		mxcsrOE = 1 << 3 // Overflow.
+		mxcsrUE = 1 << 4 // Underflow.
+		mxcsrPE = 1 << 5 // Precision.
+	)
+	// MXCSR is at offset 24 of the FXSAVE area.
+	mxcsr := uint32(t.fpState[24]) | uint32(t.fpState[25])<<8
+	// The exception mask bits are 7 bits above the flags.
+	exc := mxcsr &^ (mxcsr >> 7) & 0x3f
+	switch {
+	case exc&mxcsrIE != 0:
+		return _FPE_FLTINV
+	case exc&mxcsrZE != 0:
+		return _FPE_FLTDIV
+	case exc&mxcsrOE != 0:
+		return _FPE_FLTOVF
+	case exc&mxcsrUE != 0:
+		return _FPE_FLTUND
+	case exc&mxcsrPE != 0:
+		return _FPE_FLTRES
+	default:
+		return 0
+	}
+}
+
+// onAltStack reports whether sp is on the alternate signal stack.
+//go:nosplit
+func (s *signals) onAltStack(sp uint64) bool {
+	a := &s.altstack
+	if a.flags&_SS_DISABLE != 0 || a.size == 0 {
+		return false
+	}
+	return a.sp < sp && sp <= a.sp+a.size
+}
+
+// hasSignal reports whether t has a pending signal that is not
+// blocked.
+//go:nosplit
+func (t *thread) hasSignal() bool {
+	return atomic.LoadUint64(&t.signals.pending)&^t.signals.mask != 0
+}
+
+// deliverSignal prepares t for running the handler of the first
+// pending and unblocked signal, if any. It must be called with the
+// scheduler lock held.
+//go:nosplit
+func (t *thread) deliverSignal() {
+	s := &t.signals
+	for {
+		deliverable := s.pending &^ s.mask
+		if deliverable == 0 {
+			return
+		}
+		sig := bits.TrailingZeros64(deliverable) + 1
+		atomic.StoreUint64(&s.pending, s.pending&^sigbit(sig))
+		act := &sigactions[sig]
+		switch act.handler {
+		case _SIG_IGN:
+			continue
+		case _SIG_DFL:
+			if defaultIgnored(sig) {
+				continue
+			}
+			outputString("signal: ")
+			outputUint64(uint64(sig))
+			if s.info.code > 0 {
+				outputString(" address: ")
+				outputUint64(s.info.addr)
+			}
+			outputString(" ip: ")
+			outputUint64(t.ip)
+			outputString("\n")
+			fatal("deliverSignal: killed by signal")
+		}
+		if act.flags&_SA_RESTORER == 0 {
+			fatal("deliverSignal: signal handler without restorer")
+		}
+		t.pushSigframe(sig, act)
+		return
+	}
+}
+
+// pushSigframe builds a signal frame on the stack of t and redirects
+// t to the signal handler.
+//go:nosplit
+func (t *thread) pushSigframe(sig int, act *sigaction) {
+	s := &t.signals
+	sp := t.sp
+	if act.flags&_SA_ONSTACK != 0 && s.altstack.flags&_SS_DISABLE == 0 && s.altstack.size != 0 && !s.onAltStack(sp) {
+		sp = s.altstack.sp + s.altstack.size
+	} else {
+		sp -= redZoneSize
+	}
+	// Floating point state, aligned as for XSAVE.
+	sp -= uint64(len(t.fpState))
+	sp &^= 63
+	fpstate := sp
+	sp -= uint64(unsafe.Sizeof(sigframe{}))
+	sp = sp&^15 - 8
+	if !userAccessible(virtualAddress(sp), fpstate+uint64(len(t.fpState))-sp, true) {
+		fatal("deliverSignal: signal stack not accessible")
+	}
+	copy(sliceForMem(virtualAddress(fpstate), len(t.fpState)), t.fpState[:])
+
+	frame := (*sigframe)(unsafe.Pointer(uintptr(sp)))
+	*frame = sigframe{}
+	frame.restorer = act.restorer
+	frame.info = s.info
+	frame.info.signo = int32(sig)
+	uc := &frame.uc
+	uc.stack = s.altstack
+	uc.sigmask = s.mask
+	mc := &uc.mcontext
+	mc.r8, mc.r9, mc.r10, mc.r11 = t.r8, t.r9, t.r10, t.r11
+	mc.r12, mc.r13, mc.r14, mc.r15 = t.r12, t.r13, t.r14, t.r15
+	mc.di, mc.si, mc.bp, mc.bx = t.di, t.si, t.bp, t.bx
+	mc.dx, mc.ax, mc.cx, mc.sp = t.dx, t.ax, t.cx, t.sp
+	mc.ip, mc.flags = t.ip, t.flags
+	mc.cs = segment64Code3<<3 | uint16(ring3)
+	mc.oldmask = s.mask
+	mc.fpstate = fpstate
+	mc.trapno, mc.err = s.trapno, s.err
+	if sig == _SIGSEGV {
+		mc.cr2 = s.info.addr
+	}
+
+	s.mask |= act.mask
+	if act.flags&_SA_NODEFER == 0 {
+		s.mask |= sigbit(sig)
+	}
+	s.mask &^= unblockable
+	if act.flags&_SA_RESETHAND != 0 {
+		act.handler = _SIG_DFL
+	}
+
+	t.sp = sp
+	t.ip = act.handler
+	t.di = uint64(sig)
+	t.si = uint64(uintptr(unsafe.Pointer(&frame.info)))
+	t.dx = uint64(uintptr(unsafe.Pointer(uc)))
+	t.ax = 0
+	t.flags &^= _FLAG_DF | _FLAG_TF
+}
+
+// sigreturn restores the thread state saved by pushSigframe. It is
+// called after the signal handler has returned to the restorer
+// function.
+//go:nosplit
+func (t *thread) sigreturn() {
+	// The handler popped the restorer address.
+	frame := (*sigframe)(unsafe.Pointer(uintptr(t.sp - 8)))
+	mc := &frame.uc.mcontext
+	if !userAccessible(virtualAddress(t.sp-8), uint64(unsafe.Sizeof(*frame)), false) ||
+		mc.fpstate != 0 && !userAccessible(virtualAddress(mc.fpstate), uint64(len(t.fpState)), false) {
+		// Like Linux, punish a corrupt frame with SIGSEGV.
+		t.forceSignal(_SIGSEGV, _SI_KERNEL, 0, intGeneralProtectionFault, 0)
+		return
+	}
+	t.r8, t.r9, t.r10, t.r11 = mc.r8, mc.r9, mc.r10, mc.r11
+	t.r12, t.r13, t.r14, t.r15 = mc.r12, mc.r13, mc.r14, mc.r15
+	t.di, t.si, t.bp, t.bx = mc.di, mc.si, mc.bp, mc.bx
+	t.dx, t.ax, t.cx, t.sp = mc.dx, mc.ax, mc.cx, mc.sp
+	t.ip = mc.ip
+	t.flags = t.flags&^userFlags | mc.flags&userFlags
+	if mc.fpstate != 0 {
+		copy(t.fpState[:], sliceForMem(virtualAddress(mc.fpstate), len(t.fpState)))
+	}
+	ts := &globalThreads
+	ts.lock.lock()
+	t.signals.mask = frame.uc.sigmask &^ unblockable
+	ts.lock.unlock()
+}
+
+// defaultIgnored reports whether the default action of a signal is
+// to ignore it.
+//go:nosplit
+func defaultIgnored(sig int) bool {
+	const (
+		_SIGCHLD  = 17
+		_SIGURG   = 23
+		_SIGWINCH = 28
+	)
+	switch sig {
+	case _SIGCHLD, _SIGURG, _SIGWINCH:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// TestSignalABI verifies the signal structures against the offsets of
+// the Linux amd64 struct rt_sigframe, ucontext, sigcontext, siginfo,
+// sigaction and stack_t.
+func TestSignalABI(t *testing.T) {
+	var (
+		sa  sigaction
+		st  stackt
+		sc  sigcontext
+		uc  ucontext
+		si  siginfo
+		frm sigframe
+	)
+	tests := []struct {
+		name      string
+		got, want uintptr
+	}{
+		{"sizeof(struct sigaction)", unsafe.Sizeof(sa), 32},
+		{"sa_handler", unsafe.Offsetof(sa.handler), 0},
+		{"sa_flags", unsafe.Offsetof(sa.flags), 8},
+		{"sa_restorer", unsafe.Offsetof(sa.restorer), 16},
+		{"sa_mask", unsafe.Offsetof(sa.mask), 24},
+
+		{"sizeof(stack_t)", unsafe.Sizeof(st), 24},
+		{"ss_sp", unsafe.Offsetof(st.sp), 0},
+		{"ss_flags", unsafe.Offsetof(st.flags), 8},
+		{"ss_size", unsafe.Offsetof(st.size), 16},
+
+		{"sizeof(struct sigcontext)", unsafe.Sizeof(sc), 256},
+		{"r8", unsafe.Offsetof(sc.r8), 0},
+		{"r15", unsafe.Offsetof(sc.r15), 56},
+		{"rdi", unsafe.Offsetof(sc.di), 64},
+		{"rsi", unsafe.Offsetof(sc.si), 72},
+		{"rbp", unsafe.Offsetof(sc.bp), 80},
+		{"rbx", unsafe.Offsetof(sc.bx), 88},
+		{"rdx", unsafe.Offsetof(sc.dx), 96},
+		{"rax", unsafe.Offsetof(sc.ax), 104},
+		{"rcx", unsafe.Offsetof(sc.cx), 112},
+		{"rsp", unsafe.Offsetof(sc.sp), 120},
+		{"rip", unsafe.Offsetof(sc.ip), 128},
+		{"eflags", unsafe.Offsetof(sc.flags), 136},
+		{"cs", unsafe.Offsetof(sc.cs), 144},
+		{"gs", unsafe.Offsetof(sc.gs), 146},
+		{"fs", unsafe.Offsetof(sc.fs), 148},
+		{"err", unsafe.Offsetof(sc.err), 152},
+		{"trapno", unsafe.Offsetof(sc.trapno), 160},
+		{"oldmask", unsafe.Offsetof(sc.oldmask), 168},
+		{"cr2", unsafe.Offsetof(sc.cr2), 176},
+		{"fpstate", unsafe.Offsetof(sc.fpstate), 184},
+
+		{"sizeof(struct ucontext)", unsafe.Sizeof(uc), 304},
+		{"uc_flags", unsafe.Offsetof(uc.flags), 0},
+		{"uc_link", unsafe.Offsetof(uc.link), 8},
+		{"uc_stack", unsafe.Offsetof(uc.stack), 16},
+		{"uc_mcontext", unsafe.Offsetof(uc.mcontext), 40},
+		{"uc_sigmask", unsafe.Offsetof(uc.sigmask), 296},
+
+		{"sizeof(siginfo_t)", unsafe.Sizeof(si), 128},
+		{"si_signo", unsafe.Offsetof(si.signo), 0},
+		{"si_errno", unsafe.Offsetof(si.errno), 4},
+		{"si_code", unsafe.Offsetof(si.code), 8},
+		{"si_addr", unsafe.Offsetof(si.addr), 16},
+
+		{"sizeof(struct rt_sigframe)", unsafe.Sizeof(frm), 440},
+		{"pretcode", unsafe.Offsetof(frm.restorer), 0},
+		{"uc", unsafe.Offsetof(frm.uc), 8},
+		{"info", unsafe.Offsetof(frm.info), 312},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, test.got, test.want)
+		}
+	}
+}
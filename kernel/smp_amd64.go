@@ -0,0 +1,441 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Support for symmetric multiprocessing (SMP). The application
+// processors (APs) are discovered through the ACPI MADT table and
+// started with the INIT-SIPI-SIPI sequence. Every processor runs
+// the same scheduler loop.
+
+const maxCPUs = 16
+
+// cpu contains the per-processor state. The offsets of the first
+// fields are known to assembly.
+type cpu struct {
+	self *cpu
+	// kstackTop is the top of the stack for handling system
+	// calls.
+	kstackTop uint64
+	// kernelThread is the thread for idling the processor.
+	kernelThread *thread
+	// thread is the thread currently running on the processor.
+	thread *thread
+
+	id     int
+	apicID uint32
+	// started is set by a processor when it is running.
+	started uint32
+	// idle is set when the processor is halted waiting for a
+	// runnable thread.
+	idle uint32
+	// next is the index of the first thread to consider when
+	// scheduling.
+	next int
+	// tlbGen is the TLB shootdown generation last flushed by
+	// the processor.
+	tlbGen uint64
+
+	istackTop         uint64
+	pageFaultStackTop uint64
+
+	gdt gdt
+	tss tss
+
+	// epollEvents holds the events collected by epoll_pwait until
+	// they're copied to user memory outside the thread lock.
+	epollEvents [maxEpollItems]epollEvent
+}
+
+// apStacks contains the stacks of an application processor.
+type apStacks struct {
+	kstack         stack
+	istack         stack
+	pageFaultStack stack
+}
+
+// spinlock is a mutual exclusion lock for kernel data structures
+// shared between processors. Interrupts must be disabled while
+// holding a spinlock.
+type spinlock uint32
+
+// cpuLock is a spinlock that can be locked recursively by the
+// processor holding it. It is used for locks that may be needed
+// by the page fault handler.
+type cpuLock struct {
+	mu spinlock
+	// owner is the address of the processor holding the lock. It
+	// is not a pointer, to avoid write barriers and their deep
+	// runtime calls in nosplit code.
+	owner uintptr
+	depth int
+}
+
+var (
+	cpus [maxCPUs]cpu
+	// kernelThreads are the idle threads, one per processor.
+	kernelThreads [maxCPUs]thread
+	// ncpu is the number of started processors.
+	ncpu int
+
+	// memLock protects globalMap, globalMem and globalPT.
+	memLock cpuLock
+
+	// tlbGen counts TLB shootdowns.
+	tlbGen uint64
+	// tlbShootdown is set while a processor waits for the others
+	// to flush their TLBs.
+	tlbShootdown uint32
+)
+
+// apBoot passes the processor and stack to apEntry.
+var apBoot struct {
+	cpu   *cpu
+	stack uint64
+}
+
+// apTrampoline is the 16-bit real mode code executed by an
+// application processor after receiving a startup IPI. It switches
+// directly to long mode and jumps to apEntry. The code is copied to
+// a page below 1MB and the GDT, CR3 and jump target is filled in
+// before use.
+var apTrampoline = [...]byte{
+	0xfa,       // CLI
+	0x8c, 0xc8, // MOV AX, CS
+	0x8e, 0xd8, // MOV DS, AX
+	0x66, 0x0f, 0x01, 0x16, apTrampolineGDTR, 0x00, // LGDTL [apTrampolineGDTR]
+	0x0f, 0x20, 0xe0, // MOV EAX, CR4
+	0x66, 0x0d, _CR4_PAE, 0x00, 0x00, 0x00, // OR EAX, _CR4_PAE
+	0x0f, 0x22, 0xe0, // MOV CR4, EAX
+	0x66, 0xa1, apTrampolineCR3, 0x00, // MOV EAX, [apTrampolineCR3]
+	0x0f, 0x22, 0xd8, // MOV CR3, EAX
+	0x66, 0xb9, 0x80, 0x00, 0x00, 0xc0, // MOV ECX, _MSR_IA32_EFER
+	0x0f, 0x32, // RDMSR
+	0x66, 0x0d, 0x00, 0x00, 0x00, 0x00, // OR EAX, <EFER flags>
+	0x0f, 0x30, // WRMSR
+	0x66, 0xb8, 0x33, 0x00, 0x01, 0x80, // MOV EAX, PG|WP|NE|ET|MP|PE
+	0x0f, 0x22, 0xc0, // MOV CR0, EAX
+	0x66, 0xea, 0x00, 0x00, 0x00, 0x00, segmentCode0 << 3, 0x00, // JMPL segmentCode0:<apEntry>
+}
+
+// Offsets into the trampoline page.
+const (
+	apTrampolineEFER  = 0x28
+	apTrampolineEntry = 0x39
+	apTrampolineGDT   = 0xa0
+	apTrampolineGDTR  = 0xb8
+	apTrampolineCR3   = 0xc0
+)
+
+// Interrupt command register values.
+const (
+	ipiFixed       = 0x0 << 8
+	ipiInit        = 0x5 << 8
+	ipiStartup     = 0x6 << 8
+	ipiAssert      = 1 << 14
+	ipiSendPending = 1 << 12
+	ipiDestShift   = 24
+)
+
+// initBootCPU initializes the state of the boot processor.
+//go:nosplit
+func initBootCPU() *cpu {
+	if unsafe.Offsetof(cpu{}.kstackTop) != 1*8 ||
+		unsafe.Offsetof(cpu{}.kernelThread) != 2*8 {
+		fatal("initBootCPU: unexpected cpu field offset")
+	}
+	c := &cpus[0]
+	c.init(0)
+	c.kstackTop = kernelStackTop()
+	c.istackTop = uint64(istack.top())
+	c.pageFaultStackTop = uint64(pageFaultStack.top())
+	c.started = 1
+	ncpu = 1
+	return c
+}
+
+//go:nosplit
+func (c *cpu) init(id int) {
+	c.self = c
+	c.id = id
+	kt := &kernelThreads[id]
+	kt.self = kt
+	kt.cpu = c
+	c.kernelThread = kt
+}
+
+// thisCPU returns the current processor.
+//go:nosplit
+func thisCPU() *cpu {
+	if ncpu <= 1 {
+		// Uniprocessor, or the current thread may not be set up
+		// yet.
+		return &cpus[0]
+	}
+	return currentThread().cpu
+}
+
+// initSMP starts the application processors listed in the ACPI
+// tables.
+//go:nosplit
+func initSMP() error {
+	n := 0
+	for _, l := range acpiTables.MADT.LocalAPICs() {
+		if l.Enabled {
+			n++
+		}
+	}
+	if n <= 1 {
+		// No ACPI tables or a single processor.
+		return nil
+	}
+	if timerMode == timerHPET {
+		// The HPET timer interrupts only the boot processor, and
+		// threads on the other processors would never be
+		// preempted.
+		outputString("initSMP: no local APIC timer; using the boot processor only\n")
+		return nil
+	}
+	page, err := setupAPTrampoline()
+	if err != nil {
+		return err
+	}
+	bsp := &cpus[0]
+	for _, l := range acpiTables.MADT.LocalAPICs() {
+		if !l.Enabled || l.APICID == bsp.apicID {
+			continue
+		}
+		if err := startAP(l.APICID, page); err != nil {
+			// Run without the processor.
+			outputString(string(err.(kernError)))
+			outputString("\n")
+		}
+	}
+	return nil
+}
+
+// setupAPTrampoline copies apTrampoline to an identity mapped page
+// below 1MB and returns its address.
+//go:nosplit
+func setupAPTrampoline() (physicalAddress, error) {
+	pml4 := physicalAddress(uintptr(unsafe.Pointer(globalPT)) - uintptr(physicalMapOffset))
+	entry := funcPC(apEntry)
+	if pml4 >= 1<<32 || entry >= 1<<32 {
+		return 0, kernError("setupAPTrampoline: page table or kernel above 4GB")
+	}
+	page, err := globalMem.allocPageBelow(1 << 20)
+	if err != nil {
+		return 0, err
+	}
+	vpage := virtualAddress(page)
+	flags := pageFlagWritable
+	if !globalMap.addRange(vpage, vpage+pageSize, flags) {
+		return 0, kernError("setupAPTrampoline: trampoline address in use")
+	}
+	if err := mmapAligned(&globalMem, globalPT, vpage, vpage+pageSize, page, flags); err != nil {
+		return 0, err
+	}
+	var efer uint32 = _EFER_LME
+	if nxSupport {
+		efer |= _EFER_NXE
+	}
+	bo := binary.LittleEndian
+	code := sliceForMem(physToVirt(page), pageSize)
+	copy(code, apTrampoline[:])
+	bo.PutUint32(code[apTrampolineEFER:], efer)
+	bo.PutUint32(code[apTrampolineEntry:], uint32(entry))
+	// Null, 64-bit code and data segment descriptors.
+	bo.PutUint64(code[apTrampolineGDT+1*8:], 0x00af9a000000ffff)
+	bo.PutUint64(code[apTrampolineGDT+2*8:], 0x00cf92000000ffff)
+	bo.PutUint16(code[apTrampolineGDTR:], 3*8-1)
+	bo.PutUint32(code[apTrampolineGDTR+2:], uint32(page)+apTrampolineGDT)
+	bo.PutUint32(code[apTrampolineCR3:], uint32(pml4))
+	return page, nil
+}
+
+// startAP starts the application processor with the APIC ID id and
+// waits for it to run.
+//go:nosplit
+func startAP(id uint32, trampoline physicalAddress) error {
+	if ncpu == maxCPUs {
+		return nil
+	}
+	c := &cpus[ncpu]
+	c.init(ncpu)
+	c.apicID = id
+	// Address the stacks through the kernel only physical memory
+	// map, which is writable and not executable.
+	page, err := globalMem.alloc(int(unsafe.Sizeof(apStacks{})))
+	if err != nil {
+		return err
+	}
+	stacks := (*apStacks)(unsafe.Pointer(uintptr(physToVirt(page))))
+	c.kstackTop = uint64(stacks.kstack.top())
+	c.istackTop = uint64(stacks.istack.top())
+	c.pageFaultStackTop = uint64(stacks.pageFaultStack.top())
+	apBoot.cpu = c
+	apBoot.stack = c.kstackTop
+	// Count the processor before it starts, so thisCPU doesn't
+	// assume a uniprocessor.
+	ncpu++
+
+	sendIPI(id, ipiInit|ipiAssert)
+	spin(10 * time.Millisecond)
+	vector := uint32(trampoline >> 12)
+	for i := 0; i < 2; i++ {
+		sendIPI(id, ipiStartup|ipiAssert|vector)
+		for j := 0; j < 100; j++ {
+			if atomic.LoadUint32(&c.started) != 0 {
+				return nil
+			}
+			spin(100 * time.Microsecond)
+		}
+	}
+	// Put the processor back into its wait state, in case it
+	// starts after all, and release its slot and stacks.
+	sendIPI(id, ipiInit|ipiAssert)
+	ncpu--
+	if err := globalMem.free(page, int(unsafe.Sizeof(apStacks{}))); err != nil {
+		return err
+	}
+	return kernError("startAP: processor failed to start")
+}
+
+// apMain is called by apEntry on the application processor.
+//go:nosplit
+func apMain() {
+	c := apBoot.cpu
+	setCR4Reg(cr4Flags)
+	c.loadGDT()
+	c.kernelThread.makeCurrent(c)
+	reloadIDT()
+	initLocalAPIC()
+	initSYSCALL()
+	atomic.StoreUint32(&c.started, 1)
+	globalThreads.schedule(c, nil)
+}
+
+// sendIPI sends an inter-processor interrupt to the processor with
+// the APIC ID id.
+//go:nosplit
+func sendIPI(id uint32, cmd uint32) {
+	apicWrite(apicRegICRHigh, id<<ipiDestShift)
+	apicWrite(apicRegICRLow, cmd)
+	for apicRead(apicRegICRLow)&ipiSendPending != 0 {
+		pause()
+	}
+}
+
+// wakeIdleCPUs interrupts the idle processors so they look for
+// runnable threads.
+//go:nosplit
+func wakeIdleCPUs() {
+	n := ncpu
+	if n == 1 {
+		return
+	}
+	self := thisCPU()
+	for i := 0; i < n; i++ {
+		c := &cpus[i]
+		if c == self || atomic.LoadUint32(&c.idle) == 0 {
+			continue
+		}
+		sendIPI(c.apicID, ipiFixed|ipiAssert|uint32(intWakeup))
+	}
+}
+
+// shootdownTLB invalidates the TLBs of the other processors and
+// waits for them to complete. It must be called with memLock held
+// after unmapping pages.
+//go:nosplit
+func shootdownTLB() {
+	n := ncpu
+	if n == 1 {
+		return
+	}
+	self := thisCPU()
+	atomic.StoreUint32(&tlbShootdown, 1)
+	gen := atomic.AddUint64(&tlbGen, 1)
+	atomic.StoreUint64(&self.tlbGen, gen)
+	for i := 0; i < n; i++ {
+		c := &cpus[i]
+		if c != self && atomic.LoadUint32(&c.started) != 0 {
+			sendIPI(c.apicID, ipiFixed|ipiAssert|uint32(intTLBFlush))
+		}
+	}
+	for i := 0; i < n; i++ {
+		c := &cpus[i]
+		if c == self || atomic.LoadUint32(&c.started) == 0 {
+			continue
+		}
+		for atomic.LoadUint64(&c.tlbGen) < gen {
+			pause()
+		}
+	}
+	atomic.StoreUint32(&tlbShootdown, 0)
+}
+
+// flushStaleTLB flushes the TLB of the processor if it hasn't
+// served the latest shootdown.
+//go:nosplit
+func (c *cpu) flushStaleTLB() {
+	gen := atomic.LoadUint64(&tlbGen)
+	if atomic.LoadUint64(&c.tlbGen) < gen {
+		flushTLB()
+		atomic.StoreUint64(&c.tlbGen, gen)
+	}
+}
+
+//go:nosplit
+func tlbFlushInterrupt() {
+	thisCPU().flushStaleTLB()
+}
+
+//go:nosplit
+func (l *spinlock) lock() {
+	for !atomic.CompareAndSwapUint32((*uint32)(l), 0, 1) {
+		// Interrupts are disabled, so serve TLB shootdowns while
+		// waiting. The lock holder may be waiting for this
+		// processor.
+		if atomic.LoadUint32(&tlbShootdown) != 0 {
+			thisCPU().flushStaleTLB()
+		}
+		pause()
+	}
+}
+
+//go:nosplit
+func (l *spinlock) unlock() {
+	atomic.StoreUint32((*uint32)(l), 0)
+}
+
+//go:nosplit
+func (l *cpuLock) lock() {
+	c := uintptr(unsafe.Pointer(thisCPU()))
+	if l.owner == c {
+		l.depth++
+		return
+	}
+	l.mu.lock()
+	l.owner = c
+	l.depth = 1
+}
+
+//go:nosplit
+func (l *cpuLock) unlock() {
+	l.depth--
+	if l.depth == 0 {
+		l.owner = 0
+		l.mu.unlock()
+	}
+}
+
+func apEntry()
+func pause()
+func tlbFlushTrampoline()
@@ -0,0 +1,397 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Network implements the sockets of the program. See ServeNetwork.
+type Network interface {
+	// Socket creates a socket. The arguments are those of
+	// socket(2), without the SOCK_NONBLOCK and SOCK_CLOEXEC flags.
+	Socket(domain, typ, proto int) (Socket, error)
+}
+
+// Socket is a socket of a Network. Its methods must not block:
+// operations that can't complete immediately fail with
+// syscall.EAGAIN, except for Connect, which fails with
+// syscall.EINPROGRESS and completes in the background. Errors are
+// reported to the program as the syscall.Errno they wrap.
+type Socket interface {
+	Bind(sa syscall.Sockaddr) error
+	Connect(sa syscall.Sockaddr) error
+	Listen(backlog int) error
+	Accept() (Socket, syscall.Sockaddr, error)
+	// Recvfrom and Sendto transfer data with the flags of
+	// recvfrom(2) and sendto(2), except for MSG_DONTWAIT. The
+	// address of Sendto may be nil.
+	Recvfrom(p []byte, flags int) (int, syscall.Sockaddr, error)
+	Sendto(p []byte, flags int, to syscall.Sockaddr) (int, error)
+	Shutdown(how int) error
+	Getsockname() (syscall.Sockaddr, error)
+	Getpeername() (syscall.Sockaddr, error)
+	SetsockoptInt(level, opt, value int) error
+	GetsockoptInt(level, opt int) (int, error)
+	// Notify arranges for the socket to call ready with its
+	// readiness events, the EPOLL* flags of epoll(7), whenever they
+	// change. Notify calls ready with the current events before
+	// returning. The ready function must not call the methods of
+	// the socket.
+	Notify(ready func(events uint32))
+	Close() error
+}
+
+// netServer forwards socket requests to a Network.
+type netServer struct {
+	mu      sync.Mutex
+	net     Network
+	sockets map[uint64]*sockHandle
+	next    uint64
+}
+
+// sockHandle is an open socket.
+type sockHandle struct {
+	sock Socket
+
+	mu   sync.Mutex
+	cond sync.Cond
+	// events are the readiness events last reported by the socket.
+	events uint32
+	// open is set when the kernel knows the handle of the socket.
+	open bool
+}
+
+var userNet netServer
+
+// ServeNetwork makes the sockets of n available to the program
+// through the socket system calls and the standard library net
+// package. ServeNetwork may be called at most once.
+func ServeNetwork(n Network) error {
+	s := &userNet
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.net != nil {
+		return errors.New("kernel: network already served")
+	}
+	userFS.start()
+	if _, _, errno := syscall.Syscall(_SYS_sockregister, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	s.net = n
+	s.sockets = make(map[uint64]*sockHandle)
+	s.next = 1
+	return nil
+}
+
+// serve performs the socket request c and replies to it.
+func (s *netServer) serve(c uintptr, req *fsRequest) {
+	s.mu.Lock()
+	h := s.sockets[req.ino]
+	if req.op == sockClose {
+		delete(s.sockets, req.ino)
+	}
+	s.mu.Unlock()
+	var ret uint64
+	var err error
+	switch req.op {
+	case sockSocket:
+		var sock Socket
+		sock, err = s.net.Socket(int(req.mode), int(req.flags), int(req.n))
+		if err == nil {
+			s.open(c, sock)
+			return
+		}
+	case sockClose:
+		if h != nil {
+			h.sock.Close()
+		}
+	default:
+		if h == nil {
+			err = syscall.EBADF
+			break
+		}
+		if req.op == sockAccept {
+			var sock Socket
+			var sa syscall.Sockaddr
+			err = h.wait(req.flags, _EPOLLIN, func() error {
+				var err error
+				sock, sa, err = h.sock.Accept()
+				return err
+			})
+			if err == nil {
+				putSockaddr(req.addr, req.addrLen, sa)
+				s.open(c, sock)
+				return
+			}
+			break
+		}
+		ret, err = h.serve(req)
+	}
+	if err != nil {
+		ret = errnoResult(err)
+	}
+	syscall.Syscall(_SYS_fsreply, c, uintptr(ret), 0)
+}
+
+// open replies to the request c with a new handle for sock.
+func (s *netServer) open(c uintptr, sock Socket) {
+	h := &sockHandle{sock: sock}
+	h.cond.L = &h.mu
+	s.mu.Lock()
+	ino := s.next
+	s.next++
+	s.sockets[ino] = h
+	s.mu.Unlock()
+	sock.Notify(func(events uint32) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.events = events
+		h.cond.Broadcast()
+		if h.open {
+			syscall.Syscall(_SYS_sockready, uintptr(ino), uintptr(events), 0)
+		}
+	})
+	// Hold the lock until the kernel knows the handle, so the
+	// reply carries the latest events.
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	syscall.Syscall(_SYS_fsreply, c, uintptr(ino), uintptr(h.events))
+	h.open = true
+}
+
+// serve performs the request req on the socket.
+func (h *sockHandle) serve(req *fsRequest) (uint64, error) {
+	flags := int(req.flags &^ _MSG_DONTWAIT)
+	switch req.op {
+	case sockBind, sockConnect:
+		sa, err := sockaddr(req.addr, req.addrLen)
+		if err != nil {
+			return 0, err
+		}
+		if req.op == sockBind {
+			return 0, h.sock.Bind(sa)
+		}
+		err = h.sock.Connect(sa)
+		if err != syscall.EINPROGRESS || req.flags&_MSG_DONTWAIT != 0 {
+			return 0, err
+		}
+		h.mu.Lock()
+		for h.events&(_EPOLLOUT|_EPOLLERR|_EPOLLHUP) == 0 {
+			h.cond.Wait()
+		}
+		h.mu.Unlock()
+		errno, err := h.sock.GetsockoptInt(syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if err == nil && errno != 0 {
+			err = syscall.Errno(errno)
+		}
+		return 0, err
+	case sockListen:
+		return 0, h.sock.Listen(int(int32(req.n)))
+	case sockRecv:
+		var n int
+		var sa syscall.Sockaddr
+		err := h.wait(req.flags, _EPOLLIN, func() error {
+			var err error
+			n, sa, err = h.sock.Recvfrom(userBytes(req.buf, req.n), flags)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		if req.addr != 0 {
+			putSockaddr(req.addr, req.addrLen, sa)
+		}
+		return uint64(n), nil
+	case sockSend:
+		var to syscall.Sockaddr
+		if req.addr != 0 {
+			var err error
+			to, err = sockaddr(req.addr, req.addrLen)
+			if err != nil {
+				return 0, err
+			}
+		}
+		var n int
+		err := h.wait(req.flags, _EPOLLOUT, func() error {
+			var err error
+			n, err = h.sock.Sendto(userBytes(req.buf, req.n), flags, to)
+			return err
+		})
+		return uint64(n), err
+	case sockRecvmsg, sockSendmsg:
+		return h.serveMsg(req)
+	case sockShutdown:
+		return 0, h.sock.Shutdown(int(req.n))
+	case sockName, sockPeerName:
+		var sa syscall.Sockaddr
+		var err error
+		if req.op == sockName {
+			sa, err = h.sock.Getsockname()
+		} else {
+			sa, err = h.sock.Getpeername()
+		}
+		if err != nil {
+			return 0, err
+		}
+		putSockaddr(req.addr, req.addrLen, sa)
+		return 0, nil
+	case sockSetopt:
+		if req.n < 4 {
+			return 0, syscall.EINVAL
+		}
+		v := *(*int32)(unsafe.Pointer(uintptr(req.buf)))
+		return 0, h.sock.SetsockoptInt(int(req.flags), int(req.mode), int(v))
+	case sockGetopt:
+		n := (*uint32)(unsafe.Pointer(uintptr(req.addrLen)))
+		if *n < 4 {
+			return 0, syscall.EINVAL
+		}
+		v, err := h.sock.GetsockoptInt(int(req.flags), int(req.mode))
+		if err != nil {
+			return 0, err
+		}
+		*(*int32)(unsafe.Pointer(uintptr(req.buf))) = int32(v)
+		*n = 4
+		return 0, nil
+	}
+	return 0, syscall.EOPNOTSUPP
+}
+
+// serveMsg performs a sockRecvmsg or sockSendmsg request. Control
+// messages are not supported.
+func (h *sockHandle) serveMsg(req *fsRequest) (uint64, error) {
+	msg := (*syscall.Msghdr)(unsafe.Pointer(uintptr(req.buf)))
+	var iovs []syscall.Iovec
+	if msg.Iovlen > 0 {
+		iovs = (*[1 << 20]syscall.Iovec)(unsafe.Pointer(msg.Iov))[:msg.Iovlen:msg.Iovlen]
+	}
+	size := 0
+	for _, iov := range iovs {
+		size += int(iov.Len)
+	}
+	// Gather the buffers into a contiguous buffer.
+	var buf []byte
+	if len(iovs) == 1 {
+		buf = userBytes(uint64(uintptr(unsafe.Pointer(iovs[0].Base))), iovs[0].Len)
+	} else {
+		buf = make([]byte, size)
+	}
+	flags := int(req.flags &^ _MSG_DONTWAIT)
+	name := uint64(uintptr(unsafe.Pointer(msg.Name)))
+	var n int
+	if req.op == sockSendmsg {
+		if len(iovs) > 1 {
+			off := 0
+			for _, iov := range iovs {
+				off += copy(buf[off:], userBytes(uint64(uintptr(unsafe.Pointer(iov.Base))), iov.Len))
+			}
+		}
+		var to syscall.Sockaddr
+		if name != 0 {
+			var err error
+			to, err = sockaddr(name, uint64(msg.Namelen))
+			if err != nil {
+				return 0, err
+			}
+		}
+		err := h.wait(req.flags, _EPOLLOUT, func() error {
+			var err error
+			n, err = h.sock.Sendto(buf, flags, to)
+			return err
+		})
+		return uint64(n), err
+	}
+	var sa syscall.Sockaddr
+	err := h.wait(req.flags, _EPOLLIN, func() error {
+		var err error
+		n, sa, err = h.sock.Recvfrom(buf, flags)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(iovs) > 1 {
+		off := 0
+		for _, iov := range iovs {
+			off += copy(userBytes(uint64(uintptr(unsafe.Pointer(iov.Base))), iov.Len), buf[off:n])
+		}
+	}
+	if name != 0 {
+		putSockaddr(name, uint64(uintptr(unsafe.Pointer(&msg.Namelen))), sa)
+	}
+	msg.Controllen = 0
+	msg.Flags = 0
+	return uint64(n), nil
+}
+
+// wait calls op until it doesn't fail with syscall.EAGAIN, waiting
+// for the events between calls. It doesn't wait if the message flags
+// contain _MSG_DONTWAIT.
+func (h *sockHandle) wait(flags uint64, events uint32, op func() error) error {
+	for {
+		err := op()
+		if err != syscall.EAGAIN || flags&_MSG_DONTWAIT != 0 {
+			return err
+		}
+		h.mu.Lock()
+		for h.events&(events|_EPOLLERR|_EPOLLHUP) == 0 {
+			h.cond.Wait()
+		}
+		h.mu.Unlock()
+	}
+}
+
+// sockaddr decodes the socket address of length n at addr.
+func sockaddr(addr, n uint64) (syscall.Sockaddr, error) {
+	if n < 2 {
+		return nil, syscall.EINVAL
+	}
+	switch family := *(*uint16)(unsafe.Pointer(uintptr(addr))); family {
+	case syscall.AF_INET:
+		if n < syscall.SizeofSockaddrInet4 {
+			return nil, syscall.EINVAL
+		}
+		raw := (*syscall.RawSockaddrInet4)(unsafe.Pointer(uintptr(addr)))
+		return &syscall.SockaddrInet4{Port: int(ntohs(raw.Port)), Addr: raw.Addr}, nil
+	case syscall.AF_INET6:
+		if n < syscall.SizeofSockaddrInet6 {
+			return nil, syscall.EINVAL
+		}
+		raw := (*syscall.RawSockaddrInet6)(unsafe.Pointer(uintptr(addr)))
+		return &syscall.SockaddrInet6{Port: int(ntohs(raw.Port)), ZoneId: raw.Scope_id, Addr: raw.Addr}, nil
+	default:
+		return nil, syscall.EAFNOSUPPORT
+	}
+}
+
+// putSockaddr stores sa at addr, truncated to the length at the
+// address lenAddr, and stores the length of sa at lenAddr.
+func putSockaddr(addr, lenAddr uint64, sa syscall.Sockaddr) {
+	if addr == 0 || lenAddr == 0 {
+		return
+	}
+	var raw []byte
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		r := syscall.RawSockaddrInet4{Family: syscall.AF_INET, Port: ntohs(uint16(sa.Port)), Addr: sa.Addr}
+		raw = (*[syscall.SizeofSockaddrInet4]byte)(unsafe.Pointer(&r))[:]
+	case *syscall.SockaddrInet6:
+		r := syscall.RawSockaddrInet6{Family: syscall.AF_INET6, Port: ntohs(uint16(sa.Port)), Scope_id: sa.ZoneId, Addr: sa.Addr}
+		raw = (*[syscall.SizeofSockaddrInet6]byte)(unsafe.Pointer(&r))[:]
+	default:
+		// Unnamed socket.
+		raw = []byte{syscall.AF_UNSPEC, 0}
+	}
+	n := (*uint32)(unsafe.Pointer(uintptr(lenAddr)))
+	copy(userBytes(addr, uint64(*n)), raw)
+	*n = uint32(len(raw))
+}
+
+// ntohs converts between the network and host byte order of a port.
+func ntohs(v uint16) uint16 {
+	return v<<8 | v>>8
+}
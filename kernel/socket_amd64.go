@@ -0,0 +1,268 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+// Sockets are implemented by a network registered by the program
+// itself. Like the operations of user file systems, socket operations
+// are forwarded to the server threads, which implement blocking
+// sockets by delaying their replies. The server reports changes in
+// the readiness of sockets through the sockready system call.
+
+const (
+	_SOCK_NONBLOCK = _O_NONBLOCK
+	_SOCK_CLOEXEC  = _O_CLOEXEC
+
+	_MSG_DONTWAIT = 0x40
+
+	_S_IFSOCK = 0xc000
+)
+
+const (
+	// sockSocket creates a socket in the domain mode with the type
+	// flags and the protocol n. The reply is the handle of the
+	// socket and the auxiliary value is its readiness events.
+	sockSocket fsOp = 0x100 + iota
+	// sockBind and sockConnect bind and connect the socket ino to
+	// the addrLen bytes of the socket address at addr.
+	sockBind
+	sockConnect
+	// sockListen marks the socket ino as listening with a backlog
+	// of n connections.
+	sockListen
+	// sockAccept accepts a connection from the socket ino. The
+	// reply is as for sockSocket. If addr is not zero, the peer
+	// address is stored at addr, and its length at the address
+	// addrLen, which holds the size of the buffer.
+	sockAccept
+	// sockRecv and sockSend transfer n bytes at buf to or from the
+	// socket ino with the message flags in flags. The source
+	// address of sockRecv is stored as for sockAccept; the
+	// destination address of sockSend is at addr, with length
+	// addrLen.
+	sockRecv
+	sockSend
+	// sockRecvmsg and sockSendmsg transfer the message described
+	// by the msghdr at buf with the message flags in flags.
+	sockRecvmsg
+	sockSendmsg
+	// sockShutdown shuts down the directions n of the socket ino.
+	sockShutdown
+	// sockName and sockPeerName store the local and remote address
+	// of the socket ino as for sockAccept.
+	sockName
+	sockPeerName
+	// sockSetopt sets the option mode at the level flags to the n
+	// bytes at buf.
+	sockSetopt
+	// sockGetopt stores the option mode at the level flags at buf.
+	// The address addrLen holds the size of buf and receives the
+	// length of the option.
+	sockGetopt
+	// sockClose releases the socket ino.
+	sockClose
+)
+
+// isSocketOp reports whether op is a socket operation.
+//go:nosplit
+func isSocketOp(op fsOp) bool {
+	return op >= sockSocket
+}
+
+// forwardSocket forwards the operation op on the socket file f. The
+// message flags of the request includes _MSG_DONTWAIT if the file is
+// non-blocking.
+//go:nosplit
+func (fs *files) forwardSocket(t *thread, f int32, op fsOp) (*fsCall, uint64) {
+	file := &fs.files[f]
+	c, errno := fs.forward(t, -1, op, f)
+	if errno != _EOK {
+		return nil, errno
+	}
+	c.req.ino = file.ino
+	if file.flags&_O_NONBLOCK != 0 {
+		c.req.flags = _MSG_DONTWAIT
+	}
+	return c, _EOK
+}
+
+// openSocket creates a file and descriptor for the socket handle ino
+// created by the request call.
+//go:nosplit
+func (fs *files) openSocket(call *fsCall, ino uint64, events uint32) uint64 {
+	f, ok := fs.newFile(fileSocket)
+	if !ok {
+		fs.closeSocket(ino)
+		return _ENFILE
+	}
+	nf := &fs.files[f]
+	nf.flags = _O_RDWR
+	if call.nonblock {
+		nf.flags |= _O_NONBLOCK
+	}
+	nf.ino = ino
+	nf.events = events
+	d, ok := fs.newFd(f, call.cloexec)
+	if !ok {
+		fs.files[f] = file{}
+		fs.closeSocket(ino)
+		return _EMFILE
+	}
+	return uint64(d)
+}
+
+// closeSocket forwards the release of the socket handle ino.
+//go:nosplit
+func (fs *files) closeSocket(ino uint64) {
+	c, errno := fs.forward(nil, -1, sockClose, -1)
+	if errno != _EOK {
+		// Leak the socket.
+		return
+	}
+	c.req.ino = ino
+}
+
+// lookupSocket returns the socket file of the descriptor d.
+//go:nosplit
+func (fs *files) lookupSocket(d uint64) (int32, uint64) {
+	f, ok := fs.lookup(d)
+	if !ok {
+		return 0, _EBADF
+	}
+	if fs.files[f].kind != fileSocket {
+		return 0, _ENOTSOCK
+	}
+	return f, _EOK
+}
+
+// sysSockRegister enables the socket system calls. The calling
+// program must serve the socket operations.
+//go:nosplit
+func sysSockRegister() uint64 {
+	ts := &globalThreads
+	ts.lock.lock()
+	fs := &globalFiles
+	ret := uint64(_EOK)
+	if fs.network {
+		ret = _EBUSY
+	}
+	fs.network = true
+	ts.lock.unlock()
+	return ret
+}
+
+// sysSockReady sets the readiness events of the socket handle
+// ino.
+//go:nosplit
+func sysSockReady(ino uint64, events uint32) uint64 {
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	woken := false
+	for i := range fs.files {
+		f := &fs.files[i]
+		if f.kind != fileSocket || f.ino != ino {
+			continue
+		}
+		f.events = events
+		if fs.notify(int32(i)) {
+			woken = true
+		}
+	}
+	ts.lock.unlock()
+	if woken {
+		wakeIdleCPUs()
+	}
+	return _EOK
+}
+
+//go:nosplit
+func sysSocket(t *thread, domain, typ, proto uint64) uint64 {
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	if !fs.network {
+		ts.lock.unlock()
+		return _EAFNOSUPPORT
+	}
+	c, errno := fs.forward(t, -1, sockSocket, -1)
+	if errno == _EOK {
+		c.req.mode = domain
+		c.req.flags = typ &^ (_SOCK_NONBLOCK | _SOCK_CLOEXEC)
+		c.req.n = proto
+		c.nonblock = typ&_SOCK_NONBLOCK != 0
+		c.cloexec = typ&_SOCK_CLOEXEC != 0
+	}
+	ts.lock.unlock()
+	return errno
+}
+
+//go:nosplit
+func sysAccept4(t *thread, d uint64, addr virtualAddress, addrLen virtualAddress, flags uint64) uint64 {
+	if flags&^(_SOCK_NONBLOCK|_SOCK_CLOEXEC) != 0 {
+		return _EINVAL
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, errno := fs.lookupSocket(d)
+	var c *fsCall
+	if errno == _EOK {
+		c, errno = fs.forwardSocket(t, f, sockAccept)
+	}
+	if errno == _EOK {
+		c.req.addr = uint64(addr)
+		c.req.addrLen = uint64(addrLen)
+		c.nonblock = flags&_SOCK_NONBLOCK != 0
+		c.cloexec = flags&_SOCK_CLOEXEC != 0
+	}
+	ts.lock.unlock()
+	return errno
+}
+
+// sysSockop forwards the socket operation op on the descriptor d.
+//go:nosplit
+func sysSockop(t *thread, op fsOp, d uint64, buf virtualAddress, n, flags uint64, addr virtualAddress, addrLen uint64) uint64 {
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, errno := fs.lookupSocket(d)
+	var c *fsCall
+	if errno == _EOK {
+		c, errno = fs.forwardSocket(t, f, op)
+	}
+	if errno == _EOK {
+		c.req.buf = uint64(buf)
+		c.req.n = n
+		c.req.flags |= flags
+		c.req.addr = uint64(addr)
+		c.req.addrLen = addrLen
+	}
+	ts.lock.unlock()
+	return errno
+}
+
+// sysSockopt implements setsockopt and getsockopt. For getsockopt,
+// n is the address of the option length.
+//go:nosplit
+func sysSockopt(t *thread, op fsOp, d, level, name uint64, val virtualAddress, n uint64) uint64 {
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, errno := fs.lookupSocket(d)
+	var c *fsCall
+	if errno == _EOK {
+		c, errno = fs.forwardSocket(t, f, op)
+	}
+	if errno == _EOK {
+		c.req.flags = level
+		c.req.mode = name
+		c.req.buf = uint64(val)
+		if op == sockGetopt {
+			c.req.addrLen = n
+		} else {
+			c.req.n = n
+		}
+	}
+	ts.lock.unlock()
+	return errno
+}
@@ -3,6 +3,7 @@
 package kernel
 
 import (
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -15,7 +16,30 @@ const (
 
 const (
 	// SYSCALL numbers.
+	_SYS_read           = 0
 	_SYS_write          = 1
+	_SYS_open           = 2
+	_SYS_close          = 3
+	_SYS_stat           = 4
+	_SYS_fstat          = 5
+	_SYS_lstat          = 6
+	_SYS_lseek          = 8
+	_SYS_pread64        = 17
+	_SYS_pwrite64       = 18
+	_SYS_fcntl          = 72
+	_SYS_getdents64     = 217
+	_SYS_openat         = 257
+	_SYS_newfstatat     = 262
+	_SYS_mkdir          = 83
+	_SYS_mkdirat        = 258
+	_SYS_unlink         = 87
+	_SYS_rmdir          = 84
+	_SYS_unlinkat       = 263
+	_SYS_rename         = 82
+	_SYS_renameat       = 264
+	_SYS_ftruncate      = 77
+	_SYS_fsync          = 74
+	_SYS_fdatasync      = 75
 	_SYS_mmap           = 9
 	_SYS_pipe           = 22
 	_SYS_pipe2          = 293
@@ -27,11 +51,45 @@ const (
 	_SYS_clone          = 56
 	_SYS_exit_group     = 231
 	_SYS_exit           = 60
+	_SYS_reboot         = 169
 	_SYS_nanosleep      = 35
+	_SYS_clock_gettime  = 228
+	_SYS_gettimeofday   = 96
 	_SYS_futex          = 202
 	_SYS_epoll_create1  = 291
 	_SYS_epoll_pwait    = 281
 	_SYS_epoll_ctl      = 233
+	_SYS_eventfd2       = 290
+	_SYS_socket         = 41
+	_SYS_connect        = 42
+	_SYS_accept         = 43
+	_SYS_sendto         = 44
+	_SYS_recvfrom       = 45
+	_SYS_sendmsg        = 46
+	_SYS_recvmsg        = 47
+	_SYS_shutdown       = 48
+	_SYS_bind           = 49
+	_SYS_listen         = 50
+	_SYS_getsockname    = 51
+	_SYS_getpeername    = 52
+	_SYS_setsockopt     = 54
+	_SYS_getsockopt     = 55
+	_SYS_accept4        = 288
+	_SYS_splice         = 275
+	_SYS_getrandom      = 318
+
+	_SYS_sched_yield       = 24
+	_SYS_sched_getaffinity = 204
+
+	_SYS_rt_sigreturn = 15
+	_SYS_getpid       = 39
+	_SYS_kill         = 62
+	_SYS_gettid       = 186
+	_SYS_tgkill       = 234
+
+	_SYS_munmap   = 11
+	_SYS_madvise  = 28
+	_SYS_mprotect = 10
 
 	// Custom syscall numbers.
 	_SYS_outl = 0x80000000 + iota
@@ -39,19 +97,39 @@ const (
 	_SYS_iomap
 	_SYS_alloc
 	_SYS_waitinterrupt
+	_SYS_free
+	_SYS_fsmount
+	_SYS_fsserve
+	_SYS_fsreply
+	_SYS_sockregister
+	_SYS_sockready
+	_SYS_consoleopen
+	_SYS_addentropy
 
 	_ARCH_SET_FS = 0x1002
 
-	_AT_PAGESZ = 6
-	_AT_NULL   = 0
+	_AT_PAGESZ       = 6
+	_AT_SYSINFO_EHDR = 33
+	_AT_NULL         = 0
+
+	_CLOCK_REALTIME         = 0
+	_CLOCK_MONOTONIC        = 1
+	_CLOCK_MONOTONIC_RAW    = 4
+	_CLOCK_REALTIME_COARSE  = 5
+	_CLOCK_MONOTONIC_COARSE = 6
+	_CLOCK_BOOTTIME         = 7
 
 	_MAP_ANONYMOUS = 0x20
 	_MAP_PRIVATE   = 0x2
 	_MAP_FIXED     = 0x10
 
+	_PROT_READ  = 0x1
 	_PROT_WRITE = 0x2
 	_PROT_EXEC  = 0x4
 
+	_MADV_DONTNEED = 4
+	_MADV_FREE     = 8
+
 	_CLONE_VM      = 0x100
 	_CLONE_FS      = 0x200
 	_CLONE_FILES   = 0x400
@@ -76,6 +154,28 @@ const (
 	_ENOTSUP = ^uint64(95) + 1
 	_ENOMEM  = ^uint64(0xc) + 1
 	_EINVAL  = ^uint64(0x16) + 1
+	_EAGAIN  = ^uint64(0xb) + 1
+	_EPERM   = ^uint64(0x1) + 1
+	_ESRCH   = ^uint64(0x3) + 1
+	_EACCES  = ^uint64(0xd) + 1
+	_ENOENT  = ^uint64(0x2) + 1
+	_EBADF   = ^uint64(0x9) + 1
+	_EFAULT  = ^uint64(0xe) + 1
+	_EEXIST  = ^uint64(0x11) + 1
+	_ENFILE  = ^uint64(0x17) + 1
+	_EMFILE  = ^uint64(0x18) + 1
+	_ENOSPC  = ^uint64(0x1c) + 1
+	_EPIPE   = ^uint64(0x20) + 1
+	_ENOTDIR = ^uint64(0x14) + 1
+	_EISDIR  = ^uint64(0x15) + 1
+	_ESPIPE  = ^uint64(0x1d) + 1
+	_EROFS   = ^uint64(0x1e) + 1
+	_EBUSY   = ^uint64(0x10) + 1
+	_EXDEV   = ^uint64(0x12) + 1
+
+	_ENAMETOOLONG = ^uint64(0x24) + 1
+	_ENOTSOCK     = ^uint64(0x58) + 1
+	_EAFNOSUPPORT = ^uint64(0x61) + 1
 )
 
 const (
@@ -88,7 +188,7 @@ const (
 
 type timespec struct {
 	seconds     int64
-	nanoseconds int32
+	nanoseconds int64
 }
 
 //go:nosplit
@@ -109,6 +209,13 @@ func initSYSCALL() {
 
 //go:nosplit
 func sysenter(t *thread, sysno, a0, a1, a2, a3, a4, a5 uint64) {
+	if sysno == _SYS_rt_sigreturn {
+		// Restore the complete thread state from the signal
+		// frame.
+		t.sigreturn()
+		t.block = blockCondition{}
+		globalThreads.schedule(t.cpu, t)
+	}
 	t.block = blockCondition{
 		syscall: 1,
 	}
@@ -116,9 +223,15 @@ func sysenter(t *thread, sysno, a0, a1, a2, a3, a4, a5 uint64) {
 	// Return values are passed in AX, DX.
 	t.setSyscallResult(ret0, ret1)
 	if t.block.conditions == 0 {
+		if t.hasSignal() {
+			ts := &globalThreads
+			ts.lock.lock()
+			t.deliverSignal()
+			ts.lock.unlock()
+		}
 		resumeThreadFast()
 	} else {
-		globalThreads.schedule(t)
+		globalThreads.schedule(t.cpu, t)
 	}
 	fatal("sysenter: resume failed")
 }
@@ -135,24 +248,54 @@ func (ts *timespec) duration() (time.Duration, bool) {
 //go:nosplit
 func sysenter0(t *thread, sysno, a0, a1, a2, a3, a4, a5 uint64) (uint64, uint64) {
 	switch sysno {
+	case _SYS_read:
+		return sysRead(t, a0, virtualAddress(a1), a2)
 	case _SYS_write:
-		fd := a0
-		p := virtualAddress(a1)
-		n := uint32(a2)
-		const dummyFd = 0
-		if fd == dummyFd {
-			return uint64(n), 0
-		}
-		if fd != 1 && fd != 2 {
-			return _ENOTSUP, 0
-		}
-		bytes := sliceForMem(p, int(n))
-		output(bytes)
-		return uint64(len(bytes)), 0
+		return sysWrite(t, a0, virtualAddress(a1), a2)
+	case _SYS_pread64:
+		return sysPread(t, a0, virtualAddress(a1), a2, int64(a3), false), 0
+	case _SYS_pwrite64:
+		return sysPread(t, a0, virtualAddress(a1), a2, int64(a3), true), 0
+	case _SYS_open:
+		return sysOpenat(t, _AT_FDCWD, virtualAddress(a0), a1, a2), 0
+	case _SYS_openat:
+		return sysOpenat(t, int32(a0), virtualAddress(a1), a2, a3), 0
+	case _SYS_close:
+		return sysClose(a0), 0
+	case _SYS_fstat:
+		return sysFstat(t, a0, (*stat)(unsafe.Pointer(uintptr(a1)))), 0
+	case _SYS_stat, _SYS_lstat:
+		return sysFstatat(t, _AT_FDCWD, virtualAddress(a0), (*stat)(unsafe.Pointer(uintptr(a1))), 0), 0
+	case _SYS_newfstatat:
+		return sysFstatat(t, int32(a0), virtualAddress(a1), (*stat)(unsafe.Pointer(uintptr(a2))), a3), 0
+	case _SYS_lseek:
+		return sysLseek(t, a0, int64(a1), a2), 0
+	case _SYS_getdents64:
+		return sysGetdents64(t, a0, virtualAddress(a1), a2), 0
+	case _SYS_mkdir:
+		return sysMkdirat(t, _AT_FDCWD, virtualAddress(a0), a1), 0
+	case _SYS_mkdirat:
+		return sysMkdirat(t, int32(a0), virtualAddress(a1), a2), 0
+	case _SYS_unlink:
+		return sysUnlinkat(t, _AT_FDCWD, virtualAddress(a0), 0), 0
+	case _SYS_rmdir:
+		return sysUnlinkat(t, _AT_FDCWD, virtualAddress(a0), _AT_REMOVEDIR), 0
+	case _SYS_unlinkat:
+		return sysUnlinkat(t, int32(a0), virtualAddress(a1), a2), 0
+	case _SYS_rename:
+		return sysRenameat(t, _AT_FDCWD, virtualAddress(a0), _AT_FDCWD, virtualAddress(a1)), 0
+	case _SYS_renameat:
+		return sysRenameat(t, int32(a0), virtualAddress(a1), int32(a2), virtualAddress(a3)), 0
+	case _SYS_ftruncate:
+		return sysFtruncate(t, a0, int64(a1)), 0
+	case _SYS_fsync, _SYS_fdatasync:
+		return sysFsync(t, a0), 0
+	case _SYS_fcntl:
+		return sysFcntl(a0, a1, a2), 0
 	case _SYS_mmap:
 		addr := virtualAddress(a0)
 		n := a1
-		// prot := a2
+		prot := a2
 		flags := a3
 		// fd := a4
 		// off := a5
@@ -160,27 +303,50 @@ func sysenter0(t *thread, sysno, a0, a1, a2, a3, a4, a5 uint64) (uint64, uint64)
 		if flags & ^uint64(supported) != 0 {
 			return _ENOTSUP, 0
 		}
-		/*var pf pageFlags
-		if prot&_PROT_WRITE != 0 {
-			pf |= pageWritable
+		pf, errno := protFlags(prot)
+		if errno != _EOK {
+			return errno, 0
 		}
-		if prot&_PROT_EXEC == 0 {
-			pf |= pageNotExecutable
-		}*/
-		// Always use the most lenient flags for now.
-		pf := pageFlagWritable | pageFlagUserAccess
+		if n == 0 {
+			return _EINVAL, 0
+		}
+		memLock.lock()
+		ret := uint64(addr)
 		if flags&_MAP_FIXED != 0 {
-			if !globalMap.mmapFixed(addr, n, pf) {
-				// Ignore error and assume the range is
-				// already mapped.
+			// Replace existing mappings.
+			end := (addr + virtualAddress(n)).AlignUp()
+			switch {
+			case addr != addr.Align() || end <= addr:
+				ret = _EINVAL
+			default:
+				if errno := sysUnmap0(addr, end, true); errno != _EOK {
+					ret = errno
+				} else if !globalMap.mmapFixed(addr, n, pf) {
+					ret = _ENOMEM
+				}
 			}
-			return uint64(addr), 0
 		} else {
 			addr, err := globalMap.mmap(addr, n, pf)
 			if err != nil {
-				return _ENOMEM, 0
+				ret = _ENOMEM
+			} else {
+				ret = uint64(addr)
 			}
-			return uint64(addr), 0
+		}
+		memLock.unlock()
+		return ret, 0
+	case _SYS_munmap:
+		return sysUnmap(virtualAddress(a0), a1, true), 0
+	case _SYS_mprotect:
+		return sysMprotect(virtualAddress(a0), a1, a2), 0
+	case _SYS_madvise:
+		switch a2 {
+		case _MADV_DONTNEED, _MADV_FREE:
+			// Drop the pages but keep the range.
+			return sysUnmap(virtualAddress(a0), a1, false), 0
+		default:
+			// Ignore hints.
+			return _EOK, 0
 		}
 	case _SYS_clone:
 		flags := a0
@@ -195,16 +361,32 @@ func sysenter0(t *thread, sysno, a0, a1, a2, a3, a4, a5 uint64) (uint64, uint64)
 			return _ENOTSUP, 0
 		}
 		stack := a1
-		clone, err := globalThreads.newThread()
+		ts := &globalThreads
+		ts.lock.lock()
+		clone, err := ts.newThread()
 		if err != nil {
+			ts.lock.unlock()
 			return _ENOMEM, 0
 		}
 		clone.context = t.context
+		// The signal mask is inherited.
+		clone.signals.mask = t.signals.mask
 		clone.sp = stack
 		clone.ax = 0 // Return 0 from the cloned thread.
+		ts.lock.unlock()
+		wakeIdleCPUs()
 		return uint64(clone.id), 0
 	case _SYS_exit_group:
+		// The program is done; turn off the machine after
+		// writing the console output the program didn't get to.
+		globalThreads.lock.lock()
+		globalFiles.console.flush()
+		globalThreads.lock.unlock()
+		powerOff(int(a0))
+		ts := &globalThreads
+		ts.lock.lock()
 		t.block.conditions = deadCondition
+		ts.lock.unlock()
 		return _EOK, 0
 	case _SYS_arch_prctl:
 		switch code := a0; code {
@@ -223,40 +405,185 @@ func sysenter0(t *thread, sysno, a0, a1, a2, a3, a4, a5 uint64) (uint64, uint64)
 		val := a2
 		switch op := a1; op {
 		case _FUTEX_WAIT, _FUTEX_WAIT_PRIVATE:
-			ts := (*timespec)(unsafe.Pointer(uintptr(a3)))
-			if d, ok := ts.duration(); ok {
+			if !userAccessible(virtualAddress(addr), 4, false) || !userPtr(unsafe.Pointer(uintptr(a3)), unsafe.Sizeof(timespec{}), false) {
+				return _EFAULT, 0
+			}
+			ts := &globalThreads
+			ts.lock.lock()
+			// Check the futex value while holding the lock, to not
+			// miss a wakeup from another processor.
+			if atomic.LoadUint32((*uint32)(unsafe.Pointer(uintptr(addr)))) != uint32(val) {
+				ts.lock.unlock()
+				return _EAGAIN, 0
+			}
+			timeout := (*timespec)(unsafe.Pointer(uintptr(a3)))
+			if d, ok := timeout.duration(); ok {
 				t.sleepFor(d)
 			}
 			t.block.conditions |= futexCondition
 			t.block.futex = addr
+			ts.lock.unlock()
 			return 0, 0
 		case _FUTEX_WAKE, _FUTEX_WAKE_PRIVATE:
-			globalThreads.futexWakeup(addr, int(val))
-			return _EOK, 0
+			ts := &globalThreads
+			ts.lock.lock()
+			n := ts.futexWakeup(addr, int(val))
+			ts.lock.unlock()
+			if n > 0 {
+				wakeIdleCPUs()
+			}
+			return uint64(n), 0
 		}
-	case _SYS_rt_sigprocmask, _SYS_sigaltstack, _SYS_rt_sigaction:
-		// Ignore signals.
-		return _EOK, 0
+	case _SYS_rt_sigaction:
+		act := (*sigaction)(unsafe.Pointer(uintptr(a1)))
+		oact := (*sigaction)(unsafe.Pointer(uintptr(a2)))
+		return sysSigaction(int(a0), act, oact, a3), 0
+	case _SYS_rt_sigprocmask:
+		set := (*uint64)(unsafe.Pointer(uintptr(a1)))
+		oset := (*uint64)(unsafe.Pointer(uintptr(a2)))
+		return t.sysSigprocmask(int(a0), set, oset, a3), 0
+	case _SYS_sigaltstack:
+		ss := (*stackt)(unsafe.Pointer(uintptr(a0)))
+		oss := (*stackt)(unsafe.Pointer(uintptr(a1)))
+		return t.sysSigaltstack(ss, oss), 0
+	case _SYS_tgkill:
+		return sysTgkill(int(a0), int(a1), int(a2)), 0
+	case _SYS_kill:
+		if pid := int(a0); pid != 0 && pid != processID {
+			return _ESRCH, 0
+		}
+		// Deliver process signals to the calling thread.
+		return sysTgkill(processID, int(t.id), int(a1)), 0
+	case _SYS_getpid:
+		return processID, 0
+	case _SYS_gettid:
+		return uint64(t.id), 0
 	case _SYS_nanosleep:
-		ts := (*timespec)(unsafe.Pointer(uintptr(a0)))
-		if d, ok := ts.duration(); ok {
+		if !userPtr(unsafe.Pointer(uintptr(a0)), unsafe.Sizeof(timespec{}), false) {
+			return _EFAULT, 0
+		}
+		ts := &globalThreads
+		ts.lock.lock()
+		timeout := (*timespec)(unsafe.Pointer(uintptr(a0)))
+		if d, ok := timeout.duration(); ok {
 			t.sleepFor(d)
 		}
+		ts.lock.unlock()
 		return _EOK, 0
-	case _SYS_epoll_create1:
+	case _SYS_clock_gettime:
+		if !userPtr(unsafe.Pointer(uintptr(a1)), unsafe.Sizeof(timespec{}), true) {
+			return _EFAULT, 0
+		}
+		wall, mono := unixClock.read()
+		var now instant
+		switch clk := a0; clk {
+		case _CLOCK_REALTIME, _CLOCK_REALTIME_COARSE:
+			now = wall
+		case _CLOCK_MONOTONIC, _CLOCK_MONOTONIC_RAW, _CLOCK_MONOTONIC_COARSE, _CLOCK_BOOTTIME:
+			now = mono
+		default:
+			return _EINVAL, 0
+		}
+		if ts := (*timespec)(unsafe.Pointer(uintptr(a1))); ts != nil {
+			ts.seconds = now.seconds
+			ts.nanoseconds = int64(now.nanoseconds)
+		}
 		return _EOK, 0
-	case _SYS_epoll_ctl:
+	case _SYS_gettimeofday:
+		if !userPtr(unsafe.Pointer(uintptr(a0)), unsafe.Sizeof(timespec{}), true) {
+			return _EFAULT, 0
+		}
+		wall, _ := unixClock.read()
+		if tv := (*timespec)(unsafe.Pointer(uintptr(a0))); tv != nil {
+			tv.seconds = wall.seconds
+			// Microseconds.
+			tv.nanoseconds = int64(wall.nanoseconds / 1000)
+		}
 		return _EOK, 0
-	case _SYS_pipe2:
+	case _SYS_sched_yield:
+		ts := &globalThreads
+		ts.lock.lock()
+		// Let the scheduler pick another thread.
+		t.sleepFor(0)
+		ts.lock.unlock()
 		return _EOK, 0
+	case _SYS_sched_getaffinity:
+		size := a1
+		mask := virtualAddress(a2)
+		if size < 8 {
+			return _EINVAL, 0
+		}
+		if !userAccessible(mask, 8, true) {
+			return _EFAULT, 0
+		}
+		// Report every processor as available.
+		bits := uint64(1)<<uint(ncpu) - 1
+		*(*uint64)(unsafe.Pointer(mask)) = bits
+		return 8, 0
+	case _SYS_epoll_create1:
+		return sysEpollCreate1(a0), 0
+	case _SYS_epoll_ctl:
+		ev := (*epollEvent)(unsafe.Pointer(uintptr(a3)))
+		return sysEpollCtl(a0, a1, a2, ev), 0
 	case _SYS_epoll_pwait:
-		timeout := time.Duration(a3) * time.Millisecond
-		if timeout >= 0 {
-			t.sleepFor(timeout)
-		} else {
-			t.block.conditions = deadCondition
+		return sysEpollPwait(t, a0, virtualAddress(a1), int32(a2), int32(a3))
+	case _SYS_pipe:
+		fds := (*[2]int32)(unsafe.Pointer(uintptr(a0)))
+		return sysPipe2(fds, 0), 0
+	case _SYS_pipe2:
+		fds := (*[2]int32)(unsafe.Pointer(uintptr(a0)))
+		return sysPipe2(fds, a1), 0
+	case _SYS_eventfd2:
+		return sysEventfd2(a0, a1), 0
+	case _SYS_socket:
+		return sysSocket(t, a0, a1, a2), 0
+	case _SYS_bind:
+		return sysSockop(t, sockBind, a0, 0, 0, 0, virtualAddress(a1), a2), 0
+	case _SYS_connect:
+		return sysSockop(t, sockConnect, a0, 0, 0, 0, virtualAddress(a1), a2), 0
+	case _SYS_listen:
+		return sysSockop(t, sockListen, a0, 0, a1, 0, 0, 0), 0
+	case _SYS_accept:
+		return sysAccept4(t, a0, virtualAddress(a1), virtualAddress(a2), 0), 0
+	case _SYS_accept4:
+		return sysAccept4(t, a0, virtualAddress(a1), virtualAddress(a2), a3), 0
+	case _SYS_sendto:
+		return sysSockop(t, sockSend, a0, virtualAddress(a1), a2, a3, virtualAddress(a4), a5), 0
+	case _SYS_recvfrom:
+		return sysSockop(t, sockRecv, a0, virtualAddress(a1), a2, a3, virtualAddress(a4), a5), 0
+	case _SYS_sendmsg:
+		return sysSockop(t, sockSendmsg, a0, virtualAddress(a1), 0, a2, 0, 0), 0
+	case _SYS_recvmsg:
+		return sysSockop(t, sockRecvmsg, a0, virtualAddress(a1), 0, a2, 0, 0), 0
+	case _SYS_shutdown:
+		return sysSockop(t, sockShutdown, a0, 0, a1, 0, 0, 0), 0
+	case _SYS_getsockname:
+		return sysSockop(t, sockName, a0, 0, 0, 0, virtualAddress(a1), a2), 0
+	case _SYS_getpeername:
+		return sysSockop(t, sockPeerName, a0, 0, 0, 0, virtualAddress(a1), a2), 0
+	case _SYS_setsockopt:
+		return sysSockopt(t, sockSetopt, a0, a1, a2, virtualAddress(a3), a4), 0
+	case _SYS_getsockopt:
+		return sysSockopt(t, sockGetopt, a0, a1, a2, virtualAddress(a3), a4), 0
+	case _SYS_getrandom:
+		return sysGetrandom(virtualAddress(a0), a1, a2), 0
+	case _SYS_splice:
+		// Report splicing as unsupported for every kind of file,
+		// which makes Go fall back to copying.
+		return _EINVAL, 0
+	case _SYS_reboot:
+		if a0 != _LINUX_REBOOT_MAGIC1 || a1 != _LINUX_REBOOT_MAGIC2 {
+			return _EINVAL, 0
 		}
-		return _EOK, 0
+		switch cmd := a2; cmd {
+		case _LINUX_REBOOT_CMD_RESTART:
+			reboot()
+		case _LINUX_REBOOT_CMD_HALT, _LINUX_REBOOT_CMD_POWER_OFF:
+			powerOff(0)
+		default:
+			return _EINVAL, 0
+		}
+		return _ENOTSUP, 0
 	case _SYS_outl:
 		port := uint16(a0)
 		val := uint32(a1)
@@ -277,43 +604,212 @@ func sysenter0(t *thread, sysno, a0, a1, a2, a3, a4, a5 uint64) (uint64, uint64)
 			return _EINVAL, 0
 		}
 		size = (size + pageSize - 1) &^ (pageSize - 1)
+		memLock.lock()
 		r, ok := globalMap.rangeForAddress(vaddr, int(size))
 		if !ok {
+			memLock.unlock()
 			return _EINVAL, 0
 		}
-		err := mmapAligned(&globalMem, globalPT, vaddr, vaddr+virtualAddress(size), addr, r.flags)
+		end := vaddr + virtualAddress(size)
+		err := mmapAligned(&globalMem, globalPT, vaddr, end, addr, r.flags)
 		if err != nil {
-			// TODO: free virtual map.
+			// Undo the partial mapping.
+			unmapRange(&globalMem, globalPT, vaddr, end)
+			shootdownTLB()
+			memLock.unlock()
 			return _ENOMEM, 0
 		}
+		memLock.unlock()
 		return _EOK, 0
 	case _SYS_alloc:
-		maxSize := a0
-		addr, size, err := globalMem.alloc(int(maxSize))
+		size, align := a0, a1
+		if size == 0 || size > maxBlockSize || align > maxBlockSize {
+			return _EINVAL, 0
+		}
+		if align&(align-1) != 0 {
+			return _EINVAL, 0
+		}
+		memLock.lock()
+		addr, err := globalMem.allocUser(int(size), int(align))
+		memLock.unlock()
 		if err != nil {
 			return _ENOMEM, 0
 		}
-		return uint64(addr), uint64(size)
+		return uint64(addr), 0
+	case _SYS_free:
+		addr, size := physicalAddress(a0), a1
+		if size > 1<<48 {
+			return _EINVAL, 0
+		}
+		memLock.lock()
+		err := globalMem.freeUser(addr, int(size))
+		memLock.unlock()
+		if err != nil {
+			return _EINVAL, 0
+		}
+		return _EOK, 0
 	case _SYS_waitinterrupt:
+		ts := &globalThreads
+		ts.lock.lock()
 		t.block.conditions = interruptCondition
+		ts.lock.unlock()
 		return 0, 0
+	case _SYS_fsmount:
+		return sysFSMount(virtualAddress(a0)), 0
+	case _SYS_fsserve:
+		return sysFSServe(t, (*fsRequest)(unsafe.Pointer(uintptr(a0)))), 0
+	case _SYS_fsreply:
+		return sysFSReply(a0, a1, a2), 0
+	case _SYS_sockregister:
+		return sysSockRegister(), 0
+	case _SYS_sockready:
+		return sysSockReady(a0, uint32(a1)), 0
+	case _SYS_consoleopen:
+		return sysConsoleOpen(), 0
+	case _SYS_addentropy:
+		if !userAccessible(virtualAddress(a0), a1, false) {
+			return _EFAULT, 0
+		}
+		addEntropy(sliceForMem(virtualAddress(a0), int(a1)))
+		return _EOK, 0
 	}
 	return _ENOTSUP, 0
 }
 
-const COM1 = 0x3f8
+// protFlags converts mmap protection bits to the page flags of user
+// memory. Writable and executable memory is not allowed.
+//go:nosplit
+func protFlags(prot uint64) (pageFlags, uint64) {
+	if prot&^(_PROT_READ|_PROT_WRITE|_PROT_EXEC) != 0 {
+		return 0, _EINVAL
+	}
+	if prot&_PROT_WRITE != 0 && prot&_PROT_EXEC != 0 {
+		return 0, _EACCES
+	}
+	if prot == 0 {
+		return protNone, _EOK
+	}
+	pf := pageFlagUserAccess
+	if prot&_PROT_WRITE != 0 {
+		pf |= pageFlagWritable
+	}
+	if prot&_PROT_EXEC == 0 {
+		pf |= pageFlagNX
+	}
+	return pf, _EOK
+}
 
 //go:nosplit
-func output(b []byte) {
-	for i := 0; i < len(b); i++ {
-		outb(COM1, b[i])
+func sysMprotect(addr virtualAddress, size, prot uint64) uint64 {
+	if addr&(pageSize-1) != 0 {
+		return _EINVAL
 	}
+	pf, errno := protFlags(prot)
+	if errno != _EOK {
+		return errno
+	}
+	if size == 0 {
+		return _EOK
+	}
+	end := (addr + virtualAddress(size)).AlignUp()
+	if end <= addr {
+		return _ENOMEM
+	}
+	memLock.lock()
+	ret := sysMprotect0(addr, end, pf)
+	memLock.unlock()
+	return ret
+}
+
+//go:nosplit
+func sysMprotect0(start, end virtualAddress, flags pageFlags) uint64 {
+	vm := &globalMap
+	// The range must be fully mapped user memory.
+	next := start
+	for i := vm.closestRange(start); i < len(vm.ranges) && next < end; i++ {
+		r := vm.ranges[i]
+		if r.start > next {
+			return _ENOMEM
+		}
+		if !r.isUser() {
+			return _EINVAL
+		}
+		next = r.end
+	}
+	if next < end {
+		return _ENOMEM
+	}
+	err := protectRange(&globalMem, globalPT, start, end, flags)
+	shootdownTLB()
+	if err != nil {
+		return _ENOMEM
+	}
+	vm.removeRange(start, end)
+	vm.mustAddRange(start, end, flags)
+	return _EOK
+}
+
+// sysUnmap implements munmap and madvise(MADV_DONTNEED). It removes
+// the page mappings of the user memory range and frees the memory
+// backing it. If remove is set, the range is also removed from the
+// virtual memory map.
+//go:nosplit
+func sysUnmap(addr virtualAddress, size uint64, remove bool) uint64 {
+	if addr&(pageSize-1) != 0 || size == 0 {
+		return _EINVAL
+	}
+	end := (addr + virtualAddress(size)).AlignUp()
+	if end <= addr {
+		return _EINVAL
+	}
+	memLock.lock()
+	ret := sysUnmap0(addr, end, remove)
+	memLock.unlock()
+	return ret
+}
+
+//go:nosplit
+func sysUnmap0(start, end virtualAddress, remove bool) uint64 {
+	vm := &globalMap
+	first := vm.closestRange(start)
+	for i := first; i < len(vm.ranges) && vm.ranges[i].start < end; i++ {
+		if !vm.ranges[i].isUser() {
+			return _EINVAL
+		}
+	}
+	ret := uint64(_EOK)
+	// Unmap only the pages of mapped ranges; the holes may contain
+	// kernel mappings.
+	for i := first; i < len(vm.ranges) && vm.ranges[i].start < end; i++ {
+		r := vm.ranges[i]
+		s, e := r.start, r.end
+		if s < start {
+			s = start
+		}
+		if e > end {
+			e = end
+		}
+		if err := unmapRange(&globalMem, globalPT, s, e); err != nil {
+			ret = _ENOMEM
+			break
+		}
+	}
+	shootdownTLB()
+	if ret == _EOK && remove {
+		vm.removeRange(start, end)
+	}
+	return ret
+}
+
+//go:nosplit
+func output(b []byte) {
+	serialWrite(b)
 }
 
 //go:nosplit
 func outputString(b string) {
 	for i := 0; i < len(b); i++ {
-		outb(COM1, b[i])
+		serialWriteByte(b[i])
 	}
 }
 
@@ -331,9 +827,9 @@ func outputUint64(v uint64) {
 		onlyZero = false
 		switch {
 		case 0 <= nib && nib <= 9:
-			outb(COM1, nib+'0')
+			serialWriteByte(nib + '0')
 		default:
-			outb(COM1, nib-10+'a')
+			serialWriteByte(nib - 10 + 'a')
 		}
 	}
 }
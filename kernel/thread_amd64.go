@@ -4,6 +4,7 @@ package kernel
 
 import (
 	"reflect"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -20,6 +21,9 @@ var globalThreads threads
 type tid uint64
 
 type threads struct {
+	// lock protects threads and the scheduling state of every
+	// thread.
+	lock    spinlock
 	threads []thread
 }
 
@@ -29,9 +33,16 @@ type thread struct {
 	self *thread
 	context
 
+	// cpu is the processor running the thread, or nil if the
+	// thread is not running. The offset of cpu is known to
+	// assembly.
+	cpu *cpu
+
 	id tid
 
 	block blockCondition
+
+	signals signals
 }
 
 type blockCondition struct {
@@ -47,7 +58,24 @@ type blockCondition struct {
 	// For futexCondition.
 	futex uint64
 
-	_ uint32
+	// For fileCondition.
+	file struct {
+		file   int32
+		events uint32
+	}
+
+	// For pollCondition.
+	poll struct {
+		epoll int32
+	}
+
+	// For fsCondition and fsServeCondition.
+	fs struct {
+		// call is the index of the outstanding request.
+		call int32
+		// req is the address of the request buffer of a server.
+		req uint64
+	}
 }
 
 // waitConditions is a set of potential conditions that will wake up a
@@ -59,6 +87,15 @@ const (
 	sleepCondition
 	futexCondition
 	deadCondition
+	// fileCondition waits for a file to become ready.
+	fileCondition
+	// pollCondition waits for events from an epoll instance.
+	pollCondition
+	// fsCondition waits for the reply to a user file system
+	// request.
+	fsCondition
+	// fsServeCondition waits for a user file system request.
+	fsServeCondition
 )
 
 const scheduleTimeSlice = 10 * time.Millisecond
@@ -66,9 +103,6 @@ const scheduleTimeSlice = 10 * time.Millisecond
 // Thread state for early initialization.
 var thread0 thread
 
-// Kernel thread for yielding.
-var kernelThread thread
-
 // context represent a thread's CPU state. The exact layout of context
 // is known to the thread assembly functions.
 type context struct {
@@ -110,13 +144,24 @@ func initThreads() error {
 	if unsafe.Offsetof(thread{}.fpState)%16 != 0 {
 		fatal("initThreads: invalid thread.context field alignment")
 	}
+	if unsafe.Sizeof(thread{})%16 != 0 {
+		fatal("initThreads: invalid thread size")
+	}
+	if unsafe.Sizeof(siginfo{}) != 128 {
+		fatal("initThreads: invalid siginfo size")
+	}
+	if unsafe.Offsetof(thread{}.cpu) != 20*8+512 {
+		fatal("initThreads: invalid thread.cpu field alignment")
+	}
 	return globalThreads.init()
 }
 
 //go:nosplit
 func (ts *threads) init() error {
 	size := unsafe.Sizeof(ts.threads[0]) * maxThreads
-	addr, err := globalMap.mmap(0, uint64(size), pageFlagNX|pageFlagWritable)
+	// Populate the memory up front to avoid page faults while
+	// holding the scheduler lock.
+	addr, err := mmapPopulated(uint64(size), pageFlagNX|pageFlagWritable)
 	if err != nil {
 		return err
 	}
@@ -134,25 +179,40 @@ func (ts *threads) newThread() (*thread, error) {
 	tid := tid(len(ts.threads))
 	ts.threads = ts.threads[:tid+1]
 	newt := &ts.threads[tid]
-	*newt = thread{
-		id: tid,
-	}
+	// Clear the thread as bytes to avoid the write barriers for
+	// the pointer fields.
+	*(*[unsafe.Sizeof(thread{})]byte)(unsafe.Pointer(newt)) = [unsafe.Sizeof(thread{})]byte{}
+	newt.id = tid
 	newt.self = newt
 	return newt, nil
 }
 
-// Schedule selects an appropriate thread to resume and makes it
-// current.
+// Schedule selects an appropriate thread to resume on the processor
+// c and makes it current. The thread t, if not nil, is the thread
+// that was interrupted or blocked on c.
 //go:nosplit
-func (ts *threads) schedule(t *thread) {
+func (ts *threads) schedule(c *cpu, t *thread) {
+	ts.lock.lock()
+	if t != nil {
+		// The state of t is saved; let any processor resume it.
+		// Make the idle thread current, so thisCPU doesn't rely
+		// on t.
+		t.cpu = nil
+		c.kernelThread.makeCurrent(c)
+	}
 	for {
 		updateClock()
 		maxDur := 24 * time.Hour
-		monotoneTime := unixClock.monotoneMillis()
-		for i := 0; i < len(ts.threads); i++ {
+		monotoneTime := unixClock.monotoneNanos()
+		n := len(ts.threads)
+		for i := 0; i < n; i++ {
 			// Round-robin scheduling.
-			tid := (int(t.id) + 1) % len(ts.threads)
-			t = &ts.threads[tid]
+			idx := (c.next + i) % n
+			t := &ts.threads[idx]
+			if t.cpu != nil {
+				// Running on another processor.
+				continue
+			}
 			if dur, ok := t.runnable(monotoneTime); !ok {
 				if dur > 0 && dur < maxDur {
 					maxDur = dur
@@ -160,8 +220,12 @@ func (ts *threads) schedule(t *thread) {
 				continue
 			}
 			t.block.conditions = 0
-			t.makeCurrent()
-			setTimer(scheduleTimeSlice)
+			t.deliverSignal()
+			t.makeCurrent(c)
+			c.next = idx + 1
+			atomic.StoreUint32(&c.idle, 0)
+			ts.lock.unlock()
+			c.setTimer(scheduleTimeSlice)
 			if t.block.syscall != 0 {
 				resumeThreadFast()
 			} else {
@@ -169,13 +233,23 @@ func (ts *threads) schedule(t *thread) {
 			}
 			fatal("schedule: resume failed")
 		}
-		setTimer(maxDur)
-		yield()
+		// Mark the processor idle before releasing the lock, so
+		// wakeIdleCPUs can't miss it. Interrupts are disabled
+		// until yield halts the processor.
+		atomic.StoreUint32(&c.idle, 1)
+		ts.lock.unlock()
+		c.setTimer(maxDur)
+		yield(c)
+		ts.lock.lock()
 	}
 }
 
+// futexWakeup wakes up to nwaiters threads waiting for the futex at
+// addr and returns the number of woken threads. It must be called
+// with ts.lock held.
 //go:nosplit
-func (ts *threads) futexWakeup(addr uint64, nwaiters int) {
+func (ts *threads) futexWakeup(addr uint64, nwaiters int) int {
+	woken := 0
 	for i := 0; i < len(ts.threads); i++ {
 		if nwaiters == 0 {
 			break
@@ -189,7 +263,9 @@ func (ts *threads) futexWakeup(addr uint64, nwaiters int) {
 		}
 		t.block.conditions = 0
 		nwaiters--
+		woken++
 	}
+	return woken
 }
 
 //go:nosplit
@@ -208,9 +284,39 @@ func (t *thread) runnable(monotoneTime uint64) (time.Duration, bool) {
 			}
 		}
 	}
+	if cond&pollCondition != 0 {
+		// The restarted epoll_pwait collects the events.
+		if globalFiles.epollReady(t.block.poll.epoll) {
+			return 0, true
+		}
+	}
+	if cond&fileCondition != 0 {
+		f := &t.block.file
+		if globalFiles.ready(f.file)&f.events != 0 {
+			return 0, true
+		}
+	}
+	if cond&fsCondition != 0 {
+		if ret, ok := globalFiles.callResult(t.block.fs.call); ok {
+			t.setSyscallResult(ret, 0)
+			return 0, true
+		}
+	}
+	if cond&fsServeCondition != 0 {
+		req := (*fsRequest)(unsafe.Pointer(uintptr(t.block.fs.req)))
+		if c := globalFiles.serveCall(req); c != -1 {
+			t.setSyscallResult(uint64(c), 0)
+			return 0, true
+		}
+	}
 	if cond&sleepCondition != 0 {
-		dur := time.Duration(monotoneTime-t.block.sleep.monotoneTime) * time.Millisecond
+		dur := time.Duration(monotoneTime - t.block.sleep.monotoneTime)
 		rem := t.block.sleep.duration - dur
+		if rem <= 0 && cond&pollCondition != 0 {
+			// Clear the timeout argument, so the restarted
+			// epoll_pwait returns without blocking.
+			t.r10 = 0
+		}
 		return rem, rem <= 0
 	}
 	return 0, false
@@ -222,8 +328,12 @@ func (t *thread) setSyscallResult(ret0, ret1 uint64) {
 	t.dx = ret1
 }
 
+// makeCurrent marks t as running on the processor c and
+// loads it into GS.
 //go:nosplit
-func (t *thread) makeCurrent() {
+func (t *thread) makeCurrent(c *cpu) {
+	t.cpu = c
+	c.thread = t
 	v := uint64(uintptr(unsafe.Pointer(t)))
 	wrmsr(_IA32_GS_BASE, v)
 }
@@ -231,7 +341,7 @@ func (t *thread) makeCurrent() {
 //go:nosplit
 func (t *thread) sleepFor(duration time.Duration) {
 	t.block.conditions |= sleepCondition
-	t.block.sleep.monotoneTime = unixClock.monotoneMillis()
+	t.block.sleep.monotoneTime = unixClock.monotoneNanos()
 	t.block.sleep.duration = duration
 }
 
@@ -285,14 +395,14 @@ func (t *thread) dump() {
 //go:nosplit
 func interruptSchedule(t *thread) {
 	t.block = blockCondition{}
-	globalThreads.schedule(t)
+	globalThreads.schedule(t.cpu, t)
 }
 
-// yield halts the processor until an interrupt arrives.
+// yield halts the processor c until an interrupt arrives.
 //go:nosplit
-func yield() {
+func yield(c *cpu) {
 	swapgs()
-	kernelThread.makeCurrent()
+	c.kernelThread.makeCurrent(c)
 	swapgs()
 	yield0()
 }
@@ -3,17 +3,52 @@
 package kernel
 
 import (
+	"math/bits"
 	"sync/atomic"
 	"time"
 	"unsafe"
+
+	"eliasnaur.com/unik/kernel/acpi"
+)
+
+// Timer implementations.
+const (
+	timerLAPIC = iota
+	timerTSCDeadline
+	timerHPET
 )
 
+// timerMode selects the implementation of cpu.setTimer.
+var timerMode int
+
+// lapicTimerFreq is the frequency of the local APIC timers, in
+// ticks per second.
+var lapicTimerFreq uint64
+
 const (
-	// Assume a fixed address for the HPET.
-	// TODO: Detect HPET presence and address from ACPI.
-	hpetBase virtualAddress = 0xfed00000
+	_IA32_TSC_DEADLINE = 0x6e0
+
+	apicTimerTSCDeadline = 0b10 << 17
+
+	// pmTimerFreq is the frequency of the ACPI power management
+	// timer.
+	pmTimerFreq = 3579545
+
+	// Ports and frequency of the programmable interval timer.
+	pitFreq          = 1193182
+	pitChannel2Port  = 0x42
+	pitCommandPort   = 0x43
+	pitControlPort   = 0x61
+	pitGate2         = 1 << 0
+	pitSpeakerEnable = 1 << 1
+	pitOut2          = 1 << 5
 )
 
+// hpetBase is the address of the HPET registers, identity mapped
+// by initClock. It defaults to the conventional address if the ACPI
+// tables don't list a HPET.
+var hpetBase virtualAddress
+
 const (
 	_TN_FSB_INT_DEL_CAP = 1 << 15
 	_Tn_FSB_EN_CNF      = 1 << 14
@@ -53,7 +88,7 @@ type HPETTimer struct {
 // Uses a similar algorithm as the gettimeofday implementation in
 // Linux.
 //
-// Note that vdsoGettimeofday depends on the field offsets.
+// Note that the vDSO functions depend on the field offsets.
 type clock struct {
 	// seq is the sequence number of the clock, as is incremented
 	// before and after a write. An odd seq indicates a write is in
@@ -63,6 +98,13 @@ type clock struct {
 	time instant
 
 	monotoneTime instant
+
+	// tscBase is the TSC value at the time of time and
+	// monotoneTime. If tscMult is non-zero, readers add the
+	// elapsed TSC ticks times tscMult, in 32.32 fixed point
+	// nanoseconds, to the clock.
+	tscBase uint64
+	tscMult uint64
 }
 
 type instant struct {
@@ -80,29 +122,81 @@ var hpetDev struct {
 
 var unixClock clock
 
+// clockLock serializes updates to unixClock and the HPET timer
+// state.
+var clockLock spinlock
+
 //go:nosplit
 func initClock() error {
 	unixClock.init(readCMOSTime())
 
 	globalIDT.install(intTimer, ring0, istGeneric, timerTrampoline)
 
+	if err := initHPET(); err != nil {
+		return err
+	}
+	// Without the HPET, the TSC is the only clock source.
+	if hasInvariantTSC() || hpetDev.device == nil {
+		calibrateTSC()
+	}
+	if hpetDev.device == nil && unixClock.tscMult == 0 {
+		return kernError("initClock: no clock source")
+	}
+	calibrateLAPICTimer()
+	switch {
+	case unixClock.tscMult != 0 && hasTSCDeadline():
+		timerMode = timerTSCDeadline
+	case lapicTimerFreq != 0:
+		timerMode = timerLAPIC
+	case hpetDev.device != nil:
+		timerMode = timerHPET
+		enableHPETTimer()
+	default:
+		return kernError("initClock: no timer")
+	}
+	return nil
+}
+
+// initHPET maps and enables the HPET, if present.
+//go:nosplit
+func initHPET() error {
+	hpetBase = 0xfed00000
+	if acpiTables.RSDP != 0 {
+		h := &acpiTables.HPET
+		if !h.Present || h.Addr == 0 {
+			return nil
+		}
+		hpetBase = virtualAddress(h.Addr)
+	}
 	// Map the HPET address range.
 	flags := pageFlagWritable | pageFlagNX | pageFlagNoCache
 	globalMap.mustAddRange(hpetBase, hpetBase+pageSize, flags)
 	if err := mmapAligned(&globalMem, globalPT, hpetBase, hpetBase+pageSize, physicalAddress(hpetBase), flags); err != nil {
 		return err
 	}
-	hpetDev.device = (*HPET)(unsafe.Pointer(hpetBase))
-	hpetDev.period = hpetDev.device.clockPeriod()
-	hpetDev.timers = hpetDev.device.timers[:hpetDev.device.numTimers()]
+	dev := (*HPET)(unsafe.Pointer(hpetBase))
 
 	// Sanity checks.
 
-	// The maximum HPET period is 100 ns.
-	if hpetDev.period == 0 || hpetDev.period > 1e8 {
-		return kernError("setupClock: invalid clock period")
+	// The maximum HPET period is 100 ns. Missing devices read as
+	// all ones.
+	if period := dev.clockPeriod(); period == 0 || period > 1e8 {
+		return nil
 	}
+	hpetDev.device = dev
+	hpetDev.period = dev.clockPeriod()
+	hpetDev.timers = dev.timers[:dev.numTimers()]
+
+	// Reset and enable the HPET.
+	dev.setCounter(0)
+	dev.enable()
+	return nil
+}
 
+// enableHPETTimer configures the first HPET timer to interrupt the
+// boot processor.
+//go:nosplit
+func enableHPETTimer() {
 	t := &hpetDev.timers[0]
 	if !t.supportsFSB() {
 		// TODO: The Qemu HPET device doesn't announce FSB support,
@@ -114,11 +208,137 @@ func initClock() error {
 	t.confCap = _Tn_FSB_EN_CNF | // Enable FSB.
 		_Tn_INT_ENB_CNF | // Enable interrupts.
 		_Tn_32MODE_CNF // 32-bit mode.
+}
 
-	// Reset and enable the HPET.
-	hpetDev.device.setCounter(0)
-	hpetDev.device.enable()
-	return nil
+// calibrateTSC measures the TSC frequency against the reference
+// timer and switches the clock to the TSC for nanosecond resolution
+// readings.
+//go:nosplit
+func calibrateTSC() {
+	start := rdtsc()
+	nanos := waitReference(50 * time.Millisecond)
+	ticks := rdtsc() - start
+	mult := tscMultiplier(nanos, ticks)
+	if mult == 0 {
+		return
+	}
+
+	clockLock.lock()
+	if hpetDev.device != nil {
+		updateClockWithCounter(hpetDev.device.readCounter())
+	}
+	c := &unixClock
+	atomic.AddUint64(&c.seq, 1)
+	c.tscBase = rdtsc()
+	c.tscMult = mult
+	atomic.AddUint64(&c.seq, 1)
+	clockLock.unlock()
+}
+
+// calibrateLAPICTimer measures the local APIC timer frequency
+// against the reference timer.
+//go:nosplit
+func calibrateLAPICTimer() {
+	apicWrite(apicRegLVTTimer, apicIntMasked)
+	apicWrite(apicRegTimerDivide, 0xb) // Divide by 1.
+	apicWrite(apicRegTimerInitial, ^uint32(0))
+	nanos := waitReference(10 * time.Millisecond)
+	elapsed := ^uint32(0) - apicRead(apicRegTimerCurrent)
+	apicWrite(apicRegTimerInitial, 0)
+	if nanos == 0 {
+		return
+	}
+	lapicTimerFreq = uint64(elapsed) * uint64(time.Second) / nanos
+}
+
+// hasTSCDeadline reports whether the local APIC timer supports the
+// TSC-deadline mode.
+//go:nosplit
+func hasTSCDeadline() bool {
+	_, _, ecx, _ := cpuid(0x1, 0)
+	return ecx&(1<<24) != 0
+}
+
+// waitReference busy waits for about the duration d, measured by
+// the most accurate timer not calibrated by the kernel. It returns
+// the actual duration in nanoseconds, or 0 if no timer is available.
+//go:nosplit
+func waitReference(d time.Duration) uint64 {
+	switch {
+	case hpetDev.device != nil:
+		return hpetWait(d)
+	case acpiTables.FADT.PMTimer != 0:
+		return pmTimerWait(d)
+	default:
+		return pitWait(d)
+	}
+}
+
+//go:nosplit
+func hpetWait(d time.Duration) uint64 {
+	fsPrPeriod := uint64(hpetDev.period)
+	periods := uint32(uint64(d) * 1e6 / fsPrPeriod)
+	start := hpetDev.device.readCounter()
+	end := start
+	for end-start < periods {
+		pause()
+		end = hpetDev.device.readCounter()
+	}
+	return uint64(end-start) * fsPrPeriod / 1e6
+}
+
+// pmTimerWait waits using the ACPI power management timer.
+//go:nosplit
+func pmTimerWait(d time.Duration) uint64 {
+	port := uint16(acpiTables.FADT.PMTimer)
+	mask := uint32(1<<24 - 1)
+	if acpiTables.FADT.Flags&acpi.FlagTimerExt != 0 {
+		mask = ^uint32(0)
+	}
+	ticks := uint32(uint64(d) * pmTimerFreq / uint64(time.Second))
+	start := inl(port) & mask
+	elapsed := uint32(0)
+	for elapsed < ticks {
+		pause()
+		elapsed = (inl(port) - start) & mask
+	}
+	return uint64(elapsed) * uint64(time.Second) / pmTimerFreq
+}
+
+// pitWait waits using channel 2 of the legacy programmable
+// interval timer.
+//go:nosplit
+func pitWait(d time.Duration) uint64 {
+	var nanos uint64
+	for d > 0 {
+		ticks := uint64(d) * pitFreq / uint64(time.Second)
+		if ticks > 0xffff {
+			ticks = 0xffff
+		}
+		if ticks == 0 {
+			break
+		}
+		// Enable the channel 2 gate and disable the speaker.
+		ctrl := inb(pitControlPort)&^pitSpeakerEnable | pitGate2
+		outb(pitControlPort, ctrl&^pitGate2)
+		// Channel 2, low and high byte, mode 0.
+		outb(pitCommandPort, 0b10110000)
+		outb(pitChannel2Port, uint8(ticks))
+		outb(pitChannel2Port, uint8(ticks>>8))
+		// Start counting.
+		outb(pitControlPort, ctrl)
+		for i := 0; inb(pitControlPort)&pitOut2 == 0; i++ {
+			if i == 1e8 {
+				// No PIT.
+				return 0
+			}
+			pause()
+		}
+		elapsed := time.Duration(ticks * uint64(time.Second) / pitFreq)
+		nanos += uint64(elapsed)
+		d -= elapsed
+	}
+	return nanos
 }
 
 // clockPeriod returns the clock period in femtoseconds (10⁻¹⁵).
@@ -171,8 +391,14 @@ func (t *HPETTimer) oneshot(counter uint32) {
 
 //go:nosplit
 func updateClock() {
+	if hpetDev.device == nil {
+		// The TSC clock needs no updates.
+		return
+	}
+	clockLock.lock()
 	counter := hpetDev.device.readCounter()
 	updateClockWithCounter(counter)
+	clockLock.unlock()
 }
 
 func updateClockWithCounter(counter uint32) {
@@ -186,17 +412,49 @@ func updateClockWithCounter(counter uint32) {
 	acc := hpetDev.accum + femtos
 	nanos := acc / 1e6
 	hpetDev.accum = acc % 1e6
-	unixClock.advance(nanos)
+	if unixClock.tscMult == 0 {
+		unixClock.advance(nanos)
+	}
 }
 
+// setTimer schedules a timer interrupt on the processor after the
+// duration.
 //go:nosplit
-func setTimer(dur time.Duration) {
+func (c *cpu) setTimer(dur time.Duration) {
 	if max := 2 * time.Second; dur > max {
 		// Make sure that the current time is updated regularly,
 		// and that no time is lost because of the HPET wrapping
 		// around.
 		dur = max
 	}
+	switch timerMode {
+	case timerTSCDeadline:
+		ticks := nanosToTSC(uint64(dur), unixClock.tscMult)
+		apicWrite(apicRegLVTTimer, apicTimerTSCDeadline|uint32(intTimer))
+		// Order the LVT write before the deadline MSR write.
+		mfence()
+		wrmsr(_IA32_TSC_DEADLINE, rdtsc()+ticks+1)
+	case timerLAPIC:
+		ticks := uint64(dur) * lapicTimerFreq / uint64(time.Second)
+		if ticks == 0 {
+			ticks = 1
+		}
+		if ticks > uint64(^uint32(0)) {
+			ticks = uint64(^uint32(0))
+		}
+		// One-shot mode.
+		apicWrite(apicRegLVTTimer, uint32(intTimer))
+		apicWrite(apicRegTimerInitial, uint32(ticks))
+	case timerHPET:
+		// The HPET interrupts only the boot processor; initSMP
+		// doesn't start the other processors in this mode.
+		hpetSetTimer(dur)
+	}
+}
+
+//go:nosplit
+func hpetSetTimer(dur time.Duration) {
+	clockLock.lock()
 	fsPrPeriod := uint64(hpetDev.period)
 	counter := hpetDev.last
 	// Convert to periods.
@@ -216,6 +474,7 @@ func setTimer(dur time.Duration) {
 		}
 	}
 	updateClockWithCounter(counter)
+	clockLock.unlock()
 }
 
 //go:nosplit
@@ -223,6 +482,9 @@ func (c *clock) init(seconds int64) {
 	// Verify field offsets.
 	if unsafe.Offsetof(clock{}.seq) != 0 ||
 		unsafe.Offsetof(clock{}.time) != 8 ||
+		unsafe.Offsetof(clock{}.monotoneTime) != 24 ||
+		unsafe.Offsetof(clock{}.tscBase) != 40 ||
+		unsafe.Offsetof(clock{}.tscMult) != 48 ||
 		unsafe.Offsetof(clock{}.time.seconds) != 0 ||
 		unsafe.Offsetof(clock{}.time.nanoseconds) != 8 {
 		fatal("clock.init: unexpected field offset")
@@ -245,10 +507,82 @@ func (t *instant) advance(nanoseconds uint64) {
 	t.nanoseconds = uint32(nanoseconds % 1e9)
 }
 
-// monotoneMillis reports the monotone time in milliseconds.
+// read returns the current wall clock and monotone time.
 //go:nosplit
-func (c *clock) monotoneMillis() uint64 {
-	return uint64(c.monotoneTime.seconds)*1e9 + uint64(c.monotoneTime.nanoseconds)
+func (c *clock) read() (instant, instant) {
+	for {
+		seq := atomic.LoadUint64(&c.seq)
+		if seq%2 != 0 {
+			// Write in progress.
+			pause()
+			continue
+		}
+		wall, mono := c.time, c.monotoneTime
+		var elapsed uint64
+		if mult := c.tscMult; mult != 0 {
+			elapsed = tscToNanos(rdtsc()-c.tscBase, mult)
+		}
+		if atomic.LoadUint64(&c.seq) == seq {
+			wall.advance(elapsed)
+			mono.advance(elapsed)
+			return wall, mono
+		}
+	}
+}
+
+// monotoneNanos reports the monotone time in nanoseconds.
+//go:nosplit
+func (c *clock) monotoneNanos() uint64 {
+	_, mono := c.read()
+	return uint64(mono.seconds)*1e9 + uint64(mono.nanoseconds)
+}
+
+// tscToNanos converts TSC ticks to nanoseconds with the 32.32 fixed
+// point multiplier mult.
+//go:nosplit
+func tscToNanos(ticks, mult uint64) uint64 {
+	hi, lo := bits.Mul64(ticks, mult)
+	return hi<<32 | lo>>32
+}
+
+// nanosToTSC converts nanoseconds to TSC ticks with the 32.32 fixed
+// point multiplier mult. The result saturates at the maximum uint64.
+//go:nosplit
+func nanosToTSC(nanos, mult uint64) uint64 {
+	hi, lo := nanos>>32, nanos<<32
+	if hi >= mult {
+		return ^uint64(0)
+	}
+	ticks, _ := bits.Div64(hi, lo, mult)
+	return ticks
+}
+
+// tscMultiplier returns the 32.32 fixed point nanoseconds per TSC
+// tick from a measurement of ticks over nanos nanoseconds, or zero if
+// the measurement is unusable.
+//go:nosplit
+func tscMultiplier(nanos, ticks uint64) uint64 {
+	if ticks == 0 || nanos >= 1<<32 {
+		return 0
+	}
+	return nanos << 32 / ticks
+}
+
+// spin busy waits for at least the duration d.
+//go:nosplit
+func spin(d time.Duration) {
+	mult := unixClock.tscMult
+	if mult == 0 {
+		waitReference(d)
+		return
+	}
+	ticks := nanosToTSC(uint64(d), mult)
+	start := rdtsc()
+	for rdtsc()-start < ticks {
+		pause()
+	}
 }
 
 func timerTrampoline()
+func mfence()
+func rdtsc() uint64
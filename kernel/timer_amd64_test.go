@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTSCMultiplier(t *testing.T) {
+	tests := []struct {
+		nanos, ticks uint64
+		mult         uint64
+	}{
+		// 1 GHz.
+		{50e6, 50e6, 1 << 32},
+		// 2 GHz.
+		{50e6, 100e6, 1 << 31},
+		// 3 GHz, truncated.
+		{50e6, 150e6, 1431655765},
+		{50e6, 0, 0},
+		// A measurement that overflows the fixed point
+		// multiplication.
+		{1 << 32, 1 << 40, 0},
+	}
+	for _, test := range tests {
+		if got := tscMultiplier(test.nanos, test.ticks); got != test.mult {
+			t.Errorf("tscMultiplier(%d, %d) = %d, want %d", test.nanos, test.ticks, got, test.mult)
+		}
+	}
+}
+
+func TestTSCConversion(t *testing.T) {
+	for _, freq := range []uint64{1e9, 2.4e9, 3e9, 3.7e9} {
+		mult := tscMultiplier(50e6, freq/20)
+		// One second of ticks is one second, up to the truncation
+		// of the multiplier and the result.
+		if got := tscToNanos(freq, mult); got > 1e9 || got < 1e9-2 {
+			t.Errorf("%d Hz: tscToNanos(%d) = %d, want 1e9", freq, freq, got)
+		}
+		// Ten hours of ticks don't overflow.
+		const hours = 10
+		ticks := freq * 3600 * hours
+		want := uint64(hours * time.Hour)
+		if got := tscToNanos(ticks, mult); got > want || want-got > want/1e8 {
+			t.Errorf("%d Hz: tscToNanos(%d) = %d, want %d", freq, ticks, got, want)
+		}
+		// Durations survive the round trip through ticks up to
+		// truncation.
+		for _, d := range []time.Duration{time.Microsecond, time.Millisecond, 2 * time.Second, time.Hour} {
+			ticks := nanosToTSC(uint64(d), mult)
+			if n := tscToNanos(ticks, mult); n > uint64(d) || uint64(d)-n > 1 {
+				t.Errorf("%d Hz: %v round trips to %dns", freq, d, n)
+			}
+		}
+	}
+	if got := nanosToTSC(^uint64(0), 1<<30); got != ^uint64(0) {
+		t.Errorf("nanosToTSC didn't saturate: %d", got)
+	}
+}
+
+func TestInstantAdvance(t *testing.T) {
+	i := instant{seconds: 10, nanoseconds: 999999999}
+	i.advance(1)
+	if i != (instant{seconds: 11}) {
+		t.Errorf("advance by 1ns: %+v", i)
+	}
+	i.advance(2500000000)
+	if i != (instant{seconds: 13, nanoseconds: 500000000}) {
+		t.Errorf("advance by 2.5s: %+v", i)
+	}
+}
@@ -0,0 +1,599 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Symbolized stack traces for fatal errors. The kernel image passed
+// from the loader contains the ELF section headers and the Go
+// pclntab, which map program counters to functions and source lines.
+// Stacks are unwound by following the frame pointer chain.
+
+// symbolTable contains the symbol information extracted from the
+// kernel image.
+type symbolTable struct {
+	// format is the pclntab format, or zero if no pclntab was found.
+	format    pclnFormat
+	minLC     uint64
+	ptrSize   int
+	nfunc     int
+	textStart uint64
+
+	pclntab     []byte
+	funcnametab []byte
+	cutab       []byte
+	filetab     []byte
+	pctab       []byte
+	functab     []byte
+
+	// syms and strs are the ELF symbol table and its string table,
+	// used when the pclntab format is unknown.
+	syms []byte
+	strs []byte
+}
+
+// funcInfo describes a function from the pclntab.
+type funcInfo struct {
+	entry uint64
+	// data is the _func structure of the function.
+	data []byte
+}
+
+type pclnFormat int
+
+const (
+	pcln12 pclnFormat = iota + 1
+	pcln116
+	pcln118
+)
+
+const (
+	_SHT_SYMTAB = 2
+	_STT_FUNC   = 2
+
+	elfSectionSize = 64
+	elfSymbolSize  = 24
+)
+
+// maxFrames limits the number of frames in a stack trace.
+const maxFrames = 64
+
+var kernelSymbols symbolTable
+
+// tracingBack is set when a fatal error has printed its stack
+// traces, to avoid recursive tracebacks should the unwinding fault.
+var tracingBack uint32
+
+// tracebackReady is set when the traceback interrupt is installed.
+var tracebackReady uint32
+
+// tracebackStack is the stack of the traceback interrupt. Only the
+// first fatal error prints stack traces, so the processors share it.
+var tracebackStack stack
+
+// fatalPC and fatalBP are the caller frame of the fatal error that
+// raised the traceback interrupt.
+var fatalPC, fatalBP uint64
+
+// tracebackAll is set to print the stack traces of every thread
+// on fatal errors.
+var tracebackAll uint32
+
+// initSymbols locates the symbol tables of the kernel image. A
+// missing or unknown table is not an error; stack traces are printed
+// with the raw program counters instead.
+//go:nosplit
+func initSymbols(img []byte) {
+	if len(img) < 64 || binary.LittleEndian.Uint32(img) != _ELFMagic {
+		return
+	}
+	bo := binary.LittleEndian
+	shoff := bo.Uint64(img[0x28:])
+	shentsize := uint64(bo.Uint16(img[0x3a:]))
+	shnum := uint64(bo.Uint16(img[0x3c:]))
+	shstrndx := uint64(bo.Uint16(img[0x3e:]))
+	if shentsize != elfSectionSize || shstrndx >= shnum || shoff > uint64(len(img)) || shnum*shentsize > uint64(len(img))-shoff {
+		return
+	}
+	shdrs := img[shoff : shoff+shnum*shentsize]
+	shstrtab, ok := elfSection(img, shdrs, shstrndx)
+	if !ok {
+		return
+	}
+	var textAddr uint64
+	for i := uint64(0); i < shnum; i++ {
+		shdr := shdrs[i*elfSectionSize:]
+		name := cstring(shstrtab, uint64(bo.Uint32(shdr)))
+		switch {
+		case equalString(name, ".text"):
+			textAddr = bo.Uint64(shdr[16:])
+		case equalString(name, ".gopclntab"):
+			if tab, ok := elfSection(img, shdrs, i); ok {
+				kernelSymbols.initPclntab(tab)
+			}
+		case bo.Uint32(shdr[4:]) == _SHT_SYMTAB:
+			syms, ok := elfSection(img, shdrs, i)
+			if !ok {
+				continue
+			}
+			strs, ok := elfSection(img, shdrs, uint64(bo.Uint32(shdr[40:])))
+			if !ok {
+				continue
+			}
+			kernelSymbols.syms = syms
+			kernelSymbols.strs = strs
+		}
+	}
+	// Recent linkers leave the text start of the pclntab header
+	// zero.
+	if kernelSymbols.format == pcln118 && kernelSymbols.textStart == 0 {
+		kernelSymbols.textStart = textAddr
+	}
+}
+
+// elfSection returns the contents of the ith section.
+//go:nosplit
+func elfSection(img, shdrs []byte, i uint64) ([]byte, bool) {
+	if i >= uint64(len(shdrs))/elfSectionSize {
+		return nil, false
+	}
+	shdr := shdrs[i*elfSectionSize:]
+	off := binary.LittleEndian.Uint64(shdr[24:])
+	size := binary.LittleEndian.Uint64(shdr[32:])
+	if off > uint64(len(img)) || size > uint64(len(img))-off {
+		return nil, false
+	}
+	return img[off : off+size], true
+}
+
+//go:nosplit
+func (s *symbolTable) initPclntab(tab []byte) {
+	if len(tab) < 8 {
+		return
+	}
+	minLC := tab[6]
+	ptrSize := int(tab[7])
+	if ptrSize != 8 || minLC == 0 {
+		return
+	}
+	var format pclnFormat
+	switch binary.LittleEndian.Uint32(tab) {
+	case 0xfffffffb:
+		format = pcln12
+	case 0xfffffffa:
+		format = pcln116
+	case 0xfffffff0, 0xfffffff1:
+		format = pcln118
+	default:
+		return
+	}
+	nfunc := pclnWord(tab, 0)
+	if nfunc > uint64(len(tab)) {
+		return
+	}
+	s.nfunc = int(nfunc)
+	switch format {
+	case pcln12:
+		s.functab = subTable(tab, uint64(8+ptrSize))
+		// The file table offset follows the function table and
+		// its end address.
+		ftabSize := (nfunc*2 + 1) * uint64(ptrSize)
+		if ftabSize+4 > uint64(len(s.functab)) {
+			return
+		}
+		s.filetab = subTable(tab, uint64(binary.LittleEndian.Uint32(s.functab[ftabSize:])))
+		s.funcnametab = tab
+		s.pctab = tab
+	case pcln116:
+		s.funcnametab = subTable(tab, pclnWord(tab, 2))
+		s.cutab = subTable(tab, pclnWord(tab, 3))
+		s.filetab = subTable(tab, pclnWord(tab, 4))
+		s.pctab = subTable(tab, pclnWord(tab, 5))
+		s.functab = subTable(tab, pclnWord(tab, 6))
+	case pcln118:
+		s.textStart = pclnWord(tab, 2)
+		s.funcnametab = subTable(tab, pclnWord(tab, 3))
+		s.cutab = subTable(tab, pclnWord(tab, 4))
+		s.filetab = subTable(tab, pclnWord(tab, 5))
+		s.pctab = subTable(tab, pclnWord(tab, 6))
+		s.functab = subTable(tab, pclnWord(tab, 7))
+	}
+	if uint64(len(s.functab)) < uint64(s.nfunc+1)*uint64(s.ftabEntrySize()) {
+		return
+	}
+	s.pclntab = tab
+	s.minLC = uint64(minLC)
+	s.ptrSize = ptrSize
+	s.format = format
+}
+
+// pclnWord returns the nth pointer sized header word following the
+// pclntab magic, or ^0 if tab is too short.
+//go:nosplit
+func pclnWord(tab []byte, n int) uint64 {
+	off := 8 + n*8
+	if off+8 > len(tab) {
+		return ^uint64(0)
+	}
+	return binary.LittleEndian.Uint64(tab[off:])
+}
+
+// subTable returns the part of tab starting at off, or nil if off
+// is out of range.
+//go:nosplit
+func subTable(tab []byte, off uint64) []byte {
+	if off > uint64(len(tab)) {
+		return nil
+	}
+	return tab[off:]
+}
+
+// ftabEntrySize returns the size of a function table entry.
+//go:nosplit
+func (s *symbolTable) ftabEntrySize() int {
+	if s.format == pcln118 {
+		return 8
+	}
+	return 2 * s.ptrSize
+}
+
+// ftabEntry returns the entry address and _func offset of the ith
+// function table entry.
+//go:nosplit
+func (s *symbolTable) ftabEntry(i int) (uint64, uint64) {
+	bo := binary.LittleEndian
+	if s.format == pcln118 {
+		e := s.functab[i*8:]
+		return s.textStart + uint64(bo.Uint32(e)), uint64(bo.Uint32(e[4:]))
+	}
+	e := s.functab[i*2*s.ptrSize:]
+	return bo.Uint64(e), bo.Uint64(e[s.ptrSize:])
+}
+
+// findFunc returns the function containing pc.
+//go:nosplit
+func (s *symbolTable) findFunc(pc uint64) (funcInfo, bool) {
+	if s.format == 0 || s.nfunc == 0 {
+		return funcInfo{}, false
+	}
+	start, _ := s.ftabEntry(0)
+	end, _ := s.ftabEntry(s.nfunc)
+	if pc < start || pc >= end {
+		return funcInfo{}, false
+	}
+	// Binary search for the last entry not after pc.
+	lo, hi := 0, s.nfunc
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		if entry, _ := s.ftabEntry(mid); entry <= pc {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	entry, off := s.ftabEntry(lo)
+	// The _func offsets are relative to the whole table in the
+	// Go 1.2 format, and to the function table otherwise.
+	base := s.functab
+	if s.format == pcln12 {
+		base = s.pclntab
+	}
+	if off >= uint64(len(base)) || uint64(len(base))-off < s.funcField(28)+4 {
+		return funcInfo{}, false
+	}
+	return funcInfo{entry: entry, data: base[off:]}, true
+}
+
+// funcField returns the offset of a _func field, given its offset
+// from the field following the entry.
+//go:nosplit
+func (s *symbolTable) funcField(off int) uint64 {
+	if s.format == pcln118 {
+		// The entry is a 32-bit offset from the text start.
+		return uint64(4 + off)
+	}
+	return uint64(s.ptrSize + off)
+}
+
+//go:nosplit
+func (s *symbolTable) funcName(f funcInfo) []byte {
+	nameOff := binary.LittleEndian.Uint32(f.data[s.funcField(0):])
+	return cstring(s.funcnametab, uint64(nameOff))
+}
+
+// fileLine returns the source position of pc in f.
+//go:nosplit
+func (s *symbolTable) fileLine(f funcInfo, pc uint64) ([]byte, int32, bool) {
+	bo := binary.LittleEndian
+	fileno, ok := s.pcvalue(f, bo.Uint32(f.data[s.funcField(16):]), pc)
+	if !ok || fileno < 0 {
+		return nil, 0, false
+	}
+	line, ok := s.pcvalue(f, bo.Uint32(f.data[s.funcField(20):]), pc)
+	if !ok {
+		return nil, 0, false
+	}
+	var fileOff uint64
+	switch s.format {
+	case pcln12:
+		idx := uint64(fileno) * 4
+		if idx+4 > uint64(len(s.filetab)) {
+			return nil, 0, false
+		}
+		fileOff = uint64(bo.Uint32(s.filetab[idx:]))
+		return cstring(s.pclntab, fileOff), line, true
+	default:
+		cuOff := uint64(bo.Uint32(f.data[s.funcField(28):]))
+		idx := (cuOff + uint64(fileno)) * 4
+		if idx+4 > uint64(len(s.cutab)) {
+			return nil, 0, false
+		}
+		fileOff = uint64(bo.Uint32(s.cutab[idx:]))
+		return cstring(s.filetab, fileOff), line, true
+	}
+}
+
+// pcvalue decodes the pc-value table at offset off and returns the
+// value at targetpc.
+//go:nosplit
+func (s *symbolTable) pcvalue(f funcInfo, off uint32, targetpc uint64) (int32, bool) {
+	if off == 0 || uint64(off) >= uint64(len(s.pctab)) {
+		return 0, false
+	}
+	p := s.pctab[off:]
+	pc := f.entry
+	val := int32(-1)
+	first := true
+	for {
+		uvdelta, n := uvarint(p)
+		if n == 0 || (uvdelta == 0 && !first) {
+			return 0, false
+		}
+		p = p[n:]
+		val += int32(-(uvdelta & 1) ^ (uvdelta >> 1))
+		pcdelta, n := uvarint(p)
+		if n == 0 {
+			return 0, false
+		}
+		p = p[n:]
+		pc += uint64(pcdelta) * s.minLC
+		first = false
+		if targetpc < pc {
+			return val, true
+		}
+	}
+}
+
+// elfSymbol returns the name and address of the ELF function
+// symbol containing pc.
+//go:nosplit
+func (s *symbolTable) elfSymbol(pc uint64) ([]byte, uint64, bool) {
+	bo := binary.LittleEndian
+	for i := 0; i+elfSymbolSize <= len(s.syms); i += elfSymbolSize {
+		sym := s.syms[i : i+elfSymbolSize]
+		if sym[4]&0xf != _STT_FUNC {
+			continue
+		}
+		value := bo.Uint64(sym[8:])
+		size := bo.Uint64(sym[16:])
+		if value <= pc && pc < value+size {
+			return cstring(s.strs, uint64(bo.Uint32(sym))), value, true
+		}
+	}
+	return nil, 0, false
+}
+
+// uvarint decodes an unsigned varint from p and returns it along
+// with the number of bytes read. It returns 0 bytes for an invalid
+// or truncated varint.
+//go:nosplit
+func uvarint(p []byte) (uint32, int) {
+	var v uint32
+	var shift uint
+	for i := 0; i < len(p) && i < 5; i++ {
+		b := p[i]
+		v |= uint32(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v, i + 1
+		}
+		shift += 7
+	}
+	return 0, 0
+}
+
+// cstring returns the zero terminated string at offset off in b.
+//go:nosplit
+func cstring(b []byte, off uint64) []byte {
+	if off >= uint64(len(b)) {
+		return nil
+	}
+	b = b[off:]
+	for i := 0; i < len(b); i++ {
+		if b[i] == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
+
+//go:nosplit
+func equalString(b []byte, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i := 0; i < len(b); i++ {
+		if b[i] != s[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tracebackFatal prints the stack traces of a fatal error at the
+// caller frame pc and bp. Fatal errors happen deep in the kernel,
+// so the stack traces are printed by the traceback interrupt on its
+// own stack.
+//go:nosplit
+func tracebackFatal(pc, bp uint64) {
+	if atomic.LoadUint32(&tracebackReady) == 0 {
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&tracingBack, 0, 1) {
+		return
+	}
+	fatalPC, fatalBP = pc, bp
+	raiseTraceback()
+}
+
+// tracebackInterrupt handles the traceback interrupt raised by
+// tracebackFatal. It never returns.
+//go:nosplit
+func tracebackInterrupt() {
+	printTracebacks(fatalPC, fatalBP)
+	halt()
+}
+
+// printTracebacks prints the stack trace of the kernel code starting
+// at the caller frame pc and bp, followed by the stack trace of the
+// current thread and, if enabled, every other thread.
+//go:nosplit
+func printTracebacks(pc, bp uint64) {
+	outputString("\nkernel stack:\n")
+	traceback(pc, bp)
+	var current *thread
+	if c := thisCPU(); c != nil {
+		current = c.thread
+		if current != nil && current != c.kernelThread && current != &thread0 {
+			printThreadTraceback(current)
+		}
+	}
+	if atomic.LoadUint32(&tracebackAll) == 0 {
+		return
+	}
+	ts := &globalThreads
+	for i := range ts.threads {
+		t := &ts.threads[i]
+		if t == current {
+			continue
+		}
+		printThreadTraceback(t)
+	}
+}
+
+//go:nosplit
+func printThreadTraceback(t *thread) {
+	outputString("\nthread ")
+	outputUint64(uint64(t.id))
+	if t.cpu != nil {
+		outputString(" (running)")
+	}
+	outputString(":\n")
+	traceback(t.ip, t.bp)
+}
+
+// traceback prints the symbolized stack trace starting at the
+// program counter pc with the frame pointer bp. The return address
+// of a frame is at bp+8 and the caller frame pointer at bp.
+//go:nosplit
+func traceback(pc, bp uint64) {
+	printFrame(pc, false)
+	for i := 1; i < maxFrames; i++ {
+		if bp == 0 || bp%8 != 0 || !readableAddr(bp) || !readableAddr(bp+8) {
+			return
+		}
+		next := *(*uint64)(unsafe.Pointer(uintptr(bp)))
+		ret := *(*uint64)(unsafe.Pointer(uintptr(bp + 8)))
+		if ret == 0 {
+			return
+		}
+		printFrame(ret, true)
+		// Stacks grow down.
+		if next <= bp {
+			return
+		}
+		bp = next
+	}
+	outputString("...additional frames elided...\n")
+}
+
+// printFrame prints the function and source position of pc. The
+// position of return addresses is adjusted to point to the call
+// instruction.
+//go:nosplit
+func printFrame(pc uint64, ret bool) {
+	lookup := pc
+	if ret {
+		lookup--
+	}
+	s := &kernelSymbols
+	if f, ok := s.findFunc(lookup); ok {
+		output(s.funcName(f))
+		outputString("(...)\n\t")
+		if file, line, ok := s.fileLine(f, lookup); ok {
+			output(file)
+			outputString(":")
+			outputDecimal(uint64(line))
+		} else {
+			outputString("?")
+		}
+		outputString(" pc=")
+		outputUint64(pc)
+		outputString("\n")
+		return
+	}
+	if name, entry, ok := s.elfSymbol(lookup); ok {
+		output(name)
+		outputString("(...)\n\tpc=")
+		outputUint64(pc)
+		outputString(" +")
+		outputUint64(pc - entry)
+		outputString("\n")
+		return
+	}
+	outputString("?\n\tpc=")
+	outputUint64(pc)
+	outputString("\n")
+}
+
+// readableAddr reports whether the 8-byte aligned address is mapped
+// and may be read without faulting.
+//go:nosplit
+func readableAddr(addr uint64) bool {
+	// Reject non-canonical addresses.
+	if top := addr >> 47; top != 0 && top != 1<<17-1 {
+		return false
+	}
+	if globalPT == nil {
+		return false
+	}
+	e, ok := globalPT.lookup(virtualAddress(addr))
+	return ok && e.present()
+}
+
+//go:nosplit
+func outputDecimal(v uint64) {
+	var buf [20]byte
+	i := len(buf)
+	for {
+		i--
+		buf[i] = byte(v%10) + '0'
+		v /= 10
+		if v == 0 {
+			break
+		}
+	}
+	output(buf[i:])
+}
+
+// callerFrame returns the return address and frame pointer of its
+// caller.
+func callerFrame() (pc, bp uint64)
+
+// raiseTraceback raises the traceback interrupt.
+func raiseTraceback()
+
+func tracebackTrampoline()
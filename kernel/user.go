@@ -9,8 +9,11 @@ import (
 	"fmt"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
+
+	"eliasnaur.com/unik/kernel/acpi"
 )
 
 // InterruptMessage describes a message signalled interrupt (MSI)
@@ -48,14 +51,27 @@ func Inl(port uint16) uint32 {
 	return uint32(r)
 }
 
-// Alloc allocates at most maxSize bytes of contiguous physical memory. It
-// returns the physical address and size of the block or an error.
-func Alloc(maxSize int) (uintptr, int, error) {
-	r, size, errno := syscall.Syscall(_SYS_alloc, uintptr(maxSize), 0, 0)
+// Alloc allocates size bytes of zeroed, contiguous physical memory,
+// rounded up to the page size. The address of the memory is aligned
+// to align, which must be zero or a power of two. Alloc returns the
+// physical address of the memory or an error.
+func Alloc(size, align int) (uintptr, error) {
+	r, _, errno := syscall.Syscall(_SYS_alloc, uintptr(size), uintptr(align), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return r, nil
+}
+
+// Free returns the physical memory allocated by Alloc at addr. The
+// size must be the size passed to Alloc. Free fails with EINVAL if
+// addr and size don't match an allocation that is not yet freed.
+func Free(addr uintptr, size int) error {
+	_, _, errno := syscall.Syscall(_SYS_free, addr, uintptr(size), 0)
 	if errno != 0 {
-		return 0, 0, errno
+		return errno
 	}
-	return r, int(size), nil
+	return nil
 }
 
 // AllocInterrupt reserves and sets up an MSI interrupt.
@@ -142,3 +158,31 @@ func IOMap(vaddr, addr uintptr, size int) error {
 	}
 	return nil
 }
+
+// SetTracebackAll controls whether fatal kernel errors print the
+// stack traces of every thread, not just the kernel and the current
+// thread.
+func SetTracebackAll(all bool) {
+	v := uint32(0)
+	if all {
+		v = 1
+	}
+	atomic.StoreUint32(&tracebackAll, v)
+}
+
+// ACPITables returns the ACPI tables parsed during startup. It
+// returns false if the boot loader didn't provide valid tables.
+func ACPITables() (*acpi.Tables, bool) {
+	return &acpiTables, acpiTables.RSDP != 0
+}
+
+// Shutdown turns off the machine. It returns only if the machine
+// doesn't support powering off.
+func Shutdown() error {
+	return syscall.Reboot(syscall.LINUX_REBOOT_CMD_POWER_OFF)
+}
+
+// Reboot resets the machine. It returns only on failure.
+func Reboot() error {
+	return syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART)
+}
@@ -0,0 +1,419 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"path"
+	"reflect"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// fsServer serves the requests to the file systems mounted by Mount,
+// and forwards socket requests to the network served by ServeNetwork.
+type fsServer struct {
+	once sync.Once
+
+	mu     sync.Mutex
+	mounts map[int32]fs.FS
+	// handles are the open files and directories.
+	handles    map[uint64]*fsHandle
+	nextHandle uint64
+}
+
+// fsHandle is an open file or directory.
+type fsHandle struct {
+	name string
+	file fs.File
+	// entries caches the entries of a directory for reading in
+	// several steps.
+	entries []fs.DirEntry
+}
+
+// File system interfaces for modifying files.
+type (
+	openFileFS interface {
+		OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+	}
+	mkdirFS interface {
+		Mkdir(name string, perm fs.FileMode) error
+	}
+	removeFS interface {
+		Remove(name string) error
+	}
+	renameFS interface {
+		Rename(oldname, newname string) error
+	}
+)
+
+var userFS fsServer
+
+// Mount makes fsys available to the program through the directory
+// dir. Mounting at "/" replaces the root file system, except for
+// the file systems mounted on top of it, such as /dev. The directory
+// must exist unless it is in the root directory of a file system
+// mounted by Mount.
+//
+// Files are read and written through the io.ReaderAt and io.WriterAt
+// methods of the files of fsys. Files are created, modified and
+// removed through the following methods, if fsys and its files
+// implement them:
+//
+//	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+//	Mkdir(name string, perm fs.FileMode) error
+//	Remove(name string) error
+//	Rename(oldname, newname string) error
+//	Truncate(size int64) error // File.
+//	Sync() error // File.
+func Mount(dir string, fsys fs.FS) error {
+	return userFS.mount(dir, fsys)
+}
+
+func (s *fsServer) mount(dir string, fsys fs.FS) error {
+	p, err := syscall.BytePtrFromString(dir)
+	if err != nil {
+		return &fs.PathError{Op: "mount", Path: dir, Err: err}
+	}
+	s.start()
+	// Hold the lock until the mount is registered, in case a
+	// request for it arrives first.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, _, errno := syscall.Syscall(_SYS_fsmount, uintptr(unsafe.Pointer(p)), 0, 0)
+	if errno != 0 {
+		return &fs.PathError{Op: "mount", Path: dir, Err: errno}
+	}
+	s.mounts[int32(m)] = fsys
+	return nil
+}
+
+// start starts serving requests.
+func (s *fsServer) start() {
+	s.once.Do(func() {
+		s.mounts = make(map[int32]fs.FS)
+		s.handles = make(map[uint64]*fsHandle)
+		s.nextHandle = userRoot + 1
+		go s.run()
+	})
+}
+
+func (s *fsServer) run() {
+	for {
+		req := new(fsRequest)
+		c, _, errno := syscall.Syscall(_SYS_fsserve, uintptr(unsafe.Pointer(req)), 0, 0)
+		if errno != 0 {
+			var err error = errno
+			panic(err)
+		}
+		go func() {
+			if isSocketOp(req.op) {
+				userNet.serve(c, req)
+				return
+			}
+			ret, aux, err := s.serve(req)
+			if err != nil {
+				ret = errnoResult(err)
+			}
+			syscall.Syscall(_SYS_fsreply, c, uintptr(ret), uintptr(aux))
+		}()
+	}
+}
+
+// serve performs a request and returns the result and auxiliary value
+// of the reply.
+func (s *fsServer) serve(req *fsRequest) (uint64, uint64, error) {
+	s.mu.Lock()
+	fsys := s.mounts[req.mount]
+	h := s.handles[req.ino]
+	s.mu.Unlock()
+	if fsys == nil {
+		return 0, 0, syscall.ENODEV
+	}
+	switch req.op {
+	case fsOpen:
+		return s.open(fsys, req)
+	case fsClose:
+		s.mu.Lock()
+		delete(s.handles, req.ino)
+		s.mu.Unlock()
+		if h != nil && h.file != nil {
+			h.file.Close()
+		}
+		return 0, 0, nil
+	case fsStat:
+		var fi fs.FileInfo
+		var err error
+		name := s.resolve(req.ino, req.path, req.pathLen)
+		if req.pathLen == 0 && h != nil {
+			fi, err = h.file.Stat()
+		} else {
+			fi, err = fs.Stat(fsys, name)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		fillStat((*stat)(unsafe.Pointer(uintptr(req.buf))), req.mount, name, fi)
+		return 0, 0, nil
+	case fsMkdir:
+		mfs, ok := fsys.(mkdirFS)
+		if !ok {
+			return 0, 0, syscall.EROFS
+		}
+		err := mfs.Mkdir(s.resolve(req.ino, req.path, req.pathLen), fs.FileMode(req.mode&0777))
+		return 0, 0, err
+	case fsUnlink:
+		rfs, ok := fsys.(removeFS)
+		if !ok {
+			return 0, 0, syscall.EROFS
+		}
+		name := s.resolve(req.ino, req.path, req.pathLen)
+		fi, err := fs.Stat(fsys, name)
+		switch {
+		case err != nil:
+			return 0, 0, err
+		case req.flags&_AT_REMOVEDIR != 0 && !fi.IsDir():
+			return 0, 0, syscall.ENOTDIR
+		case req.flags&_AT_REMOVEDIR == 0 && fi.IsDir():
+			return 0, 0, syscall.EISDIR
+		}
+		return 0, 0, rfs.Remove(name)
+	case fsRename:
+		rfs, ok := fsys.(renameFS)
+		if !ok {
+			return 0, 0, syscall.EROFS
+		}
+		oldname := s.resolve(req.ino, req.path, req.pathLen)
+		newname := s.resolve(req.ino2, req.path2, req.path2Ln)
+		return 0, 0, rfs.Rename(oldname, newname)
+	}
+	if h == nil {
+		return 0, 0, syscall.EBADF
+	}
+	switch req.op {
+	case fsRead:
+		r, ok := h.file.(io.ReaderAt)
+		if !ok {
+			return 0, 0, syscall.EINVAL
+		}
+		n, err := r.ReadAt(userBytes(req.buf, req.n), req.off)
+		if err == io.EOF {
+			err = nil
+		}
+		return uint64(n), uint64(req.off + int64(n)), err
+	case fsWrite:
+		w, ok := h.file.(io.WriterAt)
+		if !ok {
+			return 0, 0, syscall.EBADF
+		}
+		off := req.off
+		if off == -1 {
+			fi, err := h.file.Stat()
+			if err != nil {
+				return 0, 0, err
+			}
+			off = fi.Size()
+		}
+		n, err := w.WriteAt(userBytes(req.buf, req.n), off)
+		if n > 0 {
+			// Report partial writes.
+			err = nil
+		}
+		return uint64(n), uint64(off + int64(n)), err
+	case fsReaddir:
+		return s.readdir(fsys, h, req)
+	case fsSize:
+		fi, err := h.file.Stat()
+		if err != nil {
+			return 0, 0, err
+		}
+		return uint64(fi.Size()), 0, nil
+	case fsTruncate:
+		t, ok := h.file.(interface{ Truncate(size int64) error })
+		if !ok {
+			return 0, 0, syscall.EROFS
+		}
+		return 0, 0, t.Truncate(req.off)
+	case fsSync:
+		if f, ok := h.file.(interface{ Sync() error }); ok {
+			return 0, 0, f.Sync()
+		}
+		return 0, 0, nil
+	}
+	return 0, 0, syscall.ENOSYS
+}
+
+// open opens a file and returns its handle.
+func (s *fsServer) open(fsys fs.FS, req *fsRequest) (uint64, uint64, error) {
+	name := s.resolve(req.ino, req.path, req.pathLen)
+	flags := int(req.flags)
+	var f fs.File
+	var err error
+	if flags&(_O_ACCMODE|_O_CREAT|_O_TRUNC|_O_APPEND) == _O_RDONLY {
+		f, err = fsys.Open(name)
+	} else if ofs, ok := fsys.(openFileFS); ok {
+		f, err = ofs.OpenFile(name, flags&(_O_ACCMODE|_O_CREAT|_O_EXCL|_O_TRUNC|_O_APPEND), fs.FileMode(req.mode&0777))
+	} else {
+		err = syscall.EROFS
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, 0, err
+	}
+	dir := fi.IsDir()
+	switch {
+	case flags&_O_DIRECTORY != 0 && !dir:
+		f.Close()
+		return 0, 0, syscall.ENOTDIR
+	case dir && flags&_O_ACCMODE != _O_RDONLY:
+		f.Close()
+		return 0, 0, syscall.EISDIR
+	}
+	s.mu.Lock()
+	ino := s.nextHandle
+	s.nextHandle++
+	s.handles[ino] = &fsHandle{name: name, file: f}
+	s.mu.Unlock()
+	aux := uint64(0)
+	if dir {
+		aux = 1
+	}
+	return ino, aux, nil
+}
+
+// readdir fills the request buffer with directory entries starting at
+// the index req.off.
+func (s *fsServer) readdir(fsys fs.FS, h *fsHandle, req *fsRequest) (uint64, uint64, error) {
+	s.mu.Lock()
+	ents := h.entries
+	s.mu.Unlock()
+	if ents == nil || req.off == 0 {
+		var err error
+		ents, err = fs.ReadDir(fsys, h.name)
+		if err != nil {
+			return 0, 0, err
+		}
+		s.mu.Lock()
+		h.entries = ents
+		s.mu.Unlock()
+	}
+	p := userBytes(req.buf, req.n)
+	n := 0
+	i := req.off
+	for ; i >= 0 && i < int64(len(ents)); i++ {
+		e := ents[i]
+		ino := fileIno(path.Join(h.name, e.Name()))
+		typ := uint8(fileMode(e.Type()) >> 12)
+		c := putDirent(p[n:], ino, i+1, typ, e.Name())
+		if c == 0 {
+			if n == 0 {
+				return 0, 0, syscall.EINVAL
+			}
+			break
+		}
+		n += c
+	}
+	return uint64(n), uint64(i), nil
+}
+
+// resolve returns the file system path of the kernel path p relative
+// to the handle dir. Paths can't escape the root.
+func (s *fsServer) resolve(dir, p, n uint64) string {
+	base := "/"
+	if dir != userRoot {
+		s.mu.Lock()
+		if h := s.handles[dir]; h != nil {
+			base += h.name
+		}
+		s.mu.Unlock()
+	}
+	name := path.Join(base, string(userBytes(p, n)))
+	if name == "/" {
+		return "."
+	}
+	return name[1:]
+}
+
+// fillStat fills st with the information of the file name of the
+// mount m.
+func fillStat(st *stat, m int32, name string, fi fs.FileInfo) {
+	*st = stat{
+		dev:     uint64(m) + 1,
+		ino:     fileIno(name),
+		nlink:   1,
+		mode:    fileMode(fi.Mode()),
+		size:    fi.Size(),
+		blksize: 4096,
+		blocks:  (fi.Size() + 511) / 512,
+	}
+	if fi.IsDir() {
+		st.nlink = 2
+	}
+	if t := fi.ModTime(); !t.IsZero() {
+		st.mtime = timespec{seconds: t.Unix(), nanoseconds: int64(t.Nanosecond())}
+	}
+	st.atime = st.mtime
+	st.ctime = st.mtime
+}
+
+// fileIno derives an inode number from a path.
+func fileIno(name string) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, name)
+	return h.Sum64()
+}
+
+// fileMode converts a fs.FileMode to mode bits.
+func fileMode(m fs.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= _S_IFDIR
+	case m&fs.ModeNamedPipe != 0:
+		mode |= _S_IFIFO
+	case m&fs.ModeCharDevice != 0:
+		mode |= _S_IFCHR
+	default:
+		mode |= _S_IFREG
+	}
+	return mode
+}
+
+// errnoResult converts err to a negated errno.
+func errnoResult(err error) uint64 {
+	var errno syscall.Errno
+	switch {
+	case errors.As(err, &errno):
+	case errors.Is(err, fs.ErrNotExist):
+		errno = syscall.ENOENT
+	case errors.Is(err, fs.ErrExist):
+		errno = syscall.EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		errno = syscall.EACCES
+	case errors.Is(err, fs.ErrInvalid):
+		errno = syscall.EINVAL
+	case errors.Is(err, fs.ErrClosed):
+		errno = syscall.EBADF
+	default:
+		errno = syscall.EIO
+	}
+	return ^uint64(errno) + 1
+}
+
+// userBytes returns the n bytes at addr.
+func userBytes(addr, n uint64) []byte {
+	var b []byte
+	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&b))
+	hdr.Data = uintptr(addr)
+	hdr.Len = int(n)
+	hdr.Cap = int(n)
+	return b
+}
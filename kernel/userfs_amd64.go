@@ -0,0 +1,577 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package kernel
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// User file systems are implemented by the program itself. The
+// kernel forwards their operations as requests to server threads
+// blocked in the fsserve system call, and the calling thread blocks
+// until a server replies through the fsreply system call. Buffers
+// and paths are passed by address; the server accesses them directly
+// while the caller is blocked.
+
+const (
+	// maxFSCalls is the maximum number of outstanding requests.
+	// Every thread can wait for a request and every open file can
+	// have a close request pending, so the limit is never reached.
+	maxFSCalls = maxThreads + maxFiles
+	// userRoot is the inode of the root directory of a user file
+	// system. Other inodes are file handles chosen by the server.
+	userRoot = 1
+	// maxMountName is the maximum length of the name of a user
+	// mount point.
+	maxMountName = 64
+
+	_AT_REMOVEDIR = 0x200
+)
+
+// fsOp is an operation on a user file system.
+type fsOp uint32
+
+const (
+	// fsOpen opens path relative to ino. The reply is the handle
+	// of the file and the auxiliary value 1 for directories.
+	fsOpen fsOp = 1 + iota
+	// fsClose releases the handle ino.
+	fsClose
+	// fsStat fills in the stat structure at buf for the path
+	// relative to ino.
+	fsStat
+	// fsRead, fsWrite transfer n bytes at buf to or from the file
+	// ino at offset off. An offset of -1 means the end of the file.
+	// The auxiliary value of the reply is the offset following the
+	// transfer.
+	fsRead
+	fsWrite
+	// fsReaddir fills buf with n bytes of directory entries of ino
+	// starting at index off. The auxiliary value is the index of
+	// the next entry.
+	fsReaddir
+	// fsSize replies with the size of the file ino.
+	fsSize
+	// fsMkdir creates the directory path relative to ino.
+	fsMkdir
+	// fsUnlink removes the path relative to ino. The flags may
+	// contain _AT_REMOVEDIR.
+	fsUnlink
+	// fsRename moves path relative to ino to path2 relative to
+	// ino2.
+	fsRename
+	// fsTruncate changes the size of the file ino to off.
+	fsTruncate
+	// fsSync commits the file ino to stable storage.
+	fsSync
+)
+
+// fsRequest is a request to a user file system. The layout is known
+// to the server.
+type fsRequest struct {
+	op      fsOp
+	mount   int32
+	ino     uint64
+	path    uint64
+	pathLen uint64
+	ino2    uint64
+	path2   uint64
+	path2Ln uint64
+	flags   uint64
+	mode    uint64
+	buf     uint64
+	n       uint64
+	off     int64
+	// addr and addrLen describe the socket address of socket
+	// operations.
+	addr    uint64
+	addrLen uint64
+}
+
+type fsCallState uint8
+
+const (
+	fsCallFree fsCallState = iota
+	fsCallPending
+	fsCallServing
+	fsCallDone
+)
+
+// fsCall is an outstanding request.
+type fsCall struct {
+	req   fsRequest
+	state fsCallState
+	// waiting is set if a thread waits for the reply.
+	waiting bool
+	// advance is set for transfers that move the file offset.
+	advance bool
+	// cloexec and nonblock are the close-on-exec and
+	// non-blocking flags of a socket or file being opened.
+	cloexec  bool
+	nonblock bool
+	// file is the file the request refers to, or -1. The request
+	// holds a reference to it.
+	file int32
+	ret  uint64
+}
+
+// forward allocates a request to the user mount m and returns it for
+// the caller to fill in. If t is not nil, t blocks until the server
+// replies. It must be called with globalThreads.lock held.
+//go:nosplit
+func (fs *files) forward(t *thread, m int32, op fsOp, f int32) (*fsCall, uint64) {
+	for i := range fs.calls {
+		c := &fs.calls[i]
+		if c.state != fsCallFree {
+			continue
+		}
+		*c = fsCall{}
+		c.state = fsCallPending
+		c.req.op = op
+		c.req.mount = m
+		c.file = f
+		if f != -1 {
+			fs.files[f].refs++
+		}
+		if t != nil {
+			c.waiting = true
+			t.block.conditions |= fsCondition
+			t.block.fs.call = int32(i)
+		}
+		fs.pendingCalls++
+		return c, _EOK
+	}
+	return nil, _ENFILE
+}
+
+// forwardFile forwards a transfer for the open file f.
+//go:nosplit
+func (fs *files) forwardFile(t *thread, f int32, op fsOp, buf virtualAddress, n uint64, off int64, advance bool) uint64 {
+	file := &fs.files[f]
+	c, errno := fs.forward(t, file.mount, op, f)
+	if errno != _EOK {
+		return errno
+	}
+	c.req.ino = file.ino
+	c.req.buf = uint64(buf)
+	c.req.n = n
+	c.req.off = off
+	c.advance = advance
+	return _EOK
+}
+
+// forwardPath forwards an operation on path relative to the
+// directory dir of the user mount m.
+//go:nosplit
+func (fs *files) forwardPath(t *thread, m int32, op fsOp, dir uint64, path []byte) (*fsCall, uint64) {
+	c, errno := fs.forward(t, m, op, -1)
+	if errno != _EOK {
+		return nil, errno
+	}
+	c.req.ino = dir
+	c.req.path, c.req.pathLen = pathAddr(path)
+	return c, _EOK
+}
+
+// closeUser forwards the release of the handle ino of the user
+// mount m.
+//go:nosplit
+func (fs *files) closeUser(m int32, ino uint64) {
+	c, errno := fs.forward(nil, m, fsClose, -1)
+	if errno != _EOK {
+		// Leak the handle.
+		return
+	}
+	c.req.ino = ino
+}
+
+// isUser reports whether f is a file of a user file system.
+//go:nosplit
+func (fs *files) isUser(f int32) bool {
+	file := &fs.files[f]
+	return file.kind == fileFS && fs.mounts[file.mount].user
+}
+
+// serveCall moves a pending request to dst and returns its index,
+// or -1 if no request is pending.
+//go:nosplit
+func (fs *files) serveCall(dst *fsRequest) int32 {
+	if fs.pendingCalls == 0 {
+		return -1
+	}
+	for i := range fs.calls {
+		c := &fs.calls[i]
+		if c.state == fsCallPending {
+			*dst = c.req
+			c.state = fsCallServing
+			fs.pendingCalls--
+			return int32(i)
+		}
+	}
+	return -1
+}
+
+// callResult returns the result of the request c and frees it, if
+// the server replied.
+//go:nosplit
+func (fs *files) callResult(c int32) (uint64, bool) {
+	call := &fs.calls[c]
+	if call.state != fsCallDone {
+		return 0, false
+	}
+	ret := call.ret
+	*call = fsCall{}
+	return ret, true
+}
+
+// reply completes the request c and reports whether a thread may
+// have been woken.
+//go:nosplit
+func (fs *files) reply(c int32, ret, aux uint64) bool {
+	call := &fs.calls[c]
+	if !isErrno(ret) {
+		switch call.req.op {
+		case fsOpen:
+			ret = fs.openUser(call, ret, aux&1 != 0)
+		case sockSocket, sockAccept:
+			ret = fs.openSocket(call, ret, uint32(aux))
+		case fsRead, fsWrite, fsReaddir:
+			if call.advance {
+				fs.files[call.file].off = int64(aux)
+			}
+		case fsSize:
+			// Complete lseek with _SEEK_END.
+			off := int64(ret) + call.req.off
+			if off < 0 {
+				ret = _EINVAL
+				break
+			}
+			fs.files[call.file].off = off
+			ret = uint64(off)
+		}
+	}
+	woken := false
+	if f := call.file; f != -1 {
+		fs.files[f].refs--
+		if fs.files[f].refs == 0 {
+			woken = fs.release(f)
+		}
+	}
+	if !call.waiting {
+		*call = fsCall{}
+		return woken
+	}
+	call.ret = ret
+	call.state = fsCallDone
+	return true
+}
+
+// openUser creates a file and descriptor for the handle ino opened
+// by the request call.
+//go:nosplit
+func (fs *files) openUser(call *fsCall, ino uint64, dir bool) uint64 {
+	m := call.req.mount
+	f, ok := fs.newFile(fileFS)
+	if !ok {
+		fs.closeUser(m, ino)
+		return _ENFILE
+	}
+	nf := &fs.files[f]
+	nf.flags = uint32(call.req.flags & (_O_ACCMODE | _O_NONBLOCK | _O_APPEND))
+	nf.dir = dir
+	nf.mount = m
+	nf.ino = ino
+	d, ok := fs.newFd(f, call.cloexec)
+	if !ok {
+		fs.files[f] = file{}
+		fs.closeUser(m, ino)
+		return _EMFILE
+	}
+	return uint64(d)
+}
+
+// mountUser mounts a user file system at path. A path of "/"
+// replaces the root file system; the kernel file systems mounted at
+// the old root are moved to the new.
+//go:nosplit
+func (fs *files) mountUser(path []byte) uint64 {
+	m := -1
+	for i := 1; i < len(fs.mounts); i++ {
+		if !fs.mounts[i].used() {
+			m = i
+			break
+		}
+	}
+	if m == -1 {
+		return _ENOSPC
+	}
+	mnt := &fs.mounts[m]
+	// Split the path into its directory and name.
+	end := len(path)
+	for end > 0 && path[end-1] == '/' {
+		end--
+	}
+	start := end
+	for start > 0 && path[start-1] != '/' {
+		start--
+	}
+	name := path[start:end]
+	if len(name) == 0 {
+		if len(path) == 0 || path[0] != '/' {
+			return _ENOENT
+		}
+		old := fs.root
+		oldRoot := fs.rootOf(old)
+		mnt.user = true
+		mnt.parent = -1
+		for i := range fs.mounts {
+			sub := &fs.mounts[i]
+			if sub.used() && sub.parent == old && sub.dir == oldRoot {
+				sub.parent = int32(m)
+				sub.dir = userRoot
+			}
+		}
+		fs.root = int32(m)
+		return uint64(m)
+	}
+	if len(name) > maxMountName {
+		return _ENAMETOOLONG
+	}
+	if string(name) == "." || string(name) == ".." {
+		return _EINVAL
+	}
+	parent, dir := fs.root, fs.rootOf(fs.root)
+	if start > 0 {
+		var rest []byte
+		var errno uint64
+		parent, dir, rest, errno = fs.walk(parent, dir, path[:start])
+		if errno != _EOK {
+			return errno
+		}
+		if len(rest) > 0 {
+			// Mount points inside user file systems must be in
+			// their root directory.
+			return _EINVAL
+		}
+	}
+	if !fs.mounts[parent].user {
+		st := &fs.st
+		if errno := fs.statAt(parent, dir, st); errno != _EOK {
+			return errno
+		}
+		if st.mode&_S_IFMT != _S_IFDIR {
+			return _ENOTDIR
+		}
+	}
+	if fs.mountAt(parent, dir, string(name)) != -1 {
+		return _EBUSY
+	}
+	mnt.user = true
+	mnt.parent = parent
+	mnt.dir = dir
+	n := copy(mnt.nameBuf[:], name)
+	// Point the name to the buffer without pointer writes.
+	hdr := (*reflect.StringHeader)(unsafe.Pointer(&mnt.name))
+	hdr.Data = uintptr(unsafe.Pointer(&mnt.nameBuf[0]))
+	hdr.Len = n
+	return uint64(m)
+}
+
+// pathAddr returns the address and length of a user path.
+//go:nosplit
+func pathAddr(path []byte) (uint64, uint64) {
+	if len(path) == 0 {
+		return 0, 0
+	}
+	return uint64(uintptr(unsafe.Pointer(&path[0]))), uint64(len(path))
+}
+
+//go:nosplit
+func sysFSMount(path virtualAddress) uint64 {
+	p, errno := userPath(path)
+	if errno != _EOK {
+		return errno
+	}
+	ts := &globalThreads
+	ts.lock.lock()
+	ret := globalFiles.mountUser(p)
+	ts.lock.unlock()
+	return ret
+}
+
+// sysFSServe blocks t until a request to a user file system is
+// available and copies it to req. The result is the request index.
+//go:nosplit
+func sysFSServe(t *thread, req *fsRequest) uint64 {
+	if req == nil || !userPtr(unsafe.Pointer(req), unsafe.Sizeof(*req), true) {
+		return _EFAULT
+	}
+	ts := &globalThreads
+	ts.lock.lock()
+	t.block.conditions = fsServeCondition
+	t.block.fs.req = uint64(uintptr(unsafe.Pointer(req)))
+	ts.lock.unlock()
+	// The wakeup overwrites the result.
+	return 0
+}
+
+//go:nosplit
+func sysFSReply(c, ret, aux uint64) uint64 {
+	if c >= maxFSCalls {
+		return _EINVAL
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	if fs.calls[c].state != fsCallServing {
+		ts.lock.unlock()
+		return _EINVAL
+	}
+	woken := fs.reply(int32(c), ret, aux)
+	ts.lock.unlock()
+	if woken {
+		wakeIdleCPUs()
+	}
+	return _EOK
+}
+
+//go:nosplit
+func sysMkdirat(t *thread, dirfd int32, path virtualAddress, mode uint64) uint64 {
+	p, errno := userPath(path)
+	if errno != _EOK {
+		return errno
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	m, dir, rest, errno := fs.walkAt(dirfd, p)
+	switch {
+	case errno == _EOK && fs.mounts[m].user:
+		var c *fsCall
+		c, errno = fs.forwardPath(t, m, fsMkdir, dir, rest)
+		if errno == _EOK {
+			c.req.mode = mode
+		}
+	case errno == _EOK:
+		errno = _EEXIST
+	case errno == _ENOENT:
+		errno = _EROFS
+	}
+	ts.lock.unlock()
+	return errno
+}
+
+//go:nosplit
+func sysUnlinkat(t *thread, dirfd int32, path virtualAddress, flags uint64) uint64 {
+	if flags&^_AT_REMOVEDIR != 0 {
+		return _EINVAL
+	}
+	p, errno := userPath(path)
+	if errno != _EOK {
+		return errno
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	m, dir, rest, errno := fs.walkAt(dirfd, p)
+	switch {
+	case errno == _EOK && fs.mounts[m].user && len(rest) > 0:
+		var c *fsCall
+		c, errno = fs.forwardPath(t, m, fsUnlink, dir, rest)
+		if errno == _EOK {
+			c.req.flags = flags
+		}
+	case errno == _EOK && dir == fs.rootOf(m):
+		// Mount points can't be removed.
+		errno = _EBUSY
+	case errno == _EOK:
+		errno = _EROFS
+	}
+	ts.lock.unlock()
+	return errno
+}
+
+//go:nosplit
+func sysRenameat(t *thread, olddirfd int32, oldpath virtualAddress, newdirfd int32, newpath virtualAddress) uint64 {
+	op, errno := userPath(oldpath)
+	if errno != _EOK {
+		return errno
+	}
+	np, errno := userPath(newpath)
+	if errno != _EOK {
+		return errno
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	m, dir, rest, errno := fs.walkAt(olddirfd, op)
+	if errno != _EOK {
+		ts.lock.unlock()
+		return errno
+	}
+	m2, dir2, rest2, errno := fs.walkAt(newdirfd, np)
+	switch {
+	case !fs.mounts[m].user:
+		errno = _EROFS
+	case errno != _EOK:
+	case m != m2 || len(rest) == 0 || len(rest2) == 0:
+		errno = _EXDEV
+	default:
+		var c *fsCall
+		c, errno = fs.forwardPath(t, m, fsRename, dir, rest)
+		if errno == _EOK {
+			c.req.ino2 = dir2
+			c.req.path2, c.req.path2Ln = pathAddr(rest2)
+		}
+	}
+	ts.lock.unlock()
+	return errno
+}
+
+//go:nosplit
+func sysFtruncate(t *thread, d uint64, size int64) uint64 {
+	if size < 0 {
+		return _EINVAL
+	}
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, ok := fs.lookup(d)
+	var ret uint64
+	switch {
+	case !ok:
+		ret = _EBADF
+	case fs.files[f].kind != fileFS || fs.files[f].dir || fs.files[f].flags&_O_ACCMODE == _O_RDONLY:
+		ret = _EINVAL
+	case fs.isUser(f):
+		ret = fs.forwardFile(t, f, fsTruncate, 0, 0, size, false)
+	default:
+		ret = _EROFS
+	}
+	ts.lock.unlock()
+	return ret
+}
+
+// sysFsync implements fsync and fdatasync.
+//go:nosplit
+func sysFsync(t *thread, d uint64) uint64 {
+	ts := &globalThreads
+	fs := &globalFiles
+	ts.lock.lock()
+	f, ok := fs.lookup(d)
+	var ret uint64
+	switch {
+	case !ok:
+		ret = _EBADF
+	case fs.files[f].kind != fileFS:
+		ret = _EINVAL
+	case fs.isUser(f):
+		ret = fs.forwardFile(t, f, fsSync, 0, 0, 0, false)
+	default:
+		// Kernel file systems are not backed by storage.
+		ret = _EOK
+	}
+	ts.lock.unlock()
+	return ret
+}
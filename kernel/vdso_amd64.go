@@ -4,28 +4,204 @@ package kernel
 
 import "encoding/binary"
 
-const vdsoAddress virtualAddress = 0xffffffffff600000
+const (
+	// vdsoAddress is the address of the legacy vsyscall page.
+	vdsoAddress virtualAddress = 0xffffffffff600000
+	// vdsoImageAddress is the address of the vDSO ELF image passed
+	// to programs in AT_SYSINFO_EHDR.
+	vdsoImageAddress = vdsoAddress + pageSize
+)
+
+// Layout of the vDSO image. The image is a minimal ELF shared object
+// with just enough dynamic symbol information for the Go runtime to
+// find the time functions.
+const (
+	vdsoEhdrSize    = 64
+	vdsoPhdrSize    = 56
+	vdsoSymSize     = 24
+	vdsoVerdefSize  = 20
+	vdsoVerdauxSize = 8
+
+	vdsoPhdrOff    = vdsoEhdrSize
+	vdsoDynOff     = vdsoPhdrOff + 2*vdsoPhdrSize
+	vdsoSymtabOff  = vdsoDynOff + 6*16
+	vdsoHashOff    = vdsoSymtabOff + vdsoNumSyms*vdsoSymSize
+	vdsoVersymOff  = vdsoHashOff + (2+1+vdsoNumSyms)*4
+	vdsoVerdefOff  = (vdsoVersymOff + vdsoNumSyms*2 + 7) &^ 7
+	vdsoStrtabOff  = vdsoVerdefOff + 2*(vdsoVerdefSize+vdsoVerdauxSize)
+	vdsoTextOff    = 0x200
+	vdsoNumSyms    = 3
+	vdsoTrampoline = 16
+
+	// The string table.
+	vdsoStrtab          = "\x00linux-vdso.so.1\x00LINUX_2.6\x00__vdso_gettimeofday\x00__vdso_clock_gettime\x00"
+	vdsoStrSoname       = 1
+	vdsoStrVersion      = vdsoStrSoname + len("linux-vdso.so.1") + 1
+	vdsoStrGettimeofday = vdsoStrVersion + len("LINUX_2.6") + 1
+	vdsoStrClockGettime = vdsoStrGettimeofday + len("__vdso_gettimeofday") + 1
+
+	// ELF hashes of the soname and version.
+	vdsoSonameHash  = 0xdeebfa1
+	vdsoVersionHash = 0x3ae75f6
+)
+
+// ELF constants.
+const (
+	_ET_DYN       = 3
+	_EM_X86_64    = 62
+	_PT_DYNAMIC   = 2
+	_PF_X         = 1
+	_PF_R         = 4
+	_DT_NULL      = 0
+	_DT_HASH      = 4
+	_DT_STRTAB    = 5
+	_DT_SYMTAB    = 6
+	_DT_VERSYM    = 0x6ffffff0
+	_DT_VERDEF    = 0x6ffffffc
+	_STB_GLOBAL   = 1
+	_VER_FLG_BASE = 1
+)
 
 //go:nosplit
 func initVDSO() error {
-	// We're not yet passing a full-fledged vDSO AT_SYSINFO_EHDR to
-	// the Go runtime, in which case it expects an implementation of
-	// gettimeofday at address 0xffffffffff600000.
-	// Map a page that jumps to our implementation.
-	if !globalMap.mmapFixed(vdsoAddress, pageSize, pageFlagWritable|pageFlagUserAccess) {
+	const size = 2 * pageSize
+	page, err := globalMem.alloc(size)
+	if err != nil {
+		return err
+	}
+	// Write the pages through the kernel only physical memory map,
+	// to map them read-only and executable for user mode.
+	mem := physToVirt(page)
+	// Go runtimes without vDSO support expect an implementation of
+	// gettimeofday at the start of the vsyscall page.
+	writeTrampoline(sliceForMem(mem, vdsoTrampoline), funcPC(vdsoGettimeofday))
+	writeVDSOImage(sliceForMem(mem+vdsoImageAddress-vdsoAddress, pageSize))
+	const flags = pageFlagUserAccess
+	if !globalMap.mmapFixed(vdsoAddress, size, flags) {
 		return kernError("setupVDSO: failed to map vDSO page")
 	}
-	page := sliceForMem(vdsoAddress, pageSize)
-	// MOVQ $vdsoGettimeofday(SB), R11
-	page[0] = 0x49
-	page[1] = 0xbb
-	gettimeofday := funcPC(vdsoGettimeofday)
-	binary.LittleEndian.PutUint64(page[2:10], uint64(gettimeofday))
+	return mmapAligned(&globalMem, globalPT, vdsoAddress, vdsoAddress+size, page, flags)
+}
+
+// writeVDSOImage writes the vDSO ELF image to img.
+//go:nosplit
+func writeVDSOImage(img []byte) {
+	bo := binary.LittleEndian
+
+	// ELF header.
+	copy(img, "\x7fELF")
+	img[4] = 2 // 64-bit.
+	img[5] = 1 // Little endian.
+	img[6] = 1 // ELF version.
+	bo.PutUint16(img[16:], _ET_DYN)
+	bo.PutUint16(img[18:], _EM_X86_64)
+	bo.PutUint32(img[20:], 1)
+	bo.PutUint64(img[32:], vdsoPhdrOff)
+	bo.PutUint16(img[52:], vdsoEhdrSize)
+	bo.PutUint16(img[54:], vdsoPhdrSize)
+	bo.PutUint16(img[56:], 2)
+
+	// Program headers.
+	phdr := img[vdsoPhdrOff:]
+	bo.PutUint32(phdr[0:], _PT_LOAD)
+	bo.PutUint32(phdr[4:], _PF_R|_PF_X)
+	bo.PutUint64(phdr[32:], pageSize) // File size.
+	bo.PutUint64(phdr[40:], pageSize) // Memory size.
+	bo.PutUint64(phdr[48:], pageSize) // Alignment.
+	phdr = phdr[vdsoPhdrSize:]
+	bo.PutUint32(phdr[0:], _PT_DYNAMIC)
+	bo.PutUint32(phdr[4:], _PF_R)
+	bo.PutUint64(phdr[8:], vdsoDynOff)
+	bo.PutUint64(phdr[16:], vdsoDynOff)
+	bo.PutUint64(phdr[32:], vdsoSymtabOff-vdsoDynOff)
+	bo.PutUint64(phdr[40:], vdsoSymtabOff-vdsoDynOff)
+	bo.PutUint64(phdr[48:], 8)
+
+	// Dynamic section.
+	dyn := img[vdsoDynOff:]
+	putDyn(dyn[0*16:], _DT_STRTAB, vdsoStrtabOff)
+	putDyn(dyn[1*16:], _DT_SYMTAB, vdsoSymtabOff)
+	putDyn(dyn[2*16:], _DT_HASH, vdsoHashOff)
+	putDyn(dyn[3*16:], _DT_VERSYM, vdsoVersymOff)
+	putDyn(dyn[4*16:], _DT_VERDEF, vdsoVerdefOff)
+	putDyn(dyn[5*16:], _DT_NULL, 0)
+
+	// Symbol table. The first symbol is the undefined symbol.
+	text := img[vdsoTextOff:]
+	writeTrampoline(text, funcPC(vdsoGettimeofday))
+	writeTrampoline(text[vdsoTrampoline:], funcPC(vdsoClockGettime))
+	syms := img[vdsoSymtabOff:]
+	putSym(syms[1*vdsoSymSize:], vdsoStrGettimeofday, vdsoTextOff)
+	putSym(syms[2*vdsoSymSize:], vdsoStrClockGettime, vdsoTextOff+vdsoTrampoline)
+
+	// Hash table with a single bucket.
+	hash := img[vdsoHashOff:]
+	bo.PutUint32(hash[0:], 1)           // Number of buckets.
+	bo.PutUint32(hash[4:], vdsoNumSyms) // Number of chain entries.
+	bo.PutUint32(hash[8:], 2)           // Bucket 0.
+	bo.PutUint32(hash[12:], 0)          // Chain.
+	bo.PutUint32(hash[16:], 0)
+	bo.PutUint32(hash[20:], 1)
+
+	// Symbol versions.
+	versym := img[vdsoVersymOff:]
+	bo.PutUint16(versym[2:], 2)
+	bo.PutUint16(versym[4:], 2)
+
+	// Version definitions, the file itself and LINUX_2.6.
+	verdef := img[vdsoVerdefOff:]
+	putVerdef(verdef, _VER_FLG_BASE, 1, vdsoSonameHash, vdsoStrSoname, true)
+	verdef = verdef[vdsoVerdefSize+vdsoVerdauxSize:]
+	putVerdef(verdef, 0, 2, vdsoVersionHash, vdsoStrVersion, false)
+
+	copy(img[vdsoStrtabOff:], vdsoStrtab)
+}
+
+// writeTrampoline writes code to p that jumps to the address pc.
+//go:nosplit
+func writeTrampoline(p []byte, pc uintptr) {
+	// MOVQ $pc, R11
+	p[0] = 0x49
+	p[1] = 0xbb
+	binary.LittleEndian.PutUint64(p[2:10], uint64(pc))
 	// JMP R11
-	page[10] = 0x41
-	page[11] = 0xff
-	page[12] = 0xe3
-	return nil
+	p[10] = 0x41
+	p[11] = 0xff
+	p[12] = 0xe3
+}
+
+//go:nosplit
+func putDyn(p []byte, tag, val uint64) {
+	binary.LittleEndian.PutUint64(p[0:], tag)
+	binary.LittleEndian.PutUint64(p[8:], val)
+}
+
+//go:nosplit
+func putSym(p []byte, name int, value uint64) {
+	bo := binary.LittleEndian
+	bo.PutUint32(p[0:], uint32(name))
+	p[4] = _STB_GLOBAL<<4 | _STT_FUNC
+	// Any defined section index.
+	bo.PutUint16(p[6:], 1)
+	bo.PutUint64(p[8:], value)
+	bo.PutUint64(p[16:], vdsoTrampoline)
+}
+
+//go:nosplit
+func putVerdef(p []byte, flags, index uint16, hash uint32, name int, hasNext bool) {
+	bo := binary.LittleEndian
+	bo.PutUint16(p[0:], 1) // Version.
+	bo.PutUint16(p[2:], flags)
+	bo.PutUint16(p[4:], index)
+	bo.PutUint16(p[6:], 1) // Number of auxiliary entries.
+	bo.PutUint32(p[8:], hash)
+	bo.PutUint32(p[12:], vdsoVerdefSize) // Offset of auxiliary entry.
+	if hasNext {
+		bo.PutUint32(p[16:], vdsoVerdefSize+vdsoVerdauxSize)
+	}
+	aux := p[vdsoVerdefSize:]
+	bo.PutUint32(aux[0:], uint32(name))
 }
 
 func vdsoGettimeofday()
+func vdsoClockGettime()
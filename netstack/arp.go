@@ -0,0 +1,62 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package netstack
+
+import (
+	"encoding/binary"
+)
+
+const (
+	arpSize = 28
+
+	arpRequest = 1
+	arpReply   = 2
+)
+
+// inputARP processes a received ARP packet.
+func (s *Stack) inputARP(p []byte) {
+	if len(p) < arpSize {
+		return
+	}
+	// Only Ethernet and IPv4 addresses are supported.
+	if binary.BigEndian.Uint16(p[0:]) != 1 || binary.BigEndian.Uint16(p[2:]) != etherTypeIPv4 ||
+		p[4] != 6 || p[5] != 4 {
+		return
+	}
+	op := binary.BigEndian.Uint16(p[6:])
+	var sha [6]byte
+	copy(sha[:], p[8:14])
+	spa := v4Addr(p[14:18])
+	tpa := v4Addr(p[24:28])
+	forUs := s.v4.configured && tpa == s.v4.addr
+	if spa != v4Any {
+		// Learn the sender if it is talking to us, or refresh an
+		// existing entry.
+		s.learn(spa, sha, forUs)
+	}
+	if op == arpRequest && forUs {
+		s.sendARP(arpReply, sha, sha, spa)
+	}
+}
+
+// sendARP sends an ARP packet to the link address dst about the
+// target addresses tha and tpa.
+func (s *Stack) sendARP(op uint16, dst, tha [6]byte, tpa addr) {
+	b := make([]byte, ethHeaderSize+arpSize)
+	binary.BigEndian.PutUint16(b[12:], etherTypeARP)
+	p := b[ethHeaderSize:]
+	binary.BigEndian.PutUint16(p[0:], 1)
+	binary.BigEndian.PutUint16(p[2:], etherTypeIPv4)
+	p[4] = 6
+	p[5] = 4
+	binary.BigEndian.PutUint16(p[6:], op)
+	copy(p[8:14], s.mac[:])
+	spa := v4Any
+	if s.v4.configured {
+		spa = s.v4.addr
+	}
+	copy(p[14:18], spa[12:])
+	copy(p[18:24], tha[:])
+	copy(p[24:28], tpa[12:])
+	s.writeFrame(dst, frame{data: b, csumStart: -1})
+}
@@ -0,0 +1,367 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package netstack
+
+import (
+	"encoding/binary"
+	"syscall"
+	"time"
+)
+
+// dhcpClient configures IPv4 through DHCP (RFC 2131).
+type dhcpClient struct {
+	s    *Stack
+	sock *socket
+	// ready is signalled when the socket may have datagrams.
+	ready chan struct{}
+	xid   uint32
+	// linkReset is set when the link status changed.
+	linkReset bool
+}
+
+// dhcpLease is the configuration offered by a DHCP server.
+type dhcpLease struct {
+	typ    byte
+	addr   addr
+	mask   addr
+	router addr
+	dns    []addr
+	server addr
+	// lease is the lease duration, t1 and t2 the renewal and
+	// rebinding times.
+	lease, t1, t2 time.Duration
+}
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpHeaderSize = 240
+	dhcpMagic      = 0x63825363
+	// dhcpBroadcast asks the server to broadcast its replies.
+	dhcpBroadcast = 0x8000
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+
+	// DHCP options.
+	dhcpOptPad        = 0
+	dhcpOptSubnetMask = 1
+	dhcpOptRouter     = 3
+	dhcpOptDNS        = 6
+	dhcpOptRequested  = 50
+	dhcpOptLeaseTime  = 51
+	dhcpOptMsgType    = 53
+	dhcpOptServerID   = 54
+	dhcpOptParams     = 55
+	dhcpOptRenewal    = 58
+	dhcpOptRebinding  = 59
+	dhcpOptEnd        = 255
+
+	dhcpMinTimeout = 4 * time.Second
+	dhcpMaxTimeout = 64 * time.Second
+	// dhcpMinRetry is the minimum interval between renewal
+	// requests.
+	dhcpMinRetry = 60 * time.Second
+	// defaultLease is the lease duration if the server doesn't
+	// specify one.
+	defaultLease = time.Hour
+)
+
+func newDHCPClient(s *Stack) (*dhcpClient, error) {
+	so, err := s.socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := so.SetsockoptInt(syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1); err != nil {
+		return nil, err
+	}
+	if err := so.Bind(&syscall.SockaddrInet4{Port: dhcpClientPort}); err != nil {
+		return nil, err
+	}
+	d := &dhcpClient{
+		s:     s,
+		sock:  so,
+		ready: make(chan struct{}, 1),
+	}
+	so.Notify(func(events uint32) {
+		if events&syscall.EPOLLIN == 0 {
+			return
+		}
+		select {
+		case d.ready <- struct{}{}:
+		default:
+		}
+	})
+	return d, nil
+}
+
+func (d *dhcpClient) run() {
+	for {
+		l := d.discover()
+		d.configure(l)
+		if !d.maintain(l) {
+			d.unconfigure()
+		}
+	}
+}
+
+// discover obtains a lease from a DHCP server.
+func (d *dhcpClient) discover() *dhcpLease {
+	timeout := dhcpMinTimeout
+	for {
+		d.xid = d.s.randUint32()
+		d.send(dhcpDiscover, nil, v4Broadcast)
+		deadline := time.Now().Add(timeout)
+		if timeout < dhcpMaxTimeout {
+			timeout *= 2
+		}
+		offer, changed := d.receive(deadline)
+		if changed {
+			timeout = dhcpMinTimeout
+			continue
+		}
+		if offer == nil || offer.typ != dhcpOffer {
+			continue
+		}
+		d.send(dhcpRequest, offer, v4Broadcast)
+		for {
+			ack, changed := d.receive(time.Now().Add(dhcpMinTimeout))
+			if changed || ack == nil || ack.typ == dhcpNak {
+				break
+			}
+			if ack.typ == dhcpAck {
+				return ack
+			}
+		}
+	}
+}
+
+// maintain renews the lease l until it is lost, or the link comes
+// up again. It reports whether the address is still valid.
+func (d *dhcpClient) maintain(l *dhcpLease) bool {
+	start := time.Now()
+	for {
+		now := time.Now()
+		renew := start.Add(l.t1)
+		rebind := start.Add(l.t2)
+		expiry := start.Add(l.lease)
+		if !now.Before(expiry) {
+			return false
+		}
+		if now.Before(renew) {
+			if !d.sleep(renew) {
+				return true
+			}
+			continue
+		}
+		// Retry at half the remaining time.
+		end := rebind
+		dst := l.server
+		if !now.Before(rebind) {
+			end = expiry
+			dst = v4Broadcast
+		}
+		wait := end.Sub(now) / 2
+		if wait < dhcpMinRetry {
+			wait = dhcpMinRetry
+		}
+		deadline := now.Add(wait)
+		if deadline.After(expiry) {
+			deadline = expiry
+		}
+		d.xid = d.s.randUint32()
+		d.send(dhcpRequest, nil, dst)
+		for {
+			ack, changed := d.receive(deadline)
+			if changed {
+				return true
+			}
+			if ack == nil {
+				break
+			}
+			switch ack.typ {
+			case dhcpAck:
+				d.configure(ack)
+				l = ack
+				start = time.Now()
+			case dhcpNak:
+				return false
+			default:
+				continue
+			}
+			break
+		}
+	}
+}
+
+// receive waits for a reply until the deadline. It also returns when
+// the link comes up.
+func (d *dhcpClient) receive(deadline time.Time) (*dhcpLease, bool) {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := d.sock.Recvfrom(buf, 0)
+		if err == nil {
+			if l := d.parse(buf[:n]); l != nil {
+				return l, false
+			}
+			continue
+		}
+		if !d.wait(deadline, d.ready) {
+			return nil, d.linkChanged()
+		}
+	}
+}
+
+// sleep waits until t. It returns false if the link came up in the
+// meantime.
+func (d *dhcpClient) sleep(t time.Time) bool {
+	d.wait(t, nil)
+	return !d.linkChanged()
+}
+
+// wait waits for a value from c until the deadline or a link change
+// and reports whether c was ready.
+func (d *dhcpClient) wait(deadline time.Time, c <-chan struct{}) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-c:
+		return true
+	case <-timer.C:
+	case <-d.s.linkChanges():
+		d.linkReset = true
+	}
+	return false
+}
+
+// linkChanged reports and clears a link change that brought the link
+// up.
+func (d *dhcpClient) linkChanged() bool {
+	changed := d.linkReset
+	d.linkReset = false
+	return changed && d.s.linkUp()
+}
+
+func (d *dhcpClient) configure(l *dhcpLease) {
+	s := d.s
+	s.mu.Lock()
+	s.v4.configured = true
+	s.v4.addr = l.addr
+	s.v4.mask = l.mask
+	s.v4.router = l.router
+	s.dns4 = l.dns
+	s.mu.Unlock()
+	s.configuredOnce.Do(func() {
+		close(s.configured)
+	})
+}
+
+func (d *dhcpClient) unconfigure() {
+	s := d.s
+	s.mu.Lock()
+	s.v4.configured = false
+	s.dns4 = nil
+	s.mu.Unlock()
+}
+
+// send sends a DHCP message to dst. A request for the offer is sent
+// when offer is not nil, a renewal otherwise.
+func (d *dhcpClient) send(typ byte, offer *dhcpLease, dst addr) {
+	b := make([]byte, dhcpHeaderSize, 300)
+	b[0] = 1 // BOOTREQUEST.
+	b[1] = 1 // Ethernet.
+	b[2] = 6
+	binary.BigEndian.PutUint32(b[4:], d.xid)
+	d.s.mu.Lock()
+	renewing := typ == dhcpRequest && offer == nil
+	if renewing {
+		copy(b[12:16], d.s.v4.addr[12:])
+	} else {
+		binary.BigEndian.PutUint16(b[10:], dhcpBroadcast)
+	}
+	d.s.mu.Unlock()
+	copy(b[28:34], d.s.mac[:])
+	binary.BigEndian.PutUint32(b[236:], dhcpMagic)
+	b = append(b, dhcpOptMsgType, 1, typ)
+	b = append(b, dhcpOptParams, 7, dhcpOptSubnetMask, dhcpOptRouter, dhcpOptDNS,
+		dhcpOptLeaseTime, dhcpOptServerID, dhcpOptRenewal, dhcpOptRebinding)
+	if offer != nil {
+		b = append(b, dhcpOptRequested, 4)
+		b = append(b, offer.addr[12:]...)
+		b = append(b, dhcpOptServerID, 4)
+		b = append(b, offer.server[12:]...)
+	}
+	b = append(b, dhcpOptEnd)
+	to := &syscall.SockaddrInet4{Port: dhcpServerPort}
+	copy(to.Addr[:], dst[12:])
+	// Lost requests are retried.
+	d.sock.Sendto(b, 0, to)
+}
+
+// parse parses a reply to the current request.
+func (d *dhcpClient) parse(b []byte) *dhcpLease {
+	if len(b) < dhcpHeaderSize || b[0] != 2 || binary.BigEndian.Uint32(b[4:]) != d.xid ||
+		binary.BigEndian.Uint32(b[236:]) != dhcpMagic {
+		return nil
+	}
+	var mac [6]byte
+	copy(mac[:], b[28:34])
+	if mac != d.s.mac {
+		return nil
+	}
+	l := &dhcpLease{
+		addr:   v4Addr(b[16:20]),
+		mask:   v4Addr([]byte{255, 255, 255, 0}),
+		router: v4Any,
+		server: v4Addr(b[20:24]),
+		lease:  defaultLease,
+	}
+	var t1, t2 time.Duration
+	for opts := b[dhcpHeaderSize:]; len(opts) > 0; {
+		code := opts[0]
+		if code == dhcpOptEnd {
+			break
+		}
+		if code == dhcpOptPad {
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || int(opts[1]) > len(opts)-2 {
+			return nil
+		}
+		v := opts[2 : 2+opts[1]]
+		opts = opts[2+len(v):]
+		switch {
+		case code == dhcpOptMsgType && len(v) == 1:
+			l.typ = v[0]
+		case code == dhcpOptSubnetMask && len(v) == 4:
+			l.mask = v4Addr(v)
+		case code == dhcpOptRouter && len(v) >= 4:
+			l.router = v4Addr(v)
+		case code == dhcpOptDNS:
+			for ; len(v) >= 4; v = v[4:] {
+				l.dns = append(l.dns, v4Addr(v))
+			}
+		case code == dhcpOptServerID && len(v) == 4:
+			l.server = v4Addr(v)
+		case code == dhcpOptLeaseTime && len(v) == 4:
+			l.lease = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+		case code == dhcpOptRenewal && len(v) == 4:
+			t1 = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+		case code == dhcpOptRebinding && len(v) == 4:
+			t2 = time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+		}
+	}
+	if t1 == 0 || t1 > l.lease {
+		t1 = l.lease / 2
+	}
+	if t2 == 0 || t2 > l.lease || t2 < t1 {
+		t2 = l.lease * 7 / 8
+	}
+	l.t1, l.t2 = t1, t2
+	return l
+}
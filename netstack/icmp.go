@@ -0,0 +1,251 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package netstack
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+
+	icmpv6EchoRequest     = 128
+	icmpv6EchoReply       = 129
+	icmpv6RouterSolicit   = 133
+	icmpv6RouterAdvert    = 134
+	icmpv6NeighborSolicit = 135
+	icmpv6NeighborAdvert  = 136
+
+	// Neighbor discovery options.
+	ndSourceLinkAddr = 1
+	ndTargetLinkAddr = 2
+	ndPrefixInfo     = 3
+	ndRDNSS          = 25
+
+	// ndHopLimit is the hop limit of neighbor discovery packets.
+	ndHopLimit = 255
+
+	routerSolicitations = 3
+	routerSolicitDelay  = 4 * time.Second
+)
+
+// inputICMPv4 processes a received ICMP packet.
+func (s *Stack) inputICMPv4(src, dst addr, p []byte, valid bool) {
+	if len(p) < 8 || !valid && fold(checksum(0, p)) != 0xffff {
+		return
+	}
+	if p[0] != icmpEchoRequest || p[1] != 0 || !s.isLocal(dst) {
+		// Ignore everything but echo requests, including broadcast
+		// ones.
+		return
+	}
+	f, r := s.newPacket(dst, src, protoICMP, len(p))
+	copy(r, p)
+	r[0] = icmpEchoReply
+	r[2], r[3] = 0, 0
+	binary.BigEndian.PutUint16(r[2:], ^fold(checksum(0, r)))
+	s.transmit(src, f)
+}
+
+// inputICMPv6 processes a received ICMPv6 packet.
+func (s *Stack) inputICMPv6(src, dst addr, hopLimit uint8, p []byte, valid bool) {
+	if len(p) < 8 || !valid && !validChecksum(p, src, dst, protoICMPv6) {
+		return
+	}
+	typ := p[0]
+	switch typ {
+	case icmpv6EchoRequest:
+		if dst.isMulticast() {
+			return
+		}
+		f, r := s.newPacket(dst, src, protoICMPv6, len(p))
+		copy(r, p)
+		r[0] = icmpv6EchoReply
+		prepareChecksum(&f, r, dst, src, protoICMPv6, 2)
+		s.transmit(src, f)
+		return
+	case icmpv6RouterAdvert, icmpv6NeighborSolicit, icmpv6NeighborAdvert:
+		// Neighbor discovery packets must not be forwarded.
+		if hopLimit != ndHopLimit || p[1] != 0 {
+			return
+		}
+	default:
+		return
+	}
+	switch typ {
+	case icmpv6NeighborSolicit:
+		if len(p) < 24 {
+			return
+		}
+		var target addr
+		copy(target[:], p[8:24])
+		if target.isLoopback() || !s.isLocal(target) {
+			return
+		}
+		if mac, ok := ndLinkAddr(p[24:], ndSourceLinkAddr); ok && src != (addr{}) {
+			s.learn(src, mac, true)
+		}
+		s.sendNeighborAdvert(src, target)
+	case icmpv6NeighborAdvert:
+		if len(p) < 24 {
+			return
+		}
+		var target addr
+		copy(target[:], p[8:24])
+		if mac, ok := ndLinkAddr(p[24:], ndTargetLinkAddr); ok {
+			s.learn(target, mac, false)
+		}
+	case icmpv6RouterAdvert:
+		if len(p) < 16 || !src.isLinkLocal() {
+			return
+		}
+		s.inputRouterAdvert(src, p)
+	}
+}
+
+// inputRouterAdvert processes a router advertisement from src.
+func (s *Stack) inputRouterAdvert(src addr, p []byte) {
+	lifetime := binary.BigEndian.Uint16(p[6:])
+	switch {
+	case lifetime > 0:
+		s.v6.router = src
+	case s.v6.router == src:
+		s.v6.router = addr{}
+	}
+	for opts := p[16:]; len(opts) >= 2; {
+		n := int(opts[1]) * 8
+		if n == 0 || n > len(opts) {
+			return
+		}
+		opt := opts[:n]
+		opts = opts[n:]
+		switch opt[0] {
+		case ndSourceLinkAddr:
+			var mac [6]byte
+			copy(mac[:], opt[2:])
+			s.learn(src, mac, true)
+		case ndPrefixInfo:
+			if n < 32 {
+				break
+			}
+			const autonomous = 0x40
+			plen := int(opt[2])
+			valid := binary.BigEndian.Uint32(opt[4:])
+			var prefix addr
+			copy(prefix[:], opt[16:32])
+			// Only 64 bit prefixes can be combined with the
+			// interface identifier.
+			if opt[3]&autonomous == 0 || plen != 64 || valid == 0 || prefix.isLinkLocal() {
+				break
+			}
+			s.v6.prefix = prefix
+			s.v6.prefixLen = plen
+			s.v6.global = s.interfaceAddr(prefix)
+		case ndRDNSS:
+			if n < 24 || binary.BigEndian.Uint32(opt[4:]) == 0 {
+				break
+			}
+			s.dns6 = s.dns6[:0]
+			for a := opt[8:]; len(a) >= 16; a = a[16:] {
+				var server addr
+				copy(server[:], a)
+				s.dns6 = append(s.dns6, server)
+			}
+		}
+	}
+}
+
+// ndLinkAddr returns the link address of the neighbor discovery
+// option of type typ, if present.
+func ndLinkAddr(opts []byte, typ uint8) ([6]byte, bool) {
+	for len(opts) >= 2 {
+		n := int(opts[1]) * 8
+		if n == 0 || n > len(opts) {
+			break
+		}
+		if opts[0] == typ && n >= 8 {
+			var mac [6]byte
+			copy(mac[:], opts[2:8])
+			return mac, true
+		}
+		opts = opts[n:]
+	}
+	return [6]byte{}, false
+}
+
+// sendNeighborSolicit sends a neighbor solicitation for a.
+func (s *Stack) sendNeighborSolicit(a addr) {
+	src, err := s.source(a)
+	if err != nil {
+		src = s.v6.linkLocal
+	}
+	dst := solicitedNode(a)
+	f, p := s.ndPacket(src, dst, icmpv6NeighborSolicit, 32)
+	copy(p[8:24], a[:])
+	p[24] = ndSourceLinkAddr
+	p[25] = 1
+	copy(p[26:32], s.mac[:])
+	prepareChecksum(&f, p, src, dst, protoICMPv6, 2)
+	s.transmit(dst, f)
+}
+
+// sendNeighborAdvert answers a neighbor solicitation from dst for the
+// local address target.
+func (s *Stack) sendNeighborAdvert(dst, target addr) {
+	const (
+		solicited = 0x40
+		override  = 0x20
+	)
+	flags := byte(override)
+	if dst == (addr{}) {
+		// Answer duplicate address detection to all nodes.
+		dst = v6AllNodes
+	} else {
+		flags |= solicited
+	}
+	f, p := s.ndPacket(target, dst, icmpv6NeighborAdvert, 32)
+	p[4] = flags
+	copy(p[8:24], target[:])
+	p[24] = ndTargetLinkAddr
+	p[25] = 1
+	copy(p[26:32], s.mac[:])
+	prepareChecksum(&f, p, target, dst, protoICMPv6, 2)
+	s.transmit(dst, f)
+}
+
+// solicitRouters sends router solicitations until a router
+// advertisement arrives.
+func (s *Stack) solicitRouters() {
+	for i := 0; i < routerSolicitations; i++ {
+		s.mu.Lock()
+		if s.v6.router != (addr{}) {
+			s.mu.Unlock()
+			return
+		}
+		src := s.v6.linkLocal
+		f, p := s.ndPacket(src, v6AllRouters, icmpv6RouterSolicit, 16)
+		p[8] = ndSourceLinkAddr
+		p[9] = 1
+		copy(p[10:16], s.mac[:])
+		prepareChecksum(&f, p, src, v6AllRouters, protoICMPv6, 2)
+		s.transmit(v6AllRouters, f)
+		s.mu.Unlock()
+		time.Sleep(routerSolicitDelay)
+	}
+}
+
+// ndPacket returns a neighbor discovery packet of the given type and
+// size.
+func (s *Stack) ndPacket(src, dst addr, typ uint8, size int) (frame, []byte) {
+	f, p := s.newPacket(src, dst, protoICMPv6, size)
+	f.data[ethHeaderSize+7] = ndHopLimit
+	p[0] = typ
+	return f, p
+}
+
+// solicitedNode returns the solicited-node multicast address of a.
+func solicitedNode(a addr) addr {
+	return addr{0: 0xff, 1: 0x02, 11: 0x01, 12: 0xff, 13: a[13], 14: a[14], 15: a[15]}
+}
@@ -0,0 +1,223 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package netstack
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// IPv6 extension headers.
+	ipv6HopByHop = 0
+	ipv6DestOpts = 60
+
+	defaultHopLimit = 64
+)
+
+// inputIP processes a received IPv4 or IPv6 packet. If valid is set,
+// the checksums of the packet need not be verified.
+func (s *Stack) inputIP(p []byte, valid bool) {
+	if len(p) == 0 {
+		return
+	}
+	switch p[0] >> 4 {
+	case 4:
+		s.input4(p, valid)
+	case 6:
+		s.input6(p, valid)
+	}
+}
+
+func (s *Stack) input4(p []byte, valid bool) {
+	if len(p) < ipv4HeaderSize {
+		return
+	}
+	hlen := int(p[0]&0xf) * 4
+	total := int(binary.BigEndian.Uint16(p[2:]))
+	if hlen < ipv4HeaderSize || total < hlen || total > len(p) {
+		return
+	}
+	if !valid && fold(checksum(0, p[:hlen])) != 0xffff {
+		return
+	}
+	if binary.BigEndian.Uint16(p[6:])&0x3fff != 0 {
+		// Drop fragments.
+		return
+	}
+	src, dst := v4Addr(p[12:]), v4Addr(p[16:])
+	if !s.accept4(dst) {
+		return
+	}
+	s.deliver(p[9], src, dst, p[hlen:total], valid)
+}
+
+// accept4 reports whether the stack accepts IPv4 packets to dst.
+func (s *Stack) accept4(dst addr) bool {
+	switch {
+	case dst == v4Broadcast, s.isLocal(dst):
+		return true
+	case !s.v4.configured:
+		// Accept the unicast replies to DHCP requests.
+		return !dst.isMulticast()
+	default:
+		return dst == s.subnetBroadcast()
+	}
+}
+
+func (s *Stack) input6(p []byte, valid bool) {
+	if len(p) < ipv6HeaderSize {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(p[4:]))
+	if ipv6HeaderSize+n > len(p) {
+		return
+	}
+	var src, dst addr
+	copy(src[:], p[8:24])
+	copy(dst[:], p[24:40])
+	if !s.accept6(dst) {
+		return
+	}
+	hopLimit := p[7]
+	next := p[6]
+	payload := p[ipv6HeaderSize : ipv6HeaderSize+n]
+	// Skip option headers.
+	for next == ipv6HopByHop || next == ipv6DestOpts {
+		if len(payload) < 8 {
+			return
+		}
+		hlen := (int(payload[1]) + 1) * 8
+		if hlen > len(payload) {
+			return
+		}
+		next = payload[0]
+		payload = payload[hlen:]
+	}
+	if next == protoICMPv6 {
+		s.inputICMPv6(src, dst, hopLimit, payload, valid)
+		return
+	}
+	s.deliver(next, src, dst, payload, valid)
+}
+
+// accept6 reports whether the stack accepts IPv6 packets to dst.
+func (s *Stack) accept6(dst addr) bool {
+	if s.isLocal(dst) || dst == v6AllNodes {
+		return true
+	}
+	// The solicited-node multicast address of the link-local and
+	// global addresses, which share their interface identifier.
+	snm := solicitedNode(s.v6.linkLocal)
+	return dst == snm
+}
+
+// deliver passes a transport packet to its protocol.
+func (s *Stack) deliver(proto uint8, src, dst addr, p []byte, valid bool) {
+	switch proto {
+	case protoICMP:
+		if src.is4() {
+			s.inputICMPv4(src, dst, p, valid)
+		}
+	case protoTCP:
+		s.inputTCP(src, dst, p, valid)
+	case protoUDP:
+		s.inputUDP(src, dst, p, valid)
+	}
+}
+
+// newPacket returns a frame for an IP packet from src to dst with
+// size bytes of payload. The link addresses and the payload are left
+// for the caller to fill in.
+func (s *Stack) newPacket(src, dst addr, proto uint8, size int) (frame, []byte) {
+	if dst.is4() {
+		b := make([]byte, ethHeaderSize+ipv4HeaderSize+size)
+		h := b[ethHeaderSize:]
+		h[0] = 4<<4 | ipv4HeaderSize/4
+		binary.BigEndian.PutUint16(h[2:], uint16(ipv4HeaderSize+size))
+		s.ipID++
+		binary.BigEndian.PutUint16(h[4:], s.ipID)
+		// Don't fragment.
+		binary.BigEndian.PutUint16(h[6:], 0x4000)
+		h[8] = defaultHopLimit
+		h[9] = proto
+		copy(h[12:16], src[12:])
+		copy(h[16:20], dst[12:])
+		binary.BigEndian.PutUint16(h[10:], ^fold(checksum(0, h[:ipv4HeaderSize])))
+		return frame{data: b, csumStart: -1}, h[ipv4HeaderSize:]
+	}
+	b := make([]byte, ethHeaderSize+ipv6HeaderSize+size)
+	h := b[ethHeaderSize:]
+	h[0] = 6 << 4
+	binary.BigEndian.PutUint16(h[4:], uint16(size))
+	h[6] = proto
+	h[7] = defaultHopLimit
+	copy(h[8:24], src[:])
+	copy(h[24:40], dst[:])
+	return frame{data: b, csumStart: -1}, h[ipv6HeaderSize:]
+}
+
+// payloadSize returns the maximum payload size of packets to dst.
+func (s *Stack) payloadSize(dst addr) int {
+	if dst.is4() {
+		return s.mtuFor(dst) - ipv4HeaderSize
+	}
+	return s.mtuFor(dst) - ipv6HeaderSize
+}
+
+// prepareChecksum stores the pseudo-header checksum of the transport
+// packet p of f at the offset off of p, and arranges for the
+// checksum to be completed by the link or writeFrame.
+func prepareChecksum(f *frame, p []byte, src, dst addr, proto uint8, off int) {
+	binary.BigEndian.PutUint16(p[off:], fold(pseudoSum(src, dst, proto, len(p))))
+	f.csumStart = len(f.data) - len(p)
+	f.csumOffset = off
+}
+
+// finishChecksum completes the checksum at the offset off of p,
+// which contains the pseudo-header checksum.
+func finishChecksum(p []byte, off int) {
+	c := ^fold(checksum(0, p))
+	if c == 0 {
+		// Zero means no checksum for UDP.
+		c = 0xffff
+	}
+	binary.BigEndian.PutUint16(p[off:], c)
+}
+
+// validChecksum verifies the checksum of the transport packet p.
+func validChecksum(p []byte, src, dst addr, proto uint8) bool {
+	return fold(checksum(pseudoSum(src, dst, proto, len(p)), p)) == 0xffff
+}
+
+// pseudoSum returns the checksum of the IPv4 or IPv6 pseudo-header.
+func pseudoSum(src, dst addr, proto uint8, n int) uint32 {
+	var sum uint32
+	if src.is4() {
+		sum = checksum(sum, src[12:])
+		sum = checksum(sum, dst[12:])
+	} else {
+		sum = checksum(sum, src[:])
+		sum = checksum(sum, dst[:])
+	}
+	return sum + uint32(proto) + uint32(n)
+}
+
+// checksum adds the bytes of b to the Internet checksum sum.
+func checksum(sum uint32, b []byte) uint32 {
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	return sum
+}
+
+// fold folds the carries of sum.
+func fold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
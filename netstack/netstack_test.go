@@ -0,0 +1,442 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package netstack
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testLink is a Link that records the transmitted frames.
+type testLink struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+var (
+	testMAC  = [6]byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+	peerMAC  = [6]byte{0x52, 0x54, 0x00, 0x65, 0x43, 0x21}
+	testAddr = v4Addr([]byte{10, 0, 2, 15})
+	peerAddr = v4Addr([]byte{10, 0, 2, 2})
+)
+
+func (l *testLink) HardwareAddr() [6]byte { return testMAC }
+func (l *testLink) MTU() int              { return 1500 }
+func (l *testLink) ChecksumOffload() bool { return false }
+
+func (l *testLink) ReadFrame(p []byte) (int, bool, error) {
+	select {}
+}
+
+func (l *testLink) WriteFrame(p []byte, csumStart, csumOffset int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.frames = append(l.frames, append([]byte(nil), p...))
+	return nil
+}
+
+// sent returns and clears the transmitted frames.
+func (l *testLink) sent() [][]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := l.frames
+	l.frames = nil
+	return f
+}
+
+// newTestStack returns a stack configured with testAddr, and with
+// the link address of peerAddr resolved. Unlike New, it doesn't
+// start any goroutines.
+func newTestStack() (*Stack, *testLink) {
+	l := new(testLink)
+	s := &Stack{
+		link:       l,
+		mac:        l.HardwareAddr(),
+		mtu:        l.MTU(),
+		configured: make(chan struct{}),
+		loopWake:   make(chan struct{}, 1),
+		neighbors:  make(map[addr]*neighbor),
+		bound:      make(map[portKey][]*socket),
+		conns:      make(map[connKey]*socket),
+		rand:       rand.New(rand.NewSource(1)),
+	}
+	s.v4.configured = true
+	s.v4.addr = testAddr
+	s.v4.mask = v4Addr([]byte{255, 255, 255, 0})
+	s.neighbors[peerAddr] = &neighbor{mac: peerMAC, resolved: true}
+	return s, l
+}
+
+// tcpPacket builds a TCP segment with a valid checksum.
+func tcpPacket(src, dst endpoint, seq, ack uint32, flags uint8, data []byte) []byte {
+	p := make([]byte, tcpHeaderSize+len(data))
+	binary.BigEndian.PutUint16(p[0:], src.port)
+	binary.BigEndian.PutUint16(p[2:], dst.port)
+	binary.BigEndian.PutUint32(p[4:], seq)
+	binary.BigEndian.PutUint32(p[8:], ack)
+	p[12] = tcpHeaderSize / 4 << 4
+	p[13] = flags
+	binary.BigEndian.PutUint16(p[14:], 65535)
+	copy(p[tcpHeaderSize:], data)
+	sum := checksum(pseudoSum(src.addr, dst.addr, protoTCP, len(p)), p)
+	binary.BigEndian.PutUint16(p[16:], ^fold(sum))
+	return p
+}
+
+func TestTCPStates(t *testing.T) {
+	const (
+		connect = iota + 1
+		closeSock
+	)
+	type step struct {
+		// action is connect or closeSock, or 0 to send a segment
+		// with flags and data to the stack.
+		action int
+		flags  uint8
+		data   string
+		// oldAck acknowledges only the data acknowledged before,
+		// not everything sent.
+		oldAck bool
+		state  tcpState
+		// out are the flags of the segment sent in response, or
+		// 0 if none.
+		out uint8
+	}
+	tests := []struct {
+		name   string
+		listen bool
+		steps  []step
+		err    syscall.Errno
+	}{
+		{
+			name:   "passive open, passive close",
+			listen: true,
+			steps: []step{
+				{flags: tcpSYN, state: tcpSynReceived, out: tcpSYN | tcpACK},
+				{flags: tcpACK, state: tcpEstablished},
+				{flags: tcpFIN | tcpACK, state: tcpCloseWait, out: tcpACK},
+				{action: closeSock, state: tcpLastAck, out: tcpFIN | tcpACK},
+				{flags: tcpACK, state: tcpClosed},
+			},
+		},
+		{
+			name:   "close with unread data",
+			listen: true,
+			steps: []step{
+				{flags: tcpSYN, state: tcpSynReceived, out: tcpSYN | tcpACK},
+				{flags: tcpACK | tcpPSH, data: "data", state: tcpEstablished, out: tcpACK},
+				{action: closeSock, state: tcpClosed, out: tcpRST | tcpACK},
+			},
+		},
+		{
+			name: "active open, active close",
+			steps: []step{
+				{action: connect, state: tcpSynSent, out: tcpSYN},
+				{flags: tcpSYN | tcpACK, state: tcpEstablished, out: tcpACK},
+				{action: closeSock, state: tcpFinWait1, out: tcpFIN | tcpACK},
+				{flags: tcpACK, state: tcpFinWait2},
+				{flags: tcpFIN | tcpACK, state: tcpTimeWait, out: tcpACK},
+			},
+		},
+		{
+			name: "simultaneous close",
+			steps: []step{
+				{action: connect, state: tcpSynSent, out: tcpSYN},
+				{flags: tcpSYN | tcpACK, state: tcpEstablished, out: tcpACK},
+				{action: closeSock, state: tcpFinWait1, out: tcpFIN | tcpACK},
+				{flags: tcpFIN | tcpACK, oldAck: true, state: tcpClosing, out: tcpACK},
+				{flags: tcpACK, state: tcpTimeWait},
+			},
+		},
+		{
+			name: "simultaneous open",
+			steps: []step{
+				{action: connect, state: tcpSynSent, out: tcpSYN},
+				{flags: tcpSYN, state: tcpSynReceived, out: tcpSYN | tcpACK},
+				{flags: tcpACK, state: tcpEstablished},
+			},
+		},
+		{
+			name: "connection refused",
+			steps: []step{
+				{action: connect, state: tcpSynSent, out: tcpSYN},
+				{flags: tcpRST | tcpACK, state: tcpClosed},
+			},
+			err: syscall.ECONNREFUSED,
+		},
+		{
+			name: "connection reset",
+			steps: []step{
+				{action: connect, state: tcpSynSent, out: tcpSYN},
+				{flags: tcpSYN | tcpACK, state: tcpEstablished, out: tcpACK},
+				{flags: tcpRST, state: tcpClosed},
+			},
+			err: syscall.ECONNRESET,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, link := newTestStack()
+			local := endpoint{addr: testAddr, port: 80}
+			peer := endpoint{addr: peerAddr, port: 40000}
+			so, err := s.socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := so.Bind(&syscall.SockaddrInet4{Port: int(local.port), Addr: [4]byte{10, 0, 2, 15}}); err != nil {
+				t.Fatal(err)
+			}
+			if test.listen {
+				if err := so.Listen(1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// conn is the connection socket and peerSeq the next
+			// sequence number of the peer.
+			var conn *socket
+			if !test.listen {
+				conn = so
+			}
+			peerSeq := uint32(1000)
+			for i, st := range test.steps {
+				switch st.action {
+				case connect:
+					err := conn.Connect(&syscall.SockaddrInet4{Port: int(peer.port), Addr: [4]byte{10, 0, 2, 2}})
+					if err != syscall.EINPROGRESS {
+						t.Fatalf("step %d: Connect returned %v", i, err)
+					}
+				case closeSock:
+					if err := conn.Close(); err != nil {
+						t.Fatalf("step %d: Close: %v", i, err)
+					}
+				default:
+					var ack uint32
+					s.mu.Lock()
+					if conn != nil {
+						ack = conn.tcp.sndNxt
+						if st.oldAck {
+							ack = conn.tcp.sndUna
+						}
+					}
+					flags := st.flags
+					if flags&tcpACK == 0 {
+						ack = 0
+					}
+					p := tcpPacket(peer, local, peerSeq, ack, flags, []byte(st.data))
+					s.inputTCP(peerAddr, testAddr, p, false)
+					if conn == nil {
+						conn = s.conns[connKey{local, peer}]
+					}
+					s.mu.Unlock()
+					peerSeq += uint32(len(st.data))
+					if flags&(tcpSYN|tcpFIN) != 0 {
+						peerSeq++
+					}
+				}
+				if conn == nil {
+					t.Fatalf("step %d: no connection", i)
+				}
+				s.mu.Lock()
+				state := conn.tcp.state
+				s.mu.Unlock()
+				if state != st.state {
+					t.Errorf("step %d: state %d, want %d", i, state, st.state)
+				}
+				frames := link.sent()
+				var out uint8
+				if len(frames) > 0 {
+					f := frames[len(frames)-1]
+					p := f[ethHeaderSize+ipv4HeaderSize:]
+					if !validChecksum(p, testAddr, peerAddr, protoTCP) {
+						t.Errorf("step %d: invalid checksum of sent segment", i)
+					}
+					out = p[13]
+				}
+				if out != st.out {
+					t.Errorf("step %d: sent flags %#x, want %#x", i, out, st.out)
+				}
+			}
+			if conn.err != test.err {
+				t.Errorf("socket error %v, want %v", conn.err, test.err)
+			}
+		})
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want uint16
+	}{
+		{"empty", nil, 0},
+		// The example from RFC 1071, section 3.
+		{"RFC 1071", []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0xddf2},
+		{"odd length", []byte{0x01, 0x02, 0x03}, 0x0402},
+		{"carries", []byte{0xff, 0xff, 0xff, 0xff, 0x00, 0x01}, 0x0001},
+		// An IPv4 header with its checksum field.
+		{"valid IPv4 header", []byte{
+			0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11,
+			0xb8, 0x61, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7,
+		}, 0xffff},
+		{"IPv4 header without checksum", []byte{
+			0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11,
+			0x00, 0x00, 0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7,
+		}, ^uint16(0xb861)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := fold(checksum(0, test.data)); got != test.want {
+				t.Errorf("checksum %#04x, want %#04x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTransportChecksum(t *testing.T) {
+	v6Src := addr{0: 0xfe, 1: 0x80, 15: 1}
+	v6Dst := addr{0: 0xfe, 1: 0x80, 15: 2}
+	tests := []struct {
+		name     string
+		src, dst addr
+		proto    uint8
+		size     int
+	}{
+		{"TCP over IPv4", testAddr, peerAddr, protoTCP, 100},
+		{"UDP over IPv4, odd length", testAddr, peerAddr, protoUDP, 33},
+		{"TCP over IPv6", v6Src, v6Dst, protoTCP, 64},
+		{"UDP over IPv6, odd length", v6Src, v6Dst, protoUDP, 9},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _ := newTestStack()
+			f, p := s.newPacket(test.src, test.dst, test.proto, test.size)
+			for i := range p {
+				p[i] = byte(i*31 + 7)
+			}
+			off := 16
+			if test.proto == protoUDP {
+				off = 6
+			}
+			prepareChecksum(&f, p, test.src, test.dst, test.proto, off)
+			finishChecksum(f.data[f.csumStart:], f.csumOffset)
+			if !validChecksum(p, test.src, test.dst, test.proto) {
+				t.Fatal("completed checksum is not valid")
+			}
+			p[len(p)-1] ^= 0x40
+			if validChecksum(p, test.src, test.dst, test.proto) {
+				t.Error("checksum of corrupted packet is valid")
+			}
+		})
+	}
+}
+
+// dhcpReply builds a DHCP reply to the client with the options.
+func dhcpReply(xid uint32, mac [6]byte, opts ...byte) []byte {
+	b := make([]byte, dhcpHeaderSize)
+	b[0] = 2 // BOOTREPLY.
+	b[1] = 1
+	b[2] = 6
+	binary.BigEndian.PutUint32(b[4:], xid)
+	copy(b[16:20], []byte{10, 0, 2, 15})
+	copy(b[20:24], []byte{10, 0, 2, 2})
+	copy(b[28:34], mac[:])
+	binary.BigEndian.PutUint32(b[236:], dhcpMagic)
+	return append(b, opts...)
+}
+
+func TestDHCPParse(t *testing.T) {
+	const xid = 0x12345678
+	fullOpts := []byte{
+		dhcpOptMsgType, 1, dhcpAck,
+		dhcpOptPad,
+		dhcpOptSubnetMask, 4, 255, 255, 0, 0,
+		dhcpOptRouter, 8, 10, 0, 2, 1, 10, 0, 2, 254,
+		dhcpOptDNS, 8, 8, 8, 8, 8, 1, 1, 1, 1,
+		dhcpOptServerID, 4, 10, 0, 2, 3,
+		dhcpOptLeaseTime, 4, 0, 0, 0x0e, 0x10,
+		dhcpOptEnd,
+	}
+	full := &dhcpLease{
+		typ:    dhcpAck,
+		addr:   v4Addr([]byte{10, 0, 2, 15}),
+		mask:   v4Addr([]byte{255, 255, 0, 0}),
+		router: v4Addr([]byte{10, 0, 2, 1}),
+		dns:    []addr{v4Addr([]byte{8, 8, 8, 8}), v4Addr([]byte{1, 1, 1, 1})},
+		server: v4Addr([]byte{10, 0, 2, 3}),
+		lease:  time.Hour,
+		t1:     time.Hour / 2,
+		t2:     time.Hour * 7 / 8,
+	}
+	withTimes := *full
+	withTimes.t1, withTimes.t2 = 1000*time.Second, 2000*time.Second
+	reply := func(opts ...byte) []byte {
+		return dhcpReply(xid, testMAC, opts...)
+	}
+	corrupt := func(off int, v byte) []byte {
+		b := reply(fullOpts...)
+		b[off] = v
+		return b
+	}
+	tests := []struct {
+		name string
+		pkt  []byte
+		want *dhcpLease
+	}{
+		{"full", reply(fullOpts...), full},
+		{"renewal times", reply(append(fullOpts[:len(fullOpts)-1],
+			dhcpOptRenewal, 4, 0, 0, 0x03, 0xe8,
+			dhcpOptRebinding, 4, 0, 0, 0x07, 0xd0,
+			dhcpOptEnd)...), &withTimes},
+		{"rebinding before renewal", reply(append(fullOpts[:len(fullOpts)-1],
+			dhcpOptRenewal, 4, 0, 0, 0x07, 0xd0,
+			dhcpOptRebinding, 4, 0, 0, 0x03, 0xe8,
+			dhcpOptEnd)...), &dhcpLease{
+			typ: full.typ, addr: full.addr, mask: full.mask, router: full.router,
+			dns: full.dns, server: full.server, lease: full.lease,
+			t1: 2000 * time.Second, t2: time.Hour * 7 / 8,
+		}},
+		{"defaults", reply(dhcpOptMsgType, 1, dhcpOffer), &dhcpLease{
+			typ:    dhcpOffer,
+			addr:   v4Addr([]byte{10, 0, 2, 15}),
+			mask:   v4Addr([]byte{255, 255, 255, 0}),
+			router: v4Any,
+			server: v4Addr([]byte{10, 0, 2, 2}),
+			lease:  defaultLease,
+			t1:     defaultLease / 2,
+			t2:     defaultLease * 7 / 8,
+		}},
+		{"no end option", reply(dhcpOptMsgType, 1, dhcpNak), &dhcpLease{
+			typ:    dhcpNak,
+			addr:   v4Addr([]byte{10, 0, 2, 15}),
+			mask:   v4Addr([]byte{255, 255, 255, 0}),
+			router: v4Any,
+			server: v4Addr([]byte{10, 0, 2, 2}),
+			lease:  defaultLease,
+			t1:     defaultLease / 2,
+			t2:     defaultLease * 7 / 8,
+		}},
+		{"truncated option", reply(dhcpOptMsgType, 1, dhcpAck, dhcpOptDNS, 8, 8, 8, 8, 8), nil},
+		{"missing option length", reply(dhcpOptMsgType), nil},
+		{"short", reply(fullOpts...)[:dhcpHeaderSize-1], nil},
+		{"request", corrupt(0, 1), nil},
+		{"other transaction", corrupt(4, 0xff), nil},
+		{"other client", corrupt(33, 0xff), nil},
+		{"bad magic", corrupt(236, 0), nil},
+	}
+	s, _ := newTestStack()
+	d := &dhcpClient{s: s, xid: xid}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := d.parse(test.pkt)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parse = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
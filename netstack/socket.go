@@ -0,0 +1,552 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package netstack
+
+import (
+	"syscall"
+
+	"eliasnaur.com/unik/kernel"
+)
+
+// socket is a UDP or TCP socket. Its fields are protected by the
+// stack lock.
+type socket struct {
+	stack  *Stack
+	family int
+	typ    int
+	proto  uint8
+
+	local, remote endpoint
+	// bound is set when the socket has a local port.
+	bound bool
+	// connected is set when the socket has a remote endpoint.
+	connected bool
+	// closed is set when the program has closed the socket.
+	closed bool
+
+	v6only    bool
+	reuseAddr bool
+	broadcast bool
+	noDelay   bool
+	keepalive bool
+	keepIdle  int
+	keepIntvl int
+	keepCnt   int
+
+	// err is the pending error reported by SO_ERROR.
+	err syscall.Errno
+
+	notify func(events uint32)
+	// events are the readiness events last reported to notify.
+	events uint32
+
+	// UDP state.
+	dgrams    []datagram
+	dgramSize int
+
+	// TCP state.
+	tcp tcb
+	// listening is set for listening TCP sockets.
+	listening bool
+	backlog   int
+	// embryos is the number of connections in the SYN_RECEIVED
+	// state.
+	embryos int
+	// acceptq are the established connections waiting for Accept.
+	acceptq []*socket
+	// parent is the listener of a connection not yet accepted.
+	parent *socket
+}
+
+const (
+	ephemeralFirst = 49152
+	ephemeralCount = 65536 - ephemeralFirst
+
+	// The values reported for SO_RCVBUF and SO_SNDBUF.
+	rcvBufSize = maxRcvBuf
+	sndBufSize = maxSndBuf
+
+	defaultKeepIdle  = 7200
+	defaultKeepIntvl = 75
+	defaultKeepCnt   = 9
+)
+
+func (s *Stack) socket(domain, typ, proto int) (*socket, error) {
+	so := &socket{
+		stack:     s,
+		family:    domain,
+		typ:       typ,
+		keepIdle:  defaultKeepIdle,
+		keepIntvl: defaultKeepIntvl,
+		keepCnt:   defaultKeepCnt,
+	}
+	switch domain {
+	case syscall.AF_INET:
+		so.local.addr = v4Any
+	case syscall.AF_INET6:
+	default:
+		return nil, syscall.EAFNOSUPPORT
+	}
+	switch {
+	case typ == syscall.SOCK_STREAM && (proto == 0 || proto == syscall.IPPROTO_TCP):
+		so.proto = protoTCP
+	case typ == syscall.SOCK_DGRAM && (proto == 0 || proto == syscall.IPPROTO_UDP):
+		so.proto = protoUDP
+	default:
+		return nil, syscall.EPROTONOSUPPORT
+	}
+	return so, nil
+}
+
+func (so *socket) Bind(sa syscall.Sockaddr) error {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if so.bound || so.closed {
+		return syscall.EINVAL
+	}
+	ep, err := so.endpoint(sa)
+	if err != nil {
+		return err
+	}
+	if !ep.addr.isUnspecified() && !s.isLocal(ep.addr) {
+		return syscall.EADDRNOTAVAIL
+	}
+	return so.bind(ep)
+}
+
+func (so *socket) Connect(sa syscall.Sockaddr) error {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if so.closed {
+		return syscall.EBADF
+	}
+	ep, err := so.endpoint(sa)
+	if err != nil {
+		return err
+	}
+	if ep.addr.isUnspecified() {
+		// Connecting to the wildcard address means the local host.
+		if ep.addr.is4() {
+			ep.addr = v4LoopbackAddr
+		} else {
+			ep.addr = v6Loopback
+		}
+	}
+	if so.proto == protoUDP {
+		return so.connectUDP(ep)
+	}
+	return so.connectTCP(ep)
+}
+
+func (so *socket) Listen(backlog int) error {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if so.proto != protoTCP {
+		return syscall.EOPNOTSUPP
+	}
+	return so.listen(backlog)
+}
+
+func (so *socket) Accept() (kernel.Socket, syscall.Sockaddr, error) {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if so.proto != protoTCP {
+		return nil, nil, syscall.EOPNOTSUPP
+	}
+	c, err := so.accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, c.sockaddr(c.remote), nil
+}
+
+func (so *socket) Recvfrom(p []byte, flags int) (int, syscall.Sockaddr, error) {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	var from endpoint
+	var err error
+	if so.proto == protoUDP {
+		n, from, err = so.recvUDP(p, flags)
+	} else {
+		n, err = so.recvTCP(p, flags)
+		from = so.remote
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, so.sockaddr(from), nil
+}
+
+func (so *socket) Sendto(p []byte, flags int, to syscall.Sockaddr) (int, error) {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if so.proto == protoTCP {
+		if to != nil && !so.connected {
+			// TCP Fast Open is not supported.
+			return 0, syscall.EOPNOTSUPP
+		}
+		return so.sendTCP(p)
+	}
+	var dst endpoint
+	switch {
+	case to != nil:
+		ep, err := so.endpoint(to)
+		if err != nil {
+			return 0, err
+		}
+		dst = ep
+	case so.connected:
+		dst = so.remote
+	default:
+		return 0, syscall.EDESTADDRREQ
+	}
+	return so.sendUDP(p, dst)
+}
+
+func (so *socket) Shutdown(how int) error {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch how {
+	case syscall.SHUT_RD, syscall.SHUT_WR, syscall.SHUT_RDWR:
+	default:
+		return syscall.EINVAL
+	}
+	if !so.connected {
+		return syscall.ENOTCONN
+	}
+	if so.proto == protoTCP {
+		so.shutdownTCP(how)
+	}
+	return nil
+}
+
+func (so *socket) Getsockname() (syscall.Sockaddr, error) {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return so.sockaddr(so.local), nil
+}
+
+func (so *socket) Getpeername() (syscall.Sockaddr, error) {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !so.connected || so.proto == protoTCP && so.tcp.state == tcpSynSent {
+		return nil, syscall.ENOTCONN
+	}
+	return so.sockaddr(so.remote), nil
+}
+
+func (so *socket) SetsockoptInt(level, opt, value int) error {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	on := value != 0
+	switch level {
+	case syscall.SOL_SOCKET:
+		switch opt {
+		case syscall.SO_REUSEADDR:
+			so.reuseAddr = on
+		case syscall.SO_BROADCAST:
+			so.broadcast = on
+		case syscall.SO_KEEPALIVE:
+			so.keepalive = on
+		case syscall.SO_RCVBUF, syscall.SO_SNDBUF, syscall.SO_LINGER:
+			// The buffer sizes are fixed and closing never blocks.
+		default:
+			return syscall.ENOPROTOOPT
+		}
+	case syscall.IPPROTO_TCP:
+		if so.proto != protoTCP {
+			return syscall.ENOPROTOOPT
+		}
+		switch opt {
+		case syscall.TCP_NODELAY:
+			so.noDelay = on
+			so.output()
+		case syscall.TCP_KEEPIDLE, syscall.TCP_KEEPINTVL, syscall.TCP_KEEPCNT:
+			if value < 1 {
+				return syscall.EINVAL
+			}
+			switch opt {
+			case syscall.TCP_KEEPIDLE:
+				so.keepIdle = value
+			case syscall.TCP_KEEPINTVL:
+				so.keepIntvl = value
+			default:
+				so.keepCnt = value
+			}
+		default:
+			return syscall.ENOPROTOOPT
+		}
+	case syscall.IPPROTO_IPV6:
+		if so.family != syscall.AF_INET6 || opt != syscall.IPV6_V6ONLY {
+			return syscall.ENOPROTOOPT
+		}
+		if so.bound {
+			return syscall.EINVAL
+		}
+		so.v6only = on
+	default:
+		return syscall.ENOPROTOOPT
+	}
+	return nil
+}
+
+func (so *socket) GetsockoptInt(level, opt int) (int, error) {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch level {
+	case syscall.SOL_SOCKET:
+		switch opt {
+		case syscall.SO_ERROR:
+			err := so.err
+			so.err = 0
+			so.update()
+			return int(err), nil
+		case syscall.SO_TYPE:
+			return so.typ, nil
+		case syscall.SO_ACCEPTCONN:
+			return boolInt(so.listening), nil
+		case syscall.SO_REUSEADDR:
+			return boolInt(so.reuseAddr), nil
+		case syscall.SO_BROADCAST:
+			return boolInt(so.broadcast), nil
+		case syscall.SO_KEEPALIVE:
+			return boolInt(so.keepalive), nil
+		case syscall.SO_RCVBUF:
+			return rcvBufSize, nil
+		case syscall.SO_SNDBUF:
+			return sndBufSize, nil
+		}
+	case syscall.IPPROTO_TCP:
+		if so.proto != protoTCP {
+			break
+		}
+		switch opt {
+		case syscall.TCP_NODELAY:
+			return boolInt(so.noDelay), nil
+		case syscall.TCP_KEEPIDLE:
+			return so.keepIdle, nil
+		case syscall.TCP_KEEPINTVL:
+			return so.keepIntvl, nil
+		case syscall.TCP_KEEPCNT:
+			return so.keepCnt, nil
+		}
+	case syscall.IPPROTO_IPV6:
+		if so.family == syscall.AF_INET6 && opt == syscall.IPV6_V6ONLY {
+			return boolInt(so.v6only), nil
+		}
+	}
+	return 0, syscall.ENOPROTOOPT
+}
+
+func (so *socket) Notify(ready func(events uint32)) {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	so.notify = ready
+	so.events = so.readiness()
+	ready(so.events)
+}
+
+func (so *socket) Close() error {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if so.closed {
+		return syscall.EBADF
+	}
+	so.closed = true
+	so.notify = nil
+	if so.proto == protoTCP && so.closeTCP() {
+		// The connection lingers until it is closed gracefully.
+		return nil
+	}
+	so.unbind()
+	return nil
+}
+
+// update reports changes of the readiness events.
+func (so *socket) update() {
+	ev := so.readiness()
+	if ev == so.events {
+		return
+	}
+	so.events = ev
+	if so.notify != nil {
+		so.notify(ev)
+	}
+}
+
+func (so *socket) readiness() uint32 {
+	if so.proto == protoUDP {
+		ev := uint32(syscall.EPOLLOUT)
+		if len(so.dgrams) > 0 {
+			ev |= syscall.EPOLLIN
+		}
+		if so.err != 0 {
+			ev |= syscall.EPOLLERR
+		}
+		return ev
+	}
+	return so.readinessTCP()
+}
+
+// endpoint converts a socket address to an endpoint.
+func (so *socket) endpoint(sa syscall.Sockaddr) (endpoint, error) {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		if so.family != syscall.AF_INET {
+			return endpoint{}, syscall.EAFNOSUPPORT
+		}
+		return endpoint{addr: v4Addr(sa.Addr[:]), port: uint16(sa.Port)}, nil
+	case *syscall.SockaddrInet6:
+		if so.family != syscall.AF_INET6 {
+			return endpoint{}, syscall.EAFNOSUPPORT
+		}
+		a := addr(sa.Addr)
+		if a.is4() && so.v6only {
+			return endpoint{}, syscall.EINVAL
+		}
+		return endpoint{addr: a, port: uint16(sa.Port)}, nil
+	default:
+		return endpoint{}, syscall.EAFNOSUPPORT
+	}
+}
+
+// sockaddr converts an endpoint to a socket address of the socket
+// family. IPv4 endpoints of IPv6 sockets are IPv4-mapped.
+func (so *socket) sockaddr(ep endpoint) syscall.Sockaddr {
+	if so.family == syscall.AF_INET {
+		sa := &syscall.SockaddrInet4{Port: int(ep.port)}
+		copy(sa.Addr[:], ep.addr[12:])
+		return sa
+	}
+	a := ep.addr
+	if a == v4Any {
+		a = addr{}
+	}
+	return &syscall.SockaddrInet6{Port: int(ep.port), Addr: a}
+}
+
+// bind binds the socket to the local endpoint ep, choosing an
+// ephemeral port if its port is zero.
+func (so *socket) bind(ep endpoint) error {
+	s := so.stack
+	old := so.local
+	so.local = ep
+	if ep.port == 0 {
+		start := s.rand.Intn(ephemeralCount)
+		for i := 0; i < ephemeralCount; i++ {
+			so.local.port = uint16(ephemeralFirst + (start+i)%ephemeralCount)
+			if s.bindable(so) {
+				so.addBinding()
+				return nil
+			}
+		}
+		so.local = old
+		return syscall.EADDRINUSE
+	}
+	if !s.bindable(so) {
+		so.local = old
+		return syscall.EADDRINUSE
+	}
+	so.addBinding()
+	return nil
+}
+
+func (so *socket) addBinding() {
+	k := portKey{so.proto, so.local.port}
+	so.stack.bound[k] = append(so.stack.bound[k], so)
+	so.bound = true
+}
+
+// unbind releases the local port of the socket.
+func (so *socket) unbind() {
+	s := so.stack
+	k := portKey{so.proto, so.local.port}
+	socks := s.bound[k]
+	for i, o := range socks {
+		if o == so {
+			socks = append(socks[:i], socks[i+1:]...)
+			break
+		}
+	}
+	if len(socks) == 0 {
+		delete(s.bound, k)
+	} else {
+		s.bound[k] = socks
+	}
+}
+
+// bindable reports whether the local endpoint of so is free.
+func (s *Stack) bindable(so *socket) bool {
+	for _, o := range s.bound[portKey{so.proto, so.local.port}] {
+		if o == so || !so.covers(o.local.addr) && !o.covers(so.local.addr) {
+			continue
+		}
+		if so.proto == protoTCP && so.reuseAddr && o.reuseAddr && !so.listening && !o.listening {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// lookup returns the socket that best matches a packet to local from
+// remote. For TCP, only listening sockets are considered.
+func (s *Stack) lookup(proto uint8, local, remote endpoint) *socket {
+	var best *socket
+	bestScore := 0
+	for _, so := range s.bound[portKey{proto, local.port}] {
+		if so.closed || !so.covers(local.addr) {
+			continue
+		}
+		if proto == protoTCP && !so.listening {
+			continue
+		}
+		score := 1
+		if so.local.addr == local.addr {
+			score = 2
+		}
+		if so.connected {
+			if so.remote != remote {
+				continue
+			}
+			score = 3
+		}
+		if score > bestScore {
+			best, bestScore = so, score
+		}
+	}
+	return best
+}
+
+// covers reports whether the local address of the socket matches a.
+func (so *socket) covers(a addr) bool {
+	switch l := so.local.addr; l {
+	case addr{}:
+		return !a.is4() || !so.v6only
+	case v4Any:
+		return a.is4()
+	default:
+		return l == a
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
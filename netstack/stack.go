@@ -0,0 +1,583 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+// Package netstack implements a TCP/IP stack for Ethernet links. It
+// supports ARP, IPv4, IPv6 with stateless address autoconfiguration,
+// ICMP echo, UDP and TCP, and configures IPv4 through DHCP. The
+// sockets of a Stack are served to the program through
+// kernel.ServeNetwork.
+//
+// Fragmented IP packets and IP options are not supported.
+package netstack
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"eliasnaur.com/unik/kernel"
+)
+
+// Link is an Ethernet network interface, such as a virtio network
+// device.
+type Link interface {
+	HardwareAddr() [6]byte
+	// MTU returns the maximum payload size of frames.
+	MTU() int
+	// ChecksumOffload reports whether WriteFrame can complete
+	// checksums.
+	ChecksumOffload() bool
+	// ReadFrame blocks until a frame is received and returns its
+	// length along with whether its checksums are already
+	// validated.
+	ReadFrame(p []byte) (int, bool, error)
+	// WriteFrame transmits a frame. If csumStart is not negative,
+	// the checksum of the bytes from csumStart to the end of the
+	// frame is stored at csumStart+csumOffset. The checksum field
+	// contains the checksum of the pseudo-header.
+	WriteFrame(p []byte, csumStart, csumOffset int) error
+}
+
+// linkStatus is implemented by links that report their status.
+type linkStatus interface {
+	LinkUp() bool
+	LinkChanged() <-chan struct{}
+}
+
+// Stack is a TCP/IP stack for a single link.
+type Stack struct {
+	link    Link
+	mac     [6]byte
+	mtu     int
+	offload bool
+
+	// configured is closed when IPv4 is configured.
+	configured     chan struct{}
+	configuredOnce sync.Once
+	// loopWake is signalled when loop is not empty.
+	loopWake chan struct{}
+
+	// mu protects the fields below along with the state of every
+	// socket.
+	mu sync.Mutex
+	v4 struct {
+		configured bool
+		addr       addr
+		mask       addr
+		router     addr
+	}
+	v6 struct {
+		linkLocal addr
+		// global is the autoconfigured global address, if any.
+		global addr
+		prefix addr
+		// prefixLen is the length of prefix, or 0 if there is no
+		// global address.
+		prefixLen int
+		router    addr
+	}
+	dns4, dns6 []addr
+	neighbors  map[addr]*neighbor
+	// bound are the sockets bound to a port.
+	bound map[portKey][]*socket
+	// conns are the TCP connections by their endpoints.
+	conns map[connKey]*socket
+	// loop are the packets sent to local addresses.
+	loop [][]byte
+	ipID uint16
+	rand *rand.Rand
+}
+
+// addr is an IPv6 address or an IPv4-mapped IPv6 address.
+type addr [16]byte
+
+type endpoint struct {
+	addr addr
+	port uint16
+}
+
+type portKey struct {
+	proto uint8
+	port  uint16
+}
+
+type connKey struct {
+	local, remote endpoint
+}
+
+// neighbor is an entry of the ARP and neighbor discovery cache.
+type neighbor struct {
+	mac      [6]byte
+	resolved bool
+	// tries is the number of resolution requests sent.
+	tries int
+	// pending are the frames waiting for the resolution.
+	pending []frame
+}
+
+// frame is an outgoing Ethernet frame with its checksum offload
+// parameters.
+type frame struct {
+	data                  []byte
+	csumStart, csumOffset int
+}
+
+const (
+	ethHeaderSize  = 14
+	ipv4HeaderSize = 20
+	ipv6HeaderSize = 40
+
+	etherTypeIPv4 = 0x0800
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+
+	protoICMP   = 1
+	protoTCP    = 6
+	protoUDP    = 17
+	protoICMPv6 = 58
+
+	// loopbackMTU is the MTU of packets to local addresses.
+	loopbackMTU = 65535
+	// maxPending is the maximum number of frames waiting for
+	// address resolution per neighbor.
+	maxPending = 16
+	// resolveTries is the number of address resolution requests
+	// before giving up.
+	resolveTries   = 3
+	resolveTimeout = time.Second
+)
+
+var (
+	broadcastMAC = [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	v4InV6Prefix   = addr{10: 0xff, 11: 0xff}
+	v4Any          = v4InV6Prefix
+	v4Broadcast    = addr{10: 0xff, 11: 0xff, 12: 0xff, 13: 0xff, 14: 0xff, 15: 0xff}
+	v6Loopback     = addr{15: 1}
+	v6AllNodes     = addr{0: 0xff, 1: 0x02, 15: 1}
+	v6AllRouters   = addr{0: 0xff, 1: 0x02, 15: 2}
+	v4LoopbackAddr = addr{10: 0xff, 11: 0xff, 12: 127, 15: 1}
+	errNoRoute     = syscall.ENETUNREACH
+)
+
+// New creates a stack for link and starts it. IPv4 is configured in
+// the background; use Configured to wait for it.
+func New(link Link) (*Stack, error) {
+	s := &Stack{
+		link:       link,
+		mac:        link.HardwareAddr(),
+		mtu:        link.MTU(),
+		offload:    link.ChecksumOffload(),
+		configured: make(chan struct{}),
+		loopWake:   make(chan struct{}, 1),
+		neighbors:  make(map[addr]*neighbor),
+		bound:      make(map[portKey][]*socket),
+		conns:      make(map[connKey]*socket),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	if s.mtu < 1280 {
+		return nil, errors.New("netstack: link MTU too small")
+	}
+	s.v6.linkLocal = s.interfaceAddr(addr{0: 0xfe, 1: 0x80})
+	s.ipID = uint16(s.rand.Uint32())
+	go s.receive()
+	go s.loopback()
+	go s.solicitRouters()
+	d, err := newDHCPClient(s)
+	if err != nil {
+		return nil, err
+	}
+	go d.run()
+	return s, nil
+}
+
+// Configured returns a channel that is closed when the stack has
+// received an IPv4 address.
+func (s *Stack) Configured() <-chan struct{} {
+	return s.configured
+}
+
+// Addrs returns the IP addresses of the link.
+func (s *Stack) Addrs() []net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []net.IP
+	if s.v4.configured {
+		addrs = append(addrs, s.v4.addr.ip())
+	}
+	addrs = append(addrs, s.v6.linkLocal.ip())
+	if s.v6.prefixLen > 0 {
+		addrs = append(addrs, s.v6.global.ip())
+	}
+	return addrs
+}
+
+// DNS returns the addresses of the name servers announced by DHCP
+// and router advertisements.
+func (s *Stack) DNS() []net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var servers []net.IP
+	for _, a := range s.dns4 {
+		servers = append(servers, a.ip())
+	}
+	for _, a := range s.dns6 {
+		servers = append(servers, a.ip())
+	}
+	return servers
+}
+
+// Socket implements kernel.Network.
+func (s *Stack) Socket(domain, typ, proto int) (kernel.Socket, error) {
+	so, err := s.socket(domain, typ, proto)
+	if err != nil {
+		return nil, err
+	}
+	return so, nil
+}
+
+func (s *Stack) randUint32() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rand.Uint32()
+}
+
+// interfaceAddr returns the address with the 64 bit prefix and the
+// interface identifier derived from the link address.
+func (s *Stack) interfaceAddr(prefix addr) addr {
+	a := prefix
+	a[8] = s.mac[0] ^ 0x02
+	a[9] = s.mac[1]
+	a[10] = s.mac[2]
+	a[11] = 0xff
+	a[12] = 0xfe
+	a[13] = s.mac[3]
+	a[14] = s.mac[4]
+	a[15] = s.mac[5]
+	return a
+}
+
+func (s *Stack) receive() {
+	buf := make([]byte, ethHeaderSize+s.mtu)
+	for {
+		n, valid, err := s.link.ReadFrame(buf)
+		if err != nil {
+			// The device is broken.
+			return
+		}
+		s.mu.Lock()
+		s.input(buf[:n], valid)
+		s.mu.Unlock()
+	}
+}
+
+// loopback delivers the packets sent to local addresses.
+func (s *Stack) loopback() {
+	for range s.loopWake {
+		// Packets sent while processing the batch signal loopWake
+		// again.
+		s.mu.Lock()
+		pkts := s.loop
+		s.loop = nil
+		for _, p := range pkts {
+			s.inputIP(p, true)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// input processes a received Ethernet frame.
+func (s *Stack) input(f []byte, valid bool) {
+	if len(f) < ethHeaderSize {
+		return
+	}
+	var dst [6]byte
+	copy(dst[:], f)
+	if dst != s.mac && dst[0]&1 == 0 {
+		// Not for us, nor a multicast or broadcast frame.
+		return
+	}
+	typ := binary.BigEndian.Uint16(f[12:])
+	p := f[ethHeaderSize:]
+	switch typ {
+	case etherTypeARP:
+		s.inputARP(p)
+	case etherTypeIPv4, etherTypeIPv6:
+		s.inputIP(p, valid)
+	}
+}
+
+// transmit sends the IP packet in f, which has room for the Ethernet
+// header, to dst.
+func (s *Stack) transmit(dst addr, f frame) {
+	if s.isLocal(dst) {
+		// Checksums are not needed for local packets.
+		s.loop = append(s.loop, f.data[ethHeaderSize:])
+		select {
+		case s.loopWake <- struct{}{}:
+		default:
+		}
+		return
+	}
+	if dst.is4() {
+		binary.BigEndian.PutUint16(f.data[12:], etherTypeIPv4)
+	} else {
+		binary.BigEndian.PutUint16(f.data[12:], etherTypeIPv6)
+	}
+	switch {
+	case dst == v4Broadcast || s.v4.configured && dst.is4() && dst == s.subnetBroadcast():
+		s.writeFrame(broadcastMAC, f)
+		return
+	case dst.isMulticast():
+		if dst.is4() {
+			// IPv4 multicast is not supported.
+			return
+		}
+		mac := [6]byte{0x33, 0x33, dst[12], dst[13], dst[14], dst[15]}
+		s.writeFrame(mac, f)
+		return
+	}
+	next, ok := s.nextHop(dst)
+	if !ok {
+		return
+	}
+	n := s.neighbors[next]
+	if n == nil {
+		n = new(neighbor)
+		s.neighbors[next] = n
+	}
+	if n.resolved {
+		s.writeFrame(n.mac, f)
+		return
+	}
+	if len(n.pending) < maxPending {
+		n.pending = append(n.pending, f)
+	}
+	if n.tries == 0 {
+		s.resolve(next, n)
+	}
+}
+
+// resolve sends an address resolution request for the neighbor a.
+func (s *Stack) resolve(a addr, n *neighbor) {
+	n.tries++
+	if a.is4() {
+		s.sendARP(arpRequest, broadcastMAC, [6]byte{}, a)
+	} else {
+		s.sendNeighborSolicit(a)
+	}
+	time.AfterFunc(resolveTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.neighbors[a] != n || n.resolved {
+			return
+		}
+		if n.tries < resolveTries {
+			s.resolve(a, n)
+			return
+		}
+		// Give up and drop the pending frames.
+		delete(s.neighbors, a)
+	})
+}
+
+// learn records the link address of a neighbor. If create is false,
+// only existing entries are updated.
+func (s *Stack) learn(a addr, mac [6]byte, create bool) {
+	n := s.neighbors[a]
+	if n == nil {
+		if !create {
+			return
+		}
+		n = new(neighbor)
+		s.neighbors[a] = n
+	}
+	n.mac = mac
+	n.resolved = true
+	n.tries = 0
+	pending := n.pending
+	n.pending = nil
+	for _, f := range pending {
+		s.writeFrame(mac, f)
+	}
+}
+
+// writeFrame fills in the Ethernet addresses of f and transmits it.
+func (s *Stack) writeFrame(dst [6]byte, f frame) {
+	copy(f.data[0:6], dst[:])
+	copy(f.data[6:12], s.mac[:])
+	if f.csumStart >= 0 && !s.offload {
+		finishChecksum(f.data[f.csumStart:], f.csumOffset)
+		f.csumStart = -1
+	}
+	if f.csumStart < 0 {
+		f.csumOffset = 0
+	}
+	// Transmission errors are like lost packets.
+	s.link.WriteFrame(f.data, f.csumStart, f.csumOffset)
+}
+
+// nextHop returns the neighbor to send packets for dst through.
+func (s *Stack) nextHop(dst addr) (addr, bool) {
+	if dst.is4() {
+		if !s.v4.configured {
+			return addr{}, false
+		}
+		if s.onLink4(dst) {
+			return dst, true
+		}
+		if s.v4.router == v4Any {
+			return addr{}, false
+		}
+		return s.v4.router, true
+	}
+	if dst.isLinkLocal() || s.v6.prefixLen > 0 && prefixEqual(dst, s.v6.prefix, s.v6.prefixLen) {
+		return dst, true
+	}
+	if s.v6.router == (addr{}) {
+		return addr{}, false
+	}
+	return s.v6.router, true
+}
+
+// onLink4 reports whether dst is in the IPv4 subnet.
+func (s *Stack) onLink4(dst addr) bool {
+	for i := 12; i < 16; i++ {
+		if dst[i]&s.v4.mask[i] != s.v4.addr[i]&s.v4.mask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Stack) subnetBroadcast() addr {
+	b := s.v4.addr
+	for i := 12; i < 16; i++ {
+		b[i] |= ^s.v4.mask[i]
+	}
+	return b
+}
+
+// isLocal reports whether a is an address of the stack.
+func (s *Stack) isLocal(a addr) bool {
+	switch {
+	case a.isLoopback():
+		return true
+	case a.is4():
+		return s.v4.configured && a == s.v4.addr
+	default:
+		return a == s.v6.linkLocal || s.v6.prefixLen > 0 && a == s.v6.global
+	}
+}
+
+// source returns the source address for packets to dst.
+func (s *Stack) source(dst addr) (addr, error) {
+	switch {
+	case s.isLocal(dst):
+		if dst.is4() && dst.isLoopback() {
+			return v4LoopbackAddr, nil
+		}
+		return dst, nil
+	case dst.is4():
+		if s.v4.configured {
+			return s.v4.addr, nil
+		}
+		if dst == v4Broadcast {
+			return v4Any, nil
+		}
+	case dst.isLinkLocal() || dst.isMulticast():
+		return s.v6.linkLocal, nil
+	case s.v6.prefixLen > 0:
+		return s.v6.global, nil
+	}
+	return addr{}, errNoRoute
+}
+
+// mtuFor returns the MTU for packets to dst.
+func (s *Stack) mtuFor(dst addr) int {
+	if s.isLocal(dst) {
+		return loopbackMTU
+	}
+	return s.mtu
+}
+
+// linkChanges returns a channel that receives a value when the link
+// comes up, or nil if the link doesn't report its status.
+func (s *Stack) linkChanges() <-chan struct{} {
+	if l, ok := s.link.(linkStatus); ok {
+		return l.LinkChanged()
+	}
+	return nil
+}
+
+// linkUp reports whether the link is up.
+func (s *Stack) linkUp() bool {
+	if l, ok := s.link.(linkStatus); ok {
+		return l.LinkUp()
+	}
+	return true
+}
+
+func v4Addr(b []byte) addr {
+	a := v4InV6Prefix
+	copy(a[12:], b[:4])
+	return a
+}
+
+func (a addr) is4() bool {
+	for i := 0; i < 10; i++ {
+		if a[i] != 0 {
+			return false
+		}
+	}
+	return a[10] == 0xff && a[11] == 0xff
+}
+
+// isUnspecified reports whether a is the IPv6 or IPv4 wildcard
+// address.
+func (a addr) isUnspecified() bool {
+	return a == addr{} || a == v4Any
+}
+
+func (a addr) isLoopback() bool {
+	if a.is4() {
+		return a[12] == 127
+	}
+	return a == v6Loopback
+}
+
+func (a addr) isMulticast() bool {
+	if a.is4() {
+		return a[12]&0xf0 == 0xe0
+	}
+	return a[0] == 0xff
+}
+
+func (a addr) isLinkLocal() bool {
+	return a[0] == 0xfe && a[1]&0xc0 == 0x80
+}
+
+func (a addr) ip() net.IP {
+	if a.is4() {
+		return net.IPv4(a[12], a[13], a[14], a[15])
+	}
+	return net.IP(append([]byte(nil), a[:]...))
+}
+
+// prefixEqual reports whether the first n bits of a and b are
+// equal.
+func prefixEqual(a, b addr, n int) bool {
+	for i := 0; i < n/8; i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	if r := n % 8; r > 0 {
+		mask := byte(0xff << (8 - r))
+		return a[n/8]&mask == b[n/8]&mask
+	}
+	return true
+}
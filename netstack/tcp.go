@@ -0,0 +1,1165 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package netstack
+
+import (
+	"encoding/binary"
+	"math"
+	"syscall"
+	"time"
+)
+
+type tcpState int
+
+// tcb is the state of a TCP connection. Sequence numbers compare
+// modulo 2^32.
+type tcb struct {
+	state tcpState
+
+	iss    uint32
+	sndUna uint32
+	sndNxt uint32
+	// sndMax is the highest sequence number sent.
+	sndMax uint32
+	sndWnd uint32
+	sndWl1 uint32
+	sndWl2 uint32
+	// mss is the maximum segment size for sending.
+	mss int
+	// sbuf is the data from sndUna and on.
+	sbuf []byte
+	// finQueued is set when a FIN follows the data in sbuf.
+	finQueued bool
+	finAcked  bool
+
+	irs    uint32
+	rcvNxt uint32
+	rbuf   []byte
+	// advWnd is the receive window last advertised.
+	advWnd      int
+	finReceived bool
+	rdShut      bool
+	// ooo are the segments received out of order.
+	ooo     []oooSegment
+	oooSize int
+
+	cwnd     int
+	ssthresh int
+	dupAcks  int
+	// recover is set during fast recovery.
+	recover bool
+
+	srtt, rttvar, rto time.Duration
+	// timing is set while the segment ending at rttSeq is timed.
+	timing   bool
+	rttSeq   uint32
+	rttStart time.Time
+	// retries is the number of retransmission timeouts since the
+	// last acknowledgement.
+	retries int
+
+	// rtoAt is the deadline for retransmission or window probing,
+	// closeAt the deadline for closing the connection.
+	rtoAt, closeAt time.Time
+	timer          *time.Timer
+}
+
+type oooSegment struct {
+	seq  uint32
+	data []byte
+	fin  bool
+}
+
+// segment is a received TCP segment.
+type segment struct {
+	seq, ack uint32
+	flags    uint8
+	wnd      uint16
+	// mss is the MSS option, or 0.
+	mss  int
+	data []byte
+}
+
+const (
+	tcpClosed tcpState = iota
+	tcpSynSent
+	tcpSynReceived
+	tcpEstablished
+	tcpFinWait1
+	tcpFinWait2
+	tcpCloseWait
+	tcpClosing
+	tcpLastAck
+	tcpTimeWait
+)
+
+const (
+	tcpFIN = 1 << 0
+	tcpSYN = 1 << 1
+	tcpRST = 1 << 2
+	tcpPSH = 1 << 3
+	tcpACK = 1 << 4
+
+	tcpHeaderSize = 20
+	tcpOptMSS     = 2
+
+	maxRcvBuf = 64 << 10
+	maxSndBuf = 128 << 10
+	// maxOOO is the maximum number of bytes received out of order.
+	maxOOO = maxRcvBuf
+	// sndLowat is the free send buffer space for writability.
+	sndLowat = maxSndBuf / 4
+
+	// defaultMSS is the MSS of peers that don't send the option.
+	defaultMSS = 536
+	// initialWindow is the initial congestion window in segments.
+	initialWindow = 10
+	maxBacklog    = 4096
+
+	initialRTO    = time.Second
+	minRTO        = 200 * time.Millisecond
+	maxRTO        = 60 * time.Second
+	maxRetries    = 12
+	maxSynRetries = 6
+
+	timeWaitTimeout = 30 * time.Second
+	// finWait2Timeout limits the lifetime of closed connections in
+	// FIN_WAIT_2.
+	finWait2Timeout = 60 * time.Second
+)
+
+// inputTCP processes a received TCP segment.
+func (s *Stack) inputTCP(src, dst addr, p []byte, valid bool) {
+	if len(p) < tcpHeaderSize || !s.isLocal(dst) {
+		return
+	}
+	hlen := int(p[12]>>4) * 4
+	if hlen < tcpHeaderSize || hlen > len(p) {
+		return
+	}
+	if !valid && !validChecksum(p, src, dst, protoTCP) {
+		return
+	}
+	seg := &segment{
+		seq:   binary.BigEndian.Uint32(p[4:]),
+		ack:   binary.BigEndian.Uint32(p[8:]),
+		flags: p[13],
+		wnd:   binary.BigEndian.Uint16(p[14:]),
+		mss:   parseMSS(p[tcpHeaderSize:hlen]),
+		data:  p[hlen:],
+	}
+	local := endpoint{addr: dst, port: binary.BigEndian.Uint16(p[2:])}
+	remote := endpoint{addr: src, port: binary.BigEndian.Uint16(p[0:])}
+	if so := s.conns[connKey{local, remote}]; so != nil {
+		so.input(seg)
+		return
+	}
+	if l := s.lookup(protoTCP, local, remote); l != nil {
+		l.inputListen(local, remote, seg)
+		return
+	}
+	s.sendReset(local, remote, seg)
+}
+
+// inputListen processes a segment to a listening socket.
+func (l *socket) inputListen(local, remote endpoint, seg *segment) {
+	s := l.stack
+	switch {
+	case seg.flags&tcpRST != 0:
+		return
+	case seg.flags&tcpACK != 0:
+		s.sendReset(local, remote, seg)
+		return
+	case seg.flags&tcpSYN == 0:
+		return
+	}
+	if l.embryos+len(l.acceptq) >= l.backlog {
+		// Drop the SYN and let the peer retry.
+		return
+	}
+	c := &socket{
+		stack:     s,
+		family:    l.family,
+		typ:       l.typ,
+		proto:     protoTCP,
+		local:     local,
+		remote:    remote,
+		bound:     true,
+		connected: true,
+		noDelay:   l.noDelay,
+		keepalive: l.keepalive,
+		keepIdle:  l.keepIdle,
+		keepIntvl: l.keepIntvl,
+		keepCnt:   l.keepCnt,
+		parent:    l,
+	}
+	c.initTCB()
+	t := &c.tcp
+	t.state = tcpSynReceived
+	t.irs = seg.seq
+	t.rcvNxt = seg.seq + 1
+	c.setPeer(seg)
+	l.embryos++
+	s.conns[connKey{local, remote}] = c
+	c.output()
+	c.schedule()
+}
+
+// input processes a segment to a connection.
+func (so *socket) input(seg *segment) {
+	t := &so.tcp
+	if t.state == tcpSynSent {
+		so.inputSynSent(seg)
+		return
+	}
+	wnd := uint32(so.rcvWindow())
+	if seqGT(seg.seq, t.rcvNxt+wnd) || seqLT(seg.seq+seg.len(), t.rcvNxt) {
+		// Not acceptable.
+		if seg.flags&tcpRST == 0 {
+			so.sendAck()
+		}
+		return
+	}
+	if seg.flags&tcpRST != 0 {
+		if seg.seq != t.rcvNxt {
+			// Challenge ACK (RFC 5961).
+			so.sendAck()
+			return
+		}
+		switch t.state {
+		case tcpSynReceived:
+			if so.parent != nil {
+				so.destroy()
+			} else {
+				so.fail(syscall.ECONNREFUSED)
+			}
+		case tcpClosing, tcpLastAck, tcpTimeWait:
+			so.destroy()
+		default:
+			so.fail(syscall.ECONNRESET)
+		}
+		return
+	}
+	if seg.flags&tcpSYN != 0 {
+		if t.state == tcpSynReceived && seg.seq == t.irs {
+			// Our SYN-ACK was lost.
+			t.sndNxt = t.iss
+			so.output()
+			return
+		}
+		so.sendAck()
+		return
+	}
+	if seg.flags&tcpACK == 0 {
+		return
+	}
+	if t.state == tcpSynReceived {
+		if seqLEQ(seg.ack, t.sndUna) || seqGT(seg.ack, t.sndMax) {
+			so.stack.sendReset(so.local, so.remote, seg)
+			return
+		}
+		// Acknowledge the SYN.
+		t.sndUna++
+		t.state = tcpEstablished
+		if l := so.parent; l != nil {
+			l.embryos--
+			l.acceptq = append(l.acceptq, so)
+			l.update()
+		}
+	}
+	if !so.inputAck(seg) {
+		return
+	}
+	if len(seg.data) > 0 || seg.flags&tcpFIN != 0 {
+		switch t.state {
+		case tcpEstablished, tcpFinWait1, tcpFinWait2:
+			if so.closed && len(seg.data) > 0 {
+				// Nobody will read the data.
+				so.abort()
+				return
+			}
+			so.receive(seg.seq, seg.data, seg.flags&tcpFIN != 0)
+		case tcpTimeWait:
+			// Restart the timeout for the retransmitted FIN.
+			t.closeAt = time.Now().Add(timeWaitTimeout)
+		}
+		so.sendAck()
+	}
+	so.output()
+	so.schedule()
+	so.update()
+}
+
+// inputSynSent processes a segment to a connection in the SYN_SENT
+// state.
+func (so *socket) inputSynSent(seg *segment) {
+	t := &so.tcp
+	hasAck := seg.flags&tcpACK != 0
+	if hasAck && (seqLEQ(seg.ack, t.iss) || seqGT(seg.ack, t.sndMax)) {
+		so.stack.sendReset(so.local, so.remote, seg)
+		return
+	}
+	if seg.flags&tcpRST != 0 {
+		if hasAck {
+			so.fail(syscall.ECONNREFUSED)
+		}
+		return
+	}
+	if seg.flags&tcpSYN == 0 {
+		return
+	}
+	t.irs = seg.seq
+	t.rcvNxt = seg.seq + 1
+	so.setPeer(seg)
+	if !hasAck {
+		// Simultaneous open.
+		t.state = tcpSynReceived
+		t.sndNxt = t.iss
+		so.output()
+		so.schedule()
+		return
+	}
+	t.sndUna++
+	t.state = tcpEstablished
+	so.inputAck(seg)
+	so.sendAck()
+	so.output()
+	so.schedule()
+	so.update()
+}
+
+// inputAck processes the acknowledgement and window of a segment. It
+// reports whether the processing of the segment should continue.
+func (so *socket) inputAck(seg *segment) bool {
+	t := &so.tcp
+	ack := seg.ack
+	if seqGT(ack, t.sndMax) {
+		so.sendAck()
+		return false
+	}
+	now := time.Now()
+	if t.timing && seqGEQ(ack, t.rttSeq) {
+		t.timing = false
+		so.sampleRTT(now.Sub(t.rttStart))
+	}
+	switch {
+	case seqGT(ack, t.sndUna):
+		acked := int(ack - t.sndUna)
+		if acked > len(t.sbuf) {
+			// The FIN is acknowledged.
+			t.finAcked = true
+			acked = len(t.sbuf)
+		}
+		t.sbuf = t.sbuf[acked:]
+		if len(t.sbuf) == 0 {
+			t.sbuf = nil
+		}
+		t.sndUna = ack
+		if seqLT(t.sndNxt, t.sndUna) {
+			t.sndNxt = t.sndUna
+		}
+		switch {
+		case t.recover:
+			t.cwnd = t.ssthresh
+			t.recover = false
+		case t.cwnd < t.ssthresh:
+			if acked > t.mss {
+				acked = t.mss
+			}
+			t.cwnd += acked
+		default:
+			inc := t.mss * t.mss / t.cwnd
+			if inc == 0 {
+				inc = 1
+			}
+			t.cwnd += inc
+		}
+		t.dupAcks = 0
+		t.retries = 0
+		t.rtoAt = time.Time{}
+		if t.sndUna != t.sndMax {
+			t.rtoAt = now.Add(t.rto)
+		}
+	case ack == t.sndUna && t.sndUna != t.sndMax && len(seg.data) == 0 &&
+		seg.flags&(tcpSYN|tcpFIN) == 0 && uint32(seg.wnd) == t.sndWnd:
+		t.dupAcks++
+		switch {
+		case t.dupAcks == 3:
+			so.fastRetransmit()
+		case t.dupAcks > 3:
+			t.cwnd += t.mss
+		}
+	}
+	if seqLT(t.sndWl1, seg.seq) || t.sndWl1 == seg.seq && seqLEQ(t.sndWl2, ack) {
+		t.sndWnd = uint32(seg.wnd)
+		t.sndWl1 = seg.seq
+		t.sndWl2 = ack
+	}
+	if !t.finAcked {
+		return true
+	}
+	switch t.state {
+	case tcpFinWait1:
+		t.state = tcpFinWait2
+		if so.closed {
+			t.closeAt = now.Add(finWait2Timeout)
+		}
+	case tcpClosing:
+		so.timeWait()
+	case tcpLastAck:
+		so.destroy()
+		return false
+	}
+	return true
+}
+
+// receive processes the data and FIN of a segment.
+func (so *socket) receive(seq uint32, data []byte, fin bool) {
+	t := &so.tcp
+	if t.finReceived {
+		return
+	}
+	if seqGT(seq, t.rcvNxt) {
+		if t.oooSize+len(data) > maxOOO {
+			return
+		}
+		t.ooo = append(t.ooo, oooSegment{seq: seq, data: append([]byte(nil), data...), fin: fin})
+		t.oooSize += len(data)
+		return
+	}
+	so.appendData(seq, data, fin)
+	// Add the queued segments that are now in order.
+	for i := 0; i < len(t.ooo); {
+		o := t.ooo[i]
+		if seqGT(o.seq, t.rcvNxt) {
+			i++
+			continue
+		}
+		t.ooo = append(t.ooo[:i], t.ooo[i+1:]...)
+		t.oooSize -= len(o.data)
+		if !t.finReceived {
+			so.appendData(o.seq, o.data, o.fin)
+		}
+		i = 0
+	}
+}
+
+// appendData adds in order data to the receive buffer.
+func (so *socket) appendData(seq uint32, data []byte, fin bool) {
+	t := &so.tcp
+	if d := int(t.rcvNxt - seq); d > 0 {
+		if d > len(data) {
+			return
+		}
+		data = data[d:]
+	}
+	if space := maxRcvBuf - len(t.rbuf); len(data) > space {
+		data = data[:space]
+		fin = false
+	}
+	if !t.rdShut {
+		t.rbuf = append(t.rbuf, data...)
+	}
+	t.rcvNxt += uint32(len(data))
+	if !fin {
+		return
+	}
+	t.rcvNxt++
+	t.finReceived = true
+	t.ooo = nil
+	t.oooSize = 0
+	switch t.state {
+	case tcpEstablished:
+		t.state = tcpCloseWait
+	case tcpFinWait1:
+		t.state = tcpClosing
+	case tcpFinWait2:
+		so.timeWait()
+	}
+}
+
+// output sends the segments allowed by the windows.
+func (so *socket) output() {
+	t := &so.tcp
+	now := time.Now()
+	switch t.state {
+	case tcpSynSent, tcpSynReceived:
+		if t.sndNxt != t.iss {
+			return
+		}
+		flags := uint8(tcpSYN)
+		if t.state == tcpSynReceived {
+			flags |= tcpACK
+		}
+		so.sendSegment(t.iss, flags, nil)
+		t.sndNxt = t.iss + 1
+		if t.sndMax != t.sndNxt {
+			t.sndMax = t.sndNxt
+			t.timing = true
+			t.rttSeq = t.sndNxt
+			t.rttStart = now
+		}
+		if t.rtoAt.IsZero() {
+			t.rtoAt = now.Add(t.rto)
+		}
+		return
+	case tcpEstablished, tcpCloseWait, tcpFinWait1, tcpClosing, tcpLastAck:
+	default:
+		return
+	}
+	for {
+		off := int(t.sndNxt - t.sndUna)
+		if off > len(t.sbuf) {
+			// The FIN is sent.
+			break
+		}
+		wnd := int(t.sndWnd)
+		if t.cwnd < wnd {
+			wnd = t.cwnd
+		}
+		n := len(t.sbuf) - off
+		if n > t.mss {
+			n = t.mss
+		}
+		if room := wnd - off; n > room {
+			n = room
+			if n < 0 {
+				n = 0
+			}
+		}
+		fin := t.finQueued && off+n == len(t.sbuf)
+		if n == 0 && !fin {
+			break
+		}
+		// Avoid small segments while data is in flight (Nagle's
+		// algorithm), unless limited by the window.
+		if n < t.mss && !fin && off > 0 && (!so.noDelay || off+n < len(t.sbuf)) {
+			break
+		}
+		flags := uint8(tcpACK)
+		if fin {
+			flags |= tcpFIN
+		}
+		if n > 0 && off+n == len(t.sbuf) {
+			flags |= tcpPSH
+		}
+		so.sendSegment(t.sndNxt, flags, t.sbuf[off:off+n])
+		t.sndNxt += uint32(n)
+		if fin {
+			t.sndNxt++
+		}
+		if seqGT(t.sndNxt, t.sndMax) {
+			if !t.timing {
+				t.timing = true
+				t.rttSeq = t.sndNxt
+				t.rttStart = now
+			}
+			t.sndMax = t.sndNxt
+		}
+		if t.rtoAt.IsZero() {
+			t.rtoAt = now.Add(t.rto)
+		}
+		if fin {
+			break
+		}
+	}
+	if t.sndUna == t.sndMax && len(t.sbuf) > 0 && t.sndWnd == 0 && t.rtoAt.IsZero() {
+		// Probe the closed window.
+		t.rtoAt = now.Add(t.rto)
+	}
+}
+
+// retransmit handles the expiry of the retransmission timer.
+func (so *socket) retransmit() {
+	t := &so.tcp
+	now := time.Now()
+	t.rtoAt = time.Time{}
+	synchronized := t.state != tcpSynSent && t.state != tcpSynReceived
+	if synchronized && t.sndWnd == 0 && len(t.sbuf) > 0 {
+		// Probe the closed window with a byte.
+		so.sendSegment(t.sndUna, tcpACK, t.sbuf[:1])
+		if seqLT(t.sndNxt, t.sndUna+1) {
+			t.sndNxt = t.sndUna + 1
+		}
+		if seqLT(t.sndMax, t.sndNxt) {
+			t.sndMax = t.sndNxt
+		}
+		so.backoff()
+		t.rtoAt = now.Add(t.rto)
+		return
+	}
+	if t.sndUna == t.sndMax {
+		return
+	}
+	t.retries++
+	limit := maxRetries
+	if !synchronized {
+		limit = maxSynRetries
+	}
+	if t.retries > limit {
+		if so.parent != nil {
+			so.destroy()
+		} else {
+			so.fail(syscall.ETIMEDOUT)
+		}
+		return
+	}
+	so.backoff()
+	if synchronized {
+		flight := int(t.sndMax - t.sndUna)
+		t.ssthresh = flight / 2
+		if t.ssthresh < 2*t.mss {
+			t.ssthresh = 2 * t.mss
+		}
+		t.cwnd = t.mss
+	}
+	t.timing = false
+	t.recover = false
+	t.dupAcks = 0
+	// Go back and resend everything unacknowledged.
+	t.sndNxt = t.sndUna
+	if !synchronized {
+		t.sndNxt = t.iss
+	}
+	so.output()
+}
+
+// fastRetransmit resends the first unacknowledged segment after three
+// duplicate acknowledgements.
+func (so *socket) fastRetransmit() {
+	t := &so.tcp
+	flight := int(t.sndMax - t.sndUna)
+	t.ssthresh = flight / 2
+	if t.ssthresh < 2*t.mss {
+		t.ssthresh = 2 * t.mss
+	}
+	t.cwnd = t.ssthresh + 3*t.mss
+	t.recover = true
+	t.timing = false
+	n := len(t.sbuf)
+	if n > t.mss {
+		n = t.mss
+	}
+	flags := uint8(tcpACK)
+	if n == len(t.sbuf) && flight > n {
+		flags |= tcpFIN
+	}
+	so.sendSegment(t.sndUna, flags, t.sbuf[:n])
+}
+
+func (so *socket) backoff() {
+	t := &so.tcp
+	t.rto *= 2
+	if t.rto > maxRTO {
+		t.rto = maxRTO
+	}
+}
+
+// sampleRTT updates the retransmission timeout with a round-trip time
+// measurement (RFC 6298).
+func (so *socket) sampleRTT(r time.Duration) {
+	t := &so.tcp
+	if t.srtt == 0 {
+		t.srtt = r
+		t.rttvar = r / 2
+	} else {
+		delta := t.srtt - r
+		if delta < 0 {
+			delta = -delta
+		}
+		t.rttvar = (3*t.rttvar + delta) / 4
+		t.srtt = (7*t.srtt + r) / 8
+	}
+	t.rto = t.srtt + 4*t.rttvar
+	switch {
+	case t.rto < minRTO:
+		t.rto = minRTO
+	case t.rto > maxRTO:
+		t.rto = maxRTO
+	}
+}
+
+// schedule arms the connection timer for the earliest deadline.
+func (so *socket) schedule() {
+	t := &so.tcp
+	at := t.rtoAt
+	if at.IsZero() || !t.closeAt.IsZero() && t.closeAt.Before(at) {
+		at = t.closeAt
+	}
+	if at.IsZero() {
+		return
+	}
+	d := time.Until(at)
+	if t.timer == nil {
+		t.timer = time.AfterFunc(d, so.timeout)
+	} else {
+		t.timer.Reset(d)
+	}
+}
+
+func (so *socket) timeout() {
+	s := so.stack
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &so.tcp
+	now := time.Now()
+	switch {
+	case !t.closeAt.IsZero() && !now.Before(t.closeAt):
+		so.destroy()
+		return
+	case !t.rtoAt.IsZero() && !now.Before(t.rtoAt):
+		so.retransmit()
+	}
+	so.schedule()
+	so.update()
+}
+
+func (so *socket) initTCB() {
+	s := so.stack
+	t := &so.tcp
+	t.iss = s.rand.Uint32()
+	t.sndUna = t.iss
+	t.sndNxt = t.iss
+	t.sndMax = t.iss
+	t.mss = s.payloadSize(so.remote.addr) - tcpHeaderSize
+	t.cwnd = initialWindow * t.mss
+	t.ssthresh = math.MaxInt32
+	t.rto = initialRTO
+}
+
+// setPeer records the window and MSS of the SYN of the peer.
+func (so *socket) setPeer(seg *segment) {
+	t := &so.tcp
+	t.sndWnd = uint32(seg.wnd)
+	t.sndWl1 = seg.seq
+	t.sndWl2 = seg.ack
+	mss := seg.mss
+	if mss == 0 {
+		mss = defaultMSS
+	}
+	if mss < t.mss {
+		t.mss = mss
+	}
+	t.cwnd = initialWindow * t.mss
+}
+
+func (so *socket) connectTCP(ep endpoint) error {
+	s := so.stack
+	switch {
+	case so.listening:
+		return syscall.EINVAL
+	case so.connected && so.tcp.state == tcpSynSent:
+		return syscall.EALREADY
+	case so.connected:
+		return syscall.EISCONN
+	}
+	src := so.local.addr
+	if src.isUnspecified() {
+		var err error
+		src, err = s.source(ep.addr)
+		if err != nil {
+			return err
+		}
+	}
+	if src.is4() != ep.addr.is4() {
+		return syscall.ENETUNREACH
+	}
+	if !so.bound {
+		if err := so.bind(endpoint{addr: so.local.addr}); err != nil {
+			return err
+		}
+	}
+	key := connKey{local: endpoint{addr: src, port: so.local.port}, remote: ep}
+	if s.conns[key] != nil {
+		return syscall.EADDRNOTAVAIL
+	}
+	so.local.addr = src
+	so.remote = ep
+	so.connected = true
+	so.initTCB()
+	so.tcp.state = tcpSynSent
+	s.conns[key] = so
+	so.output()
+	so.schedule()
+	so.update()
+	return syscall.EINPROGRESS
+}
+
+func (so *socket) listen(backlog int) error {
+	if so.connected || so.closed {
+		return syscall.EINVAL
+	}
+	if !so.bound {
+		if err := so.bind(endpoint{addr: so.local.addr}); err != nil {
+			return err
+		}
+	}
+	if !so.listening {
+		so.listening = true
+		if !so.stack.bindable(so) {
+			so.listening = false
+			return syscall.EADDRINUSE
+		}
+	}
+	switch {
+	case backlog < 1:
+		backlog = 1
+	case backlog > maxBacklog:
+		backlog = maxBacklog
+	}
+	so.backlog = backlog
+	so.update()
+	return nil
+}
+
+func (so *socket) accept() (*socket, error) {
+	if !so.listening {
+		return nil, syscall.EINVAL
+	}
+	if len(so.acceptq) == 0 {
+		return nil, syscall.EAGAIN
+	}
+	c := so.acceptq[0]
+	so.acceptq[0] = nil
+	so.acceptq = so.acceptq[1:]
+	c.parent = nil
+	so.update()
+	return c, nil
+}
+
+func (so *socket) recvTCP(p []byte, flags int) (int, error) {
+	t := &so.tcp
+	if so.err != 0 {
+		err := so.err
+		so.err = 0
+		so.update()
+		return 0, err
+	}
+	if !so.connected || so.listening {
+		return 0, syscall.ENOTCONN
+	}
+	switch t.state {
+	case tcpSynSent, tcpSynReceived:
+		return 0, syscall.EAGAIN
+	}
+	if len(t.rbuf) == 0 {
+		if t.finReceived || t.rdShut || t.state == tcpClosed {
+			return 0, nil
+		}
+		return 0, syscall.EAGAIN
+	}
+	n := copy(p, t.rbuf)
+	if flags&syscall.MSG_PEEK != 0 {
+		return n, nil
+	}
+	t.rbuf = t.rbuf[n:]
+	if len(t.rbuf) == 0 {
+		t.rbuf = nil
+	}
+	// Announce the opened window.
+	if w := so.rcvWindow(); w-t.advWnd >= maxRcvBuf/2 || t.advWnd < t.mss && w >= t.mss {
+		switch t.state {
+		case tcpEstablished, tcpFinWait1, tcpFinWait2:
+			so.sendAck()
+		}
+	}
+	so.update()
+	return n, nil
+}
+
+func (so *socket) sendTCP(p []byte) (int, error) {
+	t := &so.tcp
+	if so.err != 0 {
+		err := so.err
+		so.err = 0
+		so.update()
+		return 0, err
+	}
+	if !so.connected || so.listening {
+		return 0, syscall.ENOTCONN
+	}
+	switch t.state {
+	case tcpSynSent, tcpSynReceived:
+		return 0, syscall.EAGAIN
+	case tcpEstablished, tcpCloseWait:
+	default:
+		return 0, syscall.EPIPE
+	}
+	room := maxSndBuf - len(t.sbuf)
+	if room == 0 {
+		return 0, syscall.EAGAIN
+	}
+	if len(p) > room {
+		p = p[:room]
+	}
+	t.sbuf = append(t.sbuf, p...)
+	so.output()
+	so.schedule()
+	so.update()
+	return len(p), nil
+}
+
+func (so *socket) shutdownTCP(how int) {
+	t := &so.tcp
+	if how != syscall.SHUT_WR {
+		t.rdShut = true
+		t.rbuf = nil
+	}
+	if how != syscall.SHUT_RD {
+		so.closeWrite()
+	}
+	so.output()
+	so.schedule()
+	so.update()
+}
+
+// closeWrite queues a FIN after the data to send.
+func (so *socket) closeWrite() {
+	t := &so.tcp
+	switch t.state {
+	case tcpEstablished:
+		t.state = tcpFinWait1
+	case tcpCloseWait:
+		t.state = tcpLastAck
+	default:
+		return
+	}
+	t.finQueued = true
+}
+
+// closeTCP closes the TCP socket on behalf of the program. It reports
+// whether the connection lives on to close gracefully.
+func (so *socket) closeTCP() bool {
+	s := so.stack
+	t := &so.tcp
+	if so.listening {
+		so.listening = false
+		for _, c := range s.conns {
+			if c.parent == so {
+				c.abort()
+			}
+		}
+		return false
+	}
+	switch t.state {
+	case tcpClosed:
+		return false
+	case tcpSynSent:
+		so.destroy()
+		return false
+	case tcpSynReceived:
+		so.abort()
+		return false
+	case tcpTimeWait:
+		return true
+	}
+	if len(t.rbuf) > 0 {
+		// Reset the connection to signal the lost data.
+		so.abort()
+		return false
+	}
+	so.closeWrite()
+	if t.state == tcpFinWait2 {
+		t.closeAt = time.Now().Add(finWait2Timeout)
+	}
+	so.output()
+	so.schedule()
+	return true
+}
+
+// abort resets the connection.
+func (so *socket) abort() {
+	so.sendSegment(so.tcp.sndNxt, tcpRST|tcpACK, nil)
+	so.destroy()
+}
+
+// fail destroys the connection and reports err to the program.
+func (so *socket) fail(err syscall.Errno) {
+	so.err = err
+	so.tcp.rbuf = nil
+	so.destroy()
+}
+
+func (so *socket) timeWait() {
+	t := &so.tcp
+	t.state = tcpTimeWait
+	t.rtoAt = time.Time{}
+	t.closeAt = time.Now().Add(timeWaitTimeout)
+	t.sbuf = nil
+}
+
+// destroy removes the connection.
+func (so *socket) destroy() {
+	s := so.stack
+	t := &so.tcp
+	key := connKey{so.local, so.remote}
+	if s.conns[key] == so {
+		delete(s.conns, key)
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.state = tcpClosed
+	t.rtoAt = time.Time{}
+	t.closeAt = time.Time{}
+	t.sbuf = nil
+	t.ooo = nil
+	t.oooSize = 0
+	if l := so.parent; l != nil {
+		so.parent = nil
+		queued := false
+		for i, c := range l.acceptq {
+			if c == so {
+				l.acceptq = append(l.acceptq[:i], l.acceptq[i+1:]...)
+				queued = true
+				break
+			}
+		}
+		if !queued {
+			l.embryos--
+		}
+		l.update()
+	}
+	if so.closed {
+		so.unbind()
+	}
+	so.update()
+}
+
+func (so *socket) readinessTCP() uint32 {
+	if so.listening {
+		if len(so.acceptq) > 0 {
+			return syscall.EPOLLIN
+		}
+		return 0
+	}
+	t := &so.tcp
+	var ev uint32
+	if so.err != 0 {
+		ev |= syscall.EPOLLERR
+	}
+	switch t.state {
+	case tcpClosed:
+		if !so.connected {
+			return ev | syscall.EPOLLOUT | syscall.EPOLLHUP
+		}
+		return ev | syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLOUT | syscall.EPOLLHUP
+	case tcpSynSent, tcpSynReceived:
+		return ev
+	}
+	if len(t.rbuf) > 0 || t.finReceived || t.rdShut {
+		ev |= syscall.EPOLLIN
+	}
+	if t.finReceived || t.rdShut {
+		ev |= syscall.EPOLLRDHUP
+	}
+	if t.finQueued || maxSndBuf-len(t.sbuf) >= sndLowat {
+		ev |= syscall.EPOLLOUT
+	}
+	if t.finReceived && t.finQueued {
+		ev |= syscall.EPOLLHUP
+	}
+	return ev
+}
+
+// rcvWindow returns the receive window.
+func (so *socket) rcvWindow() int {
+	w := maxRcvBuf - len(so.tcp.rbuf)
+	if w > math.MaxUint16 {
+		w = math.MaxUint16
+	}
+	return w
+}
+
+func (so *socket) sendAck() {
+	so.sendSegment(so.tcp.sndNxt, tcpACK, nil)
+}
+
+// sendSegment sends a segment of the connection.
+func (so *socket) sendSegment(seq uint32, flags uint8, data []byte) {
+	s := so.stack
+	t := &so.tcp
+	var ack uint32
+	if flags&tcpACK != 0 {
+		ack = t.rcvNxt
+	}
+	wnd := so.rcvWindow()
+	t.advWnd = wnd
+	mss := s.payloadSize(so.remote.addr) - tcpHeaderSize
+	s.writeSegment(so.local, so.remote, seq, ack, flags, uint16(wnd), mss, data)
+}
+
+// sendReset answers a segment that doesn't belong to a connection.
+func (s *Stack) sendReset(local, remote endpoint, seg *segment) {
+	if seg.flags&tcpRST != 0 {
+		return
+	}
+	if seg.flags&tcpACK != 0 {
+		s.writeSegment(local, remote, seg.ack, 0, tcpRST, 0, 0, nil)
+		return
+	}
+	s.writeSegment(local, remote, 0, seg.seq+seg.len(), tcpRST|tcpACK, 0, 0, nil)
+}
+
+// writeSegment transmits a segment. SYN segments carry the MSS option
+// with the value mss.
+func (s *Stack) writeSegment(local, remote endpoint, seq, ack uint32, flags uint8, wnd uint16, mss int, data []byte) {
+	hlen := tcpHeaderSize
+	if flags&tcpSYN != 0 {
+		hlen += 4
+	}
+	f, p := s.newPacket(local.addr, remote.addr, protoTCP, hlen+len(data))
+	binary.BigEndian.PutUint16(p[0:], local.port)
+	binary.BigEndian.PutUint16(p[2:], remote.port)
+	binary.BigEndian.PutUint32(p[4:], seq)
+	binary.BigEndian.PutUint32(p[8:], ack)
+	p[12] = uint8(hlen/4) << 4
+	p[13] = flags
+	binary.BigEndian.PutUint16(p[14:], wnd)
+	if flags&tcpSYN != 0 {
+		p[20] = tcpOptMSS
+		p[21] = 4
+		binary.BigEndian.PutUint16(p[22:], uint16(mss))
+	}
+	copy(p[hlen:], data)
+	prepareChecksum(&f, p, local.addr, remote.addr, protoTCP, 16)
+	s.transmit(remote.addr, f)
+}
+
+// len returns the sequence space occupied by the segment.
+func (seg *segment) len() uint32 {
+	n := uint32(len(seg.data))
+	if seg.flags&tcpSYN != 0 {
+		n++
+	}
+	if seg.flags&tcpFIN != 0 {
+		n++
+	}
+	return n
+}
+
+// parseMSS returns the value of the MSS option, or 0.
+func parseMSS(opts []byte) int {
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0:
+			return 0
+		case 1:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return 0
+		}
+		if opts[0] == tcpOptMSS && opts[1] == 4 {
+			return int(binary.BigEndian.Uint16(opts[2:]))
+		}
+		opts = opts[opts[1]:]
+	}
+	return 0
+}
+
+func seqLT(a, b uint32) bool  { return int32(a-b) < 0 }
+func seqLEQ(a, b uint32) bool { return int32(a-b) <= 0 }
+func seqGT(a, b uint32) bool  { return int32(a-b) > 0 }
+func seqGEQ(a, b uint32) bool { return int32(a-b) >= 0 }
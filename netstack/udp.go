@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package netstack
+
+import (
+	"encoding/binary"
+	"syscall"
+)
+
+// datagram is a received UDP datagram.
+type datagram struct {
+	from endpoint
+	data []byte
+}
+
+const (
+	udpHeaderSize = 8
+
+	// maxDgramQueue is the maximum number of bytes queued per
+	// socket.
+	maxDgramQueue = 256 << 10
+)
+
+// inputUDP processes a received UDP packet.
+func (s *Stack) inputUDP(src, dst addr, p []byte, valid bool) {
+	if len(p) < udpHeaderSize {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(p[4:]))
+	if n < udpHeaderSize || n > len(p) {
+		return
+	}
+	p = p[:n]
+	// The checksum is optional for IPv4.
+	hasSum := binary.BigEndian.Uint16(p[6:]) != 0
+	if !hasSum && !src.is4() || hasSum && !valid && !validChecksum(p, src, dst, protoUDP) {
+		return
+	}
+	from := endpoint{addr: src, port: binary.BigEndian.Uint16(p[0:])}
+	to := endpoint{addr: dst, port: binary.BigEndian.Uint16(p[2:])}
+	so := s.lookup(protoUDP, to, from)
+	if so == nil {
+		return
+	}
+	data := p[udpHeaderSize:]
+	if so.dgramSize+len(data) > maxDgramQueue {
+		return
+	}
+	so.dgrams = append(so.dgrams, datagram{from: from, data: append([]byte(nil), data...)})
+	so.dgramSize += len(data)
+	so.update()
+}
+
+func (so *socket) connectUDP(ep endpoint) error {
+	if !so.bound {
+		if err := so.bind(endpoint{addr: so.local.addr}); err != nil {
+			return err
+		}
+	}
+	if so.local.addr.isUnspecified() {
+		src, err := so.stack.source(ep.addr)
+		if err != nil {
+			return err
+		}
+		so.local.addr = src
+	}
+	so.remote = ep
+	so.connected = true
+	return nil
+}
+
+func (so *socket) recvUDP(p []byte, flags int) (int, endpoint, error) {
+	if so.err != 0 {
+		err := so.err
+		so.err = 0
+		so.update()
+		return 0, endpoint{}, err
+	}
+	if len(so.dgrams) == 0 {
+		return 0, endpoint{}, syscall.EAGAIN
+	}
+	d := so.dgrams[0]
+	n := copy(p, d.data)
+	if flags&syscall.MSG_PEEK == 0 {
+		// The rest of a truncated datagram is discarded.
+		so.dgrams[0] = datagram{}
+		so.dgrams = so.dgrams[1:]
+		so.dgramSize -= len(d.data)
+		so.update()
+	}
+	return n, d.from, nil
+}
+
+func (so *socket) sendUDP(p []byte, dst endpoint) (int, error) {
+	s := so.stack
+	if dst.port == 0 {
+		return 0, syscall.EINVAL
+	}
+	if (dst.addr == v4Broadcast || s.v4.configured && dst.addr == s.subnetBroadcast()) && !so.broadcast {
+		return 0, syscall.EACCES
+	}
+	if !so.bound {
+		if err := so.bind(endpoint{addr: so.local.addr}); err != nil {
+			return 0, err
+		}
+	}
+	src := so.local.addr
+	if src.isUnspecified() {
+		var err error
+		src, err = s.source(dst.addr)
+		if err != nil {
+			return 0, err
+		}
+	}
+	size := udpHeaderSize + len(p)
+	if size > s.payloadSize(dst.addr) {
+		return 0, syscall.EMSGSIZE
+	}
+	f, b := s.newPacket(src, dst.addr, protoUDP, size)
+	binary.BigEndian.PutUint16(b[0:], so.local.port)
+	binary.BigEndian.PutUint16(b[2:], dst.port)
+	binary.BigEndian.PutUint16(b[4:], uint16(size))
+	copy(b[udpHeaderSize:], p)
+	prepareChecksum(&f, b, src, dst.addr, protoUDP, 6)
+	s.transmit(dst.addr, f)
+	return len(p), nil
+}
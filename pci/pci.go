@@ -4,10 +4,12 @@ package pci
 
 import (
 	"errors"
+	"sync"
 	"sync/atomic"
 	"unsafe"
 
 	"eliasnaur.com/unik/kernel"
+	"eliasnaur.com/unik/kernel/acpi"
 )
 
 // Address represents a PCI device.
@@ -34,6 +36,22 @@ const (
 	pciConfigDataPort = 0xcfc
 )
 
+// ecam tracks the memory mapped configuration space of PCI segment
+// 0, if the ACPI MCFG table describes one.
+var ecam struct {
+	once sync.Once
+	area acpi.ECAM
+	ok   bool
+
+	mu sync.Mutex
+	// buses contains the mapped configuration space of each bus,
+	// mapped on first access.
+	buses [256][]byte
+}
+
+// ecamBusSize is the size of the configuration space of a bus.
+const ecamBusSize = 1 << 20
+
 const (
 	_PCI_CAP_ID_MSI  = 0x05
 	_PCI_CAP_ID_MSIX = 0x11
@@ -156,6 +174,9 @@ func (a Address) ReadPCIRegister(reg uint8) uint32 {
 	if reg&0x3 != 0 {
 		panic("unaligned PCI register access")
 	}
+	if r := a.ecamRegister(reg); r != nil {
+		return atomic.LoadUint32(r)
+	}
 	addr := 0x80000000 | uint32(a.Bus)<<16 | uint32(a.Device)<<11 | uint32(a.Function)<<8 | uint32(reg)
 	kernel.Outl(pciConfigAddrPort, addr)
 	return kernel.Inl(pciConfigDataPort)
@@ -165,11 +186,53 @@ func (a Address) writePCIRegister(reg uint8, val uint32) {
 	if reg&0x3 != 0 {
 		panic("unaligned PCI register access")
 	}
+	if r := a.ecamRegister(reg); r != nil {
+		atomic.StoreUint32(r, val)
+		return
+	}
 	addr := 0x80000000 | uint32(a.Bus)<<16 | uint32(a.Device)<<11 | uint32(a.Function)<<8 | uint32(reg)
 	kernel.Outl(pciConfigAddrPort, addr)
 	kernel.Outl(pciConfigDataPort, val)
 }
 
+// ecamRegister returns the memory mapped configuration register reg
+// of the device, or nil if the device must be accessed through the
+// legacy I/O ports.
+func (a Address) ecamRegister(reg uint8) *uint32 {
+	ecam.once.Do(initECAM)
+	if !ecam.ok || a.Bus < ecam.area.StartBus || a.Bus > ecam.area.EndBus {
+		return nil
+	}
+	ecam.mu.Lock()
+	defer ecam.mu.Unlock()
+	bus := ecam.buses[a.Bus]
+	if bus == nil {
+		addr := ecam.area.Addr + uint64(a.Bus-ecam.area.StartBus)*ecamBusSize
+		b, err := kernel.Map(uintptr(addr), ecamBusSize)
+		if err != nil {
+			return nil
+		}
+		ecam.buses[a.Bus] = b
+		bus = b
+	}
+	off := uint32(a.Device)<<15 | uint32(a.Function)<<12 | uint32(reg)
+	return (*uint32)(unsafe.Pointer(&bus[off]))
+}
+
+func initECAM() {
+	tables, ok := kernel.ACPITables()
+	if !ok || !tables.MCFG.Present {
+		return
+	}
+	for _, s := range tables.MCFG.Segments() {
+		if s.Segment == 0 {
+			ecam.area = s
+			ecam.ok = true
+			break
+		}
+	}
+}
+
 func (t *InterruptTable) SetupInterrupt(intr int, enable bool, addr uint64, data uint32) {
 	if addr&0x2 != 0 {
 		panic("pci: unaligned message address")
@@ -2,4 +2,4 @@
 
 set -e
 
-qemu-system-x86_64 -enable-kvm -machine q35 -net none -drive if=pflash,format=raw,readonly,file=/usr/share/OVMF/OVMF_CODE.fd -drive media=cdrom,format=raw,readonly,file=boot.img -vga virtio -display sdl,gl=on -device virtio-tablet-pci -serial stdio $@
+qemu-system-x86_64 -enable-kvm -machine q35 -netdev ${NETDEV:-user,id=net0} -device virtio-net-pci,netdev=net0 -drive if=pflash,format=raw,readonly,file=/usr/share/OVMF/OVMF_CODE.fd -drive if=virtio,format=raw,file=boot.img -vga virtio -display sdl,gl=on -device virtio-tablet-pci -device virtio-keyboard-pci -smp 4 -device isa-debug-exit,iobase=0xf4,iosize=0x04 -serial stdio $@
@@ -6,15 +6,17 @@
 #define ET_EXEC 0x02
 #define PT_LOAD 1
 
-static EFI_STATUS loadKernel(EFI_HANDLE imgHandle, EFI_SYSTEM_TABLE *sysTab, char **kernelRet, UINTN *kernelSizeRet) {
+// loadFile reads the file name from the boot volume into memory
+// allocated from the pool.
+static EFI_STATUS loadFile(EFI_HANDLE imgHandle, EFI_SYSTEM_TABLE *sysTab, CHAR16 *name, char **fileRet, UINTN *fileSizeRet) {
 	EFI_STATUS res;
 	EFI_LOADED_IMAGE_PROTOCOL *image;
 	EFI_SIMPLE_FILE_SYSTEM_PROTOCOL *fs;
-	EFI_FILE_PROTOCOL *root, *kernelFile;
+	EFI_FILE_PROTOCOL *root, *file;
 	UINTN bufSize;
 	EFI_FILE_INFO *fileInfo;
-	UINTN kernelSize;
-	VOID *kernel;
+	UINTN fileSize;
+	VOID *buf;
 
 	res = uefi_call_wrapper(sysTab->BootServices->HandleProtocol, 3,
 		imgHandle,
@@ -40,17 +42,17 @@ static EFI_STATUS loadKernel(EFI_HANDLE imgHandle, EFI_SYSTEM_TABLE *sysTab, cha
 		return res;
 	}
 	Print(L"Opened file system root\n");
-	res = uefi_call_wrapper(root->Open, 5, root, &kernelFile, L"\\KERNEL.ELF", EFI_FILE_MODE_READ, 0);
+	res = uefi_call_wrapper(root->Open, 5, root, &file, name, EFI_FILE_MODE_READ, 0);
 	uefi_call_wrapper(root->Close, 1, root);
 	if (res != EFI_SUCCESS) {
-		Print(L"Open(\"\\KERNEL.ELF\") failed: %d\n", res);
+		Print(L"Open(\"%s\") failed: %d\n", name, res);
 		return res;
 	}
 	bufSize = 0;
-	res = uefi_call_wrapper(kernelFile->GetInfo, 4, kernelFile, &gEfiFileInfoGuid, &bufSize, NULL);
+	res = uefi_call_wrapper(file->GetInfo, 4, file, &gEfiFileInfoGuid, &bufSize, NULL);
 	if (res != EFI_BUFFER_TOO_SMALL) {
-		Print(L"kernel->GetInfo failed: %d\n", res);
-		uefi_call_wrapper(kernelFile->Close, 1, kernelFile);
+		Print(L"%s: GetInfo failed: %d\n", name, res);
+		uefi_call_wrapper(file->Close, 1, file);
 		return res;
 	}
 	fileInfo = AllocatePool(bufSize);
@@ -58,53 +60,77 @@ static EFI_STATUS loadKernel(EFI_HANDLE imgHandle, EFI_SYSTEM_TABLE *sysTab, cha
 		Print(L"AllocPool(%d) failed\n", bufSize);
 		return EFI_OUT_OF_RESOURCES;
 	}
-	res = uefi_call_wrapper(kernelFile->GetInfo, 4, kernelFile, &gEfiFileInfoGuid, &bufSize, fileInfo);
-	kernelSize = fileInfo->FileSize;
+	res = uefi_call_wrapper(file->GetInfo, 4, file, &gEfiFileInfoGuid, &bufSize, fileInfo);
+	fileSize = fileInfo->FileSize;
 	FreePool(fileInfo);
 	if (res != EFI_SUCCESS) {
-		Print(L"kernel->GetInfo failed: %d\n", res);
-		uefi_call_wrapper(kernelFile->Close, 1, kernelFile);
-		return res;
-	}
-	Print(L"Found kernel, size %d\n", kernelSize);
-	if (kernelSize < ELF_HEADER_SIZE) {
-		Print(L"kernel image too small (%d)\n", kernelSize);
-		uefi_call_wrapper(kernelFile->Close, 1, kernelFile);
+		Print(L"%s: GetInfo failed: %d\n", name, res);
+		uefi_call_wrapper(file->Close, 1, file);
 		return res;
 	}
-	kernel = AllocatePool(kernelSize);
-	if (kernel == NULL) {
-		uefi_call_wrapper(kernelFile->Close, 1, kernelFile);
-		Print(L"AllocPool(%d) failed\n", kernelSize);
+	Print(L"Found %s, size %d\n", name, fileSize);
+	buf = AllocatePool(fileSize);
+	if (buf == NULL) {
+		uefi_call_wrapper(file->Close, 1, file);
+		Print(L"AllocPool(%d) failed\n", fileSize);
 		return EFI_OUT_OF_RESOURCES;
 	}
-	res = uefi_call_wrapper(kernelFile->Read, 3, kernelFile, &kernelSize, kernel);
-	uefi_call_wrapper(kernelFile->Close, 1, kernelFile);
+	res = uefi_call_wrapper(file->Read, 3, file, &fileSize, buf);
+	uefi_call_wrapper(file->Close, 1, file);
 	if (res != EFI_SUCCESS) {
-		FreePool(kernel);
-		Print(L"kernel->Read failed: %d\n", res);
+		FreePool(buf);
+		Print(L"%s: Read failed: %d\n", name, res);
 		return res;
 	}
-	*kernelRet = kernel;
-	*kernelSizeRet = kernelSize;
+	*fileRet = buf;
+	*fileSizeRet = fileSize;
 	return EFI_SUCCESS;
 }
 
+// findRSDP returns the address of the ACPI root system description
+// pointer, or NULL if the firmware doesn't provide one.
+static void *findRSDP(EFI_SYSTEM_TABLE *sysTab) {
+	void *rsdp = NULL;
+	for (UINTN i = 0; i < sysTab->NumberOfTableEntries; i++) {
+		EFI_CONFIGURATION_TABLE *t = &sysTab->ConfigurationTable[i];
+		// Prefer the ACPI 2.0 RSDP.
+		if (CompareGuid(&t->VendorGuid, &AcpiTableGuid) == 0 && rsdp == NULL) {
+			rsdp = t->VendorTable;
+		}
+		if (CompareGuid(&t->VendorGuid, &Acpi20TableGuid) == 0) {
+			return t->VendorTable;
+		}
+	}
+	return rsdp;
+}
+
 EFI_STATUS
 EFIAPI
 efi_main (EFI_HANDLE imgHandle, EFI_SYSTEM_TABLE *sysTab) {
 	EFI_STATUS res;
 	char *kernel;
 	UINTN kernelSize;
+	char *initramfs = NULL;
+	UINTN initramfsSize = 0;
 
 	InitializeLib(imgHandle, sysTab);
 	uefi_call_wrapper(sysTab->ConOut->ClearScreen, 1, sysTab->ConOut);
 	Print(L"Booting...\n");
-	res = loadKernel(imgHandle, sysTab, &kernel, &kernelSize);
+	res = loadFile(imgHandle, sysTab, L"\\KERNEL.ELF", &kernel, &kernelSize);
 	if (res != EFI_SUCCESS) {
+		return EFI_LOAD_ERROR;
+	}
+	if (kernelSize < ELF_HEADER_SIZE) {
 		FreePool(kernel);
+		Print(L"kernel image too small (%d)\n", kernelSize);
 		return EFI_LOAD_ERROR;
 	}
+	// The initramfs archive is optional.
+	res = loadFile(imgHandle, sysTab, L"\\INITRAMFS.CPIO", &initramfs, &initramfsSize);
+	if (res != EFI_SUCCESS) {
+		initramfs = NULL;
+		initramfsSize = 0;
+	}
 
 	int32_t magic = *(int32_t *)(kernel + 0);
 	if (magic != ELF_MAGIC) {
@@ -149,6 +175,9 @@ efi_main (EFI_HANDLE imgHandle, EFI_SYSTEM_TABLE *sysTab) {
 	// Go side reads the kernel image.
 	//FreePool(kernel);
 
+	void *rsdp = findRSDP(sysTab);
+	Print(L"ACPI RSDP: 0x%lx\n", rsdp);
+
 	Print(L"Exiting boot services and jumping to entry 0x%lx\n", entryAddr);
 	UINTN mapKey;
 	UINTN mmapSize = 0;
@@ -181,9 +210,9 @@ efi_main (EFI_HANDLE imgHandle, EFI_SYSTEM_TABLE *sysTab) {
 		return EFI_LOAD_ERROR;
 	}
 
-	typedef void (*entryFunc)(uint64_t mmapSize, uint64_t descSize, uint64_t kernelImageSize, EFI_MEMORY_DESCRIPTOR *mmap, void *kernelImage);
+	typedef void (*entryFunc)(uint64_t mmapSize, uint64_t descSize, uint64_t kernelImageSize, EFI_MEMORY_DESCRIPTOR *mmap, void *kernelImage, void *rsdp, void *initramfs, uint64_t initramfsSize);
 
 	entryFunc entry = (entryFunc)entryAddr;
-	entry(mmapSize, descSize, kernelSize, mmap, kernel);
+	entry(mmapSize, descSize, kernelSize, mmap, kernel, rsdp, initramfs, initramfsSize);
 	return EFI_LOAD_ERROR;
 }
@@ -0,0 +1,411 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+// Package blk implements a driver for virtio block devices.
+package blk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"unsafe"
+
+	"eliasnaur.com/unik/kernel"
+	"eliasnaur.com/unik/virtio"
+)
+
+// Device is a virtio block device. Its methods are safe for
+// concurrent use; concurrent requests are spread over the device
+// queues.
+type Device struct {
+	dev *virtio.Device
+	cfg *config
+
+	capacity  int64
+	blockSize int
+	readOnly  bool
+	flush     bool
+	discard   struct {
+		enabled bool
+		// maxSectors is the maximum number of sectors in a single
+		// discard request.
+		maxSectors uint32
+	}
+	// maxTransfer is the maximum number of bytes transferred by a
+	// single request.
+	maxTransfer int
+
+	// queues holds the idle request queues.
+	queues chan *queue
+}
+
+// queue is a request queue along with its request buffer.
+type queue struct {
+	q *virtio.Commander
+	// buf holds the request header, followed by the data and the
+	// status byte.
+	buf *virtio.IOMem
+}
+
+type config struct {
+	capacity uint64
+	size_max uint32
+	seg_max  uint32
+	geometry struct {
+		cylinders uint16
+		heads     uint8
+		sectors   uint8
+	}
+	blk_size uint32
+	topology struct {
+		physical_block_exp uint8
+		alignment_offset   uint8
+		min_io_size        uint16
+		opt_io_size        uint32
+	}
+	writeback                uint8
+	unused0                  uint8
+	num_queues               uint16
+	max_discard_sectors      uint32
+	max_discard_seg          uint32
+	discard_sector_alignment uint32
+}
+
+type reqHeader struct {
+	_type    uint32
+	reserved uint32
+	sector   uint64
+}
+
+type discardSegment struct {
+	sector      uint64
+	num_sectors uint32
+	flags       uint32
+}
+
+const (
+	// Feature bits.
+	_VIRTIO_BLK_F_SIZE_MAX = 1 << 1
+	_VIRTIO_BLK_F_SEG_MAX  = 1 << 2
+	_VIRTIO_BLK_F_RO       = 1 << 5
+	_VIRTIO_BLK_F_BLK_SIZE = 1 << 6
+	_VIRTIO_BLK_F_FLUSH    = 1 << 9
+	_VIRTIO_BLK_F_MQ       = 1 << 12
+	_VIRTIO_BLK_F_DISCARD  = 1 << 13
+
+	// Request types.
+	_VIRTIO_BLK_T_IN      = 0
+	_VIRTIO_BLK_T_OUT     = 1
+	_VIRTIO_BLK_T_FLUSH   = 4
+	_VIRTIO_BLK_T_DISCARD = 11
+
+	// Request status.
+	_VIRTIO_BLK_S_OK     = 0
+	_VIRTIO_BLK_S_IOERR  = 1
+	_VIRTIO_BLK_S_UNSUPP = 2
+)
+
+const (
+	// SectorSize is the unit of block device addresses.
+	SectorSize = 512
+
+	headerSize = int(unsafe.Sizeof(reqHeader{}))
+
+	// maxTransfer is the maximum size of a request.
+	maxTransfer = 128 << 10
+	// maxQueues is the maximum number of request queues used.
+	maxQueues = 4
+)
+
+var (
+	ErrReadOnly    = errors.New("blk: read-only device")
+	ErrUnsupported = errors.New("blk: unsupported request")
+)
+
+func New() (*Device, error) {
+	const deviceTypeBlock = 2
+	vdev, err := virtio.New(deviceTypeBlock)
+	if err != nil {
+		return nil, err
+	}
+	return newDevice(vdev)
+}
+
+func newDevice(dev *virtio.Device) (*Device, error) {
+	devCfgMap, _, err := dev.FindCapability(virtio.PCI_CAP_DEVICE_CFG)
+	if err != nil {
+		return nil, err
+	}
+	if cfgSize := uintptr(len(devCfgMap)); unsafe.Offsetof(config{}.num_queues)+2 > cfgSize {
+		return nil, fmt.Errorf("blk: device configuration area too small (%d bytes)", cfgSize)
+	}
+	d := &Device{
+		dev: dev,
+		cfg: (*config)(unsafe.Pointer(&devCfgMap[0])),
+	}
+	var queues []*virtio.Queue
+	for {
+		before := dev.ConfigGeneration()
+		dev.Reset()
+		needFeats := uint64(virtio.F_VERSION_1)
+		feats := dev.Features()
+		if feats&needFeats != needFeats {
+			return nil, fmt.Errorf("blk: supports features %#x need at least %#x", feats, needFeats)
+		}
+		wantFeats := uint64(_VIRTIO_BLK_F_SIZE_MAX | _VIRTIO_BLK_F_SEG_MAX | _VIRTIO_BLK_F_RO |
+			_VIRTIO_BLK_F_BLK_SIZE | _VIRTIO_BLK_F_FLUSH | _VIRTIO_BLK_F_MQ)
+		if unsafe.Sizeof(config{}) <= uintptr(len(devCfgMap)) {
+			wantFeats |= _VIRTIO_BLK_F_DISCARD
+		}
+		feats &= needFeats | wantFeats
+		if err := dev.NegotiateFeatures(feats); err != nil {
+			return nil, err
+		}
+		d.readConfig(feats)
+		nqueues := 1
+		if feats&_VIRTIO_BLK_F_MQ != 0 {
+			nqueues = int(kernel.LoadUint16(&d.cfg.num_queues))
+			if nqueues > maxQueues {
+				nqueues = maxQueues
+			}
+			if nqueues < 1 {
+				nqueues = 1
+			}
+		}
+		queues = queues[:0]
+		for i := 0; i < nqueues; i++ {
+			q, err := dev.ConfigureQueue(uint16(i))
+			if err != nil {
+				return nil, err
+			}
+			queues = append(queues, q)
+		}
+		if after := dev.ConfigGeneration(); after != before {
+			// Configuration changed under us.
+			continue
+		}
+		dev.Start()
+		break
+	}
+	d.queues = make(chan *queue, len(queues))
+	for _, q := range queues {
+		bufSize := headerSize + d.maxTransfer + 1
+		buf, err := virtio.NewIOMem(bufSize, bufSize)
+		if err != nil {
+			return nil, err
+		}
+		d.queues <- &queue{
+			q:   virtio.NewCommander(q),
+			buf: buf,
+		}
+	}
+	return d, nil
+}
+
+// readConfig reads the device configuration for the negotiated
+// features.
+func (d *Device) readConfig(feats uint64) {
+	d.capacity = int64(atomic.LoadUint64(&d.cfg.capacity)) * SectorSize
+	d.readOnly = feats&_VIRTIO_BLK_F_RO != 0
+	d.flush = feats&_VIRTIO_BLK_F_FLUSH != 0
+	d.blockSize = SectorSize
+	if feats&_VIRTIO_BLK_F_BLK_SIZE != 0 {
+		if bs := int(atomic.LoadUint32(&d.cfg.blk_size)); bs >= SectorSize && bs&(bs-1) == 0 {
+			d.blockSize = bs
+		}
+	}
+	// The header and data of a write request share a segment.
+	d.maxTransfer = maxTransfer
+	if feats&_VIRTIO_BLK_F_SIZE_MAX != 0 {
+		if max := int(atomic.LoadUint32(&d.cfg.size_max)) - headerSize; max < d.maxTransfer {
+			d.maxTransfer = max &^ (SectorSize - 1)
+		}
+		if d.maxTransfer < SectorSize {
+			d.maxTransfer = SectorSize
+		}
+	}
+	d.discard.enabled = false
+	if feats&_VIRTIO_BLK_F_DISCARD != 0 {
+		d.discard.maxSectors = atomic.LoadUint32(&d.cfg.max_discard_sectors)
+		d.discard.enabled = d.discard.maxSectors > 0
+	}
+}
+
+// Size returns the capacity of the device in bytes.
+func (d *Device) Size() int64 {
+	return d.capacity
+}
+
+// BlockSize returns the logical block size of the device. Accesses
+// aligned to the block size are the most efficient.
+func (d *Device) BlockSize() int {
+	return d.blockSize
+}
+
+// ReadOnly reports whether the device rejects writes.
+func (d *Device) ReadOnly() bool {
+	return d.readOnly
+}
+
+// ReadAt implements io.ReaderAt.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("blk: negative offset")
+	}
+	var err error
+	if max := d.capacity - off; int64(len(p)) > max {
+		if max < 0 {
+			max = 0
+		}
+		p = p[:max]
+		err = io.EOF
+	}
+	q := <-d.queues
+	defer func() { d.queues <- q }()
+	n := 0
+	for len(p) > 0 {
+		sector, size, m := d.chunk(off, len(p))
+		if err := q.transfer(_VIRTIO_BLK_T_IN, sector, size); err != nil {
+			return n, err
+		}
+		copy(p, q.data(size)[off%SectorSize:][:m])
+		p = p[m:]
+		off += int64(m)
+		n += m
+	}
+	return n, err
+}
+
+// WriteAt implements io.WriterAt. Writes of partial sectors are
+// completed with the existing contents of the device.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	if off < 0 || off+int64(len(p)) > d.capacity {
+		return 0, errors.New("blk: write outside device")
+	}
+	q := <-d.queues
+	defer func() { d.queues <- q }()
+	n := 0
+	for len(p) > 0 {
+		sector, size, m := d.chunk(off, len(p))
+		if off%SectorSize != 0 || m%SectorSize != 0 {
+			// Read the partial sectors before overwriting.
+			if err := q.transfer(_VIRTIO_BLK_T_IN, sector, size); err != nil {
+				return n, err
+			}
+		}
+		copy(q.data(size)[off%SectorSize:], p[:m])
+		if err := q.transfer(_VIRTIO_BLK_T_OUT, sector, size); err != nil {
+			return n, err
+		}
+		p = p[m:]
+		off += int64(m)
+		n += m
+	}
+	return n, nil
+}
+
+// chunk returns the first sector and size of the largest request
+// that covers the n bytes at off, along with the number of bytes
+// covered.
+func (d *Device) chunk(off int64, n int) (uint64, int, int) {
+	start := off &^ (SectorSize - 1)
+	end := off + int64(n)
+	if max := start + int64(d.maxTransfer); end > max {
+		end = max
+	}
+	size := int((end+SectorSize-1)&^(SectorSize-1) - start)
+	return uint64(start / SectorSize), size, int(end - off)
+}
+
+// Flush commits written data to stable storage.
+func (d *Device) Flush() error {
+	if !d.flush {
+		// The device is write-through.
+		return nil
+	}
+	q := <-d.queues
+	defer func() { d.queues <- q }()
+	return q.transfer(_VIRTIO_BLK_T_FLUSH, 0, 0)
+}
+
+// Discard informs the device that the n bytes at off are unused.
+// The offset and length must be multiples of SectorSize. Discard is a
+// hint and does nothing if the device doesn't support it.
+func (d *Device) Discard(off, n int64) error {
+	if off%SectorSize != 0 || n%SectorSize != 0 || off < 0 || n < 0 || off+n > d.capacity {
+		return errors.New("blk: invalid discard range")
+	}
+	if !d.discard.enabled {
+		return nil
+	}
+	q := <-d.queues
+	defer func() { d.queues <- q }()
+	sector := uint64(off / SectorSize)
+	nsectors := uint64(n / SectorSize)
+	for nsectors > 0 {
+		count := nsectors
+		if max := uint64(d.discard.maxSectors); count > max {
+			count = max
+		}
+		seg := (*discardSegment)(unsafe.Pointer(&q.buf.Mem[headerSize]))
+		*seg = discardSegment{
+			sector:      sector,
+			num_sectors: uint32(count),
+		}
+		err := q.transfer(_VIRTIO_BLK_T_DISCARD, 0, int(unsafe.Sizeof(*seg)))
+		if err != nil {
+			return err
+		}
+		sector += count
+		nsectors -= count
+	}
+	return nil
+}
+
+// data returns the data area of the request buffer.
+func (q *queue) data(size int) []byte {
+	return q.buf.Mem[headerSize : headerSize+size]
+}
+
+// transfer issues a request with size bytes of data and waits for
+// its completion. The device reads the data of all request types
+// except _VIRTIO_BLK_T_IN.
+func (q *queue) transfer(typ uint32, sector uint64, size int) error {
+	hdr := (*reqHeader)(unsafe.Pointer(&q.buf.Mem[0]))
+	*hdr = reqHeader{
+		_type:  typ,
+		sector: sector,
+	}
+	status := &q.buf.Mem[headerSize+size]
+	*status = 0xff
+	var req, resp virtio.IOMem
+	if typ == _VIRTIO_BLK_T_IN {
+		req = q.buf.Slice(0, headerSize)
+		resp = q.buf.Slice(headerSize, headerSize+size+1)
+	} else {
+		req = q.buf.Slice(0, headerSize+size)
+		resp = q.buf.Slice(headerSize+size, headerSize+size+1)
+	}
+	for !q.q.Command(req, resp) {
+		if _, err := q.q.Read(); err != nil {
+			return err
+		}
+	}
+	q.q.Sync()
+	if _, err := q.q.Read(); err != nil {
+		return err
+	}
+	switch s := kernel.LoadUint8(status); s {
+	case _VIRTIO_BLK_S_OK:
+		return nil
+	case _VIRTIO_BLK_S_IOERR:
+		return fmt.Errorf("blk: I/O error at sector %d", sector)
+	case _VIRTIO_BLK_S_UNSUPP:
+		return ErrUnsupported
+	default:
+		return fmt.Errorf("blk: invalid request status %#x", s)
+	}
+}
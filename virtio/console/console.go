@@ -0,0 +1,433 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+// Package console implements a driver for virtio console devices.
+package console
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"eliasnaur.com/unik/virtio"
+)
+
+// Device is a virtio console device. Its methods are safe for
+// concurrent use.
+type Device struct {
+	dev *virtio.Device
+	cfg *config
+
+	multiport bool
+	// ports are the ports with configured queues, indexed by port
+	// id.
+	ports []*Port
+
+	ctrl struct {
+		r   *virtio.Reader
+		buf []byte
+
+		mu  sync.Mutex
+		cmd *virtio.Commander
+		msg *virtio.IOMem
+	}
+
+	// mu protects the port state and cond signals its changes.
+	mu   sync.Mutex
+	cond sync.Cond
+}
+
+// Port is a port of a console device. Read and Write transfer data
+// with the host, which discards data written while it is not
+// connected.
+type Port struct {
+	d  *Device
+	id uint32
+
+	rx struct {
+		mu sync.Mutex
+		r  *virtio.Reader
+	}
+
+	tx struct {
+		mu  sync.Mutex
+		cmd *virtio.Commander
+		buf *virtio.IOMem
+	}
+
+	// The fields below are protected by Device.mu.
+
+	// added is set while the host exposes the port.
+	added   bool
+	name    string
+	console bool
+}
+
+type config struct {
+	cols         uint16
+	rows         uint16
+	max_nr_ports uint32
+	emerg_wr     uint32
+}
+
+// controlMsg is struct virtio_console_control.
+type controlMsg struct {
+	id    uint32
+	event uint16
+	value uint16
+}
+
+const (
+	// Feature bits.
+	_VIRTIO_CONSOLE_F_MULTIPORT = 1 << 1
+
+	// Control events.
+	_VIRTIO_CONSOLE_DEVICE_READY  = 0
+	_VIRTIO_CONSOLE_DEVICE_ADD    = 1
+	_VIRTIO_CONSOLE_DEVICE_REMOVE = 2
+	_VIRTIO_CONSOLE_PORT_READY    = 3
+	_VIRTIO_CONSOLE_CONSOLE_PORT  = 4
+	_VIRTIO_CONSOLE_RESIZE        = 5
+	_VIRTIO_CONSOLE_PORT_OPEN     = 6
+	_VIRTIO_CONSOLE_PORT_NAME     = 7
+
+	// Queue indices. The queues of port n > 0 follow the control
+	// queues.
+	port0ReceiveQueue    = 0
+	port0TransmitQueue   = 1
+	controlReceiveQueue  = 2
+	controlTransmitQueue = 3
+)
+
+const (
+	ctrlSize = int(unsafe.Sizeof(controlMsg{}))
+	// ctrlBufSize is the size of control receive buffers. It
+	// bounds the length of port names.
+	ctrlBufSize = 256
+	// bufSize is the size of port receive buffers and the
+	// transmit buffer.
+	bufSize = 256
+	txSize  = 4096
+	// maxPorts bounds the number of ports, each of which uses two
+	// queues and their interrupts.
+	maxPorts = 8
+)
+
+var errRemoved = errors.New("console: port removed")
+
+func New() (*Device, error) {
+	const deviceTypeConsole = 3
+	vdev, err := virtio.New(deviceTypeConsole)
+	if err != nil {
+		return nil, err
+	}
+	return newDevice(vdev)
+}
+
+func newDevice(dev *virtio.Device) (*Device, error) {
+	d := &Device{
+		dev: dev,
+	}
+	d.cond.L = &d.mu
+	devCfgMap, _, err := dev.FindCapability(virtio.PCI_CAP_DEVICE_CFG)
+	if err == nil && unsafe.Sizeof(config{}) <= uintptr(len(devCfgMap)) {
+		d.cfg = (*config)(unsafe.Pointer(&devCfgMap[0]))
+	}
+	type portQueues struct {
+		rx, tx *virtio.Queue
+	}
+	var queues []portQueues
+	var ctrlRx, ctrlTx *virtio.Queue
+	for {
+		before := dev.ConfigGeneration()
+		dev.Reset()
+		needFeats := uint64(virtio.F_VERSION_1)
+		feats := dev.Features()
+		if feats&needFeats != needFeats {
+			return nil, fmt.Errorf("console: supports features %#x need at least %#x", feats, needFeats)
+		}
+		wantFeats := uint64(0)
+		if d.cfg != nil {
+			wantFeats |= _VIRTIO_CONSOLE_F_MULTIPORT
+		}
+		feats &= needFeats | wantFeats
+		if err := dev.NegotiateFeatures(feats); err != nil {
+			return nil, err
+		}
+		d.multiport = feats&_VIRTIO_CONSOLE_F_MULTIPORT != 0
+		nports := 1
+		if d.multiport {
+			nports = int(atomic.LoadUint32(&d.cfg.max_nr_ports))
+			if nports > maxPorts {
+				nports = maxPorts
+			}
+		}
+		queues = queues[:0]
+		for i := 0; i < nports; i++ {
+			rxIdx, txIdx := uint16(port0ReceiveQueue), uint16(port0TransmitQueue)
+			if i > 0 {
+				rxIdx = uint16(2 + 2*i)
+				txIdx = rxIdx + 1
+			}
+			rx, err := dev.ConfigureQueue(rxIdx)
+			var tx *virtio.Queue
+			if err == nil {
+				tx, err = dev.ConfigureQueue(txIdx)
+			}
+			if err != nil {
+				if i == 0 {
+					return nil, err
+				}
+				// Make do with the ports configured so far.
+				break
+			}
+			queues = append(queues, portQueues{rx, tx})
+			if i == 0 && d.multiport {
+				ctrlRx, err = dev.ConfigureQueue(controlReceiveQueue)
+				if err != nil {
+					return nil, err
+				}
+				ctrlTx, err = dev.ConfigureQueue(controlTransmitQueue)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if after := dev.ConfigGeneration(); after != before {
+			// Configuration changed under us.
+			continue
+		}
+		break
+	}
+	d.ports = make([]*Port, len(queues))
+	for i, q := range queues {
+		p := &Port{d: d, id: uint32(i)}
+		p.tx.cmd = virtio.NewCommander(q.tx)
+		p.tx.buf, err = virtio.NewIOMem(txSize, txSize)
+		if err != nil {
+			return nil, err
+		}
+		d.ports[i] = p
+	}
+	if !d.multiport {
+		// Without multiport, the only port is the console.
+		p := d.ports[0]
+		p.added = true
+		p.console = true
+	} else {
+		d.ctrl.cmd = virtio.NewCommander(ctrlTx)
+		d.ctrl.msg, err = virtio.NewIOMem(ctrlSize, ctrlSize)
+		if err != nil {
+			return nil, err
+		}
+		d.ctrl.buf = make([]byte, ctrlBufSize)
+	}
+	dev.Start()
+	// Hand the receive buffers to the device after starting it.
+	for i, q := range queues {
+		size := q.rx.Size() * bufSize
+		buf, err := virtio.NewIOMem(size, size)
+		if err != nil {
+			return nil, err
+		}
+		d.ports[i].rx.r, err = virtio.NewReader(q.rx, *buf, bufSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if d.multiport {
+		size := ctrlRx.Size() * ctrlBufSize
+		buf, err := virtio.NewIOMem(size, size)
+		if err != nil {
+			return nil, err
+		}
+		d.ctrl.r, err = virtio.NewReader(ctrlRx, *buf, ctrlBufSize)
+		if err != nil {
+			return nil, err
+		}
+		go d.control()
+		// Ask the host for its ports.
+		if err := d.sendControl(0, _VIRTIO_CONSOLE_DEVICE_READY, 1); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// control processes control messages from the host.
+func (d *Device) control() {
+	for {
+		n, err := d.ctrl.r.ReadPacket(d.ctrl.buf)
+		if err != nil {
+			return
+		}
+		if n < ctrlSize {
+			continue
+		}
+		msg := *(*controlMsg)(unsafe.Pointer(&d.ctrl.buf[0]))
+		d.handleControl(msg, d.ctrl.buf[ctrlSize:n])
+	}
+}
+
+// handleControl handles the control message msg with its trailing
+// data.
+func (d *Device) handleControl(msg controlMsg, data []byte) {
+	d.mu.Lock()
+	var p *Port
+	if msg.id < uint32(len(d.ports)) {
+		p = d.ports[msg.id]
+	}
+	switch msg.event {
+	case _VIRTIO_CONSOLE_DEVICE_ADD:
+		if p == nil {
+			d.mu.Unlock()
+			// The port is beyond the configured queues.
+			d.sendControl(msg.id, _VIRTIO_CONSOLE_PORT_READY, 0)
+			return
+		}
+		p.added = true
+		d.mu.Unlock()
+		d.sendControl(msg.id, _VIRTIO_CONSOLE_PORT_READY, 1)
+		// Connect the port, or the host won't send to it.
+		d.sendControl(msg.id, _VIRTIO_CONSOLE_PORT_OPEN, 1)
+		d.cond.Broadcast()
+		return
+	case _VIRTIO_CONSOLE_DEVICE_REMOVE:
+		if p != nil {
+			p.added = false
+			p.name = ""
+			p.console = false
+		}
+	case _VIRTIO_CONSOLE_CONSOLE_PORT:
+		if p != nil {
+			p.console = true
+		}
+	case _VIRTIO_CONSOLE_PORT_NAME:
+		if p != nil {
+			if i := bytes.IndexByte(data, 0); i != -1 {
+				data = data[:i]
+			}
+			p.name = string(data)
+		}
+	}
+	d.mu.Unlock()
+	d.cond.Broadcast()
+}
+
+// sendControl sends a control message to the host.
+func (d *Device) sendControl(id uint32, event, value uint16) error {
+	c := &d.ctrl
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*(*controlMsg)(unsafe.Pointer(&c.msg.Mem[0])) = controlMsg{id: id, event: event, value: value}
+	// Every message completes before the next, so there is always
+	// a free descriptor.
+	c.cmd.Command(c.msg.Slice(0, ctrlSize), virtio.IOMem{})
+	c.cmd.Sync()
+	_, err := c.cmd.Read()
+	return err
+}
+
+// Ports returns the ports currently exposed by the host.
+func (d *Device) Ports() []*Port {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ports []*Port
+	for _, p := range d.ports {
+		if p.added {
+			ports = append(ports, p)
+		}
+	}
+	return ports
+}
+
+// Console waits for the host to expose a console port and returns
+// it.
+func (d *Device) Console() *Port {
+	return d.wait(func(p *Port) bool {
+		return p.console
+	})
+}
+
+// Port waits for the host to expose a port with the given name and
+// returns it.
+func (d *Device) Port(name string) *Port {
+	return d.wait(func(p *Port) bool {
+		return p.name == name
+	})
+}
+
+// wait waits for an exposed port that satisfies match.
+func (d *Device) wait(match func(p *Port) bool) *Port {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		for _, p := range d.ports {
+			if p.added && match(p) {
+				return p
+			}
+		}
+		d.cond.Wait()
+	}
+}
+
+// Name returns the name of the port, or the empty string if the host
+// didn't name it.
+func (p *Port) Name() string {
+	p.d.mu.Lock()
+	defer p.d.mu.Unlock()
+	return p.name
+}
+
+// IsConsole reports whether the host uses the port as a console.
+func (p *Port) IsConsole() bool {
+	p.d.mu.Lock()
+	defer p.d.mu.Unlock()
+	return p.console
+}
+
+// Read blocks until data from the host arrives and reads it into
+// buf.
+func (p *Port) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	p.rx.mu.Lock()
+	defer p.rx.mu.Unlock()
+	for {
+		n, err := p.rx.r.Read(buf)
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Write sends buf to the host.
+func (p *Port) Write(buf []byte) (int, error) {
+	t := &p.tx
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for n < len(buf) {
+		p.d.mu.Lock()
+		added := p.added
+		p.d.mu.Unlock()
+		if !added {
+			return n, errRemoved
+		}
+		c := copy(t.buf.Mem, buf[n:])
+		t.cmd.Command(t.buf.Slice(0, c), virtio.IOMem{})
+		// Wait for the device to release the buffer.
+		t.cmd.Sync()
+		if _, err := t.cmd.Read(); err != nil {
+			return n, err
+		}
+		n += c
+	}
+	return n, nil
+}
+
+var _ io.ReadWriter = (*Port)(nil)
@@ -43,10 +43,17 @@ type Device struct {
 		rect rect
 	}
 
+	// virgl is set if the device supports 3D commands.
+	virgl bool
 	ctxID uint32
 
 	nextID uint32
 
+	// scanoutBuf backs the 2D scanouts. It is shared among
+	// scanouts to avoid leaking physical memory.
+	scanoutBuf  *virtio.IOMem
+	scanoutUsed bool
+
 	submitBuf bytes.Buffer
 	submitErr error
 }
@@ -518,12 +525,19 @@ func New() (*Device, error) {
 	if err != nil {
 		return nil, err
 	}
+	if !d.virgl {
+		// Run in 2D mode.
+		return d, nil
+	}
 	caps, err := d.queryCaps()
 	if err != nil {
 		return nil, err
 	}
 	if caps.capability_bits&_VIRGL_CAP_COPY_TRANSFER == 0 {
-		return nil, errors.New("virtgpu: VIRGL_CAP_COPY_TRANSFER not supported (qemu version < 4.2.0?)")
+		// VIRGL_CAP_COPY_TRANSFER is not supported (qemu version
+		// < 4.2.0?). Fall back to 2D mode.
+		d.virgl = false
+		return d, nil
 	}
 	ctxID := d.cmdCtxCreate()
 	if err := d.Flush3D(); err != nil {
@@ -544,14 +558,18 @@ func newDevice(dev *virtio.Device) (*Device, error) {
 	cfg := (*config)(unsafe.Pointer(&devCfgMap[0]))
 	var controlq *virtio.Queue
 	var cursorq *virtio.Queue
+	var feats uint64
 	for {
 		before := dev.ConfigGeneration()
 		dev.Reset()
-		needFeats := uint64(virtio.F_VERSION_1 | _VIRTIO_GPU_F_VIRGL)
-		if feats := dev.Features(); feats&needFeats != needFeats {
+		needFeats := uint64(virtio.F_VERSION_1)
+		feats = dev.Features()
+		if feats&needFeats != needFeats {
 			return nil, fmt.Errorf("gpu: supports features %#x need at least %#x", feats, needFeats)
 		}
-		if err := dev.NegotiateFeatures(needFeats); err != nil {
+		// Use 3D commands if available.
+		feats = needFeats | feats&_VIRTIO_GPU_F_VIRGL
+		if err := dev.NegotiateFeatures(feats); err != nil {
 			return nil, err
 		}
 		controlq, err = dev.ConfigureQueue(virtGPUControlQueue)
@@ -570,7 +588,8 @@ func newDevice(dev *virtio.Device) (*Device, error) {
 		break
 	}
 	gpu := &Device{
-		dev: dev,
+		dev:   dev,
+		virgl: feats&_VIRTIO_GPU_F_VIRGL != 0,
 	}
 	gpu.cfg.cfg = cfg
 
@@ -599,6 +618,13 @@ func (d *Device) ConfigNotify() <-chan struct{} {
 	return d.cfg.notify
 }
 
+// Has3D reports whether the device supports 3D commands. Devices
+// without 3D support, such as Qemu without OpenGL, display through
+// 2D scanouts.
+func (d *Device) Has3D() bool {
+	return d.virgl
+}
+
 func (d *Device) NewCursor(img *image.RGBA, hotspot image.Point) (Resource, error) {
 	width, height := img.Bounds().Dx(), img.Bounds().Dy()
 	if width != 64 || height != 64 {
@@ -608,7 +634,12 @@ func (d *Device) NewCursor(img *image.RGBA, hotspot image.Point) (Resource, erro
 	if img.Stride != width*4 {
 		return 0, errors.New("virtgpu: cursor stride is not width*4")
 	}
-	resID := d.cmdResourceCreate2D(VIRGL_FORMAT_B8G8R8A8_SRGB, uint32(width), uint32(height))
+	format := uint32(VIRGL_FORMAT_B8G8R8A8_SRGB)
+	if !d.virgl {
+		// Only the virtio formats are available in 2D mode.
+		format = _VIRTIO_GPU_FORMAT_B8G8R8A8_UNORM
+	}
+	resID := d.cmdResourceCreate2D(format, uint32(width), uint32(height))
 	cursor, err := d.alloc(width * height * 4)
 	if err != nil {
 		return 0, err
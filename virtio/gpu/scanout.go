@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package gpu
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+
+	"eliasnaur.com/unik/virtio"
+)
+
+// Scanout is a display buffer that works without 3D support. Its
+// pixels live in guest memory and are transferred to the host by
+// Flush. Scanout implements draw.Image.
+type Scanout struct {
+	d   *Device
+	res Resource
+	// Pix holds the pixels in B, G, R, X order, starting at the top
+	// left corner.
+	Pix    []byte
+	Stride int
+	Rect   image.Rectangle
+}
+
+// maxScanoutSize is the size of the largest scanout, 4096x4096 pixels.
+const maxScanoutSize = 4096 * 4096 * 4
+
+// NewScanout creates a Scanout for the current size of the display
+// and displays it. Only one Scanout may exist at a time.
+func (d *Device) NewScanout() (*Scanout, error) {
+	if d.scanoutUsed {
+		return nil, errors.New("gpu: scanout in use")
+	}
+	width, height, err := d.QueryScanout()
+	if err != nil {
+		return nil, err
+	}
+	size := width * height * 4
+	if size > maxScanoutSize {
+		return nil, fmt.Errorf("gpu: scanout too large (%dx%d)", width, height)
+	}
+	if d.scanoutBuf == nil {
+		buf, err := virtio.NewIOMem(0, maxScanoutSize)
+		if err != nil {
+			return nil, err
+		}
+		d.scanoutBuf = buf
+	}
+	if err := d.scanoutBuf.Ensure(size); err != nil {
+		return nil, err
+	}
+	mem := d.scanoutBuf.Slice(0, size)
+	for i := range mem.Mem {
+		mem.Mem[i] = 0
+	}
+	res := d.cmdResourceCreate2D(_VIRTIO_GPU_FORMAT_B8G8R8X8_UNORM, uint32(width), uint32(height))
+	d.cmdResourceAttachBacking(res, mem)
+	d.CmdSetScanout(res)
+	if err := d.Flush3D(); err != nil {
+		return nil, err
+	}
+	d.scanoutUsed = true
+	return &Scanout{
+		d:      d,
+		res:    res,
+		Pix:    mem.Mem,
+		Stride: width * 4,
+		Rect:   image.Rectangle{Max: image.Point{X: width, Y: height}},
+	}, nil
+}
+
+func (s *Scanout) ColorModel() color.Model {
+	return color.RGBAModel
+}
+
+func (s *Scanout) Bounds() image.Rectangle {
+	return s.Rect
+}
+
+func (s *Scanout) At(x, y int) color.Color {
+	return s.RGBAAt(x, y)
+}
+
+func (s *Scanout) RGBAAt(x, y int) color.RGBA {
+	if !(image.Point{X: x, Y: y}).In(s.Rect) {
+		return color.RGBA{}
+	}
+	p := s.Pix[s.PixOffset(x, y):]
+	return color.RGBA{R: p[2], G: p[1], B: p[0], A: 0xff}
+}
+
+func (s *Scanout) Set(x, y int, c color.Color) {
+	s.SetRGBA(x, y, color.RGBAModel.Convert(c).(color.RGBA))
+}
+
+// SetRGBA sets the pixel at (x, y). The display is opaque, so the
+// alpha component of c is ignored.
+func (s *Scanout) SetRGBA(x, y int, c color.RGBA) {
+	if !(image.Point{X: x, Y: y}).In(s.Rect) {
+		return
+	}
+	p := s.Pix[s.PixOffset(x, y):]
+	p[0], p[1], p[2], p[3] = c.B, c.G, c.R, 0xff
+}
+
+// PixOffset returns the index of the first element of Pix that
+// corresponds to the pixel at (x, y).
+func (s *Scanout) PixOffset(x, y int) int {
+	return (y-s.Rect.Min.Y)*s.Stride + (x-s.Rect.Min.X)*4
+}
+
+// Flush transfers the pixels inside the damage rectangle to the host
+// and updates the display. Flush waits until the host is done with
+// the pixels.
+func (s *Scanout) Flush(damage image.Rectangle) error {
+	damage = damage.Intersect(s.Rect)
+	if damage.Empty() {
+		return nil
+	}
+	r := rect{
+		x:      uint32(damage.Min.X),
+		y:      uint32(damage.Min.Y),
+		width:  uint32(damage.Dx()),
+		height: uint32(damage.Dy()),
+	}
+	off := uint64(s.PixOffset(damage.Min.X, damage.Min.Y))
+	s.d.cmdTransferToHost2D(s.res, off, r, false)
+	s.d.cmdResourceFlush(s.res, r)
+	return s.d.Flush3D()
+}
+
+// Release frees the scanout. A new Scanout must be created to display
+// anything after Release.
+func (s *Scanout) Release() {
+	s.d.cmdResourceDetachBacking(s.res)
+	s.d.CmdResourceUnref(s.res)
+	s.d.sync()
+	s.d.scanoutUsed = false
+}
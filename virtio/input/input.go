@@ -14,7 +14,14 @@ import (
 )
 
 type Device struct {
-	Name string
+	Name   string
+	Serial string
+	IDs    DevIDs
+
+	// props is the bitmap of input properties and evBits the bitmaps
+	// of supported event codes, indexed by event type.
+	props  Bitmap
+	evBits [EV_CNT]Bitmap
 
 	dev *virtio.Device
 	cfg *config
@@ -29,6 +36,17 @@ type Event struct {
 	Value uint32
 }
 
+// DevIDs identifies the bus, vendor, product and version of a device.
+type DevIDs struct {
+	Bustype uint16
+	Vendor  uint16
+	Product uint16
+	Version uint16
+}
+
+// Bitmap is a set of event types, codes or properties.
+type Bitmap []byte
+
 type AbsInfo struct {
 	Min  uint32
 	Max  uint32
@@ -50,21 +68,61 @@ const (
 	EV_KEY = 0x01
 	EV_REL = 0x02
 	EV_ABS = 0x03
+	EV_MSC = 0x04
+	EV_SW  = 0x05
+	EV_LED = 0x11
+	EV_SND = 0x12
+	EV_REP = 0x14
+	EV_MAX = 0x1f
+	EV_CNT = EV_MAX + 1
+)
+
+// Input properties.
+const (
+	INPUT_PROP_POINTER        = 0x00
+	INPUT_PROP_DIRECT         = 0x01
+	INPUT_PROP_BUTTONPAD      = 0x02
+	INPUT_PROP_SEMI_MT        = 0x03
+	INPUT_PROP_TOPBUTTONPAD   = 0x04
+	INPUT_PROP_POINTING_STICK = 0x05
+	INPUT_PROP_ACCELEROMETER  = 0x06
+)
+
+const (
+	SYN_REPORT  = 0
+	SYN_DROPPED = 3
 )
 
+// Values of EV_KEY events.
 const (
-	BTN_LEFT   = 0x110
-	BTN_RIGHT  = 0x111
-	BTN_MIDDLE = 0x112
-	BTN_WHEEL  = 0x150
+	KeyReleased = 0
+	KeyPressed  = 1
+	KeyRepeated = 2
 )
 
 const (
 	REL_WHEEL  = 0x08
 	REL_HWHEEL = 0x06
 
-	ABS_X = 0x00
-	ABS_Y = 0x01
+	ABS_X        = 0x00
+	ABS_Y        = 0x01
+	ABS_PRESSURE = 0x18
+
+	ABS_MT_SLOT        = 0x2f
+	ABS_MT_TOUCH_MAJOR = 0x30
+	ABS_MT_TOUCH_MINOR = 0x31
+	ABS_MT_WIDTH_MAJOR = 0x32
+	ABS_MT_WIDTH_MINOR = 0x33
+	ABS_MT_ORIENTATION = 0x34
+	ABS_MT_POSITION_X  = 0x35
+	ABS_MT_POSITION_Y  = 0x36
+	ABS_MT_TOOL_TYPE   = 0x37
+	ABS_MT_BLOB_ID     = 0x38
+	ABS_MT_TRACKING_ID = 0x39
+	ABS_MT_PRESSURE    = 0x3a
+	ABS_MT_DISTANCE    = 0x3b
+	ABS_MT_TOOL_X      = 0x3c
+	ABS_MT_TOOL_Y      = 0x3d
 )
 
 const (
@@ -81,13 +139,26 @@ const virtInputEventQueue = 0
 
 const eventSize = int(unsafe.Sizeof(Event{}))
 
-func New() (*Device, error) {
+// New returns every virtio input device, such as keyboards, mice and
+// tablets.
+func New() ([]*Device, error) {
 	const deviceTypeInput = 18
-	vdev, err := virtio.New(deviceTypeInput)
+	vdevs, err := virtio.NewAll(deviceTypeInput)
 	if err != nil {
 		return nil, err
 	}
-	return newDevice(vdev)
+	if len(vdevs) == 0 {
+		return nil, errors.New("input: no virtio input devices")
+	}
+	var devs []*Device
+	for _, vdev := range vdevs {
+		d, err := newDevice(vdev)
+		if err != nil {
+			return nil, err
+		}
+		devs = append(devs, d)
+	}
+	return devs, nil
 }
 
 func newDevice(dev *virtio.Device) (*Device, error) {
@@ -119,6 +190,7 @@ func newDevice(dev *virtio.Device) (*Device, error) {
 			name = bytes.TrimRight(name, "\x00")
 			d.Name = string(name)
 		}
+		d.queryCaps()
 		eventq, err = dev.ConfigureQueue(virtInputEventQueue)
 		if err != nil {
 			return nil, err
@@ -143,6 +215,75 @@ func newDevice(dev *virtio.Device) (*Device, error) {
 	return d, nil
 }
 
+// queryCaps reads the identity and capabilities of the device.
+func (d *Device) queryCaps() {
+	if serial, ok := d.cfg.queryCfg(_VIRTIO_INPUT_CFG_ID_SERIAL, 0); ok {
+		d.Serial = string(bytes.TrimRight(serial, "\x00"))
+	}
+	if ids, ok := d.cfg.queryCfg(_VIRTIO_INPUT_CFG_ID_DEVIDS, 0); ok && len(ids) >= int(unsafe.Sizeof(DevIDs{})) {
+		d.IDs = *(*DevIDs)(unsafe.Pointer(&ids[0]))
+	}
+	d.props, _ = d.cfg.queryCfg(_VIRTIO_INPUT_CFG_PROP_BITS, 0)
+	for typ := range d.evBits {
+		d.evBits[typ], _ = d.cfg.queryCfg(_VIRTIO_INPUT_CFG_EV_BITS, uint8(typ))
+	}
+}
+
+// EventTypes returns the set of event types supported by the device.
+func (d *Device) EventTypes() Bitmap {
+	types := make(Bitmap, EV_CNT/8)
+	for typ, codes := range d.evBits {
+		if typ == EV_SYN || !codes.Empty() {
+			types[typ/8] |= 1 << (typ % 8)
+		}
+	}
+	return types
+}
+
+// Events returns the set of event codes the device supports for the
+// event type, for example the keys of EV_KEY or the axes of EV_ABS.
+func (d *Device) Events(typ uint8) Bitmap {
+	if int(typ) >= len(d.evBits) {
+		return nil
+	}
+	return d.evBits[typ]
+}
+
+// Properties returns the set of input properties of the device. For
+// example, touchscreens have the INPUT_PROP_DIRECT property.
+func (d *Device) Properties() Bitmap {
+	return d.props
+}
+
+// Has reports whether the bitmap contains bit.
+func (b Bitmap) Has(bit uint16) bool {
+	i := int(bit / 8)
+	return i < len(b) && b[i]&(1<<(bit%8)) != 0
+}
+
+// Empty reports whether the bitmap has no bits set.
+func (b Bitmap) Empty() bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Bits returns the bits set in the bitmap, in increasing order.
+func (b Bitmap) Bits() []uint16 {
+	var bits []uint16
+	for i, v := range b {
+		for j := 0; j < 8; j++ {
+			if v&(1<<j) != 0 {
+				bits = append(bits, uint16(i*8+j))
+			}
+		}
+	}
+	return bits
+}
+
 func (d *Device) AbsInfo(axis uint8) (AbsInfo, error) {
 	abs, ok := d.cfg.queryCfg(_VIRTIO_INPUT_CFG_ABS_INFO, axis)
 	if !ok {
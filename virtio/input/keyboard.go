@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package input
+
+import "time"
+
+// Keyboard tracks the modifiers and the held key of keyboards from
+// their EV_KEY events. Devices that don't repeat keys themselves are
+// repeated by Keyboard.
+type Keyboard struct {
+	// RepeatDelay is the time a key is held before it repeats, and
+	// RepeatInterval the time between repeats.
+	RepeatDelay    time.Duration
+	RepeatInterval time.Duration
+
+	// held is the set of modifierKeys held down.
+	held  uint8
+	locks Modifiers
+	// deviceRepeat is set when a device sends repeat events.
+	deviceRepeat bool
+	repeatKey    uint16
+	repeatAt     time.Time
+}
+
+// Modifiers is a set of modifier keys.
+type Modifiers uint8
+
+const (
+	ModShift Modifiers = 1 << iota
+	ModCtrl
+	ModAlt
+	ModSuper
+	ModCapsLock
+	ModNumLock
+)
+
+const (
+	defaultRepeatDelay    = 500 * time.Millisecond
+	defaultRepeatInterval = 33 * time.Millisecond
+)
+
+var modifierKeys = [...]struct {
+	code uint16
+	mod  Modifiers
+}{
+	{KEY_LEFTSHIFT, ModShift},
+	{KEY_RIGHTSHIFT, ModShift},
+	{KEY_LEFTCTRL, ModCtrl},
+	{KEY_RIGHTCTRL, ModCtrl},
+	{KEY_LEFTALT, ModAlt},
+	{KEY_RIGHTALT, ModAlt},
+	{KEY_LEFTMETA, ModSuper},
+	{KEY_RIGHTMETA, ModSuper},
+}
+
+func NewKeyboard() *Keyboard {
+	return &Keyboard{
+		RepeatDelay:    defaultRepeatDelay,
+		RepeatInterval: defaultRepeatInterval,
+	}
+}
+
+// Event updates the keyboard state with e, received at time now.
+func (k *Keyboard) Event(now time.Time, e Event) {
+	if e.Type != EV_KEY || e.Code >= BTN_MISC && e.Code <= BTN_GEAR_UP {
+		return
+	}
+	for i, m := range modifierKeys {
+		if m.code != e.Code {
+			continue
+		}
+		switch e.Value {
+		case KeyReleased:
+			k.held &^= 1 << i
+		case KeyPressed:
+			k.held |= 1 << i
+		}
+		return
+	}
+	switch e.Value {
+	case KeyReleased:
+		if k.repeatKey == e.Code {
+			k.repeatKey = 0
+		}
+	case KeyPressed:
+		switch e.Code {
+		case KEY_CAPSLOCK:
+			k.locks ^= ModCapsLock
+			return
+		case KEY_NUMLOCK:
+			k.locks ^= ModNumLock
+			return
+		}
+		k.repeatKey = e.Code
+		k.repeatAt = now.Add(k.RepeatDelay)
+	case KeyRepeated:
+		k.deviceRepeat = true
+	}
+}
+
+// Modifiers returns the modifiers held down and the active locks.
+func (k *Keyboard) Modifiers() Modifiers {
+	mods := k.locks
+	for i, m := range modifierKeys {
+		if k.held&(1<<i) != 0 {
+			mods |= m.mod
+		}
+	}
+	return mods
+}
+
+// NextRepeat returns the time of the next repeat of the key held
+// down, if any.
+func (k *Keyboard) NextRepeat() (time.Time, bool) {
+	if k.repeatKey == 0 || k.deviceRepeat {
+		return time.Time{}, false
+	}
+	return k.repeatAt, true
+}
+
+// Repeat returns the key held down if it is due for repeating at time
+// now, and schedules its next repeat.
+func (k *Keyboard) Repeat(now time.Time) (uint16, bool) {
+	at, ok := k.NextRepeat()
+	if !ok || now.Before(at) {
+		return 0, false
+	}
+	k.repeatAt = at.Add(k.RepeatInterval)
+	if k.repeatAt.Before(now) {
+		// Skip missed repeats.
+		k.repeatAt = now.Add(k.RepeatInterval)
+	}
+	return k.repeatKey, true
+}
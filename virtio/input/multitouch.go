@@ -0,0 +1,134 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+package input
+
+// Multitouch tracks the contacts of a multitouch device from its
+// ABS_MT events, following the slot based protocol of Linux
+// ("type B"). Contacts are reported as Touches when the device
+// completes a frame with a SYN_REPORT event.
+type Multitouch struct {
+	slots []slot
+	// cur is the slot addressed by ABS_MT events.
+	cur int
+}
+
+type slot struct {
+	// id is the tracking ID of the contact, or -1 if the slot is
+	// unused.
+	id   int32
+	x, y int32
+	// reported is the tracking ID of the contact last reported
+	// as touching, or -1.
+	reported int32
+	changed  bool
+}
+
+// Touch is a change of a contact.
+type Touch struct {
+	Type TouchType
+	// Slot identifies the contact while it touches the device.
+	Slot int
+	// X and Y are the position of the contact in the units of the
+	// ABS_MT_POSITION_X and ABS_MT_POSITION_Y axes.
+	X, Y int32
+}
+
+type TouchType uint8
+
+const (
+	TouchDown TouchType = iota
+	TouchMove
+	TouchUp
+)
+
+const (
+	// defaultSlots is the number of slots of devices that don't
+	// describe their ABS_MT_SLOT axis.
+	defaultSlots = 10
+	maxSlots     = 64
+)
+
+// NewMultitouch returns a tracker for the contacts of d, or nil if d
+// is not a multitouch device.
+func NewMultitouch(d *Device) *Multitouch {
+	abs := d.Events(EV_ABS)
+	if !abs.Has(ABS_MT_SLOT) || !abs.Has(ABS_MT_POSITION_X) || !abs.Has(ABS_MT_POSITION_Y) {
+		return nil
+	}
+	n := defaultSlots
+	if inf, err := d.AbsInfo(ABS_MT_SLOT); err == nil && inf.Max < maxSlots {
+		n = int(inf.Max) + 1
+	}
+	m := &Multitouch{slots: make([]slot, n)}
+	for i := range m.slots {
+		m.slots[i] = slot{id: -1, reported: -1}
+	}
+	return m
+}
+
+// Event updates the contacts with e. At the end of a frame, Event
+// appends the changed contacts to touches and returns the result.
+func (m *Multitouch) Event(touches []Touch, e Event) []Touch {
+	switch e.Type {
+	case EV_ABS:
+		if e.Code == ABS_MT_SLOT {
+			m.cur = int(e.Value)
+			return touches
+		}
+		if m.cur < 0 || m.cur >= len(m.slots) {
+			return touches
+		}
+		s := &m.slots[m.cur]
+		switch e.Code {
+		case ABS_MT_TRACKING_ID:
+			s.id = int32(e.Value)
+		case ABS_MT_POSITION_X:
+			s.x = int32(e.Value)
+		case ABS_MT_POSITION_Y:
+			s.y = int32(e.Value)
+		default:
+			return touches
+		}
+		s.changed = true
+	case EV_SYN:
+		switch e.Code {
+		case SYN_REPORT:
+			touches = m.report(touches)
+		case SYN_DROPPED:
+			// Events were lost; lift all contacts.
+			for i := range m.slots {
+				m.slots[i].id = -1
+				m.slots[i].changed = true
+			}
+			touches = m.report(touches)
+		}
+	}
+	return touches
+}
+
+func (m *Multitouch) report(touches []Touch) []Touch {
+	for i := range m.slots {
+		s := &m.slots[i]
+		if !s.changed {
+			continue
+		}
+		s.changed = false
+		t := Touch{Slot: i, X: s.x, Y: s.y}
+		if s.reported != -1 && s.reported != s.id {
+			// The contact lifted, perhaps replaced by a new
+			// contact in the same frame.
+			t.Type = TouchUp
+			touches = append(touches, t)
+			s.reported = -1
+		}
+		if s.id != -1 {
+			t.Type = TouchMove
+			if s.reported == -1 {
+				t.Type = TouchDown
+			}
+			touches = append(touches, t)
+			s.reported = s.id
+		}
+	}
+	return touches
+}
@@ -0,0 +1,343 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+// Package net implements a driver for virtio network devices.
+package net
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"eliasnaur.com/unik/kernel"
+	"eliasnaur.com/unik/virtio"
+)
+
+// Device is a virtio network device. ReadFrame must be called from a
+// single goroutine at a time; the other methods are safe for
+// concurrent use.
+type Device struct {
+	dev *virtio.Device
+	cfg *config
+
+	mac     [6]byte
+	mtu     int
+	offload bool
+	// rxCsum is set if the device may deliver packets with
+	// partial or already validated checksums.
+	rxCsum bool
+
+	rx struct {
+		r   *virtio.Reader
+		buf []byte
+	}
+
+	tx transmitter
+
+	link struct {
+		// up is 1 when the link is up.
+		up      uint32
+		changed chan struct{}
+	}
+}
+
+// transmitter is the transmit queue along with its buffers.
+type transmitter struct {
+	mu  sync.Mutex
+	cmd *virtio.Commander
+	buf *virtio.IOMem
+	// size is the number of transmit buffers.
+	size int
+	// next is the index of the next transmit buffer.
+	next int
+	// pending is the number of transmissions not yet completed by
+	// the device.
+	pending int
+}
+
+type config struct {
+	mac                 [6]uint8
+	status              uint16
+	max_virtqueue_pairs uint16
+	mtu                 uint16
+}
+
+// netHeader is struct virtio_net_hdr.
+type netHeader struct {
+	flags       uint8
+	gso_type    uint8
+	hdr_len     uint16
+	gso_size    uint16
+	csum_start  uint16
+	csum_offset uint16
+	num_buffers uint16
+}
+
+const (
+	// Feature bits.
+	_VIRTIO_NET_F_CSUM       = 1 << 0
+	_VIRTIO_NET_F_GUEST_CSUM = 1 << 1
+	_VIRTIO_NET_F_MTU        = 1 << 3
+	_VIRTIO_NET_F_MAC        = 1 << 5
+	_VIRTIO_NET_F_STATUS     = 1 << 16
+
+	_VIRTIO_NET_S_LINK_UP = 1
+
+	// Header flags.
+	_VIRTIO_NET_HDR_F_NEEDS_CSUM = 1
+	_VIRTIO_NET_HDR_F_DATA_VALID = 2
+
+	_VIRTIO_NET_HDR_GSO_NONE = 0
+
+	receiveQueue  = 0
+	transmitQueue = 1
+)
+
+const (
+	headerSize = int(unsafe.Sizeof(netHeader{}))
+	// bufSize is the size of receive and transmit buffers. It
+	// bounds the MTU.
+	bufSize = 2048
+	// ethHeaderSize is the size of an Ethernet header.
+	ethHeaderSize = 14
+	// defaultMTU is the MTU of devices that don't report one.
+	defaultMTU = 1500
+	maxMTU     = bufSize - headerSize - ethHeaderSize
+)
+
+var ErrFrameSize = errors.New("net: frame too large")
+
+func New() (*Device, error) {
+	const deviceTypeNetwork = 1
+	vdev, err := virtio.New(deviceTypeNetwork)
+	if err != nil {
+		return nil, err
+	}
+	return newDevice(vdev)
+}
+
+func newDevice(dev *virtio.Device) (*Device, error) {
+	devCfgMap, _, err := dev.FindCapability(virtio.PCI_CAP_DEVICE_CFG)
+	if err != nil {
+		return nil, err
+	}
+	if cfgSize := uintptr(len(devCfgMap)); unsafe.Offsetof(config{}.status)+2 > cfgSize {
+		return nil, fmt.Errorf("net: device configuration area too small (%d bytes)", cfgSize)
+	}
+	d := &Device{
+		dev: dev,
+		cfg: (*config)(unsafe.Pointer(&devCfgMap[0])),
+	}
+	var rxq, txq *virtio.Queue
+	var feats uint64
+	for {
+		before := dev.ConfigGeneration()
+		dev.Reset()
+		needFeats := uint64(virtio.F_VERSION_1 | _VIRTIO_NET_F_MAC)
+		feats = dev.Features()
+		if feats&needFeats != needFeats {
+			return nil, fmt.Errorf("net: supports features %#x need at least %#x", feats, needFeats)
+		}
+		wantFeats := uint64(_VIRTIO_NET_F_CSUM | _VIRTIO_NET_F_GUEST_CSUM | _VIRTIO_NET_F_STATUS)
+		if unsafe.Sizeof(config{}) <= uintptr(len(devCfgMap)) {
+			wantFeats |= _VIRTIO_NET_F_MTU
+		}
+		feats &= needFeats | wantFeats
+		if err := dev.NegotiateFeatures(feats); err != nil {
+			return nil, err
+		}
+		d.readConfig(feats)
+		rxq, err = dev.ConfigureQueue(receiveQueue)
+		if err != nil {
+			return nil, err
+		}
+		txq, err = dev.ConfigureQueue(transmitQueue)
+		if err != nil {
+			return nil, err
+		}
+		if after := dev.ConfigGeneration(); after != before {
+			// Configuration changed under us.
+			continue
+		}
+		break
+	}
+	d.link.changed = make(chan struct{}, 1)
+	d.link.up = 1
+	if feats&_VIRTIO_NET_F_STATUS != 0 {
+		intr, err := dev.ConfigInterrupt()
+		if err != nil {
+			return nil, err
+		}
+		d.readStatus()
+		go d.watchLink(intr)
+	}
+	rxSize := rxq.Size() * bufSize
+	rxBuf, err := virtio.NewIOMem(rxSize, rxSize)
+	if err != nil {
+		return nil, err
+	}
+	d.tx.size = txq.Size()
+	txSize := d.tx.size * bufSize
+	d.tx.buf, err = virtio.NewIOMem(txSize, txSize)
+	if err != nil {
+		return nil, err
+	}
+	d.tx.cmd = virtio.NewCommander(txq)
+	d.rx.buf = make([]byte, bufSize)
+	dev.Start()
+	// Hand the receive buffers to the device after starting it.
+	d.rx.r, err = virtio.NewReader(rxq, *rxBuf, bufSize)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readConfig reads the device configuration for the negotiated
+// features.
+func (d *Device) readConfig(feats uint64) {
+	for i := range d.mac {
+		d.mac[i] = kernel.LoadUint8(&d.cfg.mac[i])
+	}
+	d.mtu = defaultMTU
+	if feats&_VIRTIO_NET_F_MTU != 0 {
+		if mtu := int(kernel.LoadUint16(&d.cfg.mtu)); mtu >= 576 {
+			d.mtu = mtu
+		}
+	}
+	if d.mtu > maxMTU {
+		d.mtu = maxMTU
+	}
+	d.offload = feats&_VIRTIO_NET_F_CSUM != 0
+	d.rxCsum = feats&_VIRTIO_NET_F_GUEST_CSUM != 0
+}
+
+// readStatus updates the link status from the device configuration
+// and reports whether it changed.
+func (d *Device) readStatus() bool {
+	var up uint32
+	if kernel.LoadUint16(&d.cfg.status)&_VIRTIO_NET_S_LINK_UP != 0 {
+		up = 1
+	}
+	return atomic.SwapUint32(&d.link.up, up) != up
+}
+
+func (d *Device) watchLink(intr <-chan struct{}) {
+	for range intr {
+		if !d.readStatus() {
+			continue
+		}
+		select {
+		case d.link.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// HardwareAddr returns the MAC address of the device.
+func (d *Device) HardwareAddr() [6]byte {
+	return d.mac
+}
+
+// MTU returns the maximum size of the payload of Ethernet frames.
+func (d *Device) MTU() int {
+	return d.mtu
+}
+
+// ChecksumOffload reports whether the device computes the checksums
+// of transmitted frames. See WriteFrame.
+func (d *Device) ChecksumOffload() bool {
+	return d.offload
+}
+
+// LinkUp reports whether the link is up. Devices that don't report
+// their status are always up.
+func (d *Device) LinkUp() bool {
+	return atomic.LoadUint32(&d.link.up) != 0
+}
+
+// LinkChanged returns a channel that receives a value when the
+// link status changes.
+func (d *Device) LinkChanged() <-chan struct{} {
+	return d.link.changed
+}
+
+// ReadFrame blocks until an Ethernet frame arrives and reads it into
+// p. Frames that don't fit in p are truncated. It returns the length
+// of the frame and whether its checksums were validated by the device
+// and need not be checked.
+func (d *Device) ReadFrame(p []byte) (int, bool, error) {
+	for {
+		n, err := d.rx.r.ReadPacket(d.rx.buf)
+		if err != nil {
+			return 0, false, err
+		}
+		if n < headerSize {
+			continue
+		}
+		hdr := (*netHeader)(unsafe.Pointer(&d.rx.buf[0]))
+		// A partial checksum means the packet originates from the
+		// host and was never exposed to transmission errors.
+		valid := d.rxCsum && hdr.flags&(_VIRTIO_NET_HDR_F_NEEDS_CSUM|_VIRTIO_NET_HDR_F_DATA_VALID) != 0
+		return copy(p, d.rx.buf[headerSize:n]), valid, nil
+	}
+}
+
+// WriteFrame transmits the Ethernet frame p. If csumStart is not
+// negative, the device completes the checksum of the bytes from
+// csumStart to the end of the frame and stores it at csumStart +
+// csumOffset. The checksum field must contain the checksum of the
+// protocol pseudo-header. WriteFrame must only request checksums
+// if ChecksumOffload returns true.
+func (d *Device) WriteFrame(p []byte, csumStart, csumOffset int) error {
+	if len(p) > bufSize-headerSize {
+		return ErrFrameSize
+	}
+	if csumStart >= 0 && (!d.offload || csumStart+csumOffset+2 > len(p)) {
+		return errors.New("net: invalid checksum offload")
+	}
+	t := &d.tx
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.reclaim(); err != nil {
+		return err
+	}
+	// The device completes transmissions in order, so the oldest
+	// buffer is free when fewer than size transmissions are
+	// pending.
+	off := t.next * bufSize
+	hdr := (*netHeader)(unsafe.Pointer(&t.buf.Mem[off]))
+	*hdr = netHeader{gso_type: _VIRTIO_NET_HDR_GSO_NONE}
+	if csumStart >= 0 {
+		hdr.flags = _VIRTIO_NET_HDR_F_NEEDS_CSUM
+		hdr.csum_start = uint16(csumStart)
+		hdr.csum_offset = uint16(csumOffset)
+	}
+	copy(t.buf.Mem[off+headerSize:], p)
+	req := t.buf.Slice(off, off+headerSize+len(p))
+	for !t.cmd.Command(req, virtio.IOMem{}) {
+		if err := t.reclaim(); err != nil {
+			return err
+		}
+	}
+	t.pending++
+	t.next = (t.next + 1) % t.size
+	return nil
+}
+
+// reclaim waits until a transmit buffer is available.
+func (t *transmitter) reclaim() error {
+	n, err := t.cmd.Read()
+	if err != nil {
+		return err
+	}
+	t.pending -= n
+	if t.pending < t.size {
+		return nil
+	}
+	t.cmd.Sync()
+	n, err = t.cmd.Read()
+	t.pending -= n
+	return err
+}
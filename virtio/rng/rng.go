@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: Unlicense OR MIT
+
+// Package rng implements a driver for virtio entropy devices.
+package rng
+
+import (
+	"sync"
+
+	"eliasnaur.com/unik/virtio"
+)
+
+// Device is a virtio entropy device. Its methods are safe for
+// concurrent use.
+type Device struct {
+	mu sync.Mutex
+	r  *virtio.Reader
+}
+
+const (
+	requestQueue = 0
+	// bufSize is the size of the buffers handed to the device.
+	bufSize = 64
+)
+
+func New() (*Device, error) {
+	const deviceTypeEntropy = 4
+	vdev, err := virtio.New(deviceTypeEntropy)
+	if err != nil {
+		return nil, err
+	}
+	return newDevice(vdev)
+}
+
+func newDevice(dev *virtio.Device) (*Device, error) {
+	var q *virtio.Queue
+	for {
+		before := dev.ConfigGeneration()
+		dev.Reset()
+		if err := dev.NegotiateFeatures(virtio.F_VERSION_1); err != nil {
+			return nil, err
+		}
+		var err error
+		q, err = dev.ConfigureQueue(requestQueue)
+		if err != nil {
+			return nil, err
+		}
+		if after := dev.ConfigGeneration(); after != before {
+			// Configuration changed under us.
+			continue
+		}
+		break
+	}
+	size := q.Size() * bufSize
+	buf, err := virtio.NewIOMem(size, size)
+	if err != nil {
+		return nil, err
+	}
+	dev.Start()
+	// Hand the buffers to the device after starting it. The
+	// device fills them with random bytes as they are consumed.
+	r, err := virtio.NewReader(q, *buf, bufSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Device{r: r}, nil
+}
+
+// Read fills p with random bytes from the device.
+func (d *Device) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		m, err := d.r.Read(p[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
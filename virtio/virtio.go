@@ -123,10 +123,40 @@ const (
 )
 
 func New(function int) (*Device, error) {
+	addrs, err := detect(function)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("virtio: no virtio device type %d", function)
+	}
+	return newVirtioDevice(addrs[0])
+}
+
+// NewAll is like New, but returns every device of the type.
+func NewAll(function int) ([]*Device, error) {
+	addrs, err := detect(function)
+	if err != nil {
+		return nil, err
+	}
+	var devs []*Device
+	for _, a := range addrs {
+		d, err := newVirtioDevice(a)
+		if err != nil {
+			return nil, err
+		}
+		devs = append(devs, d)
+	}
+	return devs, nil
+}
+
+// detect returns the addresses of the virtio devices of a type.
+func detect(function int) ([]pci.Address, error) {
 	addrs, err := pci.Detect()
 	if err != nil {
 		return nil, err
 	}
+	var devs []pci.Address
 	for _, a := range addrs {
 		if a.ReadVendorID() != 0x1af4 {
 			// Not a Virtio device.
@@ -142,9 +172,9 @@ func New(function int) (*Device, error) {
 			// Not the correct type.
 			continue
 		}
-		return newVirtioDevice(a)
+		devs = append(devs, a)
 	}
-	return nil, fmt.Errorf("virtio: no virtio device type %d", function)
+	return devs, nil
 }
 
 func newVirtioDevice(addr pci.Address) (*Device, error) {
@@ -244,9 +274,6 @@ func (d *Device) ConfigureQueue(queueIndex uint16) (*Queue, error) {
 	if err != nil {
 		return nil, fmt.Errorf("virtio: failed to allocate queue memory: %v", err)
 	}
-	if len(mem) < queueMemSize {
-		return nil, fmt.Errorf("virtio: allocated %d bytes, need at least %d", len(mem), queueMemSize)
-	}
 	mem = mem[:queueMemSize]
 	q := &Queue{
 		queue:      (*virtioDeviceQueue)(unsafe.Pointer(&mem[0])),
@@ -283,19 +310,24 @@ func (d *Device) ConfigureQueue(queueIndex uint16) (*Queue, error) {
 	return q, nil
 }
 
-// allocMem allocates contiguous physical memory. maxSize
-// is the requested size; the returned buffer may be smaller.
-func allocMem(maxSize int) ([]byte, uintptr, error) {
-	pageAddr, size, err := kernel.Alloc(maxSize)
+// allocMem allocates size bytes of page aligned, contiguous physical
+// memory. The returned buffer is rounded up to the page size.
+func allocMem(size int) ([]byte, uintptr, error) {
+	psize := syscall.Getpagesize()
+	size = (size + psize - 1) &^ (psize - 1)
+	pageAddr, err := kernel.Alloc(size, psize)
 	if err != nil {
 		return nil, 0, err
 	}
 	vmem, err := syscall.Mmap(0, 0, size, syscall.PROT_WRITE|syscall.PROT_READ, syscall.MAP_ANONYMOUS)
 	if err != nil {
+		kernel.Free(pageAddr, size)
 		return nil, 0, err
 	}
 	vaddr := ((*reflect.SliceHeader)(unsafe.Pointer(&vmem))).Data
 	if err := kernel.IOMap(vaddr, pageAddr, len(vmem)); err != nil {
+		syscall.Munmap(vmem)
+		kernel.Free(pageAddr, size)
 		return nil, 0, err
 	}
 	return vmem, pageAddr, nil
@@ -469,6 +501,26 @@ func (r *Reader) Read(buf []byte) (int, error) {
 	return n, nil
 }
 
+// ReadPacket is like Read, but reads the contents of a single
+// descriptor for devices that write one packet per descriptor. Bytes
+// that don't fit in buf are discarded.
+func (r *Reader) ReadPacket(buf []byte) (int, error) {
+	for kernel.LoadUint16(&r.q.queue.used.idx) == r.used {
+		<-r.q.interrupt
+	}
+	idx := r.used % r.q.size
+	desc := r.q.queue.used.ring[idx]
+	if uint16(desc.id) != idx {
+		return 0, errors.New("virtio: device returned descriptors out-of-order")
+	}
+	off := r.offsets[idx]
+	n := copy(buf, r.buffer[off+r.read:off+int(desc.len)])
+	r.used++
+	r.read = 0
+	r.fill()
+	return n, nil
+}
+
 func (q *Queue) Size() int {
 	return int(q.size)
 }
@@ -597,28 +649,29 @@ func (m *IOMem) Ensure(size int) error {
 	if size > cap(m.Mem) {
 		panic("buffer overflow")
 	}
-	for {
-		need := size - len(m.Mem)
-		if need <= 0 {
-			break
-		}
-		// Allocate a chunk of contiguous physical memory and map in
-		// to the end of m.mem.
-		addr, got, err := kernel.Alloc(need)
-		if err != nil {
-			return err
-		}
-		vaddr := ((*reflect.SliceHeader)(unsafe.Pointer(&m.Mem))).Data
-		vaddr += uintptr(len(m.Mem))
-		if err := kernel.IOMap(vaddr, addr, got); err != nil {
-			return fmt.Errorf("physmem: ensure: %v", err)
-		}
-		m.Blocks = append(m.Blocks, PhysPage{
-			Addr: addr,
-			Size: got,
-		})
-		m.Mem = m.Mem[:len(m.Mem)+got]
+	need := size - len(m.Mem)
+	if need <= 0 {
+		return nil
 	}
+	// Allocate a chunk of contiguous physical memory and map in
+	// to the end of m.mem.
+	psize := syscall.Getpagesize()
+	need = (need + psize - 1) &^ (psize - 1)
+	addr, err := kernel.Alloc(need, psize)
+	if err != nil {
+		return err
+	}
+	vaddr := ((*reflect.SliceHeader)(unsafe.Pointer(&m.Mem))).Data
+	vaddr += uintptr(len(m.Mem))
+	if err := kernel.IOMap(vaddr, addr, need); err != nil {
+		kernel.Free(addr, need)
+		return fmt.Errorf("physmem: ensure: %v", err)
+	}
+	m.Blocks = append(m.Blocks, PhysPage{
+		Addr: addr,
+		Size: need,
+	})
+	m.Mem = m.Mem[:len(m.Mem)+need]
 	return nil
 }
 